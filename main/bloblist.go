@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/blobutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// addContainerBlobs lists the blobs in blobContainerUri in cfg, if specified,
+// whose names start with blobPrefix, and appends them to the fileUris in cfg
+// to be downloaded along with the other files. They are saved with their names
+// relative to the virtual directory of blobPrefix, such as "app/run.sh" for
+// "scripts/app/run.sh" with the prefix "scripts/". It fails if no blob is
+// found, unless allowEmptyBlobList is set in cfg.
+func addContainerBlobs(ctx *log.Context, cfg *handlerSettings) error {
+	uri := cfg.publicSettings.BlobContainerURI
+	if uri == "" {
+		return nil
+	}
+	prefix := cfg.publicSettings.BlobPrefix
+	ctx = ctx.With("prefix", prefix)
+	d, err := getContainerLister(ctx, uri, *cfg)
+	if err != nil {
+		return err
+	}
+	ctx.Log("event", "listing blobs")
+	blobs, err := download.ListBlobs(ctx, d, prefix, cfg.retryPolicy(), cfg.maxFileURIs())
+	if err != nil {
+		return err
+	}
+
+	var urls, names []string
+	for _, b := range blobs {
+		if strings.HasSuffix(b.Name, "/") {
+			continue // directory marker
+		}
+		name, err := blobFileName(b.Name, prefix)
+		if err != nil {
+			return err
+		}
+		urls = append(urls, blobURLUnder(uri, b.Name))
+		names = append(names, name)
+	}
+	ctx.Log("event", "listed blobs", "blobs", len(urls))
+	if len(urls) == 0 {
+		if cfg.publicSettings.AllowEmptyBlobList {
+			return nil
+		}
+		return fmt.Errorf("no blobs found in 'blobContainerUri' with 'blobPrefix' %q", prefix)
+	}
+	if n, max := len(cfg.publicSettings.FileURLs)+len(urls), cfg.maxFileURIs(); n > max {
+		return fmt.Errorf("'fileUris' and the blobs listed from 'blobContainerUri' are %d files, more than 'maxFileUris' (%d)", n, max)
+	}
+
+	// the listed files are saved with their own names, the other files keep
+	// the ones in fileNames
+	for len(cfg.publicSettings.FileNames) < len(cfg.publicSettings.FileURLs) {
+		cfg.publicSettings.FileNames = append(cfg.publicSettings.FileNames, "")
+	}
+	cfg.publicSettings.FileURLs = append(cfg.publicSettings.FileURLs, urls...)
+	cfg.publicSettings.FileNames = append(cfg.publicSettings.FileNames, names...)
+	if s := cfg.publicSettings.ScriptFile; s != "" && cfg.scriptFileIndex() < 0 {
+		return fmt.Errorf("'scriptFile' %q is not the name of a file downloaded from 'fileUris' or 'blobContainerUri'", s)
+	}
+	return nil
+}
+
+// blobFileName returns the path the blob with the given name is saved to,
+// relative to the download directory: its name relative to the virtual
+// directory of prefix. It fails if the path would refer to other directories
+// or collide with the files of the extension.
+func blobFileName(name, prefix string) (string, error) {
+	rel := strings.TrimPrefix(name, prefix[:strings.LastIndex(prefix, "/")+1])
+	for _, s := range strings.Split(rel, "/") { // including rel "", "." or ".."
+		if s == "" || s == "." || s == ".." || strings.Contains(s, "\x00") {
+			return "", fmt.Errorf("cannot save blob %q: invalid path %q", name, rel)
+		}
+	}
+	if isHandlerFile(rel) {
+		return "", fmt.Errorf("cannot save blob %q: file name is reserved for the extension: %q", name, rel)
+	}
+	return rel, nil
+}
+
+// getContainerLister returns the Downloader whose requests are authorized to
+// list the blobs in the container at uri, to be used with download.ListBlobs,
+// with the SAS in the URL or the credentials in cfg, in the same order of
+// precedence as the downloads. Without credentials, the container must allow
+// public access.
+func getContainerLister(ctx *log.Context, uri string, cfg handlerSettings) (download.Downloader, error) {
+	if blobutil.HasSASSignature(uri) {
+		ctx.Log("event", "URL has a shared access signature, listing as is")
+		return download.NewURLDownload(uri), nil
+	}
+	if cfg.SASToken != "" {
+		ctx.Log("event", "using SAS token for listing") // never log the token
+		return download.NewURLDownload(blobutil.AppendSASToken(uri, cfg.SASToken)), nil
+	}
+	if cfg.StorageAccountName != "" && cfg.StorageAccountKey != "" {
+		container, err := parseContainerURL(uri)
+		if err != nil {
+			return nil, err
+		}
+		return download.NewContainerListDownload(cfg.StorageAccountName, cfg.StorageAccountKey, container), nil
+	}
+	if cfg.ManagedIdentity != nil {
+		return getManagedIdentityDownloader(ctx, uri, *cfg.ManagedIdentity)
+	}
+	return download.NewURLDownload(uri), nil
+}
+
+// parseContainerURL parses the URL of an Azure Blob Storage container, which
+// must not refer to a blob or a virtual directory in it.
+func parseContainerURL(uri string) (blobutil.AzureBlobRef, error) {
+	ref, err := blobutil.ParseBlobURL(blobURLUnder(uri, "blob"))
+	if err != nil {
+		return ref, errors.Wrap(err, "cannot parse container URL")
+	}
+	u, _ := url.Parse(uri) // parsed above
+	if p := strings.Trim(u.Path, "/"); p == "" || strings.Contains(p, "/") {
+		return ref, fmt.Errorf("not the URL of a container: %q", redactURLSecrets(uri))
+	}
+	return ref, nil
+}
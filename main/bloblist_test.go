@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_addContainerBlobs(t *testing.T) {
+	list := `<EnumerationResults><Blobs><Blob><Name>setup/</Name></Blob><Blob><Name>setup/run.sh</Name></Blob><Blob><Name>setup/app/a b.sh</Name></Blob></Blobs></EnumerationResults>`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, list)
+	}))
+	defer srv.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	cfg := handlerSettings{publicSettings: publicSettings{
+		FileURLs:         []string{"https://example.com/a", "https://example.com/b"},
+		FileNames:        []string{"x"},
+		ScriptFile:       "app/a b.sh",
+		BlobContainerURI: srv.URL + "/c?sv=1&sig=s",
+		BlobPrefix:       "setup/"}}
+	require.Nil(t, addContainerBlobs(ctx, &cfg))
+	require.Equal(t, []string{"https://example.com/a", "https://example.com/b",
+		srv.URL + "/c/setup/run.sh?sv=1&sig=s", srv.URL + "/c/setup/app/a%20b.sh?sv=1&sig=s"}, cfg.FileURLs)
+	require.Equal(t, []string{"x", "", "run.sh", "app/a b.sh"}, cfg.FileNames)
+	require.Equal(t, 3, cfg.scriptFileIndex())
+
+	cfg = handlerSettings{publicSettings: publicSettings{BlobContainerURI: srv.URL + "/c", MaxFileURIs: 1}}
+	err := addContainerBlobs(ctx, &cfg)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "more than 1 blobs")
+
+	list = `<EnumerationResults><Blobs></Blobs></EnumerationResults>`
+	cfg = handlerSettings{publicSettings: publicSettings{BlobContainerURI: srv.URL + "/c", BlobPrefix: "none/"}}
+	require.EqualError(t, addContainerBlobs(ctx, &cfg), `no blobs found in 'blobContainerUri' with 'blobPrefix' "none/"`)
+	cfg.AllowEmptyBlobList = true
+	require.Nil(t, addContainerBlobs(ctx, &cfg))
+	require.Empty(t, cfg.FileURLs)
+}
+
+func Test_blobFileName(t *testing.T) {
+	for name, want := range map[[2]string]string{
+		{"setup/app/run.sh", "setup/"}:   "app/run.sh",
+		{"setup/app/run.sh", "setup/ap"}: "app/run.sh",
+		{"setup/app/run.sh", ""}:         "setup/app/run.sh",
+		{"run.sh", "r"}:                  "run.sh",
+	} {
+		got, err := blobFileName(name[0], name[1])
+		require.Nil(t, err, "%v", name)
+		require.Equal(t, want, got, "%v", name)
+	}
+	for _, name := range []string{"setup/../x", "setup//x", "setup/./x", "setup/", "setup/.", "setup/..",
+		"setup/stdout", "setup/" + manifestFile, "setup/" + rebootRequiredFile, "setup/stderr.1", "setup/stdout.test"} {
+		_, err := blobFileName(name, "setup/")
+		require.NotNil(t, err, name)
+	}
+	got, err := blobFileName("setup/app/stdout", "setup/")
+	require.Nil(t, err, "only reserved in the download directory itself")
+	require.Equal(t, "app/stdout", got)
+}
+
+func Test_parseContainerURL(t *testing.T) {
+	ref, err := parseContainerURL("https://a.blob.core.windows.net/scripts/?sv=1&sig=x")
+	require.Nil(t, err)
+	require.Equal(t, "scripts", ref.Container)
+	require.Equal(t, "core.windows.net", ref.StorageBase)
+
+	for _, u := range []string{"https://a.blob.core.windows.net", "https://a.blob.core.windows.net/c/dir",
+		"https://example.com/c", "file:///c"} {
+		_, err := parseContainerURL(u)
+		require.NotNil(t, err, u)
+	}
+}
+
+func Test_handlerSettings_validateBlobContainer(t *testing.T) {
+	pub := publicSettings{CommandToExecute: "date", BlobPrefix: "setup/"}
+	require.Equal(t, errBlobPrefixNoContainer, handlerSettings{publicSettings: pub}.validate())
+	pub.BlobContainerURI = "https://a.blob.core.windows.net/c/dir"
+	err := handlerSettings{publicSettings: pub}.validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid 'blobContainerUri': not the URL of a container")
+
+	pub.BlobContainerURI = "https://a.blob.core.windows.net/c"
+	pub.ContinueOnDownloadError, pub.MinSuccessfulDownloads = true, 2
+	pub.CommandToExecute, pub.ScriptFile = "", "run.sh"
+	require.Nil(t, handlerSettings{publicSettings: pub}.validate(), "checked after listing")
+}
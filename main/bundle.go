@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// maxBundleManifestSize is the maximum size of the manifest in manifestUri.
+const maxBundleManifestSize = 4 << 20
+
+var sha256HexRe = regexp.MustCompile(`^[a-fA-F0-9]{64}$`)
+
+// bundleManifest is the signed JSON document at manifestUri listing the files
+// to download with their checksums, such as
+// {"files": [{"url": "run.sh", "sha256": "5dba..."}]}.
+type bundleManifest struct {
+	Files []bundleFile `json:"files"`
+}
+
+// bundleFile is a file listed in a bundleManifest. The URL can be relative to
+// the URL of the manifest, the name is derived from the URL if empty.
+type bundleFile struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	Name   string `json:"name"`
+}
+
+// addBundleFiles downloads the manifest at manifestUri in cfg, if specified,
+// verifies its signature with gpgPublicKey in cfg, and appends the files it
+// lists to the fileUris in cfg with their checksums in fileHashes, so that
+// they are downloaded and verified along with the other files. The downloads
+// are canceled when opCtx is done. Failures to verify the signature or the
+// manifest are categorized as errSignatureInvalid, before anything is
+// downloaded.
+func addBundleFiles(ctx *log.Context, opCtx context.Context, cfg *handlerSettings) error {
+	uri := cfg.publicSettings.ManifestURI
+	if uri == "" {
+		return nil
+	}
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "manifest.json")
+
+	dl, err := getDownloader(ctx, uri, *cfg)
+	if err != nil {
+		return err
+	}
+	ctx.Log("event", "downloading manifest")
+	if _, err := download.SaveTo(ctx, dl, path, download.SaveOptions{
+		Mode:    0600,
+		Retry:   cfg.retryPolicy(),
+		Context: opCtx,
+		MaxSize: maxBundleManifestSize}); err != nil {
+		return errors.Wrap(err, "failed to download manifest")
+	}
+	if err := verifyFileSignature(ctx, opCtx, path, cfg.manifestSignatureURL(), *cfg); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read manifest")
+	}
+	files, err := parseBundleManifest(b, uri, cfg.publicSettings.AllowFileUris)
+	if err != nil {
+		return categorize(errSignatureInvalid, errors.Wrap(err, "invalid manifest"))
+	}
+	ctx.Log("event", "verified manifest", "files", len(files))
+	if n, max := len(cfg.publicSettings.FileURLs)+len(files), cfg.maxFileURIs(); n > max {
+		return fmt.Errorf("'fileUris' and the files listed in 'manifestUri' are %d files, more than 'maxFileUris' (%d)", n, max)
+	}
+
+	// the listed files are verified with their checksums, the other files
+	// keep the ones in fileHashes
+	p := &cfg.publicSettings
+	for len(p.FileNames) < len(p.FileURLs) {
+		p.FileNames = append(p.FileNames, "")
+	}
+	for len(p.FileHashes) < len(p.FileURLs) {
+		p.FileHashes = append(p.FileHashes, "")
+	}
+	for _, f := range files {
+		p.FileURLs = append(p.FileURLs, f.URL)
+		p.FileNames = append(p.FileNames, f.Name)
+		p.FileHashes = append(p.FileHashes, f.SHA256)
+	}
+	var c settingChecks
+	if cfg.validateFileNames(&c); c.err() != nil {
+		return categorize(errSignatureInvalid, errors.Wrap(c.err(), "invalid manifest"))
+	}
+	if p.BlobContainerURI != "" { // checked after listing
+		return nil
+	}
+	if s := p.ScriptFile; s != "" && cfg.scriptFileIndex() < 0 {
+		return fmt.Errorf("'scriptFile' %q is not the name of a file downloaded from 'fileUris' or 'manifestUri'", s)
+	}
+	loaded := *cfg // with the listed files in fileUris
+	loaded.publicSettings.ManifestURI = ""
+	if loaded.validateFileCredentials(&c); c.err() != nil {
+		return categorize(errConfigInvalid, c.err())
+	}
+	return nil
+}
+
+// parseBundleManifest parses the manifest b downloaded from manifestURL and
+// returns the files it lists, with their URLs resolved against manifestURL.
+// The relative URLs without a query string get the one of manifestURL, such
+// as its SAS. Every file must have a valid URL and SHA-256 checksum.
+func parseBundleManifest(b []byte, manifestURL string, allowFile bool) ([]bundleFile, error) {
+	var m bundleManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrap(err, "cannot parse manifest")
+	}
+	if len(m.Files) == 0 {
+		return nil, errors.New("manifest lists no files")
+	}
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse manifest URL")
+	}
+	for i, f := range m.Files {
+		ref, err := url.Parse(f.URL)
+		if err != nil || f.URL == "" {
+			return nil, fmt.Errorf("invalid URL of file %d in manifest: %q", i, redactURLSecrets(f.URL))
+		}
+		resolved := base.ResolveReference(ref)
+		if !ref.IsAbs() && ref.Host == "" && ref.RawQuery == "" {
+			// on the same host, such as in the container with the SAS of
+			// the manifest
+			resolved.RawQuery = base.RawQuery
+		}
+		u := resolved.String()
+		if err := validateFileURL(u, allowFile); err != nil {
+			return nil, errors.Wrapf(err, "invalid URL of file %d in manifest", i)
+		}
+		if !sha256HexRe.MatchString(f.SHA256) {
+			return nil, fmt.Errorf("invalid SHA-256 checksum of file %d in manifest: %q", i, f.SHA256)
+		}
+		m.Files[i].URL = u
+	}
+	return m.Files, nil
+}
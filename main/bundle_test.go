@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// testManifestSignature is the signature of testManifest made with the key
+// testManifestPublicKey. The manifest lists a.sh with the contents
+// testSignedScript and lib/b.sh with "echo b\n".
+const (
+	testManifestPublicKey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mDMEas+oiBYJKwYBBAHaRw8BAQdA58H21MVR1teZRd4FGjisHDS40ECXc4uzOiOS
+qKJuKmC0FG1hbmlmZXN0QGV4YW1wbGUuY29tiJAEExYIADgWIQS2JTOP7BRsWPXO
+AQWBajuRmZlEDAUCas+oiAIbAwULCQgHAgYVCgkICwIEFgIDAQIeAQIXgAAKCRCB
+ajuRmZlEDB57AQDmLi0MKZZlOWU0nphft4HC/eDaIVo55T4fJseACtF4RAEA5u2o
+/PJfhYUWSUEOD53fKk477RsxQlDWIHtX59XuqQs=
+=1Mrm
+-----END PGP PUBLIC KEY BLOCK-----
+`
+	testManifest = `{"files": [{"url": "a.sh", "sha256": "5dbad7dd0b9b122dcd9956884390f4aac4738caba8ff53498a7ab6718b176c30"}, {"url": "lib/b.sh", "sha256": "256931e5627bfa46347df35ae1c25649073ce5630975d0cdf9d301d32836a118", "name": "b.sh"}]}
+`
+	testManifestSignature = `-----BEGIN PGP SIGNATURE-----
+
+iHUEABYIAB0WIQS2JTOP7BRsWPXOAQWBajuRmZlEDAUCas+oiAAKCRCBajuRmZlE
+DBOCAQDbKz7h6MfxXAhhvi/CMr5tyw214eX+qGLnQPim6ZubSQD9E7jr1j03nBGJ
+CxIn5mvGIkQjDcD/pRecYfFdsRxe1Aw=
+=xUV6
+-----END PGP SIGNATURE-----
+`
+)
+
+func Test_addBundleFiles(t *testing.T) {
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		t.Skip("gpgv is not installed")
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	bScript := "echo b\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/m/manifest.json", "/m/other.sig":
+			fmt.Fprint(w, testManifest)
+		case "/m/tampered.json":
+			fmt.Fprint(w, testManifest[:len(testManifest)-2]+`, {"url": "evil.sh", "sha256": ""}]}`)
+		case "/m/manifest.json.sig", "/m/tampered.json.sig":
+			fmt.Fprint(w, testManifestSignature)
+		case "/m/a.sh":
+			fmt.Fprint(w, testSignedScript)
+		case "/m/lib/b.sh":
+			fmt.Fprint(w, bScript)
+		case "/c.sh":
+			fmt.Fprint(w, "echo c\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	newCfg := func(manifest string) handlerSettings {
+		return handlerSettings{publicSettings: publicSettings{
+			CommandToExecute: "date",
+			FileURLs:         []string{srv.URL + "/c.sh"},
+			ManifestURI:      srv.URL + manifest,
+			GPGPublicKey:     testManifestPublicKey,
+		}}
+	}
+	ctx := log.NewContext(log.NewNopLogger())
+
+	cfg := newCfg("/m/manifest.json")
+	require.Nil(t, cfg.validate())
+	require.Nil(t, addBundleFiles(ctx, context.Background(), &cfg))
+	require.Equal(t, []string{srv.URL + "/c.sh", srv.URL + "/m/a.sh", srv.URL + "/m/lib/b.sh"}, cfg.FileURLs)
+	require.Equal(t, []string{"", "", "b.sh"}, cfg.FileNames)
+	require.Equal(t, "", cfg.fileHash(0))
+	require.Equal(t, "256931e5627bfa46347df35ae1c25649073ce5630975d0cdf9d301d32836a118", cfg.fileHash(2))
+	require.Nil(t, downloadFiles(ctx, context.Background(), dir, cfg, nil))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "b.sh"))
+	require.Nil(t, err)
+	require.Equal(t, bScript, string(b))
+
+	// the files are verified against the checksums in the manifest
+	bScript = "rm -rf /\n"
+	require.Nil(t, os.RemoveAll(dir))
+	err = downloadFiles(ctx, context.Background(), dir, cfg, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "sha256 checksum mismatch for 'b.sh'")
+
+	cfg = newCfg("/m/tampered.json")
+	err = addBundleFiles(ctx, context.Background(), &cfg)
+	require.Equal(t, errSignatureInvalid, categoryOf(err))
+	require.Contains(t, err.Error(), "invalid signature of 'manifest.json': bad signature from key 816A3B919999440C")
+	require.Len(t, cfg.FileURLs, 1, "no file added")
+
+	cfg = newCfg("/m/missing.json")
+	err = addBundleFiles(ctx, context.Background(), &cfg)
+	require.NotNil(t, err)
+	require.Equal(t, errorCategory(""), categoryOf(err), "download failure")
+	require.Contains(t, err.Error(), "failed to download manifest")
+
+	cfg = newCfg("/m/manifest.json")
+	cfg.publicSettings.ManifestSignatureURI = srv.URL + "/m/other.sig"
+	err = addBundleFiles(ctx, context.Background(), &cfg)
+	require.Equal(t, errSignatureInvalid, categoryOf(err))
+
+	cfg = newCfg("/m/manifest.json")
+	cfg.publicSettings.GPGPublicKey = testGPGPublicKey
+	err = addBundleFiles(ctx, context.Background(), &cfg)
+	require.Equal(t, errSignatureInvalid, categoryOf(err))
+	require.Contains(t, err.Error(), "which is not in 'gpgPublicKey'")
+
+	cfg = newCfg("/m/manifest.json")
+	cfg.publicSettings.ScriptFile = "missing.sh"
+	err = addBundleFiles(ctx, context.Background(), &cfg)
+	require.EqualError(t, err, `'scriptFile' "missing.sh" is not the name of a file downloaded from 'fileUris' or 'manifestUri'`)
+
+	// the credentials can be for the listed files, checked once they are added
+	cfg = newCfg("/m/manifest.json")
+	cfg.protectedSettings.FileCredentials = []fileCredential{{URL: "https://a.blob.core.windows.net/c/missing.sh"}}
+	require.Nil(t, cfg.validate())
+	err = addBundleFiles(ctx, context.Background(), &cfg)
+	require.Equal(t, errConfigInvalid, categoryOf(err))
+	require.EqualError(t, err, "'fileCredentials' at index 0 is not for a URL in 'fileUris'")
+}
+
+func Test_parseBundleManifest(t *testing.T) {
+	files, err := parseBundleManifest([]byte(testManifest), "https://a.example.com/m/manifest.json", false)
+	require.Nil(t, err)
+	require.Equal(t, []bundleFile{
+		{"https://a.example.com/m/a.sh", "5dbad7dd0b9b122dcd9956884390f4aac4738caba8ff53498a7ab6718b176c30", ""},
+		{"https://a.example.com/m/lib/b.sh", "256931e5627bfa46347df35ae1c25649073ce5630975d0cdf9d301d32836a118", "b.sh"},
+	}, files)
+
+	hash := `"sha256": "5dbad7dd0b9b122dcd9956884390f4aac4738caba8ff53498a7ab6718b176c30"`
+	files, err = parseBundleManifest([]byte(`{"files": [{"url": "a.sh", `+hash+`}, {"url": "/b.sh?sv=2", `+hash+`}, {"url": "https://b.example.com/c.sh", `+hash+`}, {"url": "//c.example.com/d.sh", `+hash+`}]}`),
+		"https://a.example.com/m/manifest.json?sv=1&sig=secret", false)
+	require.Nil(t, err)
+	var urls []string
+	for _, f := range files {
+		urls = append(urls, f.URL)
+	}
+	require.Equal(t, []string{
+		"https://a.example.com/m/a.sh?sv=1&sig=secret",
+		"https://a.example.com/b.sh?sv=2",
+		"https://b.example.com/c.sh",
+		"https://c.example.com/d.sh",
+	}, urls, "the query string of the manifest only for the relative URLs without one")
+
+	for in, msg := range map[string]string{
+		`{"files": `:                  "cannot parse manifest",
+		`{"files": []}`:               "manifest lists no files",
+		`{"files": [{` + hash + `}]}`: `invalid URL of file 0 in manifest: ""`,
+		`{"files": [{"url": "ftp://b/a.sh", ` + hash + `}]}`:          `invalid URL of file 0 in manifest: unsupported URL scheme "ftp"`,
+		`{"files": [{"url": "file:///a.sh", ` + hash + `}]}`:          `invalid URL of file 0 in manifest: file:// URLs are not allowed unless 'allowFileUris' is set to true`,
+		`{"files": [{"url": "a.sh", ` + hash + `}, {"url": "b.sh"}]}`: `invalid SHA-256 checksum of file 1 in manifest: ""`,
+		`{"files": [{"url": "a.sh", "sha256": "abc"}]}`:               `invalid SHA-256 checksum of file 0 in manifest: "abc"`,
+	} {
+		_, err := parseBundleManifest([]byte(in), "https://a.example.com/manifest.json", false)
+		require.NotNil(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func Test_handlerSettings_manifestSignatureURL(t *testing.T) {
+	h := handlerSettings{publicSettings: publicSettings{ManifestURI: "https://a.example.com/m/manifest.json?sv=1&sig=secret"}}
+	require.Equal(t, "https://a.example.com/m/manifest.json.sig?sv=1&sig=secret", h.manifestSignatureURL())
+	h.publicSettings.ManifestSignatureURI = "https://b.example.com/manifest.asc"
+	require.Equal(t, "https://b.example.com/manifest.asc", h.manifestSignatureURL())
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// cgroupParent is the cgroup, under the cgroup of the handler, of the
+	// cgroups the commands are executed in with memoryLimitMb or cpuQuota.
+	cgroupParent = "custom-script"
+
+	// handlerCgroupLeaf is the cgroup, under its own cgroup, the handler
+	// moves itself to if its cgroup has processes, which cannot enable
+	// controllers for its children otherwise (the "no internal processes"
+	// rule of cgroup v2).
+	handlerCgroupLeaf = "handler"
+
+	// cgroupCPUPeriod is the period of cpu.max in microseconds, the quota of
+	// cpuQuota is a percentage of it.
+	cgroupCPUPeriod = 100000
+)
+
+var (
+	// cgroupRoot is where the cgroup v2 hierarchy is mounted. It is a
+	// variable to be replaced in tests.
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// procSelfCgroup lists the cgroups of the handler process, as in
+	// cgroups(7). It is a variable to be replaced in tests.
+	procSelfCgroup = "/proc/self/cgroup"
+)
+
+// newCommandCgroup creates a cgroup to execute the commands in with the given
+// limits, of the memory in bytes and of the CPU time as a percentage of one
+// CPU, each not applied if zero, under the cgroup of the handler so that the
+// limits set on it by the VM agent or systemd still apply. The processes of
+// the cgroup are killed together if they exceed the memory limit, and they
+// cannot swap. It fails if cgroup v2 is not mounted or its memory and cpu
+// controllers cannot be used in the cgroup of the handler, such as if it has
+// other processes than the handler.
+func newCommandCgroup(memoryBytes int64, cpuPercent int) (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("cgroup v2 is not mounted at %s", cgroupRoot)
+	}
+	var controllers []string
+	if memoryBytes > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if cpuPercent > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	handler, err := handlerCgroup()
+	if err != nil {
+		return "", err
+	}
+	if err := moveToHandlerLeaf(handler); err != nil {
+		return "", err
+	}
+	parent := filepath.Join(handler, cgroupParent)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", errors.Wrap(err, "failed to create cgroup")
+	}
+	for _, d := range []string{handler, parent} {
+		if err := enableCgroupControllers(d, controllers); err != nil {
+			return "", err
+		}
+	}
+
+	dir, err := ioutil.TempDir(parent, "command")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create cgroup")
+	}
+	var required, optional [][2]string // files and their values
+	if memoryBytes > 0 {
+		required = append(required, [2]string{"memory.max", strconv.FormatInt(memoryBytes, 10)})
+		optional = append(optional, [2]string{"memory.swap.max", "0"}, [2]string{"memory.oom.group", "1"})
+	}
+	if cpuPercent > 0 {
+		required = append(required, [2]string{"cpu.max", fmt.Sprintf("%d %d", cpuPercent*cgroupCPUPeriod/100, cgroupCPUPeriod)})
+	}
+	for _, f := range required {
+		if err := ioutil.WriteFile(filepath.Join(dir, f[0]), []byte(f[1]), 0644); err != nil {
+			os.Remove(dir)
+			return "", errors.Wrapf(err, "failed to set %s of cgroup", f[0])
+		}
+	}
+	for _, f := range optional {
+		ioutil.WriteFile(filepath.Join(dir, f[0]), []byte(f[1]), 0644) // not supported by all kernels
+	}
+	return dir, nil
+}
+
+// handlerCgroup returns the directory of the cgroup of the handler process,
+// from its cgroup v2 entry in procSelfCgroup, or of the cgroup above it if it
+// is already in its handlerCgroupLeaf.
+func handlerCgroup() (string, error) {
+	b, err := ioutil.ReadFile(procSelfCgroup)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the cgroup of the handler")
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		// such as "0::/system.slice/walinuxagent.service"
+		if p := strings.TrimPrefix(l, "0::"); p != l {
+			p = filepath.Join("/", p)
+			if filepath.Base(p) == handlerCgroupLeaf {
+				p = filepath.Dir(p)
+			}
+			return filepath.Join(cgroupRoot, p), nil
+		}
+	}
+	return "", fmt.Errorf("the handler is not in a cgroup v2 in %s", procSelfCgroup)
+}
+
+// moveToHandlerLeaf moves the processes of the cgroup dir, the handler and
+// any other such as its parent, into the handlerCgroupLeaf of dir if dir has
+// processes and is not the root cgroup, which is exempt from the "no internal
+// processes" rule, so that controllers can be enabled for the children of dir.
+// The processes which exit meanwhile are ignored, and it fails naming the
+// processes which cannot be moved.
+func moveToHandlerLeaf(dir string) error {
+	if dir == filepath.Clean(cgroupRoot) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return errors.Wrap(err, "failed to read the processes of the cgroup of the handler")
+	}
+	pids := strings.Fields(string(b))
+	if len(pids) == 0 {
+		return nil
+	}
+	leaf := filepath.Join(dir, handlerCgroupLeaf)
+	if err := os.MkdirAll(leaf, 0755); err != nil {
+		return errors.Wrap(err, "failed to create cgroup")
+	}
+	f, err := os.OpenFile(filepath.Join(leaf, "cgroup.procs"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to move the processes of the cgroup of the handler into %s", leaf)
+	}
+	defer f.Close()
+	var failed []string
+	var lastErr error
+	for _, pid := range pids {
+		// each write moves one process
+		if _, err := f.Write([]byte(pid + "\n")); err != nil {
+			if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ESRCH {
+				continue // exited
+			}
+			failed, lastErr = append(failed, pid), err
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Wrapf(lastErr, "failed to move the processes %s of the cgroup of the handler into %s",
+			strings.Join(failed, ", "), leaf)
+	}
+	return nil
+}
+
+// enableCgroupControllers enables the controllers for the children of the
+// cgroup dir, if they are not already.
+func enableCgroupControllers(dir string, controllers []string) error {
+	path := filepath.Join(dir, "cgroup.subtree_control")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read the enabled cgroup controllers")
+	}
+	enabled := strings.Fields(string(b))
+	for _, c := range controllers {
+		if containsString(enabled, c) {
+			continue
+		}
+		if err := ioutil.WriteFile(path, []byte("+"+c), 0644); err != nil {
+			return errors.Wrapf(err, "failed to enable the %s cgroup controller in %s", c, dir)
+		}
+	}
+	return nil
+}
+
+// removeCgroup removes the cgroup dir once its commands have exited. The
+// cgroup of a command running in the background is left in place.
+func removeCgroup(ctx log.Logger, dir string) {
+	if err := os.Remove(dir); err != nil {
+		ctx.Log("event", "cgroup not removed", "path", dir, "error", err)
+	}
+}
+
+// cgroupOOMKills returns how many processes of the cgroup dir have been
+// killed by the OOM killer for exceeding its memory limit, from the oom_kill
+// entry of memory.events.
+func cgroupOOMKills(dir string) int64 {
+	if dir == "" {
+		return 0
+	}
+	f, err := os.Open(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if fields := strings.Fields(s.Text()); len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// cgroupGate holds a command started with its cgroup gate script until it is
+// moved into the cgroup, so that none of its processes run outside of it. The
+// script waits to read a line from the pipe on file descriptor 3 before
+// executing the command.
+type cgroupGate struct {
+	dir  string
+	r, w *os.File
+}
+
+// cgroupGateScript executes the command in its arguments once a line is read
+// from file descriptor 3, which is closed for the command.
+const cgroupGateScript = `read _ <&3 && exec "$@" 3<&-`
+
+// newCgroupGate returns the gate of a command c to be executed in the cgroup
+// dir, and sets the pipe it waits on as the file descriptor 3 of c.
+func newCgroupGate(dir string, c *exec.Cmd) (*cgroupGate, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create pipe")
+	}
+	c.ExtraFiles = []*os.File{r}
+	return &cgroupGate{dir, r, w}, nil
+}
+
+// release moves the started command, whose process ID is pid, into the cgroup
+// of g and lets it execute. If it cannot be moved, the command exits without
+// executing.
+func (g *cgroupGate) release(pid int) error {
+	defer g.close()
+	if err := ioutil.WriteFile(filepath.Join(g.dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return errors.Wrap(err, "failed to move command into cgroup")
+	}
+	_, err := g.w.Write([]byte("\n"))
+	return errors.Wrap(err, "failed to start command in cgroup")
+}
+
+// close closes the pipe of g. It can be called several times, and on a nil
+// gate.
+func (g *cgroupGate) close() {
+	if g != nil {
+		g.r.Close()
+		g.w.Close()
+	}
+}
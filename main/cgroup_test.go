@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// mockCgroupRoot makes a temporary directory look like the root of a cgroup
+// v2 hierarchy with the memory and cpu controllers, with the cgroup of the
+// handler, which has processes, until the returned function is called.
+func mockCgroupRoot(t *testing.T) (handler string, restore func()) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	handler = filepath.Join(root, "system.slice", "agent.service")
+	require.Nil(t, os.MkdirAll(filepath.Join(handler, cgroupParent), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory pids\n"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("cpu memory\n"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(handler, "cgroup.procs"), []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(handler, "cgroup.subtree_control"), []byte("memory\n"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(handler, cgroupParent, "cgroup.subtree_control"), nil, 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "self"), []byte("0::/system.slice/agent.service\n"), 0644))
+	oldRoot, oldSelf := cgroupRoot, procSelfCgroup
+	cgroupRoot, procSelfCgroup = root, filepath.Join(root, "self")
+	return handler, func() {
+		cgroupRoot, procSelfCgroup = oldRoot, oldSelf
+		os.RemoveAll(root)
+	}
+}
+
+func readFileString(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	return string(b)
+}
+
+func Test_newCommandCgroup(t *testing.T) {
+	root, restore := mockCgroupRoot(t)
+	defer restore()
+
+	dir, err := newCommandCgroup(512<<20, 50)
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(root, cgroupParent), filepath.Dir(dir), "under the cgroup of the handler")
+	require.Equal(t, fmt.Sprintf("%d\n", os.Getpid()), readFileString(t, filepath.Join(root, handlerCgroupLeaf, "cgroup.procs")),
+		"the handler is moved to a leaf")
+	require.Equal(t, "cpu memory\n", readFileString(t, filepath.Join(cgroupRoot, "cgroup.subtree_control")), "root not changed")
+	require.Equal(t, "536870912", readFileString(t, filepath.Join(dir, "memory.max")))
+	require.Equal(t, "0", readFileString(t, filepath.Join(dir, "memory.swap.max")))
+	require.Equal(t, "1", readFileString(t, filepath.Join(dir, "memory.oom.group")))
+	require.Equal(t, "50000 100000", readFileString(t, filepath.Join(dir, "cpu.max")))
+	require.Equal(t, "+cpu", readFileString(t, filepath.Join(root, "cgroup.subtree_control")), "only the missing controller is enabled")
+	require.Equal(t, "+cpu", readFileString(t, filepath.Join(root, cgroupParent, "cgroup.subtree_control")))
+
+	dir, err = newCommandCgroup(0, 150)
+	require.Nil(t, err)
+	require.Equal(t, "150000 100000", readFileString(t, filepath.Join(dir, "cpu.max")))
+	_, err = os.Stat(filepath.Join(dir, "memory.max"))
+	require.True(t, os.IsNotExist(err), "memory not limited")
+}
+
+func Test_handlerCgroup(t *testing.T) {
+	handler, restore := mockCgroupRoot(t)
+	defer restore()
+	for in, out := range map[string]string{
+		"0::/system.slice/agent.service\n":                       handler,
+		"12:memory:/x\n0::/system.slice/agent.service/handler\n": handler,
+		"0::/\n": cgroupRoot,
+	} {
+		require.Nil(t, ioutil.WriteFile(procSelfCgroup, []byte(in), 0644))
+		dir, err := handlerCgroup()
+		require.Nil(t, err, in)
+		require.Equal(t, out, dir, in)
+	}
+
+	require.Nil(t, ioutil.WriteFile(procSelfCgroup, []byte("12:memory:/x\n"), 0644))
+	_, err := handlerCgroup()
+	require.EqualError(t, err, "the handler is not in a cgroup v2 in "+procSelfCgroup)
+}
+
+func Test_moveToHandlerLeaf(t *testing.T) {
+	handler, restore := mockCgroupRoot(t)
+	defer restore()
+	require.Nil(t, moveToHandlerLeaf(cgroupRoot), "root cgroup")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(handler, "cgroup.procs"), nil, 0644))
+	require.Nil(t, moveToHandlerLeaf(handler), "no processes")
+	_, err := os.Stat(filepath.Join(handler, handlerCgroupLeaf))
+	require.True(t, os.IsNotExist(err), "not moved")
+
+	// with another process, such as the parent of the handler
+	procs := fmt.Sprintf("%d\n%d\n", os.Getppid(), os.Getpid())
+	require.Nil(t, ioutil.WriteFile(filepath.Join(handler, "cgroup.procs"), []byte(procs), 0644))
+	require.Nil(t, moveToHandlerLeaf(handler))
+	require.Equal(t, procs, readFileString(t, filepath.Join(handler, handlerCgroupLeaf, "cgroup.procs")), "all moved, one by one")
+
+	// the processes which cannot be moved are named
+	require.Nil(t, os.Remove(filepath.Join(handler, handlerCgroupLeaf, "cgroup.procs")))
+	require.Nil(t, os.Symlink("/dev/full", filepath.Join(handler, handlerCgroupLeaf, "cgroup.procs")))
+	err = moveToHandlerLeaf(handler)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("failed to move the processes %d, %d of the cgroup of the handler into %s",
+		os.Getppid(), os.Getpid(), filepath.Join(handler, handlerCgroupLeaf)))
+}
+
+func Test_newCommandCgroup_notMounted(t *testing.T) {
+	old := cgroupRoot
+	defer func() { cgroupRoot = old }()
+	cgroupRoot = "/non/existing"
+
+	_, err := newCommandCgroup(1<<20, 0)
+	require.EqualError(t, err, "cgroup v2 is not mounted at /non/existing")
+}
+
+func Test_newCommandCgroup_controllersNotAccessible(t *testing.T) {
+	root, restore := mockCgroupRoot(t)
+	defer restore()
+	require.Nil(t, os.Remove(filepath.Join(root, cgroupParent, "cgroup.subtree_control")))
+
+	_, err := newCommandCgroup(1<<20, 0)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to read the enabled cgroup controllers")
+}
+
+func Test_cgroupOOMKills(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	require.EqualValues(t, 0, cgroupOOMKills(""))
+	require.EqualValues(t, 0, cgroupOOMKills(dir), "no memory.events")
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "memory.events"), []byte("low 0\nhigh 0\nmax 12\noom 2\noom_kill 2\n"), 0644))
+	require.EqualValues(t, 2, cgroupOOMKills(dir))
+}
+
+func TestExec_cgroup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	o := new(mockFile)
+	_, err := Exec(`echo $$; [ ! -e /proc/self/fd/3 ]`, "/", o, new(mockFile), ExecOptions{CgroupDir: dir})
+	require.Nil(t, err, "the pipe is closed for the command")
+	require.Equal(t, strings.TrimSpace(string(o.b.Bytes())), readFileString(t, filepath.Join(dir, "cgroup.procs")),
+		"moved into the cgroup before executing")
+}
+
+func TestExec_cgroup_notMoved(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	_, err := Exec("touch "+out, "/", new(mockFile), new(mockFile), ExecOptions{CgroupDir: filepath.Join(dir, "non-existing")})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to move command into cgroup")
+	_, err = os.Stat(out)
+	require.True(t, os.IsNotExist(err), "command not executed")
+}
+
+func TestExec_cgroup_outOfMemory(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	events := filepath.Join(dir, "memory.events")
+	require.Nil(t, ioutil.WriteFile(events, []byte("oom_kill 1\n"), 0644))
+
+	// the kernel counts the OOM kill in memory.events
+	_, err := Exec(`echo "oom_kill 2" > `+events+`; kill -9 $$`, "/", new(mockFile), new(mockFile), ExecOptions{CgroupDir: dir})
+	require.Equal(t, ExitError{Code: -1, Signal: syscall.SIGKILL, OutOfMemory: true}, err)
+	require.Equal(t, "command terminated by signal=SIGKILL: out of memory, it exceeded the memory limit of its cgroup", err.Error())
+
+	_, err = Exec(`kill -9 $$`, "/", new(mockFile), new(mockFile), ExecOptions{CgroupDir: dir})
+	require.Equal(t, ExitError{Code: -1, Signal: syscall.SIGKILL}, err, "killed by another process")
+}
+
+func Test_runParallelCmds_outOfMemory(t *testing.T) {
+	dir, cg := tempDir(t), tempDir(t)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(cg)
+	events := filepath.Join(cg, "memory.events")
+	require.Nil(t, ioutil.WriteFile(events, []byte("oom_kill 0\n"), 0644))
+
+	// the kill of one command is counted in the cgroup of both
+	err := runParallelCmds(log.NewNopLogger(), []string{
+		`echo "oom_kill 1" > ` + events + `; kill -9 $$`,
+		`sleep 0.2; kill -9 $$`,
+	}, dir, ExecOptions{CgroupDir: cg}, 2, 0)
+	require.EqualError(t, err, "2 of 2 parallelCommands failed: "+
+		"parallelCommands[0]: command terminated by signal=SIGKILL; parallelCommands[1]: command terminated by signal=SIGKILL; "+
+		"out of memory, the parallelCommands exceeded the memory limit of their cgroup together")
+	require.Equal(t, ExitError{Code: -1, Signal: syscall.SIGKILL}, errors.Cause(err))
+}
+
+func Test_commandExecOptions_cgroup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root, restore := mockCgroupRoot(t)
+	defer restore()
+	cfg := handlerSettings{publicSettings: publicSettings{MemoryLimitMB: 256, CPUQuota: 25}}
+
+	opts, cleanup, err := commandExecOptions(log.NewNopLogger(), context.Background(), dir, cfg)
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(root, cgroupParent), filepath.Dir(opts.CgroupDir))
+	require.Equal(t, "268435456", readFileString(t, filepath.Join(opts.CgroupDir, "memory.max")))
+	require.Equal(t, "25000 100000", readFileString(t, filepath.Join(opts.CgroupDir, "cpu.max")))
+	cleanup()
+	_, err = os.Stat(opts.CgroupDir)
+	require.False(t, os.IsNotExist(err), "not an empty directory in the mock, removed from a real cgroupfs")
+
+	// executed without limits if cgroups are not accessible
+	cgroupRoot = "/non/existing"
+	opts, cleanup, err = commandExecOptions(log.NewNopLogger(), context.Background(), dir, cfg)
+	cleanup()
+	require.Nil(t, err)
+	require.Equal(t, "", opts.CgroupDir)
+	o := new(mockFile)
+	_, err = Exec("echo unlimited", dir, o, new(mockFile), opts)
+	require.Nil(t, err)
+	require.Equal(t, "unlimited\n", string(o.b.Bytes()))
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxSymlinks is how many symbolic links are followed to resolve a path
+	// in a chroot directory, as the ELOOP limit of Linux.
+	maxSymlinks = 40
+
+	// chrootCopyMarkerSuffix is appended to the path of a copy made by
+	// copyIntoChroot for the file recording it, which contains the topmost
+	// directory created for the copy.
+	chrootCopyMarkerSuffix = ".custom-script-copy"
+)
+
+// resolveInRoot returns the path on this system of the file at the absolute
+// path p in the directory root when root is the root directory, such as for
+// a process chrooted into it: the symbolic links are resolved within root,
+// even those with absolute targets, and ".." never leaves it.
+func resolveInRoot(root, p string) (string, error) {
+	resolved := "/" // in root
+	rest := strings.Split(p, "/")
+	for links := 0; len(rest) > 0; {
+		c := rest[0]
+		rest = rest[1:]
+		if c == "" || c == "." {
+			continue
+		}
+		if c == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, c)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", p)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// lookPathInRoot searches for the executable file in the directories of the
+// PATH environment variable in the directory root, as exec.LookPath would
+// for a process chrooted into it, and returns its path in root. If file
+// contains a slash, it is only checked at that absolute path.
+func lookPathInRoot(root, file string) (string, error) {
+	if strings.Contains(file, "/") {
+		p := filepath.Join("/", file)
+		return p, executableInRoot(root, p)
+	}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		if p := filepath.Join(dir, file); executableInRoot(root, p) == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("executable file %q not found in $PATH", file)
+}
+
+// executableInRoot checks if the file at the path p in root is an executable
+// regular file.
+func executableInRoot(root, p string) error {
+	hp, err := resolveInRoot(root, p)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(hp)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", p)
+	}
+	return nil
+}
+
+// validateChrootDir checks if the commands can be executed chrooted into the
+// directory root: it must be a directory with the interpreter of the commands
+// (/bin/sh if empty) and /bin/sh, used to set the umask and the cgroup.
+func validateChrootDir(root, interpreter string) error {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return errors.Wrap(err, "cannot access 'chrootDir'")
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("'chrootDir' %q is not a directory", root)
+	}
+	for _, f := range []string{defaultInterpreter, interpreter} {
+		if f == "" {
+			continue
+		}
+		if _, err := lookPathInRoot(root, f); err != nil {
+			return errors.Wrapf(err, "'chrootDir' %q has no usable interpreter %q", root, f)
+		}
+	}
+	return nil
+}
+
+func pathExists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+// copyIntoChroot copies the directory dir, with the modes and the owners of
+// its files, to the same path in the directory root, so that the commands
+// chrooted into root find the downloaded files, and the other files such as
+// the secrets file, at the paths they are given. The directories of the path
+// missing in root are created, and removed along with the copy by the returned
+// function. The copy is recorded in a marker file next to it until it is
+// removed, so that a copy left behind is replaced, but not a directory of
+// root at the same path. It fails if the path goes through a symbolic link in
+// root, which may lead outside of it. The files written in the copy, such as
+// by the commands, are not copied back to dir: they are discarded by remove,
+// which returns their paths relative to the copy.
+func copyIntoChroot(root, dir string) (remove func() (written []string, _ error), _ error) {
+	dst := filepath.Join(root, dir)
+	marker := dst + chrootCopyMarkerSuffix
+	top := "" // the topmost directory created
+	p := root
+	for _, c := range strings.Split(strings.Trim(dir, "/"), "/") {
+		p = filepath.Join(p, c)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			top = p
+			break
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "cannot access %s", p)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return nil, fmt.Errorf("cannot copy files to %s: %s is a symbolic link", dst, p)
+		} else if !fi.IsDir() {
+			return nil, fmt.Errorf("cannot copy files to %s: %s is not a directory", dst, p)
+		}
+	}
+	if top == "" {
+		prev, err := previousChrootCopy(root, dst, marker)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.RemoveAll(prev); err != nil {
+			return nil, errors.Wrap(err, "failed to remove previous copy")
+		}
+		top = prev
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create directory")
+	}
+	if err := ioutil.WriteFile(marker, []byte(top), 0600); err != nil {
+		os.RemoveAll(top)
+		return nil, errors.Wrap(err, "failed to record copy")
+	}
+	copied := make(map[string]os.FileInfo) // to find the files written in the copy
+	remove = func() ([]string, error) {
+		written := chrootCopyWrites(dst, copied)
+		if err := os.RemoveAll(top); err != nil {
+			return written, err
+		}
+		if err := os.Remove(marker); err != nil && !os.IsNotExist(err) { // in top unless it is dst
+			return written, err
+		}
+		return written, nil
+	}
+
+	var dirs []string // to set their modes once their contents are copied
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			err = os.Mkdir(target, 0700)
+			dirs = append(dirs, rel)
+		case fi.Mode()&os.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(path); err == nil {
+				err = os.Symlink(link, target)
+			}
+		case fi.Mode().IsRegular():
+			err = copyFile(path, target)
+		default:
+			return nil // such as a named pipe
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to copy %s", rel)
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+				return errors.Wrapf(err, "failed to set owner of %s", rel)
+			}
+		}
+		if fi.Mode().IsRegular() {
+			if err := os.Chmod(target, fi.Mode().Perm()); err != nil {
+				return errors.Wrapf(err, "failed to set mode of %s", rel)
+			}
+		}
+		if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+			copied[rel] = fi
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0 && err == nil; i-- {
+		fi, serr := os.Stat(filepath.Join(dir, dirs[i]))
+		if err = serr; err == nil {
+			err = errors.Wrapf(os.Chmod(filepath.Join(dst, dirs[i]), fi.Mode().Perm()), "failed to set mode of %s", dirs[i])
+		}
+	}
+	if err != nil {
+		remove()
+		return nil, err
+	}
+	return remove, nil
+}
+
+// chrootCopyWrites returns the paths relative to the copy at dst of the files
+// in it which are not in copied, the files as copied by their paths, or which
+// are modified since.
+func chrootCopyWrites(dst string, copied map[string]os.FileInfo) []string {
+	var written []string
+	filepath.Walk(dst, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dst, path)
+		if err != nil {
+			return nil
+		}
+		if c, ok := copied[rel]; !ok || c.Size() != fi.Size() || !c.ModTime().Equal(fi.ModTime()) {
+			written = append(written, rel)
+		}
+		return nil
+	})
+	return written
+}
+
+// previousChrootCopy returns the topmost directory created for the copy at
+// dst in root left behind by copyIntoChroot, as recorded in its marker file.
+// It fails if dst is not such a copy.
+func previousChrootCopy(root, dst, marker string) (string, error) {
+	b, err := ioutil.ReadFile(marker)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("cannot copy files to %s: it already exists and is not a previous copy", dst)
+	} else if err != nil {
+		return "", errors.Wrap(err, "failed to read the record of the previous copy")
+	}
+	top := string(b)
+	if !filepath.IsAbs(top) || filepath.Clean(top) != top || !pathIn(dst, top) || !pathIn(top, root) || top == filepath.Clean(root) {
+		return "", fmt.Errorf("cannot copy files to %s: invalid record of the previous copy in %s", dst, marker)
+	}
+	return top, nil
+}
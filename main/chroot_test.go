@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// mockChrootDir returns a directory with /bin/sh of this system and the
+// libraries it needs, to chroot into. The test is skipped if it cannot be
+// created or the test is not run as root.
+func mockChrootDir(t *testing.T) string {
+	if os.Getuid() != 0 {
+		t.Skip("chroot requires root")
+	}
+	sh, err := filepath.EvalSymlinks(defaultInterpreter)
+	require.Nil(t, err)
+	files := []string{sh}
+	out, err := exec.Command("ldd", sh).Output()
+	if err != nil {
+		t.Skipf("cannot find the libraries of %s: %v", sh, err)
+	}
+	s := bufio.NewScanner(strings.NewReader(string(out)))
+	for s.Scan() {
+		// such as "libc.so.6 => /lib/x86_64-linux-gnu/libc.so.6 (0x...)"
+		for _, f := range strings.Fields(s.Text()) {
+			if filepath.IsAbs(f) {
+				files = append(files, f)
+			}
+		}
+	}
+
+	root := tempDir(t)
+	for _, f := range files {
+		src, err := filepath.EvalSymlinks(f)
+		require.Nil(t, err)
+		dst := filepath.Join(root, f)
+		if f == sh {
+			dst = filepath.Join(root, defaultInterpreter)
+		}
+		require.Nil(t, os.MkdirAll(filepath.Dir(dst), 0755))
+		require.Nil(t, copyFile(src, dst))
+		require.Nil(t, os.Chmod(dst, 0755))
+	}
+	return root
+}
+
+func Test_resolveInRoot(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "usr", "bin"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "usr", "bin", "dash"), nil, 0755))
+	require.Nil(t, os.Symlink("dash", filepath.Join(root, "usr", "bin", "sh")))
+	require.Nil(t, os.Symlink("/usr/bin", filepath.Join(root, "bin")), "absolute, resolved in root")
+	require.Nil(t, os.Symlink("../../../../loop", filepath.Join(root, "loop")))
+
+	p, err := resolveInRoot(root, "/bin/sh")
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(root, "usr", "bin", "dash"), p)
+	p, err = resolveInRoot(root, "/../../usr/./bin/../bin")
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(root, "usr", "bin"), p, "never leaves root")
+
+	_, err = resolveInRoot(root, "/bin/bash")
+	require.True(t, os.IsNotExist(err))
+	_, err = resolveInRoot(root, "/loop")
+	require.EqualError(t, err, "too many levels of symbolic links in /loop")
+}
+
+func Test_validateChrootDir(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "bin"), 0755))
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "usr", "bin"), 0755))
+
+	err := validateChrootDir(root, "")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), `has no usable interpreter "/bin/sh"`)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "bin", "sh"), nil, 0755))
+	require.Nil(t, validateChrootDir(root, ""))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "usr", "bin", "python3"), nil, 0644))
+	err = validateChrootDir(root, "/usr/bin/python3")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "/usr/bin/python3 is not an executable file")
+
+	require.Nil(t, os.Chmod(filepath.Join(root, "usr", "bin", "python3"), 0755))
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "/usr/local/bin:/usr/bin:relative")
+	require.Nil(t, validateChrootDir(root, "python3"), "found in PATH")
+	p, err := lookPathInRoot(root, "python3")
+	require.Nil(t, err)
+	require.Equal(t, "/usr/bin/python3", p)
+	_, err = lookPathInRoot(root, "bash")
+	require.EqualError(t, err, `executable file "bash" not found in $PATH`)
+
+	require.NotNil(t, validateChrootDir(filepath.Join(root, "non-existing"), ""))
+	err = validateChrootDir(filepath.Join(root, "bin", "sh"), "")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "is not a directory")
+}
+
+func Test_copyIntoChroot(t *testing.T) {
+	root, dir := tempDir(t), tempDir(t)
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(dir)
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "app"), 0500))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "run.sh"), []byte("echo hello"), 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "app", "conf"), []byte("x=1"), 0400))
+	require.Nil(t, os.Symlink("app/conf", filepath.Join(dir, "conf")))
+	top := strings.SplitN(strings.TrimPrefix(dir, "/"), "/", 2)[0] // created in root
+
+	remove, err := copyIntoChroot(root, dir)
+	require.Nil(t, err)
+	dst := filepath.Join(root, dir)
+	require.Equal(t, "echo hello", readFileString(t, filepath.Join(dst, "run.sh")))
+	require.Equal(t, "x=1", readFileString(t, filepath.Join(dst, "conf")))
+	for name, mode := range map[string]os.FileMode{"run.sh": 0700, "app": 0500, "app/conf": 0400} {
+		fi, err := os.Stat(filepath.Join(dst, name))
+		require.Nil(t, err)
+		require.Equal(t, mode, fi.Mode().Perm(), name)
+	}
+	link, err := os.Readlink(filepath.Join(dst, "conf"))
+	require.Nil(t, err)
+	require.Equal(t, "app/conf", link)
+
+	require.True(t, pathExists(dst+chrootCopyMarkerSuffix), "copy recorded")
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dst, "app", "out"), []byte("new"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dst, "run.sh"), []byte("echo changed"), 0700))
+	written, err := remove()
+	require.Nil(t, err)
+	require.Equal(t, []string{"app/out", "run.sh"}, written, "discarded, not the unchanged files")
+	require.Equal(t, "echo hello", readFileString(t, filepath.Join(dir, "run.sh")), "not copied back")
+	_, err = os.Stat(filepath.Join(root, top))
+	require.True(t, os.IsNotExist(err), "created directories removed")
+	_, err = os.Stat(root)
+	require.Nil(t, err)
+
+	// a copy left behind is replaced, with the directories created for it
+	_, err = copyIntoChroot(root, dir)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dst, "left"), nil, 0600))
+	remove, err = copyIntoChroot(root, dir)
+	require.Nil(t, err)
+	require.False(t, pathExists(filepath.Join(dst, "left")))
+	written, err = remove()
+	require.Nil(t, err)
+	require.Empty(t, written)
+	require.False(t, pathExists(filepath.Join(root, top)))
+
+	// but not a directory of root at the same path
+	require.Nil(t, os.MkdirAll(dst, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dst, "keep"), nil, 0600))
+	_, err = copyIntoChroot(root, dir)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "it already exists and is not a previous copy")
+	require.True(t, pathExists(filepath.Join(dst, "keep")))
+	require.Nil(t, ioutil.WriteFile(dst+chrootCopyMarkerSuffix, []byte(root), 0600))
+	_, err = copyIntoChroot(root, dir)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid record of the previous copy")
+	require.True(t, pathExists(filepath.Join(dst, "keep")))
+	require.Nil(t, os.RemoveAll(filepath.Join(root, top)))
+
+	// never through symbolic links, which may lead outside of root
+	require.Nil(t, os.Symlink("/", filepath.Join(root, top)))
+	_, err = copyIntoChroot(root, dir)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "is a symbolic link")
+}
+
+func TestExec_chroot(t *testing.T) {
+	root := mockChrootDir(t)
+	defer os.RemoveAll(root)
+	require.Nil(t, os.Mkdir(filepath.Join(root, "work"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "work", "in-chroot"), []byte("yes"), 0644))
+
+	o := new(mockFile)
+	_, err := Exec(`pwd; read v < in-chroot; echo $v; [ ! -e /proc ]`, "/work", o, new(mockFile), ExecOptions{Chroot: root})
+	require.Nil(t, err)
+	require.Equal(t, "/work\nyes\n", string(o.b.Bytes()))
+
+	_, err = Exec("date", "/", new(mockFile), new(mockFile), ExecOptions{Chroot: root, Interpreter: "bash"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), `interpreter "bash" is not found or not executable`)
+}
+
+func Test_commandExecOptions_chroot(t *testing.T) {
+	root := mockChrootDir(t)
+	defer os.RemoveAll(root)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "conf"), []byte("downloaded\n"), 0600))
+	cfg := handlerSettings{publicSettings: publicSettings{ChrootDir: root, Umask: "077"}}
+
+	opts, cleanup, err := commandExecOptions(log.NewNopLogger(), context.Background(), dir, cfg)
+	require.Nil(t, err)
+	require.Equal(t, root, opts.Chroot)
+	o := new(mockFile)
+	_, err = Exec(`read v < conf && echo $v && : > "$CUSTOM_SCRIPT_REBOOT_REQUIRED_FILE"`, dir, o, new(mockFile), opts)
+	require.Nil(t, err)
+	require.Equal(t, "downloaded\n", string(o.b.Bytes()), "copied into the chroot directory")
+	cleanup()
+	require.True(t, pathExists(filepath.Join(dir, rebootRequiredFile)), "reboot request copied back")
+	require.False(t, pathExists(filepath.Join(root, dir)), "copy removed")
+}
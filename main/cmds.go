@@ -1,18 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
 	"github.com/Azure/custom-script-extension-linux/pkg/seqnum"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
-type cmdFunc func(ctx *log.Context, hEnv vmextension.HandlerEnvironment, seqNum int) error
-type preFunc func(ctx *log.Context, seqNum int) error
+// cmdFunc handles an operation and optionally returns a message to be appended
+// to the reported status and substatuses to be reported along with it.
+type cmdFunc func(ctx *log.Context, hEnv vmextension.HandlerEnvironment, seqNum int) (msg string, sub []substatus, _ error)
+type preFunc func(ctx *log.Context, hEnv vmextension.HandlerEnvironment, seqNum int) error
 
 type cmd struct {
 	f                  cmdFunc // associated function
@@ -25,140 +35,1305 @@ var (
 	cmdInstall   = cmd{install, "Install", false, nil}
 	cmdEnable    = cmd{enable, "Enable", true, enablePre}
 	cmdUninstall = cmd{uninstall, "Uninstall", false, nil}
+	cmdStatus    = cmd{inspect, "Status", false, nil}
+
+	cmdCheckCredentials = cmd{checkCredentials, "CheckCredentials", false, nil}
 
 	cmds = map[string]cmd{
-		"install":   cmdInstall,
-		"uninstall": cmdUninstall,
-		"enable":    cmdEnable,
-		"update":    {noop, "Update", true, nil},
-		"disable":   {noop, "Disable", true, nil},
+		"install":          cmdInstall,
+		"uninstall":        cmdUninstall,
+		"enable":           cmdEnable,
+		"update":           {update, "Update", true, nil},
+		"disable":          {disable, "Disable", true, nil},
+		"status":           cmdStatus,
+		"checkcredentials": cmdCheckCredentials,
 	}
 )
 
-func noop(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) error {
-	ctx.Log("event", "noop")
-	return nil
+// readOnly returns true if the subcommand c prints its results to stdout and
+// does not change the state of the extension, such as the data directory.
+func (c cmd) readOnly() bool {
+	return c.name == cmdStatus.name || c.name == cmdCheckCredentials.name
 }
 
-func install(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) error {
+func install(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) (string, []substatus, error) {
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		return errors.Wrap(err, "failed to create data dir")
+		return "", nil, errors.Wrap(err, "failed to create data dir")
 	}
 	ctx.Log("event", "created data dir", "path", dataDir)
 	ctx.Log("event", "installed")
-	return nil
+	return "", nil, nil
 }
 
-func uninstall(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) error {
+func uninstall(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) (string, []substatus, error) {
+	if dataDir != defaultDataDir {
+		if err := checkDataDirOverlap(dataDir); err != nil {
+			return "", nil, errors.Wrap(err, "data dir not removed")
+		}
+	}
 	{ // a new context scope with path
 		ctx = ctx.With("path", dataDir)
 		ctx.Log("event", "removing data dir", "path", dataDir)
 		if err := os.RemoveAll(dataDir); err != nil {
-			return errors.Wrap(err, "failed to delete data dir")
+			return "", nil, errors.Wrap(err, "failed to delete data dir")
 		}
 		ctx.Log("event", "removed data dir")
 	}
 	ctx.Log("event", "uninstalled")
-	return nil
+	return "", nil, nil
 }
 
-func enablePre(ctx *log.Context, seqNum int) error {
-	// for a few versions we need to migrate dataDirOld (introduced in v2.0.0) to
-	// dataDir (introduced in v2.0.1).
+// disable terminates the command of a previous enable if it is still running,
+// found through the pidfile, or the parallelCommands through their numbered
+// pidfiles. If no command is running, it does nothing.
+func disable(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) (string, []substatus, error) {
+	path := filepath.Join(dataDir, pidFile)
+	pid, err := terminatePIDFile(path, defaultGracePeriod)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to terminate the running command")
+	}
+	if pid != 0 {
+		ctx.Log("event", "terminated running command", "pid", pid)
+		return fmt.Sprintf("terminated the running command (pid %d)", pid), nil, nil
+	}
+
+	paths, _ := filepath.Glob(path + ".*") // the pattern is valid
+	var pids []string
+	for _, p := range paths {
+		pid, err := terminatePIDFile(p, defaultGracePeriod)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "failed to terminate the running commands")
+		}
+		if pid != 0 {
+			pids = append(pids, fmt.Sprintf("%d", pid))
+		}
+	}
+	if len(pids) == 0 {
+		ctx.Log("event", "noop", "message", "no running command")
+		return "", nil, nil
+	}
+	ctx.Log("event", "terminated running commands", "pids", strings.Join(pids, ","))
+	return fmt.Sprintf("terminated the running commands (pids %s)", strings.Join(pids, ", ")), nil, nil
+}
+
+func enablePre(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) error {
+	// the state directories are migrated by update, but the extension may be
+	// enabled without an update, such as when reinstalled
 	ctx.Log("message", "checking for state migration")
-	if err := migrateDataDir(ctx, dataDirOld, dataDir); err != nil {
-		return errors.Wrap(err, "state directory could not be migrated")
+	if _, err := migrateDataDirs(ctx, h); err != nil {
+		return err
+	}
+
+	// run one enable at a time, until this process exits, as the sequence
+	// number and the download directory are shared
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create data dir")
+	}
+	lock, err := acquireLock(ctx, filepath.Join(dataDir, lockFile), defaultLockTimeout)
+	if err != nil {
+		return errors.Wrap(err, "failed to acquire enable lock")
 	}
+	heldLock = lock
 
 	// exit if this sequence number (a snapshot of the configuration) is alrady
-	// processed. if not, save this sequence number before proceeding.
+	// processed, unless the forceUpdateTag is changed. if not, save this
+	// sequence number and the tag before proceeding.
 	seqNumPath := filepath.Join(dataDir, seqNumFile)
-	if shouldExit, err := checkAndSaveSeqNum(ctx, seqNum, seqNumPath); err != nil {
+	tagPath := filepath.Join(dataDir, forceUpdateTagFile)
+	tag, alwaysRun := readPreCheckSettings(ctx, h.HandlerEnvironment.ConfigFolder)
+	if shouldExit, err := checkAndSaveSeqNum(ctx, seqNum, seqNumPath, tag, tagPath, alwaysRun); err != nil {
 		return errors.Wrap(err, "failed to process seqnum")
 	} else if shouldExit {
+		if phase := resumePhase(ctx, seqNum); phase > 0 {
+			ctx.Log("event", "resuming the command after the requested reboot", "phase", phase)
+			return nil
+		}
 		ctx.Log("event", "exit", "message", "this script configuration is already processed, will not run again")
 		os.Exit(0)
 	}
 	return nil
 }
 
-func enable(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) error {
+func enable(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) (string, []substatus, error) {
 	// parse the extension handler settings (not available prior to 'enable')
 	cfg, err := parseAndValidateSettings(ctx, h.HandlerEnvironment.ConfigFolder)
 	if err != nil {
-		return errors.Wrap(err, "failed to get configuration")
+		err = categorize(errConfigInvalid, errors.Wrap(err, "failed to get configuration"))
+		saveResult(ctx, newEnableResult(seqNum), err)
+		return "", settingSubstatuses(err), err
+	}
+
+	// continue with the next phase of the command if it requested a reboot,
+	// in every attempt
+	phase := resumePhase(ctx, seqNum)
+	if phase > 0 {
+		ctx.Log("event", "resuming after reboot", "phase", phase)
+	} else {
+		phase = 1
+	}
+	clearResumeState(ctx)
+
+	// run the whole operation again if it fails for a retriable reason, the
+	// status is the one of the last attempt, followed by the snapshot of the
+	// resources of the VM if it failed
+	retries := cfg.publicSettings.EnableRetryCount
+	for attempt := 1; ; attempt++ {
+		actx := ctx
+		if retries > 0 {
+			actx = ctx.With("attempt", attempt)
+			actx.Log("event", "enable attempt", "attempt", attempt, "retries", retries)
+		}
+		msg, sub, err := enableAttempt(actx, h, seqNum, phase, cfg)
+		if retries > 0 && attempt > 1 {
+			msg = fmt.Sprintf("enable attempt %d of %d (enableRetryCount)\n", attempt, retries+1) + msg
+		}
+		if err == nil || attempt > retries || !retriableCategory(categoryOf(err)) {
+			return msg + cfg.systemSnapshotMsg(ctx, err), sub, err
+		}
+		interval := cfg.enableRetryInterval()
+		ctx.Log("event", "enable failed, retrying", "attempt", attempt, "retries", retries, "error", err, "wait", interval)
+		reportProgress(ctx, h, seqNum, "Enable", fmt.Sprintf("attempt %d of %d failed, retrying in %v: %v", attempt, retries+1, interval, err))
+		select {
+		case <-time.After(interval):
+		case <-shutdown.ctx.Done():
+			return msg + cfg.systemSnapshotMsg(ctx, err), sub, shutdown.aborted(err)
+		}
+	}
+}
+
+// enableAttempt runs the enable operation once with the settings in cfg,
+// executing the given phase of the command.
+func enableAttempt(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum, phase int, cfg handlerSettings) (msg string, sub []substatus, err error) {
+	// save the result of this run in the end, whatever the outcome is
+	res := newEnableResult(seqNum)
+	defer func() { saveResult(ctx, res, err) }()
+
+	// report a transitioning status as each phase starts, and the phases in
+	// the final status
+	phases := newPhaseTracker(enablePhases)
+	startPhase := func(name, msg string) {
+		phases.start(name)
+		reportProgress(ctx, h, seqNum, "Enable", msg, cfg.reportedSubstatuses(phases.substatuses(false))...)
+	}
+	defer func() {
+		phases.finish(err)
+		sub = cfg.reportedSubstatuses(append(phases.substatuses(true), sub...))
+	}()
+	startPhase(phaseConfigure, "configuring")
+
+	commandPhase = phase
+	managedIdentityTokens.reset() // acquired again after a failed attempt
+
+	// never run the command again once it completed with runOnce, the files
+	// are still validated with validateOnly
+	if cfg.RunOnce && !cfg.ValidateOnly {
+		if s, ok := runOnceCompleted(ctx, cfg.RunOnceResetTag); ok {
+			phases.finish(nil)
+			phases.skip(phaseDownload, "runOnce")
+			phases.skip(phaseTestCommand, "runOnce")
+			phases.skip(phaseCommand, "runOnce")
+			res.Skipped = true
+			ctx.Log("event", "enabled", "message", "runOnce is set, command already completed", "seqNum", s.SeqNum)
+			return fmt.Sprintf("skipped: the command already completed at %s with sequence number %d, it is not executed again (runOnce)",
+				s.Completed.Format(time.RFC3339), s.SeqNum), nil, nil
+		}
+	}
+
+	if err := configureDownloads(ctx, &cfg); err != nil {
+		return "", nil, err
+	}
+	if root := cfg.publicSettings.ChrootDir; root != "" && !cfg.SkipExecution {
+		// before anything is downloaded
+		if err := validateChrootDir(root, cfg.publicSettings.Interpreter); err != nil {
+			return "", nil, categorize(errConfigInvalid, err)
+		}
+	}
+	// limit the entire operation (the manifest, the downloads and the
+	// command) if specified, and stop it if the handler is aborted
+	opCtx := shutdown.ctx
+	if d := cfg.operationTimeout(); d > 0 {
+		var cancel context.CancelFunc
+		opCtx, cancel = context.WithTimeout(opCtx, d)
+		defer cancel()
 	}
 
+	res.setCommand(cfg)
+	if err := addBundleFiles(ctx, opCtx, &cfg); err != nil {
+		err = categorize(errDownloadFailed, errors.Wrap(err, "failed to load 'manifestUri'"))
+		return "", nil, operationTimedOut(opCtx, cfg, err)
+	}
+	if err := addContainerBlobs(ctx, &cfg); err != nil {
+		return "", nil, categorize(errDownloadFailed, errors.Wrap(err, "failed to list blobs from 'blobContainerUri'"))
+	}
+
+	if cfg.ValidateOnly {
+		startPhase(phaseDownload, "validating files")
+		phases.skip(phaseTestCommand, "validateOnly")
+		phases.skip(phaseCommand, "validateOnly")
+		msg, err := validateFiles(ctx, cfg)
+		return msg, nil, err
+	}
+
+	// download the files while periodically reporting their progress
 	dir := filepath.Join(dataDir, downloadDir, fmt.Sprintf("%d", seqNum))
-	if err := downloadFiles(ctx, dir, cfg); err != nil {
-		return errors.Wrap(err, "processing file downloads failed")
+	if n := cfg.KeepDownloadDirs; n > 0 {
+		if err := pruneDownloadDirs(ctx, filepath.Dir(dir), seqNum, n); err != nil {
+			ctx.Log("event", "failed to prune download directories", "error", err)
+		}
+	}
+	if cfg.CleanupAfterRun {
+		// after the output is collected for the status, even if anything fails
+		defer cleanupDir(ctx, dir)
+	}
+	startPhase(phaseDownload, "downloading files")
+	progress := newDownloadProgress(len(cfg.FileURLs))
+	stop := progress.reportEvery(cfg.progressInterval(), func(sub []substatus) {
+		reportProgress(ctx, h, seqNum, "Enable", "downloading files", cfg.reportedSubstatuses(append(phases.substatuses(false), sub...))...)
+	})
+	start := time.Now()
+	err = downloadFiles(ctx, opCtx, dir, cfg, progress)
+	stop()
+	res.setFiles(cfg.FileURLs, progress)
+	if len(cfg.FileURLs) > 0 {
+		sub = append(sub, newTimingSubstatus(downloadTimingName, start, time.Now(), err))
+		sub = append(sub, progress.substatuses()...)
+	}
+	if err != nil {
+		err = categorize(errDownloadFailed, errors.Wrap(err, "processing file downloads failed"))
+		return "", sub, operationTimedOut(opCtx, cfg, err)
+	}
+	if failures := progress.failures(); len(failures) > 0 {
+		// report the skipped files along with the outcome of the command
+		ctx.Log("event", "skipped files which failed to download", "failed", len(failures))
+		defer func() {
+			msg = fmt.Sprintf("skipped %d of %d file(s) which failed to download (continueOnDownloadError): %s\n",
+				len(failures), len(cfg.FileURLs), strings.Join(failures, "; ")) + msg
+		}()
+	}
+	if err := checkoutRepository(ctx, opCtx, dir, cfg); err != nil {
+		err = categorize(errDownloadFailed, errors.Wrap(err, "failed to check out git repository"))
+		return "", sub, operationTimedOut(opCtx, cfg, err)
+	}
+	if err := applyFileMappings(ctx, dir, cfg.FileMappings); err != nil {
+		return "", sub, categorize(errDownloadFailed, errors.Wrap(err, "processing file downloads failed"))
+	}
+	if cfg.SkipExecution {
+		phases.finish(nil)
+		phases.skip(phaseTestCommand, "skipExecution")
+		phases.skip(phaseCommand, "skipExecution")
+		res.Skipped = true
+		ctx.Log("event", "enabled", "message", "skipExecution is set, command intentionally not executed")
+		return fmt.Sprintf("skipped: downloaded %d file(s), the command is not executed (skipExecution)", len(cfg.FileURLs)), sub, nil
 	}
 
-	if err := runCmd(ctx, dir, cfg); err != nil {
-		return err
+	// skip the command if the testCommand reports it is not needed
+	if cfg.TestCommand != "" {
+		startPhase(phaseTestCommand, "running testCommand")
+	} else {
+		phases.skip(phaseTestCommand, "no testCommand")
+	}
+	if skip, err := runTestCmd(ctx, opCtx, dir, cfg); err != nil {
+		return "", sub, operationTimedOut(opCtx, cfg, err)
+	} else if skip {
+		phases.finish(nil)
+		phases.skip(phaseCommand, "testCommand succeeded")
+		res.Skipped = true
+		ctx.Log("event", "enabled", "message", "testCommand succeeded, command skipped")
+		return "skipped: testCommand succeeded, the command is not executed", sub, nil
 	}
 
+	// execute the command while periodically reporting it is still running,
+	// save its error
+	startPhase(phaseCommand, "executing command")
+	start = time.Now()
+	stop = every(cfg.heartbeatInterval(), func() {
+		reportProgress(ctx, h, seqNum, "Enable", heartbeatMsg(ctx, dir, cfg, time.Since(start)), cfg.reportedSubstatuses(append(phases.substatuses(false), progress.substatuses()...))...)
+	})
+	if err := os.Remove(filepath.Join(dir, rebootRequiredFile)); err != nil && !os.IsNotExist(err) {
+		ctx.Log("event", "failed to remove reboot request of the previous phase", "error", err)
+	}
+	runErr := runCmd(ctx, opCtx, dir, cfg)
+	stop()
+	sub = append(sub, newTimingSubstatus(commandTimingName, start, time.Now(), runErr))
+	if runErr == nil && cfg.RunInBackground {
+		ctx.Log("event", "enabled", "message", "command started in background, not waiting for it to exit")
+		return fmt.Sprintf("started: the command is running in the background (runInBackground), its output is saved to %s", dir), sub, nil
+	}
+	res.setExitCode(runErr)
+	var rebootMsg string
+	if rebootRequested(dir, cfg, runErr) {
+		m, err := handleRebootRequest(ctx, seqNum, commandPhase, cfg)
+		if err != nil {
+			runErr = categorize(errCommandFailed, err)
+		} else {
+			rebootMsg, runErr = m, nil // such as rebootExitCode
+			res.RebootRequired = true
+		}
+	}
+	if cfg.OutputBlobURI != "" {
+		// after the onFailureCommand, before cleanupAfterRun removes the output
+		defer uploadOutput(ctx, dir, cfg)
+	}
+
+	// collect the output tails to be reported in the status, unless only
+	// the outcome is
+	minimal := cfg.statusVerbosity() == statusVerbosityMinimal
+	if !minimal {
+		msg = outputMsg(ctx, dir, cfg.maxStatusOutputBytes())
+		if name, cmds := cfg.numberedCommands(); len(cmds) > 0 {
+			msg = commandsOutputMsg(ctx, dir, name, len(cmds), cfg.maxStatusOutputBytes())
+		}
+	}
+	if runErr != nil {
+		if shutdown.signal() == nil { // not while the handler is stopping
+			runOnFailureCmd(ctx, dir, cfg)
+		}
+		if !minimal {
+			msg += onFailureOutputMsg(ctx, dir, cfg.maxStatusOutputBytes())
+		}
+		return msg, sub, operationTimedOut(opCtx, cfg, runErr)
+	}
+	if cfg.RunOnce && !res.RebootRequired {
+		if err := saveRunOnceState(seqNum, cfg.RunOnceResetTag); err != nil {
+			// the command may be executed again, it must not fail as it ran
+			ctx.Log("event", "failed to record runOnce completion", "error", err)
+		}
+	}
 	ctx.Log("event", "enabled")
-	return nil
+	return rebootMsg + msg, sub, nil
+}
+
+// operationTimedOut returns err as caused by the abort of the handler if it
+// is aborted by a signal, or by the operation timeout in cfg if opCtx has
+// exceeded its deadline, otherwise it returns err as is.
+func operationTimedOut(opCtx context.Context, cfg handlerSettings, err error) error {
+	if shutdown.signal() != nil {
+		return shutdown.aborted(err)
+	}
+	if err == nil || opCtx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	// the timeout takes precedence over the category of the failure it caused
+	return categorizedError{errOperationTimeout,
+		errors.Wrapf(err, "enable operation timed out after %v", cfg.operationTimeout())}
+}
+
+// heartbeatMsg returns the message reported while the command executed in dir
+// has been running for the given duration, with the latest tails of its
+// output.
+func heartbeatMsg(ctx log.Logger, dir string, cfg handlerSettings, running time.Duration) string {
+	msg := fmt.Sprintf("executing command, running for %v", running/time.Second*time.Second)
+	if cfg.statusVerbosity() == statusVerbosityMinimal {
+		return msg
+	}
+	if name, cmds := cfg.numberedCommands(); len(cmds) > 0 {
+		return msg + commandsOutputMsg(ctx, dir, name, len(cmds), cfg.maxStatusOutputBytes())
+	}
+	return msg + outputMsg(ctx, dir, cfg.maxStatusOutputBytes())
+}
+
+// outputMsg returns a message containing the tails of stdout and stderr files
+// of the command executed in dir. If the files cannot be read, the error is
+// logged and a placeholder is used.
+func outputMsg(ctx log.Logger, dir string, maxBytes int64) string {
+	stdoutF, stderrF := logPaths(dir)
+	stdoutTail, err := tailFile(stdoutF, maxBytes)
+	if err != nil {
+		ctx.Log("message", "error tailing stdout logs", "error", err)
+	}
+	stderrTail, err := tailFile(stderrF, maxBytes)
+	if err != nil {
+		ctx.Log("message", "error tailing stderr logs", "error", err)
+	}
+	return fmt.Sprintf("\n[stdout]\n%s\n[stderr]\n%s", sanitizeOutput(stdoutTail), sanitizeOutput(stderrTail))
+}
+
+// commandsOutputMsg returns a message containing the tails of the numbered
+// stdout and stderr files of the n commands in 'commands' executed in dir.
+// Commands that did not run are omitted.
+func commandsOutputMsg(ctx log.Logger, dir, name string, n int, maxBytes int64) string {
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		stdoutF, stderrF := commandLogPaths(dir, i)
+		if _, err := os.Stat(stdoutF); os.IsNotExist(err) {
+			continue
+		}
+		stdoutTail, err := tailFile(stdoutF, maxBytes)
+		if err != nil {
+			ctx.Log("message", "error tailing stdout logs", "error", err, "index", i)
+		}
+		stderrTail, err := tailFile(stderrF, maxBytes)
+		if err != nil {
+			ctx.Log("message", "error tailing stderr logs", "error", err, "index", i)
+		}
+		fmt.Fprintf(&b, "\n[%s[%d] stdout]\n%s\n[%s[%d] stderr]\n%s",
+			name, i, sanitizeOutput(stdoutTail), name, i, sanitizeOutput(stderrTail))
+	}
+	return b.String()
+}
+
+// cleanupDir removes the contents of dir, such as the downloaded files and the
+// command output, keeping dir itself. Failures are logged, as the outcome of
+// the command is already determined.
+func cleanupDir(ctx log.Logger, dir string) {
+	ctx.Log("event", "cleaning up download dir", "path", dir)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ctx.Log("event", "failed to clean up download dir", "error", err)
+		}
+		return
+	}
+	for _, fi := range fis {
+		if err := os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+			ctx.Log("event", "failed to clean up download dir", "error", err)
+			return
+		}
+	}
+	ctx.Log("event", "cleaned up download dir")
 }
 
 // checkAndSaveSeqNum checks if the given seqNum is already processed
-// according to the specified seqNumFile and if so, returns true,
-// otherwise saves the given seqNum into seqNumFile returns false.
-func checkAndSaveSeqNum(ctx log.Logger, seq int, seqNumFile string) (shouldExit bool, _ error) {
+// according to the specified seqNumFile and the given forceUpdateTag is the same
+// as the one stored in tagFile and if so, returns true, otherwise saves the
+// given seqNum into seqNumFile and the tag into tagFile and returns false. If
+// alwaysRun is true, it never returns true but still saves the seqNum and the
+// tag. A stored seqNum is never replaced by a smaller one, such as one given
+// with seqNumEnvVar, so that the later configurations are still processed.
+func checkAndSaveSeqNum(ctx log.Logger, seq int, seqNumFile, tag, tagFile string, alwaysRun bool) (shouldExit bool, _ error) {
 	ctx.Log("event", "comparing seqnum", "path", seqNumFile)
 	smaller, err := seqnum.IsSmallerThan(seqNumFile, seq)
 	if err != nil {
 		return false, errors.Wrap(err, "failed to check sequence number")
 	}
+	storedTag, err := ioutil.ReadFile(tagFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.Wrap(err, "failed to read the forceUpdateTag")
+	}
+	tagChanged := string(storedTag) != tag
 	if !smaller {
 		// stored sequence number is equals or greater than the current
 		// sequence number.
-		return true, nil
+		if tagChanged {
+			ctx.Log("event", "forceUpdateTag changed, processing the seqnum again")
+		} else if alwaysRun {
+			ctx.Log("event", "alwaysRun is set, processing the seqnum again")
+		} else {
+			return true, nil
+		}
 	}
-	if err := seqnum.Set(seqNumFile, seq); err != nil {
-		return false, errors.Wrap(err, "failed to save the sequence number")
+	if smaller {
+		if err := seqnum.Set(seqNumFile, seq); err != nil {
+			return false, errors.Wrap(err, "failed to save the sequence number")
+		}
+		ctx.Log("event", "seqnum saved", "path", seqNumFile)
+	}
+	if tagChanged {
+		if err := ioutil.WriteFile(tagFile, []byte(tag), 0600); err != nil {
+			return false, errors.Wrap(err, "failed to save the forceUpdateTag")
+		}
+		ctx.Log("event", "forceUpdateTag saved", "path", tagFile)
 	}
-	ctx.Log("event", "seqnum saved", "path", seqNumFile)
 	return false, nil
 }
 
+// readPreCheckSettings returns the forceUpdateTag and alwaysRun from the public
+// settings in configFolder, which are needed before the settings are parsed in
+// enable. Settings are validated later in enable, therefore errors are only
+// logged here and the default values are returned.
+func readPreCheckSettings(ctx log.Logger, configFolder string) (forceUpdateTag string, alwaysRun bool) {
+	pub, _, err := readSettings(configFolder)
+	if err != nil {
+		ctx.Log("message", "could not read settings for forceUpdateTag", "error", err)
+		return "", false
+	}
+	forceUpdateTag, _ = pub["forceUpdateTag"].(string)
+	alwaysRun, _ = pub["alwaysRun"].(bool)
+	return forceUpdateTag, alwaysRun
+}
+
 // downloadFiles downloads the files specified in cfg into dir (creates if does
-// not exist) and takes storage credentials specified in cfg into account.
-func downloadFiles(ctx *log.Context, dir string, cfg handlerSettings) error {
+// not exist) and takes storage credentials specified in cfg into account. The
+// progress of the downloads is recorded in progress, if not nil. The downloads
+// are canceled when opCtx is done. A file fails to download before it is
+// transferred if the total length reported by the servers would exceed
+// maxTotalDownloadBytes. The first failure aborts the downloads, unless
+// continueOnDownloadError is set in cfg: then the failed files are skipped and
+// it fails only if fewer than minSuccessfulDownloads succeed.
+func downloadFiles(ctx *log.Context, opCtx context.Context, dir string, cfg handlerSettings, progress *downloadProgress) error {
 	// - prepare the output directory for files and the command output
 	// - create the directory if missing
 	ctx.Log("event", "creating output directory", "path", dir)
 	if err := os.MkdirAll(dir, 0700); err != nil {
-		return errors.Wrap(err, "failed to prepare output directory")
+		return errors.Wrap(download.WrapDiskFull(err, dir, -1), "failed to prepare output directory")
 	}
 	ctx.Log("event", "created output directory")
+	for _, d := range cfg.destinationDirs() {
+		if err := prepareDestinationDir(ctx, d); err != nil {
+			return err
+		}
+	}
 
-	// - download files
-	ctx.Log("files", len(cfg.FileURLs))
+	// - download files concurrently, at most cfg.maxConcurrentDownloads() at a time
+	//   skipping the ones already downloaded for this sequence number
+	ctx.Log("files", len(cfg.FileURLs), "concurrency", cfg.maxConcurrentDownloads())
+	manifest := loadManifest(ctx, dir)
+	if cfg.KeepDownloadDirs > 1 {
+		if prev := previousDownloadDir(dir); prev != "" {
+			ctx.Log("event", "reusing unchanged files from previous download directory", "path", prev)
+			manifest.previous = loadManifest(ctx, prev)
+		}
+	}
+	skipped, err := cfg.osSkippedFiles(ctx)
+	if err != nil {
+		return err
+	}
+	var (
+		budget   = download.NewSizeBudget(cfg.maxTotalDownloadBytes())
+		errs     = make([]error, len(cfg.FileURLs))
+		sem      = make(chan struct{}, cfg.maxConcurrentDownloads())
+		abort    = make(chan struct{}) // closed upon first failure
+		abortOne sync.Once
+		wg       sync.WaitGroup
+	)
 	for i, f := range cfg.FileURLs {
-		ctx := ctx.With("file", i)
-		ctx.Log("event", "download start")
-		if err := downloadAndProcessURL(ctx, f, dir, cfg.StorageAccountName, cfg.StorageAccountKey); err != nil {
-			ctx.Log("event", "download failed", "error", err)
+		if skipped != nil && skipped[i] {
+			ctx.Log("file", i, "event", "download skipped", "message", "the distribution matches no 'osMatch' predicate")
+			if progress != nil {
+				progress.skip(i, f, "the distribution matches no 'osMatch' predicate")
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, f string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			ctx := ctx.With("file", i)
+			select {
+			case <-abort:
+				ctx.Log("event", "download skipped", "message", "another download has failed")
+				return
+			default:
+			}
+			ctx.Log("event", "download start")
+			fd := fileDownload{f, cfg.fileMirrors(i), cfg.fileName(i), cfg.fileHash(i), cfg.contentType(i), cfg.signatureURL(i), cfg.fileMode(i), cfg.fileDir(i), cfg.ExtractArchives, cfg.archiveCheck(i), budget}
+			var pf download.ProgressFunc
+			if progress != nil {
+				path, _ := fd.path(dir) // the error fails the download
+				progress.start(i, f, path)
+				pf = progress.progressFunc(i)
+			}
+			err := downloadAndProcessURL(ctx, opCtx, fd, dir, cfg, pf, manifest)
+			if progress != nil {
+				progress.done(i, err)
+			}
+			if err != nil {
+				errs[i] = err
+				if cfg.ContinueOnDownloadError && categoryOf(err) != errSignatureInvalid {
+					ctx.Log("event", "download failed, skipping file", "error", err)
+					return
+				}
+				ctx.Log("event", "download failed", "error", err)
+				abortOne.Do(func() { close(abort) })
+				return
+			}
+			ctx.Log("event", "download complete", "output", dir)
+		}(i, f)
+	}
+	wg.Wait()
+	if err := manifest.save(); err != nil {
+		ctx.Log("event", "failed to save download manifest", "error", err)
+	}
+
+	for i, err := range errs {
+		if categoryOf(err) == errSignatureInvalid {
+			// fails the operation regardless of continueOnDownloadError
+			return errors.Wrapf(err, "failed to verify file[%d]", i)
+		}
+	}
+	if cfg.ContinueOnDownloadError {
+		var failures []string
+		for i, err := range errs {
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("file[%d]: %v", i, err))
+			}
+		}
+		total := len(errs)
+		for _, s := range skipped {
+			if s {
+				total-- // not downloaded on this distribution
+			}
+		}
+		if n := total - len(failures); n < cfg.MinSuccessfulDownloads {
+			return fmt.Errorf("only %d of %d file(s) downloaded, fewer than 'minSuccessfulDownloads' (%d): %s",
+				n, total, cfg.MinSuccessfulDownloads, strings.Join(failures, "; "))
+		}
+		return nil
+	}
+	for i, err := range errs {
+		if err != nil {
 			return errors.Wrapf(err, "failed to download file[%d]", i)
 		}
-		ctx.Log("event", "download complete", "output", dir)
 	}
 	return nil
 }
 
+// configureDownloads configures the proxy, the timeouts, the DNS server and
+// the TLS settings of the downloads as specified in cfg, and resolves the Key
+// Vault references in cfg, which may be the credentials of the downloads.
+// The returned error is categorized.
+func configureDownloads(ctx *log.Context, cfg *handlerSettings) error {
+	if err := configureProxy(ctx, *cfg); err != nil {
+		return categorize(errConfigInvalid, errors.Wrap(err, "failed to configure proxy"))
+	}
+	download.SetTimeouts(cfg.connectTimeout(), cfg.responseHeaderTimeout())
+	if err := download.SetResolver(cfg.DNSServer); err != nil {
+		return categorize(errConfigInvalid, errors.Wrap(err, "failed to configure DNS server"))
+	}
+	if err := configureTLS(ctx, *cfg); err != nil {
+		return categorize(errConfigInvalid, errors.Wrap(err, "failed to configure TLS"))
+	}
+	if err := resolveKeyVaultReferences(ctx, cfg); err != nil {
+		return categorize(errKeyVaultFailed, err)
+	}
+	return nil
+}
+
+// validateFiles checks if the files specified in cfg can be downloaded with
+// the credentials in cfg, without downloading them, and returns a message
+// describing the results. A file is valid if it can be downloaded from its URL
+// or one of its mirrors. The files skipped with 'osMatch' are not validated.
+// The command is not executed.
+func validateFiles(ctx *log.Context, cfg handlerSettings) (string, error) {
+	ctx.Log("event", "validating files", "files", len(cfg.FileURLs))
+	skipped, err := cfg.osSkippedFiles(ctx)
+	if err != nil {
+		return "", categorize(errDownloadFailed, err)
+	}
+	var failures []string
+	n := 0
+	for i, f := range cfg.FileURLs {
+		ctx := ctx.With("file", i)
+		if skipped != nil && skipped[i] {
+			ctx.Log("event", "file validation skipped", "message", "the distribution matches no 'osMatch' predicate")
+			continue
+		}
+		n++
+		err := probeFile(ctx, f, cfg)
+		for j, u := range cfg.fileMirrors(i) {
+			if err == nil {
+				break
+			}
+			ctx.Log("event", "file validation failed, trying mirror", "mirror", j+1, "error", err)
+			err = probeFile(ctx, u, cfg)
+		}
+		if err != nil {
+			ctx.Log("event", "file validation failed", "error", err)
+			failures = append(failures, fmt.Sprintf("file[%d]: %v", i, err))
+			continue
+		}
+		ctx.Log("event", "file validated")
+	}
+	if len(failures) > 0 {
+		return "", categorize(errDownloadFailed, fmt.Errorf("validation of %d file(s) failed: %s",
+			len(failures), strings.Join(failures, "; ")))
+	}
+	ctx.Log("event", "validated")
+	return fmt.Sprintf("validated the configuration and %d file(s), the command is not executed (validateOnly)", n), nil
+}
+
+func probeFile(ctx *log.Context, fileURL string, cfg handlerSettings) error {
+	dl, err := getDownloader(ctx, fileURL, cfg)
+	if err != nil {
+		return err
+	}
+	return download.Probe(dl)
+}
+
 // runCmd runs the command (extracted from cfg) in the given dir (assumed to exist).
-func runCmd(ctx log.Logger, dir string, cfg handlerSettings) error {
-	ctx.Log("event", "executing command", "output", dir)
-	cmd := cfg.publicSettings.CommandToExecute
-	if cmd == "" {
-		cmd = cfg.protectedSettings.CommandToExecute
+// The command is terminated when opCtx is done. The returned error is
+// categorized as errTimeout or errCommandFailed.
+func runCmd(ctx log.Logger, opCtx context.Context, dir string, cfg handlerSettings) error {
+	ctx.Log("event", "executing command", "output", dir, "envVars", len(cfg.environmentVariables()))
+	cmd, err := cfg.substituteMetadata(ctx, cfg.commandToExecute())
+	if err != nil {
+		return categorize(errCommandFailed, err)
+	}
+	if cmd, err = cfg.expandCommand(cmd); err != nil {
+		return categorize(errConfigInvalid, err) // such as the command from Key Vault
+	}
+	if name := cfg.publicSettings.ScriptFile; name != "" {
+		if cmd != "" {
+			ctx.Log("message", "both scriptFile and commandToExecute are specified, executing scriptFile", "scriptFile", name)
+		}
+		scriptDir := dir
+		if d := cfg.fileDir(cfg.scriptFileIndex()); d != "" {
+			scriptDir = d
+		}
+		script, err := prepareScriptFile(scriptDir, name)
+		if err != nil {
+			return categorize(errCommandFailed, err)
+		}
+		cmd = script
+	}
+	if cfg.protectedSettings.Script != "" {
+		path, err := writeScript(dir, cfg)
+		if err != nil {
+			return categorize(errCommandFailed, err)
+		}
+		defer os.Remove(path) // the script may contain secrets
+		cmd = shellQuote(path)
+	}
+	cmds, err := cfg.substituteMetadataAll(ctx, cfg.commands())
+	if err != nil {
+		return categorize(errCommandFailed, err)
+	}
+	parallelCmds, err := cfg.substituteMetadataAll(ctx, cfg.parallelCommands())
+	if err != nil {
+		return categorize(errCommandFailed, err)
+	}
+	opts, cleanup, err := commandExecOptions(ctx, opCtx, dir, cfg)
+	defer cleanup()
+	if err != nil {
+		return categorize(errCommandFailed, err)
 	}
-	if err := ExecCmdInDir(cmd, dir); err != nil {
+attempts:
+	for attempt, retries := 1, cfg.CommandRetryCount; ; attempt++ {
+		if len(cmds) > 0 {
+			err = runCmds(ctx, cmds, dir, opts, cfg.ContinueOnError)
+		} else if len(parallelCmds) > 0 {
+			err = runParallelCmds(ctx, parallelCmds, dir, opts, cfg.maxParallelCommands(), cfg.parallelCommandTimeout())
+		} else {
+			err = ExecCmdInDir(cmd, dir, opts)
+		}
+		if !retryCommand(err, dir, cfg) || attempt > retries {
+			break
+		}
+		interval := cfg.commandRetryInterval()
+		ctx.Log("event", "command failed, retrying", "attempt", attempt, "retries", retries, "error", err, "wait", interval)
+		select {
+		case <-time.After(interval):
+		case <-opCtx.Done():
+			ctx.Log("event", "command is not retried", "attempt", attempt, "error", opCtx.Err())
+			break attempts
+		}
+	}
+	if err == nil && opts.Background {
+		ctx.Log("event", "started command in background", "output", dir)
+		return nil
+	}
+	if err != nil {
+		if exitErr, ok := errors.Cause(err).(ExitError); ok {
+			ctx = log.NewContext(ctx).With("exitCode", exitErr.Code)
+		}
 		ctx.Log("event", "failed to execute command", "error", err, "output", dir)
-		return errors.Wrap(err, "failed to execute command")
+		c := errCommandFailed
+		if _, ok := errors.Cause(err).(TimeoutError); ok {
+			c = errTimeout
+		}
+		return categorize(c, errors.Wrap(err, "failed to execute command"))
 	}
 	ctx.Log("event", "executed command", "output", dir)
 	return nil
 }
+
+// retryCommand returns whether the command of cfg executed in dir and failed
+// with err should be executed again if there are retries left: only the
+// commands exiting with a non-zero code are retried, not the commands that
+// timed out, were terminated or requested a reboot, by exiting with
+// rebootExitCode or creating the rebootRequiredFile (in chrootDir if set).
+func retryCommand(err error, dir string, cfg handlerSettings) bool {
+	if err == nil {
+		return false
+	}
+	switch e := errors.Cause(err).(type) {
+	case TimeoutError, CanceledError:
+		return false
+	case ExitError:
+		if code := cfg.publicSettings.RebootExitCode; code > 0 && e.Code == code {
+			return false
+		}
+	}
+	return !pathExists(filepath.Join(cfg.publicSettings.ChrootDir, dir, rebootRequiredFile))
+}
+
+// commandExecOptions returns the options to execute the commands in cfg with
+// in dir, preparing the working directory, the secrets file and the user to
+// run them as, the copy of dir in chrootDir and their cgroup, or their systemd
+// scope with useSystemdScope if systemd is available. The commands are
+// terminated when opCtx is done. The returned cleanup function, never nil,
+// removes the secrets file, the copy and the cgroup and must be called once
+// the commands have exited, even if an error is returned.
+func commandExecOptions(ctx log.Logger, opCtx context.Context, dir string, cfg handlerSettings) (_ ExecOptions, cleanup func(), _ error) {
+	cleanup = func() {}
+	opts := cfg.execOptions()
+	opts.Context = opCtx
+	opts.PIDFile = filepath.Join(dataDir, pidFile)
+	// let the command find the downloaded files, its phase and how to request
+	// a reboot
+	env := map[string]string{
+		phaseEnvVar:              fmt.Sprintf("%d", commandPhase),
+		rebootRequiredFileEnvVar: filepath.Join(dir, rebootRequiredFile),
+	}
+	root := cfg.publicSettings.ChrootDir
+	if opts.WorkingDir != "" {
+		if err := prepareWorkingDir(ctx, filepath.Join(root, opts.WorkingDir), cfg.CreateWorkingDirectory); err != nil {
+			return opts, cleanup, err
+		}
+		env[downloadDirEnvVar] = dir
+	}
+	if d := cfg.publicSettings.DestinationDir; d != "" {
+		env[destinationDirEnvVar] = d
+	}
+	for i, d := range cfg.publicSettings.DestinationDirs {
+		if d != "" {
+			env[fmt.Sprintf("%s_%d", destinationDirEnvVar, i)] = d
+		}
+	}
+	for k, v := range opts.Env {
+		env[k] = v
+	}
+	if cfg.secretsInFile() {
+		path, err := writeSecretsFile(dir, cfg.secretVariables())
+		if err != nil {
+			return opts, cleanup, err
+		}
+		cleanup = func() {
+			if err := os.Remove(path); err != nil {
+				ctx.Log("event", "failed to remove secrets file", "error", err)
+			}
+		}
+		env[secretsFileEnvVar] = path
+	}
+	opts.Env = env
+	if name := cfg.publicSettings.RunAsUser; name != "" {
+		if err := prepareRunAsUser(ctx, dir, name, &opts); err != nil {
+			return opts, cleanup, errors.Wrap(err, "failed to prepare running command as user")
+		}
+	}
+	if root != "" {
+		// after the secrets file is written and the owner of dir is set
+		ctx.Log("event", "copying files into chroot directory", "path", root)
+		remove, err := copyIntoChroot(root, dir)
+		if err != nil {
+			return opts, cleanup, errors.Wrap(err, "failed to copy the downloaded files into 'chrootDir'")
+		}
+		opts.Chroot = root
+		prev := cleanup
+		cleanup = func() {
+			prev()
+			// the reboot request of the command is read from dir
+			if p := filepath.Join(root, dir, rebootRequiredFile); pathExists(p) {
+				if err := copyFile(p, filepath.Join(dir, rebootRequiredFile)); err != nil {
+					ctx.Log("event", "failed to copy reboot request from chroot directory", "error", err)
+				}
+			}
+			written, err := remove()
+			var discarded []string // not copied back to dir
+			for _, f := range written {
+				if f != rebootRequiredFile {
+					discarded = append(discarded, f)
+				}
+			}
+			if len(discarded) > 0 {
+				ctx.Log("warning", "the files written to the copy of the download directory in 'chrootDir' are discarded",
+					"files", strings.Join(discarded, ", "))
+			}
+			if err != nil {
+				ctx.Log("event", "failed to remove files from chroot directory", "error", err)
+			}
+		}
+	}
+	if cfg.publicSettings.UseSystemdScope {
+		if err := systemdAvailable(); err != nil {
+			ctx.Log("event", "running command without systemd scope", "message", "'useSystemdScope' is set but systemd is not available", "error", err)
+		} else {
+			// with the limits of memoryLimitMb and cpuQuota
+			ctx.Log("event", "running command in systemd scope", "properties", strings.Join(cfg.systemdProperties(), " "))
+			opts.SystemdScope = &SystemdScope{Properties: cfg.systemdProperties()}
+			return opts, cleanup, nil
+		}
+	}
+	if mem, cpu := cfg.memoryLimitBytes(), cfg.publicSettings.CPUQuota; mem > 0 || cpu > 0 {
+		cg, err := newCommandCgroup(mem, cpu)
+		if err != nil {
+			ctx.Log("event", "running command without cgroup limits", "message", "cgroups are not accessible, 'memoryLimitMb' and 'cpuQuota' are not applied", "error", err)
+		} else {
+			ctx.Log("event", "running command in cgroup", "path", cg, "memoryBytes", mem, "cpuPercent", cpu)
+			opts.CgroupDir = cg
+			removeSecrets := cleanup
+			cleanup = func() {
+				removeSecrets()
+				removeCgroup(ctx, cg)
+			}
+		}
+	}
+	return opts, cleanup, nil
+}
+
+// runTestCmd runs the testCommand in cfg, if any, in the given dir, saving its
+// output to its own stdout/stderr files, and returns true if it exited with
+// 0, which means the command should be skipped. An error is returned if it
+// could not be executed or was terminated, categorized as errCommandFailed or
+// errTimeout.
+func runTestCmd(ctx log.Logger, opCtx context.Context, dir string, cfg handlerSettings) (skip bool, _ error) {
+	cmd := cfg.publicSettings.TestCommand
+	if cmd == "" {
+		return false, nil
+	}
+	ctx.Log("event", "executing testCommand", "output", dir)
+	opts, cleanup, err := commandExecOptions(ctx, opCtx, dir, cfg)
+	defer cleanup()
+	if err != nil {
+		return false, categorize(errCommandFailed, err)
+	}
+	outFn, errFn := testLogPaths(dir)
+	err = execCmdToFiles(cmd, dir, outFn, errFn, opts)
+	if exitErr, ok := err.(ExitError); ok {
+		ctx.Log("event", "testCommand failed, executing command", "exitCode", exitErr.Code)
+		return false, nil
+	} else if err != nil {
+		c := errCommandFailed
+		if _, ok := err.(TimeoutError); ok {
+			c = errTimeout
+		}
+		return false, categorize(c, errors.Wrap(err, "failed to execute testCommand"))
+	}
+	ctx.Log("event", "testCommand succeeded")
+	return true, nil
+}
+
+// runOnFailureCmd runs the onFailureCommand in cfg, if any, in the given dir
+// after the command failed, saving its output to its own stdout/stderr files.
+// It is not terminated by the operation timeout, which may have caused the
+// failure, but by its own timeoutSeconds. Its failure is only logged, so that
+// it does not mask the failure of the command.
+func runOnFailureCmd(ctx log.Logger, dir string, cfg handlerSettings) {
+	cmd := cfg.publicSettings.OnFailureCommand
+	if cmd == "" {
+		return
+	}
+	ctx.Log("event", "executing onFailureCommand", "output", dir)
+	opts, cleanup, err := commandExecOptions(ctx, context.Background(), dir, cfg)
+	defer cleanup()
+	if err == nil {
+		outFn, errFn := onFailureLogPaths(dir)
+		err = execCmdToFiles(cmd, dir, outFn, errFn, opts)
+	}
+	if err != nil {
+		ctx.Log("event", "failed to execute onFailureCommand", "error", err)
+		return
+	}
+	ctx.Log("event", "executed onFailureCommand")
+}
+
+// onFailureOutputMsg returns a message containing the tails of the stdout and
+// stderr files of the onFailureCommand executed in dir, or an empty string if
+// it did not run.
+func onFailureOutputMsg(ctx log.Logger, dir string, maxBytes int64) string {
+	stdoutF, stderrF := onFailureLogPaths(dir)
+	if _, err := os.Stat(stdoutF); err != nil {
+		return ""
+	}
+	stdoutTail, err := tailFile(stdoutF, maxBytes)
+	if err != nil {
+		ctx.Log("message", "error tailing onFailureCommand stdout logs", "error", err)
+	}
+	stderrTail, err := tailFile(stderrF, maxBytes)
+	if err != nil {
+		ctx.Log("message", "error tailing onFailureCommand stderr logs", "error", err)
+	}
+	return fmt.Sprintf("\n[onFailureCommand stdout]\n%s\n[onFailureCommand stderr]\n%s", sanitizeOutput(stdoutTail), sanitizeOutput(stderrTail))
+}
+
+// runCmds runs the given commands in order in dir, saving the output of each
+// to its numbered stdout/stderr files. It stops at the first command that
+// fails, unless continueOnError is true, in which case the remaining commands
+// are run and an error listing the failed commands is returned. The timeout
+// in opts applies to all commands together, and a timed out or canceled
+// command is never continued from.
+func runCmds(ctx log.Logger, cmds []string, dir string, opts ExecOptions, continueOnError bool) error {
+	var deadline time.Time
+	if opts.Timeout > 0 {
+		deadline = time.Now().Add(opts.Timeout)
+	}
+	var failed []string
+	for i, cmd := range cmds {
+		o := opts
+		if !deadline.IsZero() {
+			if o.Timeout = deadline.Sub(time.Now()); o.Timeout <= 0 {
+				return errors.Wrapf(TimeoutError{opts.Timeout}, "commands[%d] is not started", i)
+			}
+		}
+		ctx.Log("event", "executing command", "index", i)
+		outFn, errFn := commandLogPaths(dir, i)
+		err := execCmdToFiles(cmd, dir, outFn, errFn, o)
+		if _, ok := err.(TimeoutError); ok {
+			return errors.Wrapf(TimeoutError{opts.Timeout}, "commands[%d] failed", i)
+		} else if _, ok := err.(CanceledError); ok {
+			return errors.Wrapf(err, "commands[%d] failed", i)
+		} else if err != nil && !continueOnError {
+			return errors.Wrapf(err, "commands[%d] failed", i)
+		} else if err != nil {
+			ctx.Log("event", "command failed, continuing", "index", i, "error", err)
+			failed = append(failed, fmt.Sprintf("commands[%d]: %v", i, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d commands failed: %s", len(failed), len(cmds), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// runParallelCmds executes the commands concurrently in dir, at most max at a
+// time, and saves the output of each command to the numbered output files,
+// such as ./stdout.0 and ./stderr.0. Each command is limited to timeout, if
+// not zero, in addition to the timeout in opts which limits all of them. All
+// the commands run even if some of them fail.
+//
+// If any command fails, the returned error describes all the failures and its
+// cause is the error of the first command (in order) which was canceled, else
+// timed out, else failed, such as its ExitError for the exit code.
+// The commands share the cgroup in opts, if any, and its memory limit: the
+// out of memory kills are reported for all of them together, not for the
+// commands which were killed as the kills of their siblings are counted in
+// the same cgroup.
+func runParallelCmds(ctx log.Logger, cmds []string, dir string, opts ExecOptions, max int, timeout time.Duration) error {
+	var deadline time.Time
+	if opts.Timeout > 0 {
+		deadline = time.Now().Add(opts.Timeout)
+	}
+	var (
+		errs     = make([]error, len(cmds))
+		sem      = make(chan struct{}, max)
+		wg       sync.WaitGroup
+		oomKills = cgroupOOMKills(opts.CgroupDir)
+	)
+	for i, cmd := range cmds {
+		sem <- struct{}{} // started in order
+		wg.Add(1)
+		go func(i int, cmd string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			o := opts
+			o.Timeout = timeout
+			if !deadline.IsZero() {
+				left := deadline.Sub(time.Now())
+				if left <= 0 {
+					errs[i] = errors.Wrap(TimeoutError{opts.Timeout}, "not started")
+					return
+				}
+				if o.Timeout == 0 || left < o.Timeout {
+					o.Timeout = left
+				}
+			}
+			if o.PIDFile != "" {
+				o.PIDFile = fmt.Sprintf("%s.%d", opts.PIDFile, i)
+			}
+			ctx.Log("event", "executing command", "index", i)
+			outFn, errFn := commandLogPaths(dir, i)
+			errs[i] = execCmdToFiles(cmd, dir, outFn, errFn, o)
+			if _, ok := errs[i].(TimeoutError); ok && o.Timeout != timeout {
+				errs[i] = TimeoutError{opts.Timeout} // of all the commands
+			} else if e, ok := errs[i].(ExitError); ok && e.OutOfMemory {
+				e.OutOfMemory = false // reported below
+				errs[i] = e
+			}
+			if errs[i] != nil {
+				ctx.Log("event", "command failed", "index", i, "error", errs[i])
+				return
+			}
+			ctx.Log("event", "executed command", "index", i)
+		}(i, cmd)
+	}
+	wg.Wait()
+
+	var (
+		failed []string
+		cause  error
+		rank   int // of cause: 3 canceled, 2 timed out, 1 failed
+	)
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("parallelCommands[%d]: %v", i, err))
+		r := 1
+		switch errors.Cause(err).(type) {
+		case CanceledError:
+			r = 3
+		case TimeoutError:
+			r = 2
+		}
+		if r > rank {
+			cause, rank = err, r
+		}
+	}
+	if cause == nil {
+		return nil
+	}
+	msg := fmt.Sprintf("%d of %d parallelCommands failed: %s", len(failed), len(cmds), strings.Join(failed, "; "))
+	if opts.CgroupDir != "" && cgroupOOMKills(opts.CgroupDir) > oomKills {
+		msg += "; out of memory, the parallelCommands exceeded the memory limit of their cgroup together"
+	}
+	return parallelCmdsError{msg, cause}
+}
+
+// parallelCmdsError describes the failures of the parallelCommands, caused by
+// the most significant of them.
+type parallelCmdsError struct {
+	msg   string
+	cause error
+}
+
+func (e parallelCmdsError) Error() string { return e.msg }
+
+// Cause returns the error of the command the failure is attributed to, so that
+// errors.Cause finds its exit code or timeout.
+func (e parallelCmdsError) Cause() error { return e.cause }
+
+// prepareScriptFile makes the downloaded file with the given name in dir
+// executable by its owner and returns the command executing it.
+func prepareScriptFile(dir, name string) (string, error) {
+	p, err := filepath.Abs(filepath.Join(dir, name))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve path of scriptFile %q", name)
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("scriptFile %q was not downloaded", name)
+	} else if err != nil {
+		return "", errors.Wrapf(err, "scriptFile %q is not accessible", name)
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("scriptFile %q is not a regular file", name)
+	}
+	if err := os.Chmod(p, fi.Mode().Perm()|0100); err != nil {
+		return "", errors.Wrapf(err, "failed to make scriptFile %q executable", name)
+	}
+	return shellQuote(p), nil
+}
+
+// writeScript decodes the script in the protected settings of cfg and writes
+// it to a new executable file in dir, returning the path of the file.
+func writeScript(dir string, cfg handlerSettings) (string, error) {
+	b, err := cfg.script()
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, scriptFilePrefix)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create script file")
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0500)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "failed to write script file")
+	}
+	p, err := filepath.Abs(f.Name())
+	return p, errors.Wrap(err, "failed to resolve path of script file")
+}
+
+// writeSecretsFile writes the variables in env to a new file in dir, only
+// readable by its owner, as "NAME='value'" lines to be read by the shell, and
+// returns its absolute path.
+func writeSecretsFile(dir string, env map[string]string) (string, error) {
+	names := make([]string, 0, len(env))
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, k := range names {
+		fmt.Fprintf(&b, "%s=%s\n", k, shellQuote(env[k]))
+	}
+	f, err := ioutil.TempFile(dir, secretsFilePrefix) // created with mode 0600
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create secrets file")
+	}
+	_, err = f.Write(b.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "failed to write secrets file")
+	}
+	p, err := filepath.Abs(f.Name())
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return p, errors.Wrap(err, "failed to resolve path of secrets file")
+}
+
+// shellQuote quotes s as a single word for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// prepareWorkingDir checks if dir exists and is a directory, or creates it if
+// it does not exist and create is true.
+func prepareWorkingDir(ctx log.Logger, dir string, create bool) error {
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) && create {
+		ctx.Log("event", "creating working directory", "path", dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrapf(err, "failed to create working directory %q", dir)
+		}
+		return nil
+	}
+	if os.IsNotExist(err) {
+		return fmt.Errorf("working directory %q does not exist", dir)
+	} else if err != nil {
+		return errors.Wrapf(err, "working directory %q is not accessible", dir)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("working directory %q is not a directory", dir)
+	}
+	return nil
+}
+
+// prepareDestinationDir creates the given directory the files are saved to, if
+// it does not exist, and checks if it is writable.
+func prepareDestinationDir(ctx log.Logger, dir string) error {
+	ctx.Log("event", "preparing destination directory", "path", dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(download.WrapDiskFull(err, dir, -1), "failed to create destination directory %q", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".write-test")
+	if err != nil {
+		return errors.Wrapf(download.WrapDiskFull(err, dir, -1), "destination directory %q is not writable", dir)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// prepareRunAsUser resolves the user with the given name, sets it in opts along
+// with its login environment (unless overridden in settings) and gives the user
+// the ownership of dir so that it can access the downloaded files.
+func prepareRunAsUser(ctx log.Logger, dir, name string, opts *ExecOptions) error {
+	u, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+	ctx.Log("event", "changing owner of output directory", "user", u.name, "path", dir)
+	if err := chownR(dir, int(u.credential.Uid), int(u.credential.Gid)); err != nil {
+		return err
+	}
+	env := u.env()
+	for k, v := range opts.Env {
+		env[k] = v
+	}
+	opts.Env = env
+	opts.Credential = u.credential
+	return nil
+}
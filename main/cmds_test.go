@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
+	"github.com/Azure/custom-script-extension-linux/pkg/download/downloadtest"
 	"github.com/ahmetalpbalkan/go-httpbin"
 	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -38,7 +48,7 @@ func Test_commands_shouldReportStatus(t *testing.T) {
 
 func Test_checkAndSaveSeqNum_fails(t *testing.T) {
 	// pass in invalid seqnum format
-	_, err := checkAndSaveSeqNum(log.NewNopLogger(), 0, "/non/existing/dir")
+	_, err := checkAndSaveSeqNum(log.NewNopLogger(), 0, "/non/existing/dir", "", "/non/existing/tag", false)
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), `failed to save the sequence number`)
 }
@@ -47,62 +57,911 @@ func Test_checkAndSaveSeqNum(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
 	fp := filepath.Join(dir, "seqnum")
+	tp := filepath.Join(dir, "tag")
 	defer os.RemoveAll(dir)
 
 	nop := log.NewNopLogger()
 
 	// no sequence number, 0 comes in.
-	shouldExit, err := checkAndSaveSeqNum(nop, 0, fp)
+	shouldExit, err := checkAndSaveSeqNum(nop, 0, fp, "", tp, false)
 	require.Nil(t, err)
 	require.False(t, shouldExit)
 
 	// file=0, seq=0 comes in. (should exit)
-	shouldExit, err = checkAndSaveSeqNum(nop, 0, fp)
+	shouldExit, err = checkAndSaveSeqNum(nop, 0, fp, "", tp, false)
 	require.Nil(t, err)
 	require.True(t, shouldExit)
 
 	// file=0, seq=1 comes in.
-	shouldExit, err = checkAndSaveSeqNum(nop, 1, fp)
+	shouldExit, err = checkAndSaveSeqNum(nop, 1, fp, "", tp, false)
 	require.Nil(t, err)
 	require.False(t, shouldExit)
 
 	// file=1, seq=1 comes in. (should exit)
-	shouldExit, err = checkAndSaveSeqNum(nop, 1, fp)
+	shouldExit, err = checkAndSaveSeqNum(nop, 1, fp, "", tp, false)
 	require.Nil(t, err)
 	require.True(t, shouldExit)
 
 	// file=1, seq=0 comes in. (should exit)
-	shouldExit, err = checkAndSaveSeqNum(nop, 1, fp)
+	shouldExit, err = checkAndSaveSeqNum(nop, 1, fp, "", tp, false)
 	require.Nil(t, err)
 	require.True(t, shouldExit)
 }
 
+func Test_checkAndSaveSeqNum_forceUpdateTag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	fp := filepath.Join(dir, "seqnum")
+	tp := filepath.Join(dir, "tag")
+	defer os.RemoveAll(dir)
+
+	nop := log.NewNopLogger()
+
+	// no sequence number, 0 comes in with tag.
+	shouldExit, err := checkAndSaveSeqNum(nop, 0, fp, "a", tp, false)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+
+	// file=0, seq=0 comes in with the same tag. (should exit)
+	shouldExit, err = checkAndSaveSeqNum(nop, 0, fp, "a", tp, false)
+	require.Nil(t, err)
+	require.True(t, shouldExit)
+
+	// file=0, seq=0 comes in with a new tag.
+	shouldExit, err = checkAndSaveSeqNum(nop, 0, fp, "b", tp, false)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+
+	// file=0, seq=0 comes in with the new tag again. (should exit)
+	shouldExit, err = checkAndSaveSeqNum(nop, 0, fp, "b", tp, false)
+	require.Nil(t, err)
+	require.True(t, shouldExit)
+
+	// file=0, seq=0 comes in with the tag removed.
+	shouldExit, err = checkAndSaveSeqNum(nop, 0, fp, "", tp, false)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+}
+
+func Test_checkAndSaveSeqNum_alwaysRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	fp := filepath.Join(dir, "seqnum")
+	tp := filepath.Join(dir, "tag")
+	defer os.RemoveAll(dir)
+
+	nop := log.NewNopLogger()
+
+	// no sequence number, 1 comes in.
+	shouldExit, err := checkAndSaveSeqNum(nop, 1, fp, "", tp, true)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+
+	// file=1, seq=1 comes in again. (should not exit)
+	shouldExit, err = checkAndSaveSeqNum(nop, 1, fp, "", tp, true)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+
+	// file=1, seq=2 comes in, still recorded.
+	shouldExit, err = checkAndSaveSeqNum(nop, 2, fp, "", tp, true)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+	b, err := ioutil.ReadFile(fp)
+	require.Nil(t, err)
+	require.Equal(t, "2", string(b))
+
+	// file=2, seq=2 comes in without alwaysRun. (should exit)
+	shouldExit, err = checkAndSaveSeqNum(nop, 2, fp, "", tp, false)
+	require.Nil(t, err)
+	require.True(t, shouldExit)
+
+	// file=2, seq=1 comes in, processed but not recorded.
+	shouldExit, err = checkAndSaveSeqNum(nop, 1, fp, "", tp, true)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+	b, err = ioutil.ReadFile(fp)
+	require.Nil(t, err)
+	require.Equal(t, "2", string(b), "never lowered")
+}
+
+func Test_checkAndSaveSeqNum_neverLowered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	fp := filepath.Join(dir, "seqnum")
+	tp := filepath.Join(dir, "tag")
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(fp, []byte("5"), 0600))
+
+	// file=5, seq=3 comes in with a new tag.
+	shouldExit, err := checkAndSaveSeqNum(log.NewNopLogger(), 3, fp, "a", tp, false)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+	b, err := ioutil.ReadFile(fp)
+	require.Nil(t, err)
+	require.Equal(t, "5", string(b))
+	b, err = ioutil.ReadFile(tp)
+	require.Nil(t, err)
+	require.Equal(t, "a", string(b), "tag still saved")
+}
+
+func Test_readPreCheckSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	nop := log.NewNopLogger()
+	tag, alwaysRun := readPreCheckSettings(nop, dir)
+	require.Equal(t, "", tag, "no settings")
+	require.False(t, alwaysRun, "no settings")
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "0.settings"), []byte(`{"runtimeSettings":[{"handlerSettings":{"publicSettings":{"forceUpdateTag":"v2"}}}]}`), 0600))
+	tag, alwaysRun = readPreCheckSettings(nop, dir)
+	require.Equal(t, "v2", tag)
+	require.False(t, alwaysRun)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "0.settings"), []byte(`{"runtimeSettings":[{"handlerSettings":{"publicSettings":{"alwaysRun":true}}}]}`), 0600))
+	tag, alwaysRun = readPreCheckSettings(nop, dir)
+	require.Equal(t, "", tag)
+	require.True(t, alwaysRun)
+}
+
 func Test_runCmd_success(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	require.Nil(t, runCmd(log.NewNopLogger(), dir, handlerSettings{
-		publicSettings: publicSettings{CommandToExecute: "date"},
-	}), "command should run successfully")
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "date"},
+	}), "command should run successfully")
+
+	// check stdout stderr files
+	_, err = os.Stat(filepath.Join(dir, "stdout"))
+	require.Nil(t, err, "stdout should exist")
+	_, err = os.Stat(filepath.Join(dir, "stderr"))
+	require.Nil(t, err, "stderr should exist")
+}
+
+func Test_runCmd_pidFileWriteFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = filepath.Join(dir, "non-existing")
+
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "sleep 10"},
+	})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to write pidfile", "cannot be tracked")
+}
+
+func Test_runCmd_retries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// fails on the first two attempts
+	cfg := handlerSettings{publicSettings: publicSettings{
+		CommandToExecute:            `echo attempt >> attempts; n=$(wc -l < attempts); echo "out $n"; [ $n -ge 3 ]`,
+		CommandRetryCount:           2,
+		CommandRetryIntervalSeconds: 1,
+	}}
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, cfg))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "out 3\n", string(b), "output of the final attempt")
+
+	require.Nil(t, os.Remove(filepath.Join(dir, "attempts")))
+	cfg.publicSettings.CommandRetryCount = 1
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, cfg)
+	require.NotNil(t, err)
+	require.Equal(t, ExitError{Code: 1}, errors.Cause(err))
+	b, err = ioutil.ReadFile(filepath.Join(dir, "attempts"))
+	require.Nil(t, err)
+	require.Equal(t, "attempt\nattempt\n", string(b))
+}
+
+func Test_retryCommand(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	var cfg handlerSettings
+	require.False(t, retryCommand(nil, dir, cfg))
+	require.True(t, retryCommand(errors.Wrap(ExitError{Code: 1}, "failed"), dir, cfg))
+	require.True(t, retryCommand(errors.New("2 of 3 commands failed"), dir, cfg))
+	require.False(t, retryCommand(errors.Wrap(TimeoutError{time.Second}, "commands[0] failed"), dir, cfg))
+	require.False(t, retryCommand(CanceledError{context.Canceled}, dir, cfg))
+
+	cfg.publicSettings.RebootExitCode = 3
+	require.False(t, retryCommand(errors.Wrap(ExitError{Code: 3}, "failed"), dir, cfg), "reboot requested")
+	require.True(t, retryCommand(errors.Wrap(ExitError{Code: 1}, "failed"), dir, cfg))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, rebootRequiredFile), nil, 0600))
+	require.False(t, retryCommand(errors.Wrap(ExitError{Code: 1}, "failed"), dir, cfg), "reboot required file")
+}
+
+func Test_runCmd_rebootNotRetried(t *testing.T) {
+	for _, cmd := range []string{"echo attempt >> attempts; exit 3", `echo attempt >> attempts; : > "$CUSTOM_SCRIPT_REBOOT_REQUIRED_FILE"; exit 1`} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		err := runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{publicSettings: publicSettings{
+			CommandToExecute: cmd, RebootExitCode: 3, CommandRetryCount: 2}})
+		require.NotNil(t, err, cmd)
+		require.Equal(t, "attempt\n", readFileString(t, filepath.Join(dir, "attempts")), cmd)
+	}
+}
+
+func Test_runCmd_scriptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "it's a script.sh")
+	require.Nil(t, ioutil.WriteFile(script, []byte("#!/bin/sh\necho from script\n"), 0400))
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{ScriptFile: "it's a script.sh", CommandToExecute: "echo inline"},
+	}))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "from script\n", string(b), "scriptFile takes precedence")
+	fi, err := os.Stat(script)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0500), fi.Mode().Perm(), "made executable")
+
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{ScriptFile: "missing.sh"},
+	})
+	require.EqualError(t, err, `scriptFile "missing.sh" was not downloaded`)
+	require.Equal(t, errCommandFailed, categoryOf(err))
+}
+
+func Test_runCmd_scriptFileInDestinationDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "dest")
+	require.Nil(t, os.Mkdir(dest, 0755))
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dest, "run.sh"), []byte("echo \"$CUSTOM_SCRIPT_DESTINATION_DIR\"\n"), 0400))
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{FileURLs: []string{"http://a/run.sh"}, ScriptFile: "run.sh", DestinationDir: dest},
+	}))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, dest+"\n", string(b))
+}
+
+func Test_runCmd_destinationDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{FileURLs: []string{"http://a/1", "http://a/2", "http://a/3"},
+			DestinationDir: "/opt/a", DestinationDirs: []string{"", "/opt/b"},
+			CommandToExecute: `echo "$CUSTOM_SCRIPT_DESTINATION_DIR ${CUSTOM_SCRIPT_DESTINATION_DIR_0-unset} $CUSTOM_SCRIPT_DESTINATION_DIR_1"`},
+	}))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "/opt/a unset /opt/b\n", string(b))
+}
+
+func Test_runCmd_expandVariablesProtected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings:    publicSettings{CommandToExecute: `echo ${TOKEN}; tr '\0' ' ' < /proc/$$/cmdline`, ExpandVariables: true},
+		protectedSettings: protectedSettings{EnvironmentVariables: map[string]string{"TOKEN": "s3cret"}},
+	}))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	lines := strings.SplitN(string(b), "\n", 2)
+	require.Equal(t, "s3cret", lines[0], "expanded by the shell")
+	require.NotContains(t, lines[1], "s3cret", "not in the command line")
+}
+
+func Test_runCmd_script(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	script := base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\nfor i in 1 2; do\n  echo \"line $i\"\ndone\n"))
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		protectedSettings: protectedSettings{Script: script},
+	}))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "line 1\nline 2\n", string(b))
+
+	fis, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	for _, fi := range fis {
+		require.False(t, strings.HasPrefix(fi.Name(), "script"), "script file should be removed")
+	}
+}
+
+func Test_runCmd_secretsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := handlerSettings{
+		publicSettings: publicSettings{SecretsDeliveryMode: "file",
+			CommandToExecute: `echo "env:${TOKEN}"; cat "$` + secretsFileEnvVar + `"; . "$` + secretsFileEnvVar + `"; echo "sourced:$TOKEN"; exit 2`},
+		protectedSettings: protectedSettings{EnvironmentVariables: map[string]string{"TOKEN": "it's secret", "A": "1"}},
+	}
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, cfg)
+	require.Equal(t, errCommandFailed, categoryOf(err))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "env:\nA='1'\nTOKEN='it'\\''s secret'\nsourced:it's secret\n", string(b))
+
+	cfg.publicSettings.CommandToExecute = `stat -c %a "$` + secretsFileEnvVar + `"; sleep 5`
+	cfg.publicSettings.TimeoutSeconds = 1
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, cfg)
+	require.Equal(t, errTimeout, categoryOf(err))
+	b, err = ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "600\n", string(b))
+
+	fis, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	for _, fi := range fis {
+		require.False(t, strings.HasPrefix(fi.Name(), ".secrets"), "secrets file should be removed")
+	}
+}
+
+func Test_runCmd_fail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "non-existing-cmd"},
+	})
+	require.NotNil(t, err, "command terminated with exit status")
+	require.Contains(t, err.Error(), "failed to execute command")
+}
+
+func Test_runCmd_failureReportsExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "exit 2"},
+	})
+	require.EqualError(t, err, "failed to execute command: command terminated with exit status=2")
+	require.Equal(t, errCommandFailed, categoryOf(err))
+	require.Equal(t, ExitError{Code: 2}, errors.Cause(err))
+}
+
+func Test_runCmd_timeoutCategory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "sleep 5", TimeoutSeconds: 1},
+	})
+	require.NotNil(t, err)
+	require.Equal(t, errTimeout, categoryOf(err))
+	require.Equal(t, TimeoutError{time.Second}, errors.Cause(err))
+}
+
+func Test_runCmd_operationCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	opCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cfg := handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "sleep 10", OperationTimeoutSeconds: 1},
+	}
+	err = operationTimedOut(opCtx, cfg, runCmd(log.NewNopLogger(), opCtx, dir, cfg))
+	require.EqualError(t, err, "enable operation timed out after 1s: failed to execute command: command terminated: context deadline exceeded")
+	require.Equal(t, errOperationTimeout, categoryOf(err))
+	require.Equal(t, CanceledError{context.DeadlineExceeded}, errors.Cause(err))
+}
+
+func Test_operationTimedOut(t *testing.T) {
+	require.Nil(t, operationTimedOut(context.Background(), handlerSettings{}, nil))
+
+	err := categorize(errCommandFailed, errors.New("boom"))
+	require.Equal(t, err, operationTimedOut(context.Background(), handlerSettings{}, err), "deadline not exceeded")
+
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, err, operationTimedOut(c, handlerSettings{}, err), "canceled is not a timeout")
+}
+
+func Test_runCmd_commands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{Commands: []string{"echo first", "echo second >&2"}},
+	}))
+	for i, expected := range []string{"first\n", "second\n"} {
+		outFn, errFn := commandLogPaths(dir, i)
+		b, _ := ioutil.ReadFile(outFn)
+		e, _ := ioutil.ReadFile(errFn)
+		require.Equal(t, expected, string(b)+string(e), "output of commands[%d]", i)
+	}
+	_, err = os.Stat(filepath.Join(dir, "stdout"))
+	require.True(t, os.IsNotExist(err), "single command output should not exist")
+
+	require.Equal(t, "\n[commands[0] stdout]\nfirst\n\n[commands[0] stderr]\n"+
+		"\n[commands[1] stdout]\n\n[commands[1] stderr]\nsecond\n",
+		commandsOutputMsg(log.NewNopLogger(), dir, "commands", 2, 1024))
+}
+
+func Test_runCmd_commandsStopOnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{Commands: []string{"true", "exit 3", "touch ran"}},
+	})
+	require.EqualError(t, err, "failed to execute command: commands[1] failed: command terminated with exit status=3")
+	require.Equal(t, errCommandFailed, categoryOf(err))
+	require.Equal(t, ExitError{Code: 3}, errors.Cause(err))
+	_, err = os.Stat(filepath.Join(dir, "ran"))
+	require.True(t, os.IsNotExist(err), "commands after the failed one should not run")
+
+	msg := commandsOutputMsg(log.NewNopLogger(), dir, "commands", 3, 1024)
+	require.Contains(t, msg, "[commands[1] stdout]")
+	require.NotContains(t, msg, "[commands[2] stdout]")
+}
+
+func Test_runCmd_commandsContinueOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{
+			Commands:        []string{"exit 1", "true", "exit 2", "touch ran"},
+			ContinueOnError: true},
+	})
+	require.EqualError(t, err, "failed to execute command: 2 of 4 commands failed: "+
+		"commands[0]: command terminated with exit status=1; commands[2]: command terminated with exit status=2")
+	require.Equal(t, errCommandFailed, categoryOf(err))
+	_, err = os.Stat(filepath.Join(dir, "ran"))
+	require.Nil(t, err, "commands after the failed ones should run")
+}
+
+func Test_runCmd_commandsTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// the timeout applies to all commands together
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{
+			Commands:        []string{"sleep 0.6", "sleep 0.6", "touch ran"},
+			ContinueOnError: true,
+			TimeoutSeconds:  1},
+	})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "commands[1] failed")
+	require.Equal(t, errTimeout, categoryOf(err))
+	require.Equal(t, TimeoutError{time.Second}, errors.Cause(err))
+	_, err = os.Stat(filepath.Join(dir, "ran"))
+	require.True(t, os.IsNotExist(err), "commands after a timeout should not run")
+}
+
+func Test_runCmd_parallelCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// each command waits for the other one to start
+	start := time.Now()
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{ParallelCommands: []string{
+			"touch a; while [ ! -f b ]; do sleep 0.1; done; echo first",
+			"touch b; while [ ! -f a ]; do sleep 0.1; done; echo second >&2"},
+			TimeoutSeconds: 5},
+	}))
+	require.True(t, time.Since(start) < 5*time.Second, "commands run concurrently")
+	require.Equal(t, "\n[parallelCommands[0] stdout]\nfirst\n\n[parallelCommands[0] stderr]\n"+
+		"\n[parallelCommands[1] stdout]\n\n[parallelCommands[1] stderr]\nsecond\n",
+		commandsOutputMsg(log.NewNopLogger(), dir, "parallelCommands", 2, 1024))
+}
+
+func Test_runCmd_parallelCommandsFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{
+			ParallelCommands:    []string{"true", "exit 3", "sleep 0.2; exit 2", "sleep 0.2; touch ran"},
+			MaxParallelCommands: 1},
+	})
+	require.EqualError(t, err, "failed to execute command: 2 of 4 parallelCommands failed: "+
+		"parallelCommands[1]: command terminated with exit status=3; parallelCommands[2]: command terminated with exit status=2")
+	require.Equal(t, errCommandFailed, categoryOf(err))
+	require.Equal(t, ExitError{Code: 3}, errors.Cause(err), "exit code of the first failed command")
+	_, err = os.Stat(filepath.Join(dir, "ran"))
+	require.Nil(t, err, "all commands run")
+}
+
+func Test_runCmd_parallelCommandsTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{
+			ParallelCommands:          []string{"exit 1", "sleep 5", "true"},
+			ParallelCmdTimeoutSeconds: 1},
+	})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "2 of 3 parallelCommands failed")
+	require.Contains(t, err.Error(), "parallelCommands[1]: command terminated due to timeout after 1s")
+	require.Equal(t, errTimeout, categoryOf(err), "the timeout takes precedence")
+
+	// the timeout of all the commands applies to the ones waiting to start
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{
+			ParallelCommands:          []string{"sleep 5", "touch ran"},
+			MaxParallelCommands:       1,
+			ParallelCmdTimeoutSeconds: 3,
+			TimeoutSeconds:            1},
+	})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "parallelCommands[0]: command terminated due to timeout after 1s")
+	require.Contains(t, err.Error(), "parallelCommands[1]: not started: command terminated due to timeout after 1s")
+	require.Equal(t, TimeoutError{time.Second}, errors.Cause(err))
+	_, err = os.Stat(filepath.Join(dir, "ran"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func Test_runCmd_workingDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	wd, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(wd)
+
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{
+			CommandToExecute: `pwd; echo "$CUSTOM_SCRIPT_DOWNLOAD_DIR"`,
+			WorkingDirectory: wd},
+	}))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, wd+"\n"+dir+"\n", string(b))
+
+	// created if missing
+	wd = filepath.Join(wd, "a", "b")
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "pwd", WorkingDirectory: wd, CreateWorkingDirectory: true},
+	}))
+	b, err = ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, wd+"\n", string(b))
+}
+
+func Test_prepareWorkingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, prepareWorkingDir(log.NewNopLogger(), dir, false))
+
+	err = prepareWorkingDir(log.NewNopLogger(), filepath.Join(dir, "missing"), false)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "does not exist")
+
+	f := filepath.Join(dir, "file")
+	require.Nil(t, ioutil.WriteFile(f, nil, 0600))
+	err = prepareWorkingDir(log.NewNopLogger(), f, true)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "is not a directory")
+
+	require.Nil(t, prepareWorkingDir(log.NewNopLogger(), filepath.Join(dir, "new"), true))
+	fi, err := os.Stat(filepath.Join(dir, "new"))
+	require.Nil(t, err)
+	require.True(t, fi.IsDir())
+}
+
+func Test_runCmd_runAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Skipping: test requires root")
+	}
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "id -u; echo $USER", RunAsUser: "nobody"},
+	}))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "65534\nnobody\n", string(b))
+}
+
+func Test_runCmd_runAsUser_notFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "date", RunAsUser: "non-existing-user"},
+	})
+	require.EqualError(t, err, `failed to prepare running command as user: user "non-existing-user" does not exist`)
+}
+
+func Test_outputMsg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// no output files
+	require.Equal(t, "\n[stdout]\n\n[stderr]\n", outputMsg(log.NewNopLogger(), dir, 1024))
+
+	require.Nil(t, ExecCmdInDir("echo 0123456789; echo ERROR >&2", dir, ExecOptions{}))
+	require.Equal(t, "\n[stdout]\n789\n\n[stderr]\nROR\n", outputMsg(log.NewNopLogger(), dir, 4))
+}
+
+func Test_disable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = dir
+
+	msg, _, err := disable(log.NewContext(log.NewNopLogger()), vmextension.HandlerEnvironment{}, 1)
+	require.Nil(t, err)
+	require.Equal(t, "", msg, "no running command")
 
-	// check stdout stderr files
-	_, err = os.Stat(filepath.Join(dir, "stdout"))
-	require.Nil(t, err, "stdout should exist")
-	_, err = os.Stat(filepath.Join(dir, "stderr"))
-	require.Nil(t, err, "stderr should exist")
+	cmdDir := filepath.Join(dir, downloadDir, "1")
+	require.Nil(t, os.MkdirAll(cmdDir, 0700))
+	pidPath := filepath.Join(dir, "command.pid")
+	done := make(chan error, 1)
+	go func() {
+		done <- runCmd(log.NewNopLogger(), context.Background(), cmdDir, handlerSettings{
+			publicSettings: publicSettings{CommandToExecute: "sleep 30"}})
+	}()
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(pidPath); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	msg, _, err = disable(log.NewContext(log.NewNopLogger()), vmextension.HandlerEnvironment{}, 1)
+	require.Nil(t, err)
+	require.Contains(t, msg, "terminated the running command (pid ")
+	err = <-done
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "command terminated by signal=SIGTERM")
+	_, err = os.Stat(pidPath)
+	require.True(t, os.IsNotExist(err), "removed after exit")
 }
 
-func Test_runCmd_fail(t *testing.T) {
+func Test_disable_parallelCommands(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = dir
 
-	err = runCmd(log.NewNopLogger(), dir, handlerSettings{
-		publicSettings: publicSettings{CommandToExecute: "non-existing-cmd"},
-	})
-	require.NotNil(t, err, "command terminated with exit status")
-	require.Contains(t, err.Error(), "failed to execute command")
+	done := make(chan error, 1)
+	go func() {
+		done <- runCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+			publicSettings: publicSettings{ParallelCommands: []string{"sleep 30", "sleep 30"}}})
+	}()
+	for i := 0; i < 50; i++ {
+		if paths, _ := filepath.Glob(filepath.Join(dir, "command.pid.*")); len(paths) == 2 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	msg, _, err := disable(log.NewContext(log.NewNopLogger()), vmextension.HandlerEnvironment{}, 1)
+	require.Nil(t, err)
+	require.Contains(t, msg, "terminated the running commands (pids ")
+	err = <-done
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "2 of 2 parallelCommands failed")
+	paths, _ := filepath.Glob(filepath.Join(dir, "command.pid.*"))
+	require.Empty(t, paths, "removed after exit")
+}
+
+func Test_enable_skipExecution(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = filepath.Join(dir, "data")
+	var h vmextension.HandlerEnvironment
+	h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder = filepath.Join(dir, "config"), filepath.Join(dir, "status")
+	for _, d := range []string{dataDir, h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder} {
+		require.Nil(t, os.Mkdir(d, 0700))
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "echo hello")
+	}))
+	defer srv.Close()
+	marker := filepath.Join(dir, "executed")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(h.HandlerEnvironment.ConfigFolder, "1.settings"), []byte(fmt.Sprintf(
+		`{"runtimeSettings": [{"handlerSettings": {"publicSettings": {"commandToExecute": "touch %s", "fileUris": ["%s/a.sh"], "skipExecution": true}}}]}`,
+		marker, srv.URL)), 0600))
+
+	msg, sub, err := enable(log.NewContext(log.NewNopLogger()), h, 1)
+	require.Nil(t, err)
+	require.Equal(t, "skipped: downloaded 1 file(s), the command is not executed (skipExecution)", msg)
+	require.Equal(t, "phase configure", sub[0].Name)
+	require.Equal(t, "phase download", sub[1].Name)
+	require.Equal(t, status.StatusSuccess, sub[1].Status)
+	require.Equal(t, "skipped: skipExecution", sub[3].FormattedMessage.Message)
+	require.Equal(t, downloadTimingName, sub[4].Name)
+	_, err = os.Stat(filepath.Join(dataDir, downloadDir, "1", "a.sh"))
+	require.Nil(t, err, "file is downloaded")
+	_, err = os.Stat(marker)
+	require.True(t, os.IsNotExist(err), "command is not executed")
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, resultFile))
+	require.Nil(t, err)
+	require.Contains(t, string(b), `"skipped": true`)
+}
+
+func Test_enable_chrootDirWithoutInterpreter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = filepath.Join(dir, "data")
+	var h vmextension.HandlerEnvironment
+	h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder = filepath.Join(dir, "config"), filepath.Join(dir, "status")
+	for _, d := range []string{dataDir, h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder, filepath.Join(dir, "target")} {
+		require.Nil(t, os.Mkdir(d, 0700))
+	}
+	srv := downloadtest.NewCountingServer(func(w http.ResponseWriter, r *http.Request) {})
+	defer srv.Close()
+	require.Nil(t, ioutil.WriteFile(filepath.Join(h.HandlerEnvironment.ConfigFolder, "1.settings"), []byte(fmt.Sprintf(
+		`{"runtimeSettings": [{"handlerSettings": {"publicSettings": {"commandToExecute": "date", "fileUris": ["%s/a.sh"], "chrootDir": %q}}}]}`,
+		srv.URL, filepath.Join(dir, "target"))), 0600))
+
+	_, _, err = enable(log.NewContext(log.NewNopLogger()), h, 1)
+	require.NotNil(t, err)
+	require.Equal(t, errConfigInvalid, categoryOf(err))
+	require.Contains(t, err.Error(), `has no usable interpreter "/bin/sh"`)
+	require.Equal(t, 0, srv.Requests(), "nothing downloaded")
+}
+
+func Test_enable_retry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = filepath.Join(dir, "data")
+	var h vmextension.HandlerEnvironment
+	h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder = filepath.Join(dir, "config"), filepath.Join(dir, "status")
+	for _, d := range []string{dataDir, h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder} {
+		require.Nil(t, os.Mkdir(d, 0700))
+	}
+	attempts := filepath.Join(dir, "attempts")
+	settings := func(cmd string, extra string) {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(h.HandlerEnvironment.ConfigFolder, "1.settings"), []byte(fmt.Sprintf(
+			`{"runtimeSettings": [{"handlerSettings": {"publicSettings": {"commandToExecute": %q, "enableRetryCount": 2, "enableRetryIntervalSeconds": 1%s}}}]}`,
+			cmd, extra)), 0600))
+	}
+	countAttempts := func() int {
+		b, err := ioutil.ReadFile(attempts)
+		require.Nil(t, err)
+		return len(b)
+	}
+
+	// fails the first attempt only
+	settings(fmt.Sprintf("printf x >> %s; [ $(wc -c < %s) -gt 1 ]", attempts, attempts), "")
+	msg, _, err := enable(log.NewContext(log.NewNopLogger()), h, 1)
+	require.Nil(t, err)
+	require.Equal(t, 2, countAttempts())
+	require.True(t, strings.HasPrefix(msg, "enable attempt 2 of 3 (enableRetryCount)\n"), msg)
+	require.NotContains(t, msg, "[system]", "no snapshot on success")
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, resultFile))
+	require.Nil(t, err)
+	require.Contains(t, string(b), `"exitCode": 0`, "result of the last attempt")
+
+	// fails every attempt
+	require.Nil(t, os.Remove(attempts))
+	settings(fmt.Sprintf("printf x >> %s; exit 3", attempts), "")
+	msg, _, err = enable(log.NewContext(log.NewNopLogger()), h, 1)
+	require.Equal(t, errCommandFailed, categoryOf(err))
+	require.Equal(t, 3, countAttempts())
+	require.Contains(t, msg, "\n[system]\nfree disk space on "+dataDir+": ", "snapshot of the last attempt")
+
+	// timeouts are not retried
+	require.Nil(t, os.Remove(attempts))
+	settings(fmt.Sprintf("printf x >> %s; sleep 5", attempts), `, "timeoutSeconds": 1`)
+	_, _, err = enable(log.NewContext(log.NewNopLogger()), h, 1)
+	require.Equal(t, errTimeout, categoryOf(err))
+	require.Equal(t, 1, countAttempts())
+}
+
+func Test_runTestCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	skip, err := runTestCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{})
+	require.Nil(t, err)
+	require.False(t, skip, "not specified")
+
+	skip, err = runTestCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{TestCommand: "echo installed; true"}})
+	require.Nil(t, err)
+	require.True(t, skip)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout.test"))
+	require.Nil(t, err)
+	require.Equal(t, "installed\n", string(b))
+
+	skip, err = runTestCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{TestCommand: "exit 1"}})
+	require.Nil(t, err)
+	require.False(t, skip)
+
+	_, err = runTestCmd(log.NewNopLogger(), context.Background(), dir, handlerSettings{
+		publicSettings: publicSettings{TestCommand: "sleep 5", TimeoutSeconds: 1}})
+	require.NotNil(t, err)
+	require.Equal(t, errTimeout, categoryOf(err))
+}
+
+func Test_runOnFailureCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// not specified
+	runOnFailureCmd(log.NewNopLogger(), dir, handlerSettings{})
+	require.Equal(t, "", onFailureOutputMsg(log.NewNopLogger(), dir, 1024))
+
+	cfg := handlerSettings{publicSettings: publicSettings{
+		CommandToExecute: "echo main; exit 3",
+		OnFailureCommand: "echo rolling back; echo oops >&2; exit 1"}}
+	require.NotNil(t, runCmd(log.NewNopLogger(), context.Background(), dir, cfg))
+	runOnFailureCmd(log.NewNopLogger(), dir, cfg)
+	require.Equal(t, "\n[onFailureCommand stdout]\nrolling back\n\n[onFailureCommand stderr]\noops\n",
+		onFailureOutputMsg(log.NewNopLogger(), dir, 1024))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "main\n", string(b), "output of the command is kept")
+}
+
+func Test_heartbeatMsg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, ExecCmdInDir("echo still working", dir, ExecOptions{}))
+	require.Equal(t, "executing command, running for 1m30s\n[stdout]\nstill working\n\n[stderr]\n",
+		heartbeatMsg(log.NewNopLogger(), dir, handlerSettings{}, 90*time.Second+300*time.Millisecond))
+	require.Equal(t, "executing command, running for 1m30s",
+		heartbeatMsg(log.NewNopLogger(), dir, handlerSettings{publicSettings: publicSettings{StatusVerbosity: statusVerbosityMinimal}}, 90*time.Second))
+}
+
+func Test_cleanupDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, ExecCmdInDir("mkdir sub && echo secret > sub/script.sh && chmod 0500 sub/script.sh", dir, ExecOptions{}))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "script.sh"), []byte("secret"), 0500))
+	cleanupDir(log.NewNopLogger(), dir)
+
+	fis, err := ioutil.ReadDir(dir)
+	require.Nil(t, err, "dir should be kept")
+	require.Empty(t, fis)
+
+	// no-op if the directory does not exist, such as if nothing is downloaded
+	cleanupDir(log.NewNopLogger(), filepath.Join(dir, "nonexistent"))
 }
 
 func Test_downloadFiles(t *testing.T) {
@@ -113,7 +972,7 @@ func Test_downloadFiles(t *testing.T) {
 	srv := httptest.NewServer(httpbin.GetMux())
 	defer srv.Close()
 
-	err = downloadFiles(log.NewContext(log.NewNopLogger()),
+	err = downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(),
 		dir,
 		handlerSettings{
 			publicSettings: publicSettings{
@@ -122,7 +981,7 @@ func Test_downloadFiles(t *testing.T) {
 					srv.URL + "/bytes/100",
 					srv.URL + "/bytes/1000",
 				}},
-		})
+		}, nil)
 	require.Nil(t, err)
 
 	// check the files
@@ -133,3 +992,362 @@ func Test_downloadFiles(t *testing.T) {
 		require.Nil(t, err, "%s is missing from download dir", fp)
 	}
 }
+
+func Test_downloadFiles_skipsUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var gets int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method == "GET" {
+			gets++
+		}
+		fmt.Fprint(w, "echo hello")
+	}))
+	defer srv.Close()
+
+	cfg := handlerSettings{publicSettings: publicSettings{FileURLs: []string{srv.URL + "/a.sh"}}}
+	ctx := log.NewContext(log.NewNopLogger())
+	require.Nil(t, downloadFiles(ctx, context.Background(), dir, cfg, nil))
+	require.Nil(t, downloadFiles(ctx, context.Background(), dir, cfg, nil))
+	require.Equal(t, 1, gets, "unchanged file should not be downloaded again")
+
+	cfg.publicSettings.ForceDownload = true
+	require.Nil(t, downloadFiles(ctx, context.Background(), dir, cfg, nil))
+	require.Equal(t, 2, gets, "forceDownload should download again")
+}
+
+func Test_downloadFiles_verifiesKeptFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	srv := downloadtest.NewCountingServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "echo hello")
+	})
+	defer srv.Close()
+
+	cfg := handlerSettings{publicSettings: publicSettings{FileURLs: []string{srv.URL + "/a.sh"}, KeepDownloadDirs: 2,
+		FileHashes: []string{"584a331fd6b02dcb1ecbe2eba731f609a2e1e3dac0bb73ae998dfad14c309a77"}}}
+	ctx := log.NewContext(log.NewNopLogger())
+	require.Nil(t, downloadFiles(ctx, context.Background(), filepath.Join(root, "1"), cfg, nil))
+	for _, d := range []string{"1", "2"} { // kept, then copied from the previous directory
+		// tampered with, keeping the size the manifest records
+		require.Nil(t, ioutil.WriteFile(filepath.Join(root, "1", "a.sh"), []byte("echo he11o"), 0700))
+		srv.Reset()
+		require.Nil(t, downloadFiles(ctx, context.Background(), filepath.Join(root, d), cfg, nil))
+		require.Equal(t, "echo hello", readFileString(t, filepath.Join(root, d, "a.sh")), d)
+		require.Equal(t, 2, srv.Requests(), "%s: checked and downloaded again", d)
+	}
+}
+
+func Test_downloadFiles_reusesPrevious(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	var gets int
+	etag := `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if r.Method == "GET" {
+			gets++
+		}
+		fmt.Fprint(w, "echo hello")
+	}))
+	defer srv.Close()
+
+	cfg := handlerSettings{publicSettings: publicSettings{FileURLs: []string{srv.URL + "/a.sh"}, KeepDownloadDirs: 2}}
+	ctx := log.NewContext(log.NewNopLogger())
+	require.Nil(t, downloadFiles(ctx, context.Background(), filepath.Join(root, "1"), cfg, nil))
+	require.Nil(t, downloadFiles(ctx, context.Background(), filepath.Join(root, "2"), cfg, nil))
+	require.Equal(t, 1, gets, "unchanged file should be copied from the previous directory")
+	b, err := ioutil.ReadFile(filepath.Join(root, "2", "a.sh"))
+	require.Nil(t, err)
+	require.Equal(t, "echo hello", string(b))
+
+	// recorded in the manifest of the new directory
+	require.Nil(t, downloadFiles(ctx, context.Background(), filepath.Join(root, "2"), cfg, nil))
+	require.Equal(t, 1, gets)
+
+	etag = `"v2"`
+	require.Nil(t, downloadFiles(ctx, context.Background(), filepath.Join(root, "3"), cfg, nil))
+	require.Equal(t, 2, gets, "changed file should be downloaded")
+
+	cfg.publicSettings.FileHashes = []string{"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"}
+	require.NotNil(t, downloadFiles(ctx, context.Background(), filepath.Join(root, "4"), cfg, nil), "checksum is verified again")
+	require.Equal(t, 3, gets)
+
+	cfg.publicSettings.FileHashes, cfg.publicSettings.KeepDownloadDirs = nil, 0
+	require.Nil(t, downloadFiles(ctx, context.Background(), filepath.Join(root, "5"), cfg, nil))
+	require.Equal(t, 4, gets, "files are reused only if keepDownloadDirs is 2 or more")
+}
+
+func Test_downloadFiles_progress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
+
+	progress := newDownloadProgress(2)
+	err = downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(),
+		dir,
+		handlerSettings{
+			publicSettings: publicSettings{
+				FileURLs: []string{
+					srv.URL + "/bytes/10",
+					srv.URL + "/bytes/1000",
+				}},
+		}, progress)
+	require.Nil(t, err)
+	sub := progress.substatuses()
+	require.Len(t, sub, 2)
+	for i, n := range []string{"10", "1000"} {
+		require.Equal(t, fmt.Sprintf("download file[%d]", i), sub[i].Name)
+		require.Equal(t, status.StatusSuccess, sub[i].Status)
+		require.Regexp(t, fmt.Sprintf(`^downloaded %s/bytes/%s to %s: %s bytes in [0-9.]+m?s$`, srv.URL, n, filepath.Join(dir, n), n), sub[i].FormattedMessage.Message)
+	}
+}
+
+func Test_downloadFiles_fileNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
+
+	err = downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(),
+		dir,
+		handlerSettings{
+			publicSettings: publicSettings{
+				FileURLs: []string{
+					srv.URL + "/bytes/10?seed=1",
+					srv.URL + "/bytes/10?seed=2",
+				},
+				FileNames: []string{"", "other"}},
+		}, nil)
+	require.Nil(t, err)
+	for _, fn := range []string{"10", "other"} {
+		_, err := os.Stat(filepath.Join(dir, fn))
+		require.Nil(t, err, "%s is missing from download dir", fn)
+	}
+}
+
+func Test_downloadFiles_indexedFileNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
+
+	err = downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(),
+		dir,
+		handlerSettings{
+			publicSettings: publicSettings{
+				FileURLs: []string{
+					srv.URL + "/bytes/10?seed=1",
+					srv.URL + "/bytes/10?seed=2",
+					srv.URL + "/bytes/20",
+				},
+				FileNames:        []string{"", "", "other"},
+				IndexedFileNames: true},
+		}, nil)
+	require.Nil(t, err)
+	fis, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	var names []string
+	for _, fi := range fis {
+		if fi.Name() != manifestFile {
+			names = append(names, fi.Name())
+		}
+	}
+	require.Equal(t, []string{"0_10", "1_10", "other"}, names, "same names in the URLs do not collide")
+}
+
+func Test_validateFiles(t *testing.T) {
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		switch r.URL.Path {
+		case "/a.sh", "/b.sh":
+		case "/forbidden.sh":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	msg, err := validateFiles(log.NewContext(log.NewNopLogger()), handlerSettings{
+		publicSettings: publicSettings{
+			FileURLs: []string{srv.URL + "/a.sh", srv.URL + "/b.sh"}},
+	})
+	require.Nil(t, err)
+	require.Contains(t, msg, "validated the configuration and 2 file(s)")
+	require.Equal(t, []string{"HEAD", "HEAD"}, methods, "files should not be downloaded")
+
+	_, err = validateFiles(log.NewContext(log.NewNopLogger()), handlerSettings{
+		publicSettings: publicSettings{
+			FileURLs: []string{srv.URL + "/missing.sh", srv.URL + "/a.sh", srv.URL + "/forbidden.sh"}},
+	})
+	require.NotNil(t, err)
+	require.Equal(t, errDownloadFailed, categoryOf(err))
+	require.Contains(t, err.Error(), "validation of 2 file(s) failed")
+	require.Contains(t, err.Error(), "file[0]: unexpected status code: got=404")
+	require.Contains(t, err.Error(), "file[2]: unexpected status code: got=403")
+}
+
+func Test_downloadFiles_fileModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
+
+	cfg := handlerSettings{publicSettings: publicSettings{
+		FileURLs:  []string{srv.URL + "/bytes/10", srv.URL + "/bytes/100"},
+		FileMode:  "0750",
+		FileModes: []string{"", "0640"}}}
+	require.Nil(t, downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(), dir, cfg, nil))
+	for fn, mode := range map[string]os.FileMode{"10": 0750, "100": 0640} {
+		fi, err := os.Stat(filepath.Join(dir, fn))
+		require.Nil(t, err)
+		require.Equal(t, mode, fi.Mode().Perm(), fn)
+	}
+
+	// a changed mode is applied to the files downloaded again
+	cfg.publicSettings.FileMode = ""
+	require.Nil(t, downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(), dir, cfg, nil))
+	fi, err := os.Stat(filepath.Join(dir, "10"))
+	require.Nil(t, err)
+	require.Equal(t, defaultFileMode, fi.Mode().Perm())
+}
+
+func Test_downloadFiles_destinationDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
+
+	assets, other := filepath.Join(dir, "opt", "assets"), filepath.Join(dir, "other")
+	cfg := handlerSettings{publicSettings: publicSettings{
+		FileURLs:        []string{srv.URL + "/bytes/10", srv.URL + "/bytes/100", srv.URL + "/bytes/1000"},
+		DestinationDir:  assets,
+		DestinationDirs: []string{"", other}}}
+	downloads := filepath.Join(dir, "download")
+	require.Nil(t, downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(), downloads, cfg, nil))
+	for _, fp := range []string{
+		filepath.Join(assets, "10"),
+		filepath.Join(other, "100"),
+		filepath.Join(assets, "1000")} {
+		_, err := os.Stat(fp)
+		require.Nil(t, err, fp)
+	}
+	fis, err := ioutil.ReadDir(downloads)
+	require.Nil(t, err)
+	require.Len(t, fis, 1, "only the manifest is in the download dir")
+	require.Len(t, loadManifest(log.NewNopLogger(), downloads).Files, 3)
+
+	// not a writable directory
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0600))
+	cfg.publicSettings.DestinationDir = filepath.Join(dir, "file", "assets")
+	err = downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(), downloads, cfg, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to create destination directory")
+}
+
+func Test_downloadFiles_concurrencyLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
+
+	var urls []string
+	for i := 1; i <= 10; i++ {
+		urls = append(urls, fmt.Sprintf("%s/bytes/%d", srv.URL, i))
+	}
+	err = downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(),
+		dir,
+		handlerSettings{
+			publicSettings: publicSettings{
+				FileURLs:               urls,
+				MaxConcurrentDownloads: 3,
+			},
+		}, nil)
+	require.Nil(t, err)
+
+	for i := 1; i <= 10; i++ {
+		fp := filepath.Join(dir, fmt.Sprintf("%d", i))
+		fi, err := os.Stat(fp)
+		require.Nil(t, err, "%s is missing from download dir", fp)
+		require.EqualValues(t, i, fi.Size())
+	}
+}
+
+func Test_downloadFiles_continueOnDownloadError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
+
+	cfg := handlerSettings{
+		publicSettings: publicSettings{
+			FileURLs: []string{
+				srv.URL + "/status/404",
+				srv.URL + "/bytes/10",
+				srv.URL + "/status/403",
+			},
+			ContinueOnDownloadError: true,
+			MinSuccessfulDownloads:  1,
+		}}
+	progress := newDownloadProgress(3)
+	require.Nil(t, downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(), dir, cfg, progress))
+	_, err = os.Stat(filepath.Join(dir, "10"))
+	require.Nil(t, err, "downloaded despite the failures")
+	failures := progress.failures()
+	require.Len(t, failures, 2)
+	require.Contains(t, failures[0], "file[0]: ")
+	require.Contains(t, failures[1], "file[2]: ")
+
+	cfg.MinSuccessfulDownloads = 2
+	err = downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(), dir, cfg, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "only 1 of 3 file(s) downloaded, fewer than 'minSuccessfulDownloads' (2): file[0]: ")
+	require.Contains(t, err.Error(), "; file[2]: ")
+}
+
+func Test_downloadFiles_failureNamesIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
+
+	err = downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(),
+		dir,
+		handlerSettings{
+			publicSettings: publicSettings{
+				FileURLs: []string{
+					srv.URL + "/bytes/10",
+					srv.URL + "/bytes/100",
+					srv.URL + "/", // no file name
+				}},
+		}, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to download file[2]")
+}
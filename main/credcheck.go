@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// credentialCheckOut is where the checkcredentials subcommand prints the
+// results of the checks.
+var credentialCheckOut io.Writer = os.Stdout
+
+// credentialCheck is the result of checking if a URL in the settings can be
+// accessed with the configured credentials, printed by the checkcredentials
+// subcommand.
+type credentialCheck struct {
+	Setting string `json:"setting"`         // such as "fileUris[0]"
+	URL     string `json:"url"`             // with the secrets redacted
+	OK      bool   `json:"ok"`              // if it can be accessed
+	Error   string `json:"error,omitempty"` // why it cannot be accessed
+}
+
+// checkCredentials checks if the credentials in the current settings can
+// access the files to download, without downloading them, and prints the
+// results to credentialCheckOut. The files are requested with HEAD requests
+// authenticated as they are downloaded by enable, and the blobs of
+// blobContainerUri are listed, so that rotated or expired credentials are
+// detected before they are used. It fails if any of them cannot be accessed.
+// It does not change the state of the extension.
+func checkCredentials(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) (string, []substatus, error) {
+	cfg, err := parseAndValidateSettings(ctx, h.HandlerEnvironment.ConfigFolder)
+	if err != nil {
+		return "", nil, categorize(errConfigInvalid, errors.Wrap(err, "failed to get configuration"))
+	}
+	if err := configureDownloads(ctx, &cfg); err != nil {
+		return "", nil, err
+	}
+	checks := checkDownloadCredentials(ctx, context.Background(), cfg)
+	b, err := json.MarshalIndent(checks, "", "  ")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to marshal credential checks")
+	}
+	if _, err := fmt.Fprintln(credentialCheckOut, string(b)); err != nil {
+		return "", nil, errors.Wrap(err, "failed to print credential checks")
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if !c.OK {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return "", nil, categorize(errDownloadFailed, fmt.Errorf("%d of %d URL(s) cannot be accessed with the configured credentials", failed, len(checks)))
+	}
+	ctx.Log("event", "checked credentials", "urls", len(checks))
+	return fmt.Sprintf("the configured credentials can access the %d URL(s)", len(checks)), nil, nil
+}
+
+// checkDownloadCredentials checks the access to the blobContainerUri,
+// manifestUri and fileUris in cfg with its credentials, with the requests
+// canceled when opCtx is done.
+func checkDownloadCredentials(ctx *log.Context, opCtx context.Context, cfg handlerSettings) []credentialCheck {
+	var checks []credentialCheck
+	check := func(setting, u string, f func(ctx *log.Context) error) {
+		ctx := ctx.With("setting", setting)
+		c := credentialCheck{Setting: setting, URL: redactURLSecrets(u), OK: true}
+		if err := f(ctx); err != nil {
+			ctx.Log("event", "credential check failed", "error", err)
+			c.OK, c.Error = false, logRedactor.redact(err.Error())
+		} else {
+			ctx.Log("event", "credential check succeeded")
+		}
+		checks = append(checks, c)
+	}
+
+	if u := cfg.publicSettings.BlobContainerURI; u != "" {
+		check("blobContainerUri", u, func(ctx *log.Context) error {
+			d, err := getContainerLister(ctx, u, cfg)
+			if err != nil {
+				return err
+			}
+			return download.ProbeBlobList(opCtx, d, cfg.publicSettings.BlobPrefix)
+		})
+	}
+	if u := cfg.publicSettings.ManifestURI; u != "" {
+		check("manifestUri", u, func(ctx *log.Context) error { return probeFile(ctx, u, cfg) })
+	}
+	for i, u := range cfg.FileURLs {
+		u := u
+		check(fmt.Sprintf("fileUris[%d]", i), u, func(ctx *log.Context) error { return probeFile(ctx, u, cfg) })
+	}
+	return checks
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(w io.Writer) { credentialCheckOut = w }(credentialCheckOut)
+	var h vmextension.HandlerEnvironment
+	h.HandlerEnvironment.ConfigFolder = dir
+
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if r.URL.Query().Get("sig") != "valid" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "echo hello")
+	}))
+	defer srv.Close()
+	settings := func(fileURIs ...string) {
+		b, err := json.Marshal(fileURIs)
+		require.Nil(t, err)
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "1.settings"), []byte(fmt.Sprintf(
+			`{"runtimeSettings": [{"handlerSettings": {"publicSettings": {"commandToExecute": "date", "fileUris": %s}}}]}`, b)), 0600))
+	}
+	var out bytes.Buffer
+	credentialCheckOut = &out
+
+	settings(srv.URL+"/a.sh?sv=2018&sig=valid", srv.URL+"/b.sh?sv=2018&sig=valid")
+	msg, _, err := checkCredentials(log.NewContext(log.NewNopLogger()), h, 1)
+	require.Nil(t, err)
+	require.Equal(t, "the configured credentials can access the 2 URL(s)", msg)
+	require.Equal(t, []string{"HEAD", "HEAD"}, methods, "not downloaded")
+	var checks []credentialCheck
+	require.Nil(t, json.Unmarshal(out.Bytes(), &checks), out.String())
+	require.Equal(t, []credentialCheck{
+		{Setting: "fileUris[0]", URL: srv.URL + "/a.sh?sv=2018&sig=***", OK: true},
+		{Setting: "fileUris[1]", URL: srv.URL + "/b.sh?sv=2018&sig=***", OK: true}}, checks)
+	require.NotContains(t, out.String(), "valid", "signature is redacted")
+
+	out.Reset()
+	settings(srv.URL+"/a.sh?sv=2018&sig=valid", srv.URL+"/b.sh?sv=2018&sig=rotated")
+	_, _, err = checkCredentials(log.NewContext(log.NewNopLogger()), h, 1)
+	require.EqualError(t, err, "1 of 2 URL(s) cannot be accessed with the configured credentials")
+	require.Equal(t, errDownloadFailed, categoryOf(err))
+	checks = nil
+	require.Nil(t, json.Unmarshal(out.Bytes(), &checks), out.String())
+	require.True(t, checks[0].OK)
+	require.False(t, checks[1].OK)
+	require.Contains(t, checks[1].Error, "got=403")
+
+	require.Nil(t, os.Remove(filepath.Join(dir, "1.settings")))
+	_, _, err = checkCredentials(log.NewContext(log.NewNopLogger()), h, 1)
+	require.Equal(t, errConfigInvalid, categoryOf(err))
+}
+
+func Test_checkDownloadCredentials_blobContainer(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		fmt.Fprint(w, `<EnumerationResults><Blobs /><NextMarker /></EnumerationResults>`)
+	}))
+	defer srv.Close()
+	cfg := handlerSettings{publicSettings: publicSettings{
+		BlobContainerURI: srv.URL + "/scripts?sv=2018&sig=x", BlobPrefix: "app/"}}
+
+	checks := checkDownloadCredentials(log.NewContext(log.NewNopLogger()), context.Background(), cfg)
+	require.Equal(t, []credentialCheck{{Setting: "blobContainerUri", URL: srv.URL + "/scripts?sv=2018&sig=***", OK: true}}, checks)
+	require.Equal(t, []string{"comp=list&maxresults=1&prefix=app%2F&restype=container&sig=x&sv=2018"}, queries, "only the first blob")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// configureDataDir sets dataDir to the directory in the dataDirEnvVar
+// environment variable, if set, after checking it is an absolute path that
+// does not overlap with the default data directories. If writable is set, the
+// directory is created if missing and checked to be writable.
+func configureDataDir(ctx log.Logger, writable bool) error {
+	d := os.Getenv(dataDirEnvVar)
+	if d == "" {
+		return nil
+	}
+	if !filepath.IsAbs(d) {
+		return fmt.Errorf("%s must be an absolute path: %q", dataDirEnvVar, d)
+	}
+	d = filepath.Clean(d)
+	if err := checkDataDirOverlap(d); err != nil {
+		return err
+	}
+	if writable {
+		if err := checkWritableDir(d); err != nil {
+			return errors.Wrapf(err, "invalid %s", dataDirEnvVar)
+		}
+	}
+	ctx.Log("event", "using data directory from environment", "path", d)
+	dataDir = d
+	return nil
+}
+
+// checkDataDirOverlap returns an error if d, the data directory configured
+// with dataDirEnvVar, is, contains or is in defaultDataDir or dataDirOld: the
+// state is moved from them to d on update, and d is removed on uninstall.
+func checkDataDirOverlap(d string) error {
+	for _, o := range []string{defaultDataDir, dataDirOld} {
+		if pathIn(d, o) || pathIn(o, d) {
+			return fmt.Errorf("%s cannot be, contain or be in %s: %q", dataDirEnvVar, o, d)
+		}
+	}
+	return nil
+}
+
+// pathIn returns whether the clean absolute path p is dir or in it.
+func pathIn(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// configureStatusDir sets the status folder of h to the directory in the
+// statusDirEnvVar environment variable, if set, for the agents which expect
+// the status files elsewhere than in HandlerEnvironment. The directory must be
+// an absolute path to an existing directory, checked to be writable if
+// writable is set.
+func configureStatusDir(ctx log.Logger, h *vmextension.HandlerEnvironment, writable bool) error {
+	d := os.Getenv(statusDirEnvVar)
+	if d == "" {
+		return nil
+	}
+	if !filepath.IsAbs(d) {
+		return fmt.Errorf("%s must be an absolute path: %q", statusDirEnvVar, d)
+	}
+	d = filepath.Clean(d)
+	if fi, err := os.Stat(d); err != nil {
+		return errors.Wrapf(err, "invalid %s", statusDirEnvVar)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("invalid %s: not a directory: %s", statusDirEnvVar, d)
+	}
+	if writable {
+		if err := checkWritableDir(d); err != nil {
+			return errors.Wrapf(err, "invalid %s", statusDirEnvVar)
+		}
+	}
+	ctx.Log("event", "using status directory from environment", "path", d, "default", h.HandlerEnvironment.StatusFolder)
+	h.HandlerEnvironment.StatusFolder = d
+	return nil
+}
+
+// checkWritableDir creates the directory at path if missing and checks if
+// files can be created in it.
+func checkWritableDir(path string) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return errors.Wrap(err, "failed to create directory")
+	}
+	f, err := ioutil.TempFile(path, ".write-check")
+	if err != nil {
+		return errors.Wrapf(err, "directory %s is not writable", path)
+	}
+	f.Close()
+	return errors.Wrap(os.Remove(f.Name()), "failed to remove write check file")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_configureDataDir(t *testing.T) {
+	defer func(d string) { dataDir = d }(dataDir)
+	defer os.Setenv(dataDirEnvVar, os.Getenv(dataDirEnvVar))
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+
+	dataDir = defaultDataDir
+	require.Nil(t, os.Unsetenv(dataDirEnvVar))
+	require.Nil(t, configureDataDir(log.NewNopLogger(), true))
+	require.Equal(t, defaultDataDir, dataDir, "default")
+
+	require.Nil(t, os.Setenv(dataDirEnvVar, "data/custom-script"))
+	err := configureDataDir(log.NewNopLogger(), true)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "must be an absolute path")
+
+	for _, o := range []string{defaultDataDir, "/var/lib/waagent", dataDirOld + "/data", "/"} {
+		require.Nil(t, os.Setenv(dataDirEnvVar, o))
+		err := configureDataDir(log.NewNopLogger(), false)
+		require.NotNil(t, err, o)
+		require.Contains(t, err.Error(), "cannot be, contain or be in", o)
+	}
+	require.Equal(t, defaultDataDir, dataDir, "unchanged")
+
+	custom := filepath.Join(d, "data", "custom-script")
+	require.Nil(t, os.Setenv(dataDirEnvVar, custom+"/"))
+	require.Nil(t, configureDataDir(log.NewNopLogger(), false))
+	require.Equal(t, custom, dataDir)
+	_, err = os.Stat(custom)
+	require.True(t, os.IsNotExist(err), "not created unless writable")
+
+	require.Nil(t, configureDataDir(log.NewNopLogger(), true))
+	ok, err := dirExists(custom)
+	require.Nil(t, err)
+	require.True(t, ok, "created")
+
+	if os.Geteuid() != 0 { // root can write anywhere
+		require.Nil(t, os.Chmod(custom, 0500))
+		defer os.Chmod(custom, 0700)
+		err = configureDataDir(log.NewNopLogger(), true)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "is not writable")
+	}
+}
+
+func Test_dataDirOverlap(t *testing.T) {
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = filepath.Dir(defaultDataDir) // as if configured before the check
+	ctx := log.NewContext(log.NewNopLogger())
+
+	_, err := migrateDataDirs(ctx, vmextension.HandlerEnvironment{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "cannot be, contain or be in "+defaultDataDir)
+	_, _, err = uninstall(ctx, vmextension.HandlerEnvironment{}, 0)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "data dir not removed")
+
+	require.False(t, pathIn("/var/lib/waagent/custom-script-2", defaultDataDir))
+	require.True(t, pathIn(defaultDataDir+"/a", defaultDataDir))
+}
+
+func Test_configureStatusDir(t *testing.T) {
+	defer os.Setenv(statusDirEnvVar, os.Getenv(statusDirEnvVar))
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+	var h vmextension.HandlerEnvironment
+	h.HandlerEnvironment.StatusFolder = "/var/lib/waagent/ext/status"
+
+	require.Nil(t, os.Unsetenv(statusDirEnvVar))
+	require.Nil(t, configureStatusDir(log.NewNopLogger(), &h, true))
+	require.Equal(t, "/var/lib/waagent/ext/status", h.HandlerEnvironment.StatusFolder, "default")
+
+	require.Nil(t, os.Setenv(statusDirEnvVar, "status"))
+	err := configureStatusDir(log.NewNopLogger(), &h, true)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "must be an absolute path")
+
+	require.Nil(t, os.Setenv(statusDirEnvVar, filepath.Join(d, "missing")))
+	err = configureStatusDir(log.NewNopLogger(), &h, true)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid "+statusDirEnvVar+": stat ")
+	_, err = os.Stat(filepath.Join(d, "missing"))
+	require.True(t, os.IsNotExist(err), "not created")
+
+	file := filepath.Join(d, "file")
+	require.Nil(t, ioutil.WriteFile(file, nil, 0600))
+	require.Nil(t, os.Setenv(statusDirEnvVar, file))
+	err = configureStatusDir(log.NewNopLogger(), &h, true)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "not a directory")
+
+	require.Nil(t, os.Setenv(statusDirEnvVar, d+"/"))
+	require.Nil(t, configureStatusDir(log.NewNopLogger(), &h, true))
+	require.Equal(t, d, h.HandlerEnvironment.StatusFolder)
+
+	if os.Geteuid() != 0 { // root can write anywhere
+		require.Nil(t, os.Chmod(d, 0500))
+		defer os.Chmod(d, 0700)
+		err = configureStatusDir(log.NewNopLogger(), &h, true)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "is not writable")
+		require.Nil(t, configureStatusDir(log.NewNopLogger(), &h, false), "read only")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+// errorCategory is a category of the failures of an operation, to react to them
+// programmatically, such as to exit with distinct exit codes.
+type errorCategory string
+
+const (
+	errConfigInvalid         errorCategory = "invalid configuration"
+	errDownloadFailed        errorCategory = "download failed"
+	errExtractFailed         errorCategory = "extraction failed"
+	errCommandFailed         errorCategory = "command failed"
+	errTimeout               errorCategory = "command timed out"
+	errOperationTimeout      errorCategory = "operation timed out"
+	errKeyVaultFailed        errorCategory = "key vault resolution failed"
+	errSignatureInvalid      errorCategory = "signature verification failed"
+	errAborted               errorCategory = "operation aborted"
+	errManagedIdentityFailed errorCategory = "managed identity token acquisition failed"
+)
+
+// categoryExitCodes are the exit codes of the handler for the failures of known
+// categories. Others exit with 1.
+var categoryExitCodes = map[errorCategory]int{
+	errConfigInvalid:         2,
+	errDownloadFailed:        3,
+	errCommandFailed:         4,
+	errTimeout:               5,
+	errExtractFailed:         6,
+	errOperationTimeout:      7,
+	errKeyVaultFailed:        8,
+	errSignatureInvalid:      9,
+	errAborted:               10,
+	errManagedIdentityFailed: 11,
+}
+
+// retriableCategories are the categories of the failures of the enable
+// operation which may not happen again, so the operation is run again on them
+// with enableRetryCount. The timeouts are not, like with commandRetryCount.
+var retriableCategories = map[errorCategory]bool{
+	errDownloadFailed:        true,
+	errCommandFailed:         true,
+	errKeyVaultFailed:        true,
+	errManagedIdentityFailed: true,
+}
+
+// retriableCategory returns whether the failures of category c are retriable.
+func retriableCategory(c errorCategory) bool {
+	return retriableCategories[c]
+}
+
+// categorizedError is an error of a known category wrapping the underlying
+// error. Its message is the message of the underlying error.
+type categorizedError struct {
+	category errorCategory
+	err      error
+}
+
+func (e categorizedError) Error() string { return e.err.Error() }
+
+// Cause returns the underlying error, so that errors.Cause works through a
+// categorizedError.
+func (e categorizedError) Cause() error { return e.err }
+
+// categorize returns err as an error of category c, unless err is already
+// categorized, in which case it is returned as is to keep the more specific
+// category. It returns nil if err is nil.
+func categorize(c errorCategory, err error) error {
+	if err == nil || categoryOf(err) != "" {
+		return err
+	}
+	return categorizedError{c, err}
+}
+
+// categoryOf returns the category of err, found by unwrapping it the same way
+// errors.Cause does, or an empty string if err is not categorized.
+func categoryOf(err error) errorCategory {
+	type causer interface {
+		Cause() error
+	}
+	for err != nil {
+		if e, ok := err.(categorizedError); ok {
+			return e.category
+		}
+		c, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return ""
+}
+
+// exitCode returns the exit code of the handler for the given error.
+func exitCode(err error) int {
+	if code, ok := categoryExitCodes[categoryOf(err)]; ok {
+		return code
+	}
+	return 1
+}
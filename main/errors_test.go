@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_categorize(t *testing.T) {
+	require.Nil(t, categorize(errDownloadFailed, nil))
+
+	cause := errors.New("boom")
+	err := errors.Wrap(categorize(errDownloadFailed, errors.Wrap(cause, "inner")), "outer")
+	require.EqualError(t, err, "outer: inner: boom", "message is intact")
+	require.Equal(t, errDownloadFailed, categoryOf(err))
+	require.Equal(t, cause, errors.Cause(err), "cause is reachable")
+
+	err = categorize(errDownloadFailed, errors.Wrap(categorize(errExtractFailed, cause), "outer"))
+	require.Equal(t, errExtractFailed, categoryOf(err), "more specific category is kept")
+}
+
+func Test_categoryOf_uncategorized(t *testing.T) {
+	require.Equal(t, errorCategory(""), categoryOf(nil))
+	require.Equal(t, errorCategory(""), categoryOf(errors.New("foo")))
+	require.Equal(t, errorCategory(""), categoryOf(errors.Wrap(errors.New("foo"), "bar")))
+}
+
+func Test_retriableCategory(t *testing.T) {
+	for _, c := range []errorCategory{errDownloadFailed, errCommandFailed, errKeyVaultFailed, errManagedIdentityFailed} {
+		require.True(t, retriableCategory(c), string(c))
+	}
+	for _, c := range []errorCategory{"", errConfigInvalid, errExtractFailed, errTimeout, errOperationTimeout, errSignatureInvalid} {
+		require.False(t, retriableCategory(c), string(c))
+	}
+}
+
+func Test_exitCode(t *testing.T) {
+	require.Equal(t, 1, exitCode(errors.New("foo")))
+	require.Equal(t, 2, exitCode(categorize(errConfigInvalid, errors.New("foo"))))
+	require.Equal(t, 3, exitCode(categorize(errDownloadFailed, errors.New("foo"))))
+	require.Equal(t, 4, exitCode(categorize(errCommandFailed, errors.New("foo"))))
+	require.Equal(t, 5, exitCode(errors.Wrap(categorize(errTimeout, errors.New("foo")), "bar")))
+	require.Equal(t, 6, exitCode(categorize(errExtractFailed, errors.New("foo"))))
+	require.Equal(t, 7, exitCode(categorize(errOperationTimeout, errors.New("foo"))))
+	require.Equal(t, 8, exitCode(categorize(errKeyVaultFailed, errors.New("foo"))))
+	require.Equal(t, 9, exitCode(categorize(errSignatureInvalid, errors.New("foo"))))
+	require.Equal(t, 11, exitCode(categorize(errManagedIdentityFailed, errors.New("foo"))))
+}
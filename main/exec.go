@@ -1,60 +1,597 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 )
 
-// Exec runs the given cmd in /bin/sh, saves its stdout/stderr streams to
-// the specified files. It waits until the execution terminates.
+const (
+	// defaultInterpreter is the program used to run commands unless
+	// specified otherwise.
+	defaultInterpreter = "/bin/sh"
+
+	// defaultGracePeriod is how long a timed out command is given to exit
+	// after SIGTERM before it is sent SIGKILL.
+	defaultGracePeriod = 10 * time.Second
+
+	// ioPriorityBestEffort and ioPriorityIdle are the I/O scheduling classes
+	// of ioprio_set(2), shifted by ioPriorityClassShift in the priority value
+	// with the level within the class in the lower bits.
+	ioPriorityBestEffort = 2
+	ioPriorityIdle       = 3
+	ioPriorityClassShift = 13
+
+	// ioPriorityWhoPgrp selects the process group in ioprio_set(2).
+	ioPriorityWhoPgrp = 2
+)
+
+// ExecOptions describes the constraints the command is executed with.
+type ExecOptions struct {
+	// Timeout is the duration after which the command is terminated. Zero
+	// value means the command can run indefinitely.
+	Timeout time.Duration
+
+	// GracePeriod is the duration to wait for the command to exit after
+	// SIGTERM is sent upon timeout, before sending SIGKILL. If zero,
+	// defaultGracePeriod is used.
+	GracePeriod time.Duration
+
+	// Env contains the environment variables to be set for the command in
+	// addition to the environment of this process, overriding the existing
+	// values.
+	Env map[string]string
+
+	// Interpreter is the name or path of the program used to run the
+	// command. If empty, defaultInterpreter is used.
+	Interpreter string
+
+	// Credential is the user and groups the command is executed as. If nil,
+	// the command is executed as the user of this process.
+	Credential *syscall.Credential
+
+	// WorkingDir, if not empty, is the directory the command is run in
+	// instead of the given workdir.
+	WorkingDir string
+
+	// Context, if not nil, terminates the command the same way as a timeout
+	// when it is done.
+	Context context.Context
+
+	// PIDFile, if not empty, is the path the process ID of the command (which
+	// is also its process group ID) is written to while it runs, so that it
+	// can be found and terminated by another process (see terminatePIDFile).
+	PIDFile string
+
+	// Umask, if not nil, is the file mode creation mask the command is
+	// executed with instead of the one of this process.
+	Umask *os.FileMode
+
+	// Niceness, if not nil, is the nice value from -20 (highest priority) to
+	// 19 (lowest priority) the command is executed with instead of the one of
+	// this process.
+	Niceness *int
+
+	// IOPriority, if not zero, is the I/O scheduling class and level the
+	// command is executed with as in ioprio_set(2), such as
+	// ioPriorityIdle<<ioPriorityClassShift, instead of the one of this
+	// process.
+	IOPriority int
+
+	// Background, if true, starts the command in a new session and returns
+	// without waiting for it to exit. The pidfile is left in place, and
+	// Timeout and Context do not apply.
+	Background bool
+
+	// CgroupDir, if not empty, is the cgroup v2 directory the command is moved
+	// into before it executes, so that all of its processes are limited by
+	// the cgroup (see newCommandCgroup).
+	CgroupDir string
+
+	// SystemdScope, if not nil, runs the command in a transient systemd scope
+	// unit created with systemd-run, which then executes the command in place
+	// so that it remains a child of this process.
+	SystemdScope *SystemdScope
+
+	// Chroot, if not empty, is the directory the command is chrooted into
+	// before it executes. The interpreter, the working directory and the
+	// paths in the command are then in this directory.
+	Chroot string
+}
+
+// Exec runs the given cmd in /bin/sh (or the interpreter specified in opts),
+// saves its stdout/stderr streams to the specified files. It waits until the
+// execution terminates or the timeout specified in opts elapses, unless the
+// command is started in the background.
 //
 // On error, an exit code may be returned if it is an exit code error.
 // Given stdout and stderr will be closed upon returning.
-func Exec(cmd, workdir string, stdout, stderr io.WriteCloser) (int, error) {
+func Exec(cmd, workdir string, stdout, stderr io.WriteCloser, opts ExecOptions) (int, error) {
 	defer stdout.Close()
 	defer stderr.Close()
 
-	c := exec.Command("/bin/sh", "-c", cmd)
+	interpreter := opts.Interpreter
+	if interpreter == "" {
+		interpreter = defaultInterpreter
+	}
+	var path string
+	var err error
+	if opts.Chroot != "" {
+		path, err = lookPathInRoot(opts.Chroot, interpreter)
+	} else {
+		path, err = exec.LookPath(interpreter)
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "interpreter %q is not found or not executable", interpreter)
+	}
+
+	args := []string{path, interpreterFlag(interpreter), cmd}
+	if opts.Umask != nil {
+		// set by a shell executing the interpreter, as the umask of this
+		// process is shared by all of its threads
+		args = append([]string{defaultInterpreter, "-c", `umask "$1" && shift && exec "$@"`,
+			"sh", fmt.Sprintf("%04o", *opts.Umask)}, args...)
+	}
+	if opts.CgroupDir != "" {
+		args = append([]string{defaultInterpreter, "-c", cgroupGateScript, "sh"}, args...)
+	}
+	cred := opts.Credential
+	if s := opts.SystemdScope; s != nil {
+		if args, err = s.args(args, cred); err != nil {
+			return 0, err
+		}
+		cred = nil // switched to by systemd-run
+	}
+	c := exec.Command(args[0], args[1:]...)
 	c.Dir = workdir
+	if opts.WorkingDir != "" {
+		c.Dir = opts.WorkingDir
+	}
+	if len(opts.Env) > 0 {
+		c.Env = mergeEnv(os.Environ(), opts.Env)
+	}
 	c.Stdout = stdout
 	c.Stderr = stderr
+	var gate *cgroupGate
+	if opts.CgroupDir != "" {
+		if gate, err = newCgroupGate(opts.CgroupDir, c); err != nil {
+			return 0, err
+		}
+	}
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    true, // to signal the entire process group
+		Credential: cred,
+		Chroot:     opts.Chroot,
+	}
+	if opts.Background {
+		// a new session also makes it a process group leader, and detaches
+		// it from the signals sent to the session of this process
+		c.SysProcAttr.Setpgid, c.SysProcAttr.Setsid = false, true
+		return 0, errors.Wrap(startBackground(c, opts, gate), "failed to start command")
+	}
 
-	err := c.Run()
+	oomKills := cgroupOOMKills(opts.CgroupDir)
+	timedOut, err := run(c, opts, gate)
+	if timedOut {
+		return -1, TimeoutError{opts.Timeout}
+	}
+	if e, ok := err.(CanceledError); ok {
+		return -1, e
+	}
 	exitErr, ok := err.(*exec.ExitError)
 	if ok {
 		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				oom := opts.CgroupDir != "" && status.Signal() == syscall.SIGKILL && cgroupOOMKills(opts.CgroupDir) > oomKills
+				return -1, ExitError{Code: -1, Signal: status.Signal(), OutOfMemory: oom}
+			}
 			code := status.ExitStatus()
-			return code, fmt.Errorf("command terminated with exit status=%d", code)
+			return code, ExitError{Code: code}
 		}
 	}
 	return 0, errors.Wrapf(err, "failed to execute command")
 }
 
+// ExitError is returned from Exec when the command terminates with a non-zero
+// exit status or is terminated by a signal.
+type ExitError struct {
+	// Code is the exit status of the command, or -1 if the command is
+	// terminated by a signal.
+	Code int
+	// Signal is the signal that terminated the command, if any.
+	Signal syscall.Signal
+	// OutOfMemory is true if the command is killed for exceeding the memory
+	// limit of its cgroup.
+	OutOfMemory bool
+}
+
+func (e ExitError) Error() string {
+	if e.OutOfMemory {
+		return fmt.Sprintf("command terminated by signal=%s: out of memory, it exceeded the memory limit of its cgroup", signalName(e.Signal))
+	}
+	if e.Signal != 0 {
+		return fmt.Sprintf("command terminated by signal=%s", signalName(e.Signal))
+	}
+	return fmt.Sprintf("command terminated with exit status=%d", e.Code)
+}
+
+// TimeoutError is returned from Exec when the command is terminated because it
+// did not complete in the specified timeout.
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("command terminated due to timeout after %v", e.Timeout)
+}
+
+// CanceledError is returned from Exec when the command is terminated because
+// the context in ExecOptions is done.
+type CanceledError struct {
+	Err error // the error of the context
+}
+
+func (e CanceledError) Error() string {
+	return fmt.Sprintf("command terminated: %v", e.Err)
+}
+
+// signalNames contains the names of the signals commonly terminating processes.
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+}
+
+// signalName returns the conventional name of the signal (e.g. SIGKILL).
+func signalName(sig syscall.Signal) string {
+	if n, ok := signalNames[sig]; ok {
+		return n
+	}
+	return fmt.Sprintf("%d", int(sig))
+}
+
+// interpreterFlag returns the command-line flag the given interpreter takes
+// the program text with.
+func interpreterFlag(interpreter string) string {
+	switch filepath.Base(interpreter) {
+	case "perl", "ruby", "node", "nodejs":
+		return "-e"
+	}
+	return "-c" // sh, bash, python and most others
+}
+
+// mergeEnv returns the environment in "key=value" format consisting of environ
+// and the extra variables, which take precedence over the variables in environ
+// with the same name. The extra variables are appended in sorted order.
+func mergeEnv(environ []string, extra map[string]string) []string {
+	var out []string
+	for _, kv := range environ {
+		k := kv
+		if i := strings.Index(kv, "="); i >= 0 {
+			k = kv[:i]
+		}
+		if _, ok := extra[k]; !ok {
+			out = append(out, kv)
+		}
+	}
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		out = append(out, k+"="+extra[k])
+	}
+	return out
+}
+
+// run starts the command and waits for it to complete. If a timeout is
+// specified in opts and the command does not complete in time, its process
+// group is sent SIGTERM and then SIGKILL after the grace period, and true is
+// returned. If the context in opts is done before the command completes, it is
+// terminated the same way and a CanceledError is returned.
+func run(c *exec.Cmd, opts ExecOptions, gate *cgroupGate) (timedOut bool, _ error) {
+	if err := start(c, opts, gate); err != nil {
+		return false, err
+	}
+	if opts.PIDFile != "" {
+		defer os.Remove(opts.PIDFile)
+	}
+	var canceled <-chan struct{}
+	if opts.Context != nil {
+		canceled = opts.Context.Done()
+	}
+	if opts.Timeout == 0 && canceled == nil {
+		return false, c.Wait()
+	}
+
+	var timeout <-chan time.Time
+	if opts.Timeout > 0 {
+		t := time.NewTimer(opts.Timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+	select {
+	case err := <-done:
+		return false, err
+	case <-timeout:
+		terminate(c, done, opts.GracePeriod)
+		return true, nil
+	case <-canceled:
+		terminate(c, done, opts.GracePeriod)
+		return false, CanceledError{opts.Context.Err()}
+	}
+}
+
+// startBackground starts the command and returns without waiting for it to
+// exit. The pidfile in opts, if any, is left behind for the command to be
+// found by another process.
+func startBackground(c *exec.Cmd, opts ExecOptions, gate *cgroupGate) error {
+	if err := start(c, opts, gate); err != nil {
+		return err
+	}
+	go c.Wait() // reaped if it exits while this process runs
+	return nil
+}
+
+// start starts the command in its own process group, sets the scheduling
+// priorities in opts on the process group, moves it into its cgroup through
+// gate if not nil, and writes the pidfile in opts, if any. If the priorities
+// cannot be set, the command cannot be moved or the pidfile cannot be
+// written, the command is killed.
+func start(c *exec.Cmd, opts ExecOptions, gate *cgroupGate) error {
+	if err := c.Start(); err != nil {
+		gate.close()
+		return err
+	}
+	err := setPriority(c.Process.Pid, opts)
+	if gate != nil {
+		if err == nil {
+			err = gate.release(c.Process.Pid)
+		}
+		gate.close()
+	}
+	if err == nil && opts.PIDFile != "" {
+		err = writePIDFile(opts.PIDFile, c.Process.Pid)
+	}
+	if err != nil {
+		syscall.Kill(-c.Process.Pid, syscall.SIGKILL) // cannot run as specified or be tracked
+		c.Wait()
+		return err
+	}
+	return nil
+}
+
+// setPriority sets the niceness and the I/O priority in opts, if any, on the
+// process group pgid, which is inherited by the processes the command starts
+// afterwards.
+func setPriority(pgid int, opts ExecOptions) error {
+	if opts.Niceness != nil {
+		if err := syscall.Setpriority(syscall.PRIO_PGRP, pgid, *opts.Niceness); err != nil {
+			return errors.Wrapf(err, "failed to set niceness %d", *opts.Niceness)
+		}
+	}
+	if opts.IOPriority != 0 {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioPriorityWhoPgrp, uintptr(pgid), uintptr(opts.IOPriority)); errno != 0 {
+			return errors.Wrapf(errno, "failed to set I/O priority")
+		}
+	}
+	return nil
+}
+
+// terminate sends SIGTERM to the process group of the running command c and
+// then SIGKILL if it does not exit in the grace period (or defaultGracePeriod
+// if zero). It waits until the command exits, as reported on done.
+func terminate(c *exec.Cmd, done <-chan error, grace time.Duration) {
+	if grace == 0 {
+		grace = defaultGracePeriod
+	}
+	pgid := -c.Process.Pid
+	syscall.Kill(pgid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(grace):
+		syscall.Kill(pgid, syscall.SIGKILL)
+		<-done
+	}
+}
+
+// writePIDFile writes the given process ID and the start time of the process
+// to the file at path, so that the process can be told apart from a process
+// that reuses its ID after it exits.
+func writePIDFile(path string, pid int) error {
+	start, err := processStartTime(pid)
+	if err != nil {
+		return err
+	}
+	b := []byte(fmt.Sprintf("%d %s\n", pid, start))
+	return errors.Wrap(ioutil.WriteFile(path, b, 0600), "failed to write pidfile")
+}
+
+// processStartTime returns the start time of the process with the given ID,
+// in clock ticks since the system boot, from /proc/<pid>/stat.
+func processStartTime(pid int) (string, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read process status")
+	}
+	// the name of the executable in parentheses may contain spaces, the
+	// start time is the 22nd field, the 20th after the name
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	if len(fields) < 20 {
+		return "", fmt.Errorf("unexpected process status format: %q", s)
+	}
+	return fields[19], nil
+}
+
+// terminatePIDFile terminates the process group of the command recorded in
+// the pidfile at path, if it is still running: it sends SIGTERM and then
+// SIGKILL if the command does not exit in the grace period (or
+// defaultGracePeriod if zero). It returns the process ID of the terminated
+// command, or 0 if no recorded command is running. A stale pidfile, left
+// behind by a handler process that crashed, is removed.
+func terminatePIDFile(path string, grace time.Duration) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "failed to read pidfile")
+	}
+	var (
+		pid   int
+		start string
+	)
+	if _, err := fmt.Sscanf(string(b), "%d %s", &pid, &start); err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pidfile %s: %q", path, b)
+	}
+	if s, err := processStartTime(pid); err != nil || s != start {
+		os.Remove(path) // exited, possibly with its ID reused since
+		return 0, nil
+	}
+	if grace == 0 {
+		grace = defaultGracePeriod
+	}
+	if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil {
+		return 0, errors.Wrapf(err, "failed to send SIGTERM to process group %d", pid)
+	}
+	for deadline := time.Now().Add(grace); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if syscall.Kill(-pid, 0) != nil {
+			return pid, nil // the entire process group exited
+		}
+	}
+	if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return 0, errors.Wrapf(err, "failed to send SIGKILL to process group %d", pid)
+	}
+	return pid, nil
+}
+
 // ExecCmdInDir executes the given command in given directory and saves output
 // to ./stdout and ./stderr files (truncates files if exists, creates them if not
 // with 0600/-rw------- permissions).
 //
 // Ideally, we execute commands only once per sequence number in custom-script-extension,
 // and save their output under /var/lib/waagent/<dir>/download/<seqnum>/*.
-func ExecCmdInDir(cmd, workdir string) error {
-	outFn := filepath.Join(workdir, "stdout")
-	errFn := filepath.Join(workdir, "stderr")
+func ExecCmdInDir(cmd, workdir string, opts ExecOptions) error {
+	outFn, errFn := logPaths(workdir)
+	return execCmdToFiles(cmd, workdir, outFn, errFn, opts)
+}
 
+// execCmdToFiles executes the given command in given directory and saves its
+// stdout and stderr to the given files (truncated if they exist, created with
+// 0600/-rw------- permissions if not).
+func execCmdToFiles(cmd, workdir, outFn, errFn string, opts ExecOptions) error {
 	outF, err := os.OpenFile(outFn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
 		return errors.Wrapf(err, "failed to open stdout file")
 	}
 	errF, err := os.OpenFile(errFn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
+		outF.Close()
 		return errors.Wrapf(err, "failed to open stderr file")
 	}
 
-	_, err = Exec(cmd, workdir, outF, errF)
+	_, err = Exec(cmd, workdir, outF, errF, opts)
 	return err
 }
+
+// logPaths returns stdout and stderr file paths for the specified output
+// directory. It does not create the files.
+func logPaths(dir string) (stdout string, stderr string) {
+	return filepath.Join(dir, "stdout"), filepath.Join(dir, "stderr")
+}
+
+// commandLogPaths returns stdout and stderr file paths for the i-th command in
+// 'commands' for the specified output directory, such as ./stdout.0 and
+// ./stderr.0. It does not create the files.
+func commandLogPaths(dir string, i int) (stdout string, stderr string) {
+	stdout, stderr = logPaths(dir)
+	return fmt.Sprintf("%s.%d", stdout, i), fmt.Sprintf("%s.%d", stderr, i)
+}
+
+// testLogPaths returns stdout and stderr file paths for the testCommand for the
+// specified output directory, ./stdout.test and ./stderr.test. It does not
+// create the files.
+func testLogPaths(dir string) (stdout string, stderr string) {
+	stdout, stderr = logPaths(dir)
+	return stdout + ".test", stderr + ".test"
+}
+
+// onFailureLogPaths returns stdout and stderr file paths for the
+// onFailureCommand for the specified output directory, ./stdout.onfailure and
+// ./stderr.onfailure. It does not create the files.
+func onFailureLogPaths(dir string) (stdout string, stderr string) {
+	stdout, stderr = logPaths(dir)
+	return stdout + ".onfailure", stderr + ".onfailure"
+}
+
+// tailFile returns the last max bytes (or the entire file if the file size is
+// smaller than max) of the file at path. If the file does not exist, it returns
+// a nil slice and no error.
+func tailFile(path string, max int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error opening file")
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting file size")
+	}
+	if fi.Size() > max {
+		if _, err := f.Seek(fi.Size()-max, io.SeekStart); err != nil {
+			return nil, errors.Wrap(err, "error seeking file")
+		}
+	}
+	b, err := ioutil.ReadAll(f)
+	return b, errors.Wrap(err, "error reading from file")
+}
+
+// sanitizeOutput converts the given command output into a string that can be
+// safely embedded into the status file, by replacing invalid UTF-8 sequences
+// and control characters (other than tabs and new lines) with U+FFFD.
+func sanitizeOutput(b []byte) string {
+	var buf bytes.Buffer
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError || (unicode.IsControl(r) && r != '\n' && r != '\t' && r != '\r') {
+			r = utf8.RuneError
+		}
+		buf.WriteRune(r)
+		b = b[size:]
+	}
+	return buf.String()
+}
@@ -2,18 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestExec_success(t *testing.T) {
 	v := new(mockFile)
-	ec, err := Exec("date", "/", v, v)
+	ec, err := Exec("date", "/", v, v, ExecOptions{})
 	require.Nil(t, err, "err: %v -- out: %s", err, v.b.Bytes())
 	require.EqualValues(t, 0, ec)
 }
@@ -23,7 +28,7 @@ func TestExec_success_redirectsStdStreams_closesFds(t *testing.T) {
 	require.False(t, o.closed, "stdout open")
 	require.False(t, e.closed, "stderr open")
 
-	_, err := Exec("/bin/echo 'I am stdout!'>&1; /bin/echo 'I am stderr!'>&2", "/", o, e)
+	_, err := Exec("/bin/echo 'I am stdout!'>&1; /bin/echo 'I am stderr!'>&2", "/", o, e, ExecOptions{})
 	require.Nil(t, err, "err: %v -- stderr: %s", err, e.b.Bytes())
 	require.Equal(t, "I am stdout!\n", string(o.b.Bytes()))
 	require.Equal(t, "I am stderr!\n", string(e.b.Bytes()))
@@ -32,14 +37,73 @@ func TestExec_success_redirectsStdStreams_closesFds(t *testing.T) {
 }
 
 func TestExec_failure_exitError(t *testing.T) {
-	ec, err := Exec("exit 12", "/", new(mockFile), new(mockFile))
+	ec, err := Exec("exit 12", "/", new(mockFile), new(mockFile), ExecOptions{})
 	require.NotNil(t, err)
 	require.EqualError(t, err, "command terminated with exit status=12") // error is customized
 	require.EqualValues(t, 12, ec)
 }
 
+func TestExec_failure_exitErrorType(t *testing.T) {
+	_, err := Exec("exit 2", "/", new(mockFile), new(mockFile), ExecOptions{})
+	require.Equal(t, ExitError{Code: 2}, err)
+}
+
+func TestExec_failure_signaled(t *testing.T) {
+	ec, err := Exec("kill -9 $$", "/", new(mockFile), new(mockFile), ExecOptions{})
+	require.NotNil(t, err)
+	require.EqualError(t, err, "command terminated by signal=SIGKILL")
+	require.Equal(t, ExitError{Code: -1, Signal: syscall.SIGKILL}, err)
+	require.EqualValues(t, -1, ec)
+}
+
+func TestExec_env(t *testing.T) {
+	os.Setenv("CSE_TEST_EXISTING", "old")
+	defer os.Unsetenv("CSE_TEST_EXISTING")
+
+	o := new(mockFile)
+	_, err := Exec(`echo "$CSE_TEST_EXISTING $CSE_TEST_NEW $HOME"`, "/", o, new(mockFile), ExecOptions{
+		Env: map[string]string{
+			"CSE_TEST_EXISTING": "new",
+			"CSE_TEST_NEW":      "foo"}})
+	require.Nil(t, err)
+	require.Equal(t, "new foo "+os.Getenv("HOME")+"\n", string(o.b.Bytes()))
+}
+
+func TestExec_interpreter(t *testing.T) {
+	o := new(mockFile)
+	_, err := Exec(`echo "${BASH_VERSION:+bash}"`, "/", o, new(mockFile), ExecOptions{Interpreter: "bash"})
+	require.Nil(t, err)
+	require.Equal(t, "bash\n", string(o.b.Bytes()))
+}
+
+func TestExec_interpreterNotFound(t *testing.T) {
+	_, err := Exec("date", "/", new(mockFile), new(mockFile), ExecOptions{Interpreter: "/non/existing/sh"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), `interpreter "/non/existing/sh" is not found or not executable`)
+
+	_, err = Exec("date", "/", new(mockFile), new(mockFile), ExecOptions{Interpreter: "/etc/passwd"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), `interpreter "/etc/passwd" is not found or not executable`)
+}
+
+func Test_interpreterFlag(t *testing.T) {
+	require.Equal(t, "-c", interpreterFlag("/bin/sh"))
+	require.Equal(t, "-c", interpreterFlag("python3"))
+	require.Equal(t, "-e", interpreterFlag("/usr/bin/perl"))
+}
+
+func Test_mergeEnv(t *testing.T) {
+	require.Equal(t, []string{"A=1", "C=3", "B=x", "D=y"},
+		mergeEnv([]string{"A=1", "B=2", "C=3"}, map[string]string{"D": "y", "B": "x"}))
+}
+
+func Test_signalName(t *testing.T) {
+	require.Equal(t, "SIGTERM", signalName(syscall.SIGTERM))
+	require.Equal(t, "63", signalName(syscall.Signal(63)))
+}
+
 func TestExec_failure_genericError(t *testing.T) {
-	_, err := Exec("date", "/non-existing-path", new(mockFile), new(mockFile))
+	_, err := Exec("date", "/non-existing-path", new(mockFile), new(mockFile), ExecOptions{})
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), "failed to execute command:") // error is wrapped
 }
@@ -48,7 +112,7 @@ func TestExec_failure_fdClosed(t *testing.T) {
 	out := new(mockFile)
 	require.Nil(t, out.Close())
 
-	_, err := Exec("date", "/", out, out)
+	_, err := Exec("date", "/", out, out, ExecOptions{})
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), "file closed") // error is wrapped
 }
@@ -58,7 +122,7 @@ func TestExec_failure_redirectsStdStreams_closesFds(t *testing.T) {
 	require.False(t, o.closed, "stdout open")
 	require.False(t, e.closed, "stderr open")
 
-	_, err := Exec(`/bin/echo 'I am stdout!'>&1; /bin/echo 'I am stderr!'>&2; exit 12`, "/", o, e)
+	_, err := Exec(`/bin/echo 'I am stdout!'>&1; /bin/echo 'I am stderr!'>&2; exit 12`, "/", o, e, ExecOptions{})
 	require.NotNil(t, err)
 	require.Equal(t, "I am stdout!\n", string(o.b.Bytes()))
 	require.Equal(t, "I am stderr!\n", string(e.b.Bytes()))
@@ -66,12 +130,53 @@ func TestExec_failure_redirectsStdStreams_closesFds(t *testing.T) {
 	require.True(t, e.closed, "stderr closed")
 }
 
+func TestExec_failure_timeout(t *testing.T) {
+	s := time.Now()
+	ec, err := Exec("sleep 10", "/", new(mockFile), new(mockFile), ExecOptions{
+		Timeout: 100 * time.Millisecond})
+	require.NotNil(t, err)
+	require.EqualError(t, err, "command terminated due to timeout after 100ms")
+	require.EqualValues(t, -1, ec)
+	require.True(t, time.Since(s) < 5*time.Second, "command was not terminated in time")
+}
+
+func TestExec_failure_timeout_killsAfterGracePeriod(t *testing.T) {
+	s := time.Now()
+	_, err := Exec("trap '' TERM; sleep 10", "/", new(mockFile), new(mockFile), ExecOptions{
+		Timeout:     100 * time.Millisecond,
+		GracePeriod: 500 * time.Millisecond})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "command terminated due to timeout")
+	e := time.Since(s)
+	require.True(t, e >= 600*time.Millisecond, "command was killed before grace period: took=%v", e)
+	require.True(t, e < 5*time.Second, "command was not killed after grace period: took=%v", e)
+}
+
+func TestExec_failure_canceled(t *testing.T) {
+	c, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	s := time.Now()
+	ec, err := Exec("sleep 10", "/", new(mockFile), new(mockFile), ExecOptions{
+		Timeout: time.Minute,
+		Context: c})
+	require.EqualError(t, err, "command terminated: context deadline exceeded")
+	require.Equal(t, CanceledError{context.DeadlineExceeded}, err)
+	require.EqualValues(t, -1, ec)
+	require.True(t, time.Since(s) < 5*time.Second, "command was not terminated in time")
+}
+
+func TestExec_timeout_notReached(t *testing.T) {
+	ec, err := Exec("exit 3", "/", new(mockFile), new(mockFile), ExecOptions{Timeout: time.Minute})
+	require.EqualError(t, err, "command terminated with exit status=3")
+	require.EqualValues(t, 3, ec)
+}
+
 func TestExecCmdInDir(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	err = ExecCmdInDir("/bin/echo 'Hello world'", dir)
+	err = ExecCmdInDir("/bin/echo 'Hello world'", dir, ExecOptions{})
 	require.Nil(t, err)
 	require.True(t, fileExists(t, filepath.Join(dir, "stdout")), "stdout file should be created")
 	require.True(t, fileExists(t, filepath.Join(dir, "stderr")), "stderr file should be created")
@@ -85,8 +190,19 @@ func TestExecCmdInDir(t *testing.T) {
 	require.EqualValues(t, 0, len(b), "stderr file must be empty")
 }
 
+func TestExecCmdInDir_workingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, ExecCmdInDir("pwd", dir, ExecOptions{WorkingDir: "/"}))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err, "output should be saved in dir")
+	require.Equal(t, "/\n", string(b))
+}
+
 func TestExecCmdInDir_cantOpenError(t *testing.T) {
-	err := ExecCmdInDir("/bin/echo 'Hello world'", "/non-existing-dir")
+	err := ExecCmdInDir("/bin/echo 'Hello world'", "/non-existing-dir", ExecOptions{})
 	require.Contains(t, err.Error(), "failed to open stdout file")
 }
 
@@ -95,8 +211,8 @@ func TestExecCmdInDir_truncates(t *testing.T) {
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	require.Nil(t, ExecCmdInDir("/bin/echo '1:out'; /bin/echo '1:err'>&2", dir))
-	require.Nil(t, ExecCmdInDir("/bin/echo '2:out'; /bin/echo '2:err'>&2", dir))
+	require.Nil(t, ExecCmdInDir("/bin/echo '1:out'; /bin/echo '1:err'>&2", dir, ExecOptions{}))
+	require.Nil(t, ExecCmdInDir("/bin/echo '2:out'; /bin/echo '2:err'>&2", dir, ExecOptions{}))
 
 	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
 	require.Nil(t, err)
@@ -107,6 +223,42 @@ func TestExecCmdInDir_truncates(t *testing.T) {
 	require.Equal(t, "2:err\n", string(b), "stderr did not truncate")
 }
 
+func Test_logPaths(t *testing.T) {
+	stdout, stderr := logPaths("/tmp")
+	require.Equal(t, "/tmp/stdout", stdout)
+	require.Equal(t, "/tmp/stderr", stderr)
+}
+
+func Test_tailFile_notFound(t *testing.T) {
+	b, err := tailFile("/non-existing-file", 100)
+	require.Nil(t, err)
+	require.Nil(t, b)
+}
+
+func Test_tailFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(f.Name())
+	_, err = f.Write([]byte("0123456789"))
+	require.Nil(t, err)
+	f.Close()
+
+	b, err := tailFile(f.Name(), 4)
+	require.Nil(t, err)
+	require.Equal(t, "6789", string(b))
+
+	b, err = tailFile(f.Name(), 100)
+	require.Nil(t, err)
+	require.Equal(t, "0123456789", string(b), "smaller file read entirely")
+}
+
+func Test_sanitizeOutput(t *testing.T) {
+	require.Equal(t, "", sanitizeOutput(nil))
+	require.Equal(t, "hello\n\tworld ☃", sanitizeOutput([]byte("hello\n\tworld ☃")))
+	require.Equal(t, "a\uFFFDb\uFFFDc", sanitizeOutput([]byte("a\xffb\x00c")))
+	require.Equal(t, "\uFFFD\uFFFD", sanitizeOutput([]byte("☃")[1:]), "rune cut in half")
+}
+
 // Test utilities
 
 type mockFile struct {
@@ -137,3 +289,142 @@ func fileExists(t *testing.T, path string) bool {
 	t.Fatalf("failed to check if %s exists: %v", path, err)
 	return false
 }
+
+func TestExec_umask(t *testing.T) {
+	for _, interpreter := range []string{"", "/bin/bash"} {
+		o := new(mockFile)
+		m := os.FileMode(0027)
+		_, err := Exec("umask", "/", o, new(mockFile), ExecOptions{Interpreter: interpreter, Umask: &m})
+		require.Nil(t, err, interpreter)
+		require.Equal(t, "0027\n", o.b.String(), interpreter)
+	}
+
+	// the umask of the handler is not changed
+	m := os.FileMode(0077)
+	_, err := Exec("true", "/", new(mockFile), new(mockFile), ExecOptions{Umask: &m})
+	require.Nil(t, err)
+	old := syscall.Umask(0022)
+	syscall.Umask(old)
+	require.NotEqual(t, 0077, old)
+}
+
+func TestExec_priority(t *testing.T) {
+	o := new(mockFile)
+	n := 7
+	// the niceness (19th field of the status) of the shell itself, set after
+	// it is started
+	_, err := Exec(`sleep 0.1; cut -d' ' -f19 /proc/$$/stat; nice; ionice -p $$`, "/", o, new(mockFile),
+		ExecOptions{Niceness: &n, IOPriority: ioPriorityBestEffort<<ioPriorityClassShift | 6})
+	require.Nil(t, err)
+	require.Equal(t, "7\n7\nbest-effort: prio 6\n", o.b.String(), "inherited by the processes it starts")
+
+	o = new(mockFile)
+	_, err = Exec(`sleep 0.1; ionice -p $$`, "/", o, new(mockFile), ExecOptions{IOPriority: ioPriorityIdle << ioPriorityClassShift})
+	require.Nil(t, err)
+	require.Equal(t, "idle\n", o.b.String())
+
+	old, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	require.Nil(t, err)
+	require.NotEqual(t, 20-n, old, "the niceness of the handler is not changed")
+}
+
+func TestExec_pidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pid")
+
+	o := new(mockFile)
+	// the pidfile is written after the command is started
+	_, err = Exec(`until [ -s "`+path+`" ]; do sleep 0.01; done; cat "`+path+`"`, "/", o, new(mockFile), ExecOptions{PIDFile: path})
+	require.Nil(t, err)
+	require.Regexp(t, `^[0-9]+ [0-9]+\n$`, o.b.String(), "written while running")
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "removed after exit")
+
+	_, err = Exec("date", "/", new(mockFile), new(mockFile), ExecOptions{PIDFile: filepath.Join(dir, "missing", "pid")})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to write pidfile")
+}
+
+func TestExec_background(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pid")
+
+	out, err := os.Create(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	start := time.Now()
+	code, err := Exec("echo started; sleep 30", "/", out, new(mockFile), ExecOptions{PIDFile: path, Background: true, Timeout: time.Millisecond})
+	require.Nil(t, err)
+	require.Equal(t, 0, code)
+	require.True(t, time.Since(start) < 10*time.Second, "does not wait for the command")
+
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err, "pidfile is left in place")
+	var pid int
+	_, err = fmt.Sscanf(string(b), "%d", &pid)
+	require.Nil(t, err)
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	require.Nil(t, err, "still running after the timeout")
+	s := string(stat)
+	require.Equal(t, fmt.Sprintf("%d", pid), strings.Fields(s[strings.LastIndex(s, ")")+1:])[3], "session leader")
+
+	var output []byte
+	for deadline := time.Now().Add(5 * time.Second); len(output) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		output, err = ioutil.ReadFile(filepath.Join(dir, "stdout"))
+		require.Nil(t, err)
+	}
+	require.Equal(t, "started\n", string(output), "output is saved")
+
+	got, err := terminatePIDFile(path, time.Second)
+	require.Nil(t, err)
+	require.Equal(t, pid, got)
+}
+
+func Test_terminatePIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pid")
+
+	pid, err := terminatePIDFile(path, time.Second)
+	require.Nil(t, err)
+	require.Equal(t, 0, pid, "no pidfile")
+
+	// the shell ignores SIGTERM, its child does not
+	done := make(chan error, 1)
+	go func() {
+		_, err := Exec("trap '' TERM; sleep 30 & wait", "/", new(mockFile), new(mockFile), ExecOptions{PIDFile: path})
+		done <- err
+	}()
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+
+	s := time.Now()
+	pid, err = terminatePIDFile(path, 500*time.Millisecond)
+	require.Nil(t, err)
+	require.NotEqual(t, 0, pid)
+	require.Equal(t, ExitError{Code: -1, Signal: syscall.SIGKILL}, <-done, "killed after the grace period")
+	require.True(t, time.Since(s) < 5*time.Second)
+
+	// the process has exited, possibly with its ID reused
+	require.Nil(t, ioutil.WriteFile(path, b, 0600))
+	pid, err = terminatePIDFile(path, time.Second)
+	require.Nil(t, err)
+	require.Equal(t, 0, pid, "stale pidfile")
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "stale pidfile is removed")
+
+	require.Nil(t, ioutil.WriteFile(path, []byte("x"), 0600))
+	_, err = terminatePIDFile(path, time.Second)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid pidfile")
+}
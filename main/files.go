@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/Azure/custom-script-extension-linux/pkg/archive"
 	"github.com/Azure/custom-script-extension-linux/pkg/blobutil"
 	"github.com/Azure/custom-script-extension-linux/pkg/download"
 	"github.com/Azure/custom-script-extension-linux/pkg/preprocess"
@@ -14,35 +23,291 @@ import (
 	"github.com/pkg/errors"
 )
 
-// downloadAndProcessURL downloads using the specified downloader and saves it to the
-// specified existing directory, which must be the path to the saved file. Then
-// it post-processes file based on heuristics.
-func downloadAndProcessURL(ctx *log.Context, url, downloadDir, storageAccountName, storageAccountKey string) error {
-	fn, err := urlToFileName(url)
-	if err != nil {
-		return err
+// fileDownload describes a file to be downloaded.
+type fileDownload struct {
+	url     string
+	mirrors []string    // URLs to download the file from in order if url fails
+	name    string      // name of the saved file, derived from url if empty
+	sha256  string      // expected checksum of the file, not verified if empty
+	ctype   string      // expected media type of the response, not checked if empty
+	sig     string      // URL of the detached signature of the file, not verified if empty
+	mode    os.FileMode // permission bits of the file, defaultFileMode if zero
+	dir     string      // existing directory to save the file to, the download directory if empty
+
+	// extract is whether the file is extracted into the download directory
+	// if it is an archive, and check is what is expected to be extracted
+	extract bool
+	check   archiveCheck
+
+	budget *download.SizeBudget // shared by the files of the operation, not limited if nil
+}
+
+// path returns the path the file f is saved to in downloadDir, or in its own
+// directory if specified.
+func (f fileDownload) path(downloadDir string) (string, error) {
+	fn := f.name
+	if fn == "" {
+		var err error
+		if fn, err = urlToFileName(f.url); err != nil {
+			return "", err
+		}
+	}
+	if f.dir != "" {
+		downloadDir = f.dir
+	}
+	return filepath.Join(downloadDir, fn), nil
+}
+
+// downloadAndProcessURL downloads the file and saves it to the specified
+// existing directory (or the directory of f, if specified), with the specified
+// name or the name derived from the URL.
+// The credentials specified in cfg are used to access the URL, and the
+// download fails if the response is not of the expected content type. If the
+// download fails after its retries, the file is downloaded from each of its
+// mirrors in turn until one succeeds. If an expected checksum is specified,
+// the checksum of the downloaded file is verified, and if a signature is
+// specified, it is verified with the public keys in cfg
+// (failures are categorized as errSignatureInvalid). Then it extracts the file
+// if it is an archive to be extracted, or post-processes the file based on
+// heuristics. The download progress is reported to progress, if not nil. The
+// download is canceled when opCtx is done. Extraction errors are categorized
+// as errExtractFailed.
+//
+// If m is not nil, the processed file is recorded in it and the download is
+// skipped if the file is recorded as downloaded and unchanged, or copied from
+// the previous download directory of m if it is unchanged there, unless
+// forceDownload is set in cfg or the file has a signature, which is verified
+// on the downloaded contents before they are post-processed. A file kept or
+// copied this way is downloaded again if it does not have the expected
+// checksum.
+func downloadAndProcessURL(ctx *log.Context, opCtx context.Context, f fileDownload, downloadDir string, cfg handlerSettings, progress download.ProgressFunc, m *downloadManifest) (err error) {
+	fn := f.name
+	if fn == "" {
+		var err error
+		if fn, err = urlToFileName(f.url); err != nil {
+			return err
+		}
 	}
 
-	dl, err := getDownloader(url, storageAccountName, storageAccountKey)
+	dl, err := getDownloader(ctx, f.url, cfg)
 	if err != nil {
 		return err
 	}
 
+	key := fn // in the manifest of the download directory
+	if f.dir != "" {
+		downloadDir = f.dir
+		key = filepath.Join(f.dir, fn)
+	}
 	fp := filepath.Join(downloadDir, fn)
-	const mode = 0500 // we assume users download scripts to execute
-	if _, err := download.SaveTo(ctx, dl, fp, mode); err != nil {
+	if strings.Contains(fn, "/") {
+		// such as a blob listed from a virtual directory of a container
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			return errors.Wrap(download.WrapDiskFull(err, fp, -1), "failed to create directory of file")
+		}
+	}
+	mode := f.mode
+	if mode == 0 {
+		mode = defaultFileMode
+	}
+	skipUnchanged := m != nil && !cfg.ForceDownload && f.sig == ""
+	if skipUnchanged && m.unchanged(ctx, opCtx, key, fp, f.url, dl) && keptFileValid(ctx, fp, f.sha256) {
+		ctx.Log("event", "skipped download", "message", "file is already downloaded and unchanged", "file", fn)
+		return errors.Wrapf(os.Chmod(fp, mode), "failed to set mode of '%s'", fn)
+	}
+	var etag string
+	defer func() {
+		if err != nil || m == nil {
+			return
+		}
+		if err := m.record(key, fp, f.url, etag, f.sha256); err != nil {
+			ctx.Log("event", "failed to record download", "error", err) // only downloaded again
+		}
+	}()
+
+	var reused bool
+	if skipUnchanged {
+		etag, reused = m.reuse(ctx, opCtx, key, fp, f.url, f.sha256, dl)
+		reused = reused && keptFileValid(ctx, fp, f.sha256)
+	}
+	if reused {
+		ctx.Log("event", "reused file", "message", "file is unchanged since the previous download", "file", fn)
+	} else if etag, err = saveFromMirrors(ctx, opCtx, f, dl, fp, mode, cfg, progress); err != nil {
 		return err
 	}
+	// SaveTo keeps the mode of an existing file, such as a file downloaded
+	// before for the same sequence number, but the settings may have changed
+	if err := os.Chmod(fp, mode); err != nil {
+		return errors.Wrapf(err, "failed to set mode of '%s'", fn)
+	}
+
+	if f.sha256 != "" && !reused {
+		if err := verifySHA256(ctx, fp, f.sha256); err != nil {
+			f.discard(fp) // do not leave a file with unexpected contents behind
+			return err
+		}
+	}
+	if f.sig != "" {
+		if err := verifyFileSignature(ctx, opCtx, fp, f.sig, cfg); err != nil {
+			f.discard(fp) // do not leave a file which is not trusted behind
+			return err
+		}
+	}
+
+	if f.extract && archive.IsArchive(fn) {
+		ctx.Log("event", "extracting archive", "file", fn)
+		s, err := archive.ExtractWithStats(fp, downloadDir, f.check.limits())
+		if err != nil && f.check.Size != nil && errors.Cause(err) == archive.ErrLimitExceeded && s.Bytes > *f.check.Size {
+			return categorize(errExtractFailed, fmt.Errorf("extracted more than %d bytes from '%s' ('expectedExtractedSize'), the archive may be corrupted", *f.check.Size, fn))
+		} else if err != nil {
+			return categorize(errExtractFailed, errors.Wrapf(download.WrapDiskFull(err, downloadDir, -1), "failed to extract '%s'", fn))
+		}
+		ctx.Log("event", "extracted archive", "file", fn, "files", s.Files, "bytes", s.Bytes)
+		return categorize(errExtractFailed, checkExtracted(fn, s, f.check))
+	}
 
-	err = postProcessFile(fp)
-	return errors.Wrapf(err, "failed to post-process '%s'", fn)
+	if reused {
+		return nil // post-processed after the previous download
+	}
+	if !cfg.convertLineEndings() {
+		ctx.Log("event", "skipped post-processing", "file", fn)
+		return nil
+	}
+	modified, err := postProcessFile(fp)
+	if err != nil {
+		return errors.Wrapf(err, "failed to post-process '%s'", fn)
+	}
+	if modified {
+		ctx.Log("event", "post-processed file", "message", "removed BOM and converted DOS line endings", "file", fn)
+	}
+	return nil
+}
+
+// discard removes the downloaded file f at fp, and releases its size from the
+// budget of f which it was charged to.
+func (f fileDownload) discard(fp string) {
+	if fi, err := os.Stat(fp); err == nil && f.budget != nil {
+		f.budget.Release(fi.Size())
+	}
+	os.Remove(fp)
+}
+
+// saveFromMirrors downloads the file f with dl to fp, or from the first of
+// its mirrors it can be downloaded from if the download from its URL fails
+// after the retries, and returns the ETag of the file downloaded from its URL
+// (empty if downloaded from a mirror). The mirrors
+// are not tried if opCtx is done or the disk is full.
+func saveFromMirrors(ctx *log.Context, opCtx context.Context, f fileDownload, dl download.Downloader, fp string, mode os.FileMode, cfg handlerSettings, progress download.ProgressFunc) (etag string, err error) {
+	for i, u := range append([]string{f.url}, f.mirrors...) {
+		if i > 0 {
+			if opCtx.Err() != nil || download.IsDiskFull(err) {
+				break
+			}
+			ctx.Log("event", "download failed, trying mirror", "mirror", i, "error", err)
+			if dl, err = getDownloader(ctx, u, cfg); err != nil {
+				continue
+			}
+		}
+		if _, err = download.SaveTo(ctx, dl, fp, download.SaveOptions{
+			Mode:        mode,
+			Retry:       cfg.retryPolicy(),
+			Progress:    progress,
+			Context:     opCtx,
+			ETag:        &etag,
+			MaxSize:     cfg.publicSettings.MaxFileSizeBytes,
+			Budget:      f.budget,
+			ContentType: f.ctype}); err == nil {
+			if i > 0 {
+				ctx.Log("event", "downloaded from mirror", "mirror", i, "url", redactURLSecrets(u))
+				etag = "" // does not tell if the file at its URL is unchanged
+			}
+			return etag, nil
+		}
+		os.Remove(fp) // do not leave partially downloaded file behind for a retry
+	}
+	if len(f.mirrors) > 0 {
+		return "", errors.Wrap(err, "failed to download from all mirrors")
+	}
+	return "", err
 }
 
-// getDownloader returns a downloader for the given URL based on whether the
-// storage credentials are empty or not.
-func getDownloader(fileURL string, storageAccountName, storageAccountKey string) (
+// getDownloader returns a downloader for the given URL authenticated per cfg
+// (see getCredentialDownloader), which also sends the custom download headers
+// in cfg for the URL.
+func getDownloader(ctx *log.Context, fileURL string, cfg handlerSettings) (
 	download.Downloader, error) {
-	if storageAccountName == "" || storageAccountKey == "" {
+	d, err := getCredentialDownloader(ctx, fileURL, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if headers := cfg.downloadHeaders(fileURL); len(headers) > 0 {
+		names := make([]string, 0, len(headers))
+		for k := range headers {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		ctx.Log("event", "sending custom headers with download", "headers", strings.Join(names, ",")) // never log the values
+		d = download.NewHeaderDownload(d, headers)
+	}
+	return d, nil
+}
+
+// getCredentialDownloader returns a downloader for the given URL based on
+// whether the storage credentials or the managed identity in cfg are empty or
+// not. Storage credentials take precedence over the managed identity. GitHub
+// URLs are downloaded with the GitHub token in cfg, if specified, and other
+// http(s) URLs with the HTTP Basic credentials in the URL or in cfg.
+//
+// URLs already carrying a Shared Access Signature are downloaded as is, and the
+// SAS token in cfg, if specified, is appended to the Azure Blob URLs without
+// one; in both cases other credentials are not used. Otherwise, the per-file
+// storage credentials for the URL in cfg take precedence over all others.
+func getCredentialDownloader(ctx *log.Context, fileURL string, cfg handlerSettings) (
+	download.Downloader, error) {
+	if cfg.GitHubToken != "" && download.IsGitHubURL(fileURL) {
+		ctx.Log("event", "using GitHub token for download") // never log the token
+		return download.NewGitHubDownload(fileURL, cfg.GitHubToken), nil
+	}
+	if blobutil.HasSASSignature(fileURL) {
+		ctx.Log("event", "URL has a shared access signature, downloading as is")
+		return download.NewURLDownload(fileURL), nil
+	}
+	if u, err := url.Parse(fileURL); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		if u.User != nil {
+			password, _ := u.User.Password()
+			ctx.Log("event", "using credentials in URL for download", "username", u.User.Username()) // never log the password
+			return download.NewBasicAuthDownload(fileURL, u.User.Username(), password), nil
+		}
+		if _, err := blobutil.ParseBlobURL(fileURL); err != nil && cfg.HTTPUsername != "" {
+			ctx.Log("event", "using HTTP basic authentication for download", "username", cfg.HTTPUsername) // never log the password
+			return download.NewBasicAuthDownload(fileURL, cfg.HTTPUsername, cfg.HTTPPassword), nil
+		}
+	}
+	if c := cfg.fileCredential(fileURL); c != nil {
+		blob, err := blobutil.ParseBlobURL(fileURL)
+		if err != nil {
+			return nil, err
+		}
+		ctx.Log("event", "using per-file storage account credentials for download", "storageAccountName", c.StorageAccountName)
+		return download.NewBlobDownload(c.StorageAccountName, c.StorageAccountKey, blob), nil
+	}
+	if cfg.SASToken != "" {
+		if _, err := blobutil.ParseBlobURL(fileURL); err == nil {
+			ctx.Log("event", "using SAS token for download") // never log the token
+			return download.NewURLDownload(blobutil.AppendSASToken(fileURL, cfg.SASToken)), nil
+		}
+	}
+
+	storageAccountName, storageAccountKey := cfg.StorageAccountName, cfg.StorageAccountKey
+	hasKey := storageAccountName != "" && storageAccountKey != ""
+	if cfg.ManagedIdentity != nil {
+		if hasKey {
+			ctx.Log("warning", "both storage account key and managed identity are specified, using the storage account key")
+		} else {
+			return getManagedIdentityDownloader(ctx, fileURL, *cfg.ManagedIdentity)
+		}
+	}
+	if !hasKey {
 		return download.NewURLDownload(fileURL), nil
 	}
 
@@ -55,6 +320,176 @@ func getDownloader(fileURL string, storageAccountName, storageAccountKey string)
 		blob), nil
 }
 
+// getManagedIdentityDownloader acquires a token for the managed identity, or
+// reuses the one acquired earlier in the enable attempt, and returns a
+// downloader that authenticates to the blob at fileURL with it.
+func getManagedIdentityDownloader(ctx *log.Context, fileURL string, id managedIdentity) (download.Downloader, error) {
+	if _, err := blobutil.ParseBlobURL(fileURL); err != nil {
+		return nil, errors.Wrap(err, "managed identity can only be used with Azure Blob URLs")
+	}
+	token, err := managedIdentityTokens.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return download.NewBearerTokenBlobDownload(fileURL, token), nil
+}
+
+// getManagedIdentityToken is the function used to acquire managed identity
+// tokens, it is a variable to be replaced in tests.
+var getManagedIdentityToken = download.GetManagedIdentityToken
+
+// managedIdentityTokens holds the managed identity tokens acquired in the
+// current enable attempt, so that the files and their signatures do not each
+// request one. It is reset as each attempt starts.
+var managedIdentityTokens = new(tokenCache)
+
+// tokenCache holds the managed identity tokens, or the failures to acquire
+// them, by identity. It is safe for concurrent use.
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[managedIdentity]tokenResult
+}
+
+type tokenResult struct {
+	token string
+	err   error
+}
+
+// get returns the token of the identity, acquiring it if it is not acquired
+// yet. The failures are categorized as errManagedIdentityFailed.
+func (c *tokenCache) get(ctx *log.Context, id managedIdentity) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.tokens[id]; ok {
+		return r.token, r.err
+	}
+	ctx.Log("event", "acquiring managed identity token")
+	token, err := getManagedIdentityToken(download.ManagedIdentity{
+		ClientID: id.ClientID,
+		ObjectID: id.ObjectID})
+	if err != nil {
+		err = categorize(errManagedIdentityFailed, errors.Wrap(err, "failed to acquire managed identity token"))
+	} else {
+		ctx.Log("event", "acquired managed identity token")
+	}
+	if c.tokens == nil {
+		c.tokens = make(map[managedIdentity]tokenResult)
+	}
+	c.tokens[id] = tokenResult{token, err}
+	return token, err
+}
+
+// reset discards the tokens, so that they are acquired again.
+func (c *tokenCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens = nil
+}
+
+// applyFileMappings moves the files in dir as described in mappings, in order.
+// If To of a mapping ends with "/", is an existing directory or more than one
+// file matches From, the matching files are moved into the directory To,
+// otherwise the matching file is renamed to To. The parent directories of the
+// destination are created. It fails if no file matches a mapping. The mappings
+// are assumed to be validated, and the files of the extension (see
+// isHandlerFile) are never moved.
+func applyFileMappings(ctx *log.Context, dir string, mappings []fileMapping) error {
+	for i, m := range mappings {
+		matches, err := filepath.Glob(filepath.Join(dir, m.From))
+		if err != nil {
+			return errors.Wrapf(err, "fileMappings[%d]: invalid pattern %q", i, m.From)
+		}
+		var files []string
+		for _, f := range matches {
+			if rel, _ := filepath.Rel(dir, f); isHandlerFile(rel) {
+				continue
+			}
+			files = append(files, f)
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("fileMappings[%d]: no files match %q", i, m.From)
+		}
+
+		to := filepath.Join(dir, m.To)
+		intoDir := strings.HasSuffix(m.To, "/") || len(files) > 1
+		if fi, err := os.Stat(to); err == nil && fi.IsDir() {
+			intoDir = true
+		}
+		parent := filepath.Dir(to)
+		if intoDir {
+			parent = to
+		}
+		if err := os.MkdirAll(parent, 0700); err != nil {
+			return errors.Wrapf(err, "fileMappings[%d]: failed to create directory %q", i, m.To)
+		}
+		for _, f := range files {
+			dst := to
+			if intoDir {
+				dst = filepath.Join(to, filepath.Base(f))
+			}
+			from, _ := filepath.Rel(dir, f)
+			rel, _ := filepath.Rel(dir, dst)
+			if err := os.Rename(f, dst); err != nil {
+				return errors.Wrapf(err, "fileMappings[%d]: failed to move %q to %q", i, from, rel)
+			}
+			ctx.Log("event", "moved file", "from", from, "to", rel)
+		}
+	}
+	return nil
+}
+
+// isHandlerFile returns whether the file at the path name relative to the
+// download directory is one the extension writes there: the download
+// manifest, the output of the commands, the reboot request of the command, or
+// the script or the secrets file passed to it.
+func isHandlerFile(name string) bool {
+	stdout, stderr := logPaths("")
+	testOut, testErr := testLogPaths("")
+	failOut, failErr := onFailureLogPaths("")
+	switch name {
+	case manifestFile, rebootRequiredFile, stdout, stderr, testOut, testErr, failOut, failErr:
+		return true
+	}
+	for _, prefix := range []string{stdout + ".", stderr + ".", scriptFilePrefix, secretsFilePrefix} {
+		if strings.HasPrefix(name, prefix) && isDigits(name[len(prefix):]) {
+			return true // commandLogPaths, or created with ioutil.TempFile
+		}
+	}
+	return false
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// checkExtracted returns an error if the files extracted from the archive
+// with the given name are not the ones expected in c, such as when a
+// truncated archive could still be extracted.
+func checkExtracted(name string, s archive.Stats, c archiveCheck) error {
+	if c.FileCount != nil && s.Files != *c.FileCount {
+		return fmt.Errorf("extracted %d file(s) from '%s', expected %d ('expectedFileCount'), the archive may be corrupted", s.Files, name, *c.FileCount)
+	}
+	if c.Size != nil && s.Bytes != *c.Size {
+		return fmt.Errorf("extracted %d bytes from '%s', expected %d ('expectedExtractedSize'), the archive may be corrupted", s.Bytes, name, *c.Size)
+	}
+	return nil
+}
+
+// limits returns the limits an archive is extracted with: the expected
+// total size of its files, if specified, is the most worth extracting.
+func (c archiveCheck) limits() archive.Limits {
+	l := archive.Limits{Entries: maxExtractedEntries, Bytes: maxExtractedBytes}
+	if c.Size != nil && *c.Size > 0 && *c.Size < l.Bytes {
+		l.Bytes = *c.Size
+	}
+	return l
+}
+
 // urlToFileName parses given URL and returns the section after the last slash
 // character of the path segment to be used as a file name. If a value is not
 // found, an error is returned.
@@ -74,24 +509,64 @@ func urlToFileName(fileURL string) (string, error) {
 	return "", fmt.Errorf("cannot extract file name from URL: %q", fileURL)
 }
 
+// verifySHA256 computes the SHA-256 checksum of the file at path and returns
+// an error if it does not match the expected hex-encoded digest.
+func verifySHA256(ctx *log.Context, path, expected string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file for checksum verification")
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return errors.Wrap(err, "failed to compute file checksum")
+	}
+	computed := hex.EncodeToString(h.Sum(nil))
+	ctx.Log("event", "verifying checksum", "expected", expected, "computed", computed)
+	if !strings.EqualFold(computed, expected) {
+		return fmt.Errorf("sha256 checksum mismatch for '%s': expected=%s computed=%s", filepath.Base(path), expected, computed)
+	}
+	return nil
+}
+
+// keptFileValid returns whether the file at path, kept from a previous
+// download, has the expected checksum, if any. If not, such as when it was
+// modified on disk or post-processed, it has to be downloaded again.
+func keptFileValid(ctx *log.Context, path, sha256 string) bool {
+	if sha256 == "" {
+		return true
+	}
+	if err := verifySHA256(ctx, path, sha256); err != nil {
+		ctx.Log("event", "kept file does not match its checksum, downloading file again", "error", err)
+		return false
+	}
+	return true
+}
+
 // postProcessFile determines if path is a script file based on heuristics
 // and makes in-place changes to the file with some post-processing such as BOM
-// and DOS-line endings fixes to make the script POSIX-friendly.
-func postProcessFile(path string) error {
+// and DOS-line endings fixes to make the script POSIX-friendly. The file is
+// not rewritten if it does not need fixes. Returns true if the file is
+// modified.
+func postProcessFile(path string) (bool, error) {
 	ok, err := preprocess.IsTextFile(path)
 	if err != nil {
-		return errors.Wrapf(err, "error determining if script file")
+		return false, errors.Wrapf(err, "error determining if script file")
 	}
 	if !ok {
-		return nil
+		return false, nil
 	}
 
-	b, err := ioutil.ReadFile(path) // read the file into memory for processing
+	orig, err := ioutil.ReadFile(path) // read the file into memory for processing
 	if err != nil {
-		return errors.Wrapf(err, "error reading file")
+		return false, errors.Wrapf(err, "error reading file")
 	}
-	b = preprocess.RemoveBOM(b)
+	b := preprocess.RemoveBOM(orig)
 	b = preprocess.Dos2Unix(b)
+	if bytes.Equal(b, orig) {
+		return false, nil
+	}
 	err = ioutil.WriteFile(path, b, 0) // mode is ignored
-	return errors.Wrapf(err, "failed to write to file")
+	return true, errors.Wrapf(err, "failed to write to file")
 }
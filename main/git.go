@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultGitUsername is the username sent with the gitToken unless
+	// specified otherwise, accepted by the servers which only check the token.
+	defaultGitUsername = "git"
+
+	// maxGitOutputBytes is the size of the tail of the git output included in
+	// the errors.
+	maxGitOutputBytes = 1024
+)
+
+var errGitNotInstalled = errors.New("git is not installed, it is required to check out 'gitRepository'")
+
+// gitCommand runs the git commands to check out a repository.
+type gitCommand struct {
+	path string   // of the git executable
+	env  []string // in "key=value" format
+}
+
+// run runs git with args in dir and returns its trimmed output. The tail of
+// the output, with the URL passwords redacted, is included in the error.
+func (g gitCommand) run(opCtx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(opCtx, g.path, args...)
+	cmd.Dir, cmd.Env = dir, g.env
+	b, err := cmd.CombinedOutput()
+	out := strings.TrimSpace(string(b))
+	if err != nil {
+		if len(out) > maxGitOutputBytes {
+			out = out[len(out)-maxGitOutputBytes:]
+		}
+		return "", errors.Wrapf(err, "git %s failed: %s", args[0], redactURLSecrets(out))
+	}
+	return out, nil
+}
+
+// checkoutRepository checks out the commit of the git repository specified in
+// cfg, if any, into dir so that its files can be used by the command: the
+// specified commit or otherwise the tip of the specified (or the default)
+// branch. Only the commit that is checked out is fetched if possible. The git
+// commands are canceled when opCtx is done.
+func checkoutRepository(ctx *log.Context, opCtx context.Context, dir string, cfg handlerSettings) error {
+	r := cfg.GitRepository
+	if r == nil {
+		return nil
+	}
+	path, err := exec.LookPath("git")
+	if err != nil {
+		return errGitNotInstalled
+	}
+	env, cleanup, err := gitEnv(cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	g := gitCommand{path, env}
+
+	ref := r.Branch
+	if ref == "" {
+		ref = "HEAD"
+	}
+	ctx.Log("event", "checking out git repository", "url", redactURLSecrets(r.URL), "branch", ref, "commit", r.Commit)
+	if _, err := g.run(opCtx, dir, "init", "-q", "."); err != nil {
+		return err
+	}
+	rev := "FETCH_HEAD"
+	if r.Commit != "" {
+		// not all servers allow fetching a commit by its hash, nor by an
+		// abbreviated one, fall back to fetching the branch with its history
+		rev = strings.ToLower(r.Commit)
+		if _, err := g.run(opCtx, dir, "fetch", "-q", "--depth", "1", r.URL, r.Commit); err != nil {
+			ctx.Log("event", "failed to fetch commit, fetching branch", "error", err)
+			if _, err := g.run(opCtx, dir, "fetch", "-q", r.URL, ref); err != nil {
+				return err
+			}
+		}
+	} else if _, err := g.run(opCtx, dir, "fetch", "-q", "--depth", "1", r.URL, ref); err != nil {
+		return err
+	}
+	if _, err := g.run(opCtx, dir, "checkout", "-q", "--force", "--detach", rev); err != nil {
+		return err
+	}
+	head, err := g.run(opCtx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	if r.Commit != "" && !strings.HasPrefix(head, strings.ToLower(r.Commit)) {
+		return fmt.Errorf("checked out commit %s instead of %s", head, r.Commit)
+	}
+	ctx.Log("event", "checked out git repository", "commit", head)
+	return nil
+}
+
+// gitAskPass is the script answering the credential prompts of git with the
+// username and the token in its environment.
+const gitAskPass = `#!/bin/sh
+case "$1" in
+Username*) printf '%s\n' "$CUSTOM_SCRIPT_GIT_USERNAME" ;;
+*) printf '%s\n' "$CUSTOM_SCRIPT_GIT_TOKEN" ;;
+esac
+`
+
+// gitEnv returns the environment of the git commands, which never prompt for
+// credentials on the terminal, authenticate with the gitToken in cfg over HTTP
+// and honor the proxy and insecureSkipVerify in cfg. The credentials are
+// passed in the environment so that they are not visible in the process list
+// nor saved to disk. The returned function removes the files it creates.
+func gitEnv(cfg handlerSettings) (env []string, cleanup func(), _ error) {
+	cleanup = func() {}
+	extra := map[string]string{"GIT_TERMINAL_PROMPT": "0"}
+	if token := cfg.protectedSettings.GitToken; token != "" {
+		user := cfg.protectedSettings.GitUsername
+		if user == "" {
+			user = defaultGitUsername
+		}
+		f, err := ioutil.TempFile("", "git-askpass")
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to create git askpass script")
+		}
+		cleanup = func() { os.Remove(f.Name()) }
+		_, err = f.WriteString(gitAskPass)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Chmod(f.Name(), 0700)
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, errors.Wrap(err, "failed to write git askpass script")
+		}
+		extra["GIT_ASKPASS"] = f.Name()
+		extra["CUSTOM_SCRIPT_GIT_USERNAME"] = user
+		extra["CUSTOM_SCRIPT_GIT_TOKEN"] = token
+	}
+	if cfg.InsecureSkipVerify {
+		extra["GIT_SSL_NO_VERIFY"] = "true"
+	}
+	u, err := cfg.proxyURL()
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if u != nil {
+		extra["http_proxy"], extra["https_proxy"] = u.String(), u.String()
+	}
+	return mergeEnv(os.Environ(), extra), cleanup, nil
+}
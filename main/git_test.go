@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRepository creates a git repository in dir with a commit for each of
+// the given contents of a.sh and returns the hashes of the commits.
+func newTestRepository(t *testing.T, dir string, contents ...string) []string {
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		b, err := cmd.CombinedOutput()
+		require.Nil(t, err, "%s", b)
+		return strings.TrimSpace(string(b))
+	}
+	git("init", "-q", "-b", "main", ".")
+	var commits []string
+	for _, c := range contents {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.sh"), []byte(c), 0700))
+		git("add", "a.sh")
+		git("commit", "-q", "-m", c)
+		commits = append(commits, git("rev-parse", "HEAD"))
+	}
+	return commits
+}
+
+func Test_checkoutRepository(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	tmp, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmp)
+	repo, dir := filepath.Join(tmp, "repo"), filepath.Join(tmp, "dir")
+	require.Nil(t, os.Mkdir(repo, 0700))
+	require.Nil(t, os.Mkdir(dir, 0700))
+	commits := newTestRepository(t, repo, "echo 1", "echo 2")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "downloaded.sh"), nil, 0600))
+
+	checkout := func(r gitRepository) error {
+		return checkoutRepository(log.NewContext(log.NewNopLogger()), context.Background(), dir,
+			handlerSettings{publicSettings: publicSettings{GitRepository: &r}})
+	}
+	contents := func() string {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "a.sh"))
+		require.Nil(t, err)
+		return string(b)
+	}
+
+	require.Nil(t, checkout(gitRepository{URL: "file://" + repo}))
+	require.Equal(t, "echo 2", contents(), "tip of the default branch")
+	_, err = os.Stat(filepath.Join(dir, "downloaded.sh"))
+	require.Nil(t, err, "downloaded files are kept")
+
+	require.Nil(t, checkout(gitRepository{URL: "file://" + repo, Branch: "main", Commit: commits[0]}))
+	require.Equal(t, "echo 1", contents(), "pinned commit")
+	require.Nil(t, checkout(gitRepository{URL: "file://" + repo, Branch: "main", Commit: commits[1][:10]}))
+	require.Equal(t, "echo 2", contents(), "abbreviated commit")
+
+	err = checkout(gitRepository{URL: "file://" + repo, Branch: "missing"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "git fetch failed")
+	err = checkout(gitRepository{URL: "file://" + repo, Commit: "0123456789abcdef0123456789abcdef01234567"})
+	require.NotNil(t, err)
+}
+
+func Test_checkoutRepository_gitNotInstalled(t *testing.T) {
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	require.Nil(t, os.Setenv("PATH", ""))
+	err := checkoutRepository(log.NewContext(log.NewNopLogger()), context.Background(), "",
+		handlerSettings{publicSettings: publicSettings{GitRepository: &gitRepository{URL: "https://h/r"}}})
+	require.Equal(t, errGitNotInstalled, err)
+	require.Nil(t, checkoutRepository(log.NewContext(log.NewNopLogger()), context.Background(), "", handlerSettings{}), "not specified")
+}
+
+func Test_gitEnv(t *testing.T) {
+	env, cleanup, err := gitEnv(handlerSettings{
+		publicSettings:    publicSettings{ProxyURL: "http://proxy:3128", InsecureSkipVerify: true},
+		protectedSettings: protectedSettings{GitToken: "s3cret"},
+	})
+	require.Nil(t, err)
+	vars := map[string]string{}
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i >= 0 {
+			vars[kv[:i]] = kv[i+1:]
+		}
+	}
+	require.Equal(t, "0", vars["GIT_TERMINAL_PROMPT"])
+	require.Equal(t, "true", vars["GIT_SSL_NO_VERIFY"])
+	require.Equal(t, "http://proxy:3128", vars["https_proxy"])
+
+	askPass := func(prompt string) string {
+		cmd := exec.Command(vars["GIT_ASKPASS"], prompt)
+		cmd.Env = env
+		b, err := cmd.Output()
+		require.Nil(t, err)
+		return string(b)
+	}
+	require.Equal(t, "git\n", askPass("Username for 'https://h': "), "default username")
+	require.Equal(t, "s3cret\n", askPass("Password for 'https://git@h': "))
+
+	cleanup()
+	_, err = os.Stat(vars["GIT_ASKPASS"])
+	require.True(t, os.IsNotExist(err), "script is removed")
+
+	env, cleanup, err = gitEnv(handlerSettings{})
+	require.Nil(t, err)
+	cleanup()
+	for _, kv := range env {
+		require.False(t, strings.HasPrefix(kv, "GIT_ASKPASS="), "no credentials")
+	}
+}
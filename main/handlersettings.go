@@ -1,17 +1,156 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/archive"
+	"github.com/Azure/custom-script-extension-linux/pkg/blobutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
+const (
+	// defaultMaxConcurrentDownloads is the number of files downloaded at the
+	// same time, unless specified otherwise in the settings.
+	defaultMaxConcurrentDownloads = 4
+
+	// defaultCommandRetryInterval is how long to wait before executing a
+	// failed command again, unless specified otherwise in the settings.
+	defaultCommandRetryInterval = 10 * time.Second
+
+	// defaultEnableRetryInterval is how long to wait before running a failed
+	// enable operation again, unless specified otherwise in the settings.
+	defaultEnableRetryInterval = 30 * time.Second
+
+	// defaultMaxStatusOutputBytes is how many bytes from the end of the
+	// command's stdout and stderr are embedded into the status file, unless
+	// specified otherwise in the settings.
+	defaultMaxStatusOutputBytes = 4 * 1024
+
+	// verboseMaxStatusOutputBytes is the default of maxStatusOutputBytes when
+	// statusVerbosity is verbose.
+	verboseMaxStatusOutputBytes = 32 * 1024
+
+	// defaultProgressInterval is how often the progress of the downloads is
+	// reported in the status file, unless specified otherwise in the settings.
+	defaultProgressInterval = 10 * time.Second
+
+	// defaultHeartbeatInterval is how often the status file is updated while
+	// the command is running, unless specified otherwise in the settings.
+	defaultHeartbeatInterval = time.Minute
+
+	// defaultMaxFileURIs is the maximum number of 'fileUris', unless specified
+	// otherwise in the settings.
+	defaultMaxFileURIs = 1000
+
+	// defaultMaxCommandLength is the maximum length in bytes of a command,
+	// unless specified otherwise in the settings. The commands are passed to
+	// the shell as an argument, which is limited to 128 KiB by Linux.
+	defaultMaxCommandLength = 64 * 1024
+
+	// defaultMaxTotalDownloadBytes is the maximum total size of the downloaded
+	// files, unless specified otherwise in the settings.
+	defaultMaxTotalDownloadBytes = 10 * 1024 * 1024 * 1024
+
+	// defaultIoniceLevel is the level within the best-effort I/O scheduling
+	// class, unless specified otherwise in the settings, as with ionice(1).
+	defaultIoniceLevel = 4
+
+	// defaultFileMode is the permission bits of the downloaded files unless
+	// specified otherwise, as we assume users download scripts to execute.
+	defaultFileMode os.FileMode = 0500
+
+	// maxExtractedEntries and maxExtractedBytes are the limits in number of
+	// entries and total size of the files an archive is extracted with,
+	// against archives expanding to far more than their size.
+	maxExtractedEntries = 100000
+	maxExtractedBytes   = 10 * 1024 * 1024 * 1024
+)
+
 var (
+	// envVarNameRe matches the valid environment variable names.
+	envVarNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// variableRefRe matches the ${NAME} references to the environment
+	// variables expanded in the command, and the escaped "$${" sequences.
+	variableRefRe = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+	// headerNameRe matches the valid HTTP header names.
+	headerNameRe = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+	// reservedHeaders are the headers managed by the downloads, which cannot
+	// be specified in 'downloadHeaders', in canonical form.
+	reservedHeaders = []string{"Host", "Content-Length", "Transfer-Encoding", "Connection", "Range", "If-Range", "Accept-Encoding"}
+
+	// fileModeRe matches the octal permission bits of a file.
+	fileModeRe = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+	// scpLikeGitURLRe matches the scp-like syntax of the git SSH URLs, such as
+	// "git@github.com:org/repo.git".
+	scpLikeGitURLRe = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^/]`)
+
+	// gitCommitRe matches the (possibly abbreviated) hash of a git commit.
+	gitCommitRe = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+
 	errStoragePartialCredentials = errors.New("both 'storageAccountName' and 'storageAccountKey' must be specified")
 	errCmdTooMany                = errors.New("'commandToExecute' was specified both in public and protected settings; it must be specified only once")
-	errCmdMissing                = errors.New("'commandToExecute' is not specified")
+	errCmdMissing                = errors.New("'commandToExecute' is not specified or empty in both public and protected settings, and none of 'commands', 'parallelCommands', 'script', 'scriptFile' or 'commandToExecuteFromKeyVault' is specified")
+	errCommandsTooMany           = errors.New("'commands' was specified both in public and protected settings; it must be specified only once")
+	errCmdAndCommands            = errors.New("only one of 'commandToExecute' and 'commands' can be specified")
+	errParallelCommandsTooMany   = errors.New("'parallelCommands' was specified both in public and protected settings; it must be specified only once")
+	errParallelCommandsConflict  = errors.New("'parallelCommands' cannot be specified with 'commandToExecute', 'commands', 'script', 'scriptFile', 'commandToExecuteFromKeyVault' or 'runInBackground'")
+	errParallelOptionsNoCommands = errors.New("'maxParallelCommands' and 'parallelCommandTimeoutSeconds' can only be specified with 'parallelCommands'")
+	errSkipExecutionAndCleanup   = errors.New("'skipExecution' cannot be specified with 'cleanupAfterRun', which would remove the downloaded files")
+	errRunInBackgroundConflict   = errors.New("'runInBackground' cannot be specified with 'commands', 'script', 'timeoutSeconds', 'commandRetryCount', 'cleanupAfterRun' or 'skipExecution'")
+	errScriptFileAndCommands     = errors.New("only one of 'scriptFile' and 'commands' can be specified")
+	errScriptFileMetadata        = errors.New("'scriptFile' cannot contain the metadata tokens of 'substituteMetadata', it is the name of a downloaded file")
+	errScriptAndCmd              = errors.New("'script' cannot be specified with 'commandToExecute', 'commands' or 'scriptFile'")
+	errKeyVaultAndCmd            = errors.New("'commandToExecuteFromKeyVault' cannot be specified with 'commandToExecute', 'commands', 'script' or 'scriptFile'")
+	errFileHashesTooMany         = errors.New("'fileHashes' has more items than 'fileUris'")
+	errContentTypesTooMany       = errors.New("'expectedContentTypes' has more items than 'fileUris'")
+	errFileNamesTooMany          = errors.New("'fileNames' has more items than 'fileUris'")
+	errFileMirrorsTooMany        = errors.New("mirror URLs are specified for more files than 'fileUris'")
+	errArchiveChecksTooMany      = errors.New("archive checks are specified for more files than 'fileUris'")
+	errOSMatchesTooMany          = errors.New("'osMatch' is specified for more files than 'fileUris'")
+	errSignatureURLsTooMany      = errors.New("'signatureUrls' has more items than 'fileUris'")
+	errSignatureURLsNoKey        = errors.New("'signatureUrls' can only be specified with 'gpgPublicKey'")
+	errGPGPublicKeyNoSignatures  = errors.New("'gpgPublicKey' can only be specified with 'signatureUrls' or 'manifestUri'")
+	errManifestURINoKey          = errors.New("'manifestUri' can only be specified with 'gpgPublicKey' to verify its signature")
+	errManifestSigNoManifest     = errors.New("'manifestSignatureUri' can only be specified with 'manifestUri'")
+	errChrootDirNotAbsolute      = errors.New("'chrootDir' must be an absolute path other than /")
+	errChrootDirConflict         = errors.New("'chrootDir' cannot be specified with 'useSystemdScope', 'runInBackground' or 'runAsUser', whose user would be looked up outside of it")
+	errFileModesTooMany          = errors.New("'fileModes' has more items than 'fileUris'")
+	errWorkingDirNotAbsolute     = errors.New("'workingDirectory' must be an absolute path")
+	errDestinationDirsTooMany    = errors.New("'destinationDirs' has more items than 'fileUris'")
+	errMinDownloadsNoContinue    = errors.New("'minSuccessfulDownloads' can only be specified with 'continueOnDownloadError'")
+	errMinDownloadsTooMany       = errors.New("'minSuccessfulDownloads' is greater than the number of 'fileUris'")
+	errManagedIdentityAmbiguous  = errors.New("only one of 'clientId' and 'objectId' can be specified in 'managedIdentity'")
+	errFileScheme                = errors.New("file:// URLs are not allowed unless 'allowFileUris' is set to true")
+	errProxyCredentialsNoURL     = errors.New("'proxyUsername' and 'proxyPassword' can only be specified with 'proxyUrl'")
+	errExpandStrictNoExpand      = errors.New("'expandVariablesStrict' can only be specified with 'expandVariables'")
+	errProxyPasswordNoUsername   = errors.New("'proxyPassword' is specified without 'proxyUsername'")
+	errHTTPPasswordNoUsername    = errors.New("'httpPassword' is specified without 'httpUsername'")
+	errOutputBlobURINotBlob      = errors.New("'outputBlobUri' must be the URL of an Azure Blob Storage container or virtual directory")
+	errBlobPrefixNoContainer     = errors.New("'blobPrefix' and 'allowEmptyBlobList' can only be specified with 'blobContainerUri'")
+	errGitCredentialsNoRepo      = errors.New("'gitUsername' and 'gitToken' can only be specified with 'gitRepository'")
+	errGitUsernameNoToken        = errors.New("'gitUsername' is specified without 'gitToken'")
+	errIoniceLevelNoBestEffort   = errors.New("'ioniceLevel' can only be specified with 'ioniceClass' set to \"best-effort\"")
+	errRebootAndBackground       = errors.New("'rebootExitCode' and 'allowReboot' cannot be specified with 'runInBackground'")
+	errSecretsFileAndBackground  = errors.New("'secretsDeliveryMode' \"file\" cannot be specified with 'runInBackground', the file is removed once the command is started")
+	errRunOnceAndBackground      = errors.New("'runOnce' cannot be specified with 'runInBackground', the command is not known to complete")
+	errRunOnceResetTagNoRunOnce  = errors.New("'runOnceResetTag' can only be specified with 'runOnce'")
 )
 
 // handlerSettings holds the configuration of the extension handler.
@@ -20,47 +159,1552 @@ type handlerSettings struct {
 	protectedSettings
 }
 
+// settingChecks collects the problems found by the logical validation of the
+// settings, each with the JSON pointer of the setting causing it, such as
+// "/publicSettings/fileUris/1", or none if no single setting does.
+type settingChecks struct {
+	errs     []error
+	problems settingErrors
+}
+
+// add records err, if not nil, as a problem with the setting at pointer.
+func (c *settingChecks) add(pointer string, err error) {
+	if err == nil {
+		return
+	}
+	c.errs = append(c.errs, err)
+	c.problems = append(c.problems, settingError{Pointer: pointer, Message: err.Error()})
+}
+
+// err returns the first problem found, if any.
+func (c *settingChecks) err() error {
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return c.errs[0]
+}
+
+// publicSetting and protectedSetting return the JSON pointers of the public
+// and the protected setting with the name, followed by the path in it (such
+// as the index of an item), reported with the problems found with it.
+func publicSetting(name string, path ...interface{}) string {
+	return settingPointer("/publicSettings/"+name, path)
+}
+
+func protectedSetting(name string, path ...interface{}) string {
+	return settingPointer("/protectedSettings/"+name, path)
+}
+
+func settingPointer(p string, path []interface{}) string {
+	for _, v := range path {
+		p += "/" + fmt.Sprint(v)
+	}
+	return p
+}
+
+// eitherSetting returns the pointer of the setting with the name in the
+// protected settings if it is specified there, in the public settings
+// otherwise, for the settings that can be specified in either.
+func eitherSetting(inProtected bool, name string, path ...interface{}) string {
+	if inProtected {
+		return protectedSetting(name, path...)
+	}
+	return publicSetting(name, path...)
+}
+
 // validate makes logical valiation on the handlerSettings which already passed
-// the schema validation.
+// the schema validation, and returns the first problem found (see check for
+// all of them).
 func (h handlerSettings) validate() error {
-	if h.publicSettings.CommandToExecute == "" && h.protectedSettings.CommandToExecute == "" {
-		return errCmdMissing
+	var c settingChecks
+	h.check(&c)
+	return c.err()
+}
+
+// check makes the logical validation of validate and adds all the problems
+// found to c.
+func (h handlerSettings) check(c *settingChecks) {
+	pubCmd, protCmd := strings.TrimSpace(h.publicSettings.CommandToExecute), strings.TrimSpace(h.protectedSettings.CommandToExecute)
+	hasCmd := pubCmd != "" || protCmd != ""
+	hasCommands := len(h.publicSettings.Commands) > 0 || len(h.protectedSettings.Commands) > 0
+	hasParallel := len(h.publicSettings.ParallelCommands) > 0 || len(h.protectedSettings.ParallelCommands) > 0
+	hasScript := h.protectedSettings.Script != ""
+	hasKeyVault := h.protectedSettings.CommandToExecuteFromKeyVault != ""
+	protCommands, protParallel := len(h.protectedSettings.Commands) > 0, len(h.protectedSettings.ParallelCommands) > 0
+	if !hasCmd && !hasCommands && !hasParallel && !hasScript && !hasKeyVault && h.publicSettings.ScriptFile == "" && !h.publicSettings.SkipExecution {
+		c.add("", errCmdMissing)
+	}
+	if hasParallel {
+		if len(h.publicSettings.ParallelCommands) > 0 && len(h.protectedSettings.ParallelCommands) > 0 {
+			c.add(protectedSetting("parallelCommands"), errParallelCommandsTooMany)
+		}
+		if hasCmd || hasCommands || hasScript || hasKeyVault || h.publicSettings.ScriptFile != "" || h.publicSettings.RunInBackground {
+			c.add(eitherSetting(protParallel, "parallelCommands"), errParallelCommandsConflict)
+		}
+		for i, cmd := range h.parallelCommands() {
+			if strings.TrimSpace(cmd) == "" {
+				c.add(eitherSetting(protParallel, "parallelCommands", i), fmt.Errorf("empty command in 'parallelCommands' at index %d", i))
+			}
+		}
+	} else if h.publicSettings.MaxParallelCommands > 0 {
+		c.add(publicSetting("maxParallelCommands"), errParallelOptionsNoCommands)
+	} else if h.publicSettings.ParallelCmdTimeoutSeconds > 0 {
+		c.add(publicSetting("parallelCommandTimeoutSeconds"), errParallelOptionsNoCommands)
+	}
+	if h.publicSettings.SkipExecution && h.publicSettings.CleanupAfterRun {
+		c.add(publicSetting("cleanupAfterRun"), errSkipExecutionAndCleanup)
+	}
+	if h.publicSettings.RunInBackground {
+		if h.publicSettings.RebootExitCode > 0 {
+			c.add(publicSetting("rebootExitCode"), errRebootAndBackground)
+		} else if h.publicSettings.AllowReboot {
+			c.add(publicSetting("allowReboot"), errRebootAndBackground)
+		}
+		if h.secretsInFile() {
+			c.add(publicSetting("secretsDeliveryMode"), errSecretsFileAndBackground)
+		}
+		if h.publicSettings.RunOnce {
+			c.add(publicSetting("runOnce"), errRunOnceAndBackground)
+		}
+		if hasCommands || hasScript || h.publicSettings.TimeoutSeconds > 0 || h.publicSettings.CommandRetryCount > 0 ||
+			h.publicSettings.CleanupAfterRun || h.publicSettings.SkipExecution {
+			c.add(publicSetting("runInBackground"), errRunInBackgroundConflict)
+		}
+	}
+	if h.publicSettings.RunOnceResetTag != "" && !h.publicSettings.RunOnce {
+		c.add(publicSetting("runOnceResetTag"), errRunOnceResetTagNoRunOnce)
+	}
+	if hasKeyVault {
+		if hasCmd || hasCommands || hasScript || h.publicSettings.ScriptFile != "" {
+			c.add(protectedSetting("commandToExecuteFromKeyVault"), errKeyVaultAndCmd)
+		}
+		if _, err := download.ParseKeyVaultSecretURI(h.protectedSettings.CommandToExecuteFromKeyVault); err != nil {
+			c.add(protectedSetting("commandToExecuteFromKeyVault"), errors.Wrap(err, "invalid 'commandToExecuteFromKeyVault'"))
+		}
+	}
+	if hasScript {
+		if hasCmd || hasCommands || h.publicSettings.ScriptFile != "" {
+			c.add(protectedSetting("script"), errScriptAndCmd)
+		}
+		if _, err := h.script(); err != nil {
+			c.add(protectedSetting("script"), err)
+		}
+	}
+	if pubCmd != "" && protCmd != "" {
+		c.add(protectedSetting("commandToExecute"), errCmdTooMany)
+	}
+	if len(h.publicSettings.Commands) > 0 && len(h.protectedSettings.Commands) > 0 {
+		c.add(protectedSetting("commands"), errCommandsTooMany)
 	}
-	if h.publicSettings.CommandToExecute != "" && h.protectedSettings.CommandToExecute != "" {
-		return errCmdTooMany
+	if hasCmd && hasCommands {
+		c.add(eitherSetting(protCommands, "commands"), errCmdAndCommands)
 	}
+	for i, cmd := range h.commands() {
+		if strings.TrimSpace(cmd) == "" {
+			c.add(eitherSetting(protCommands, "commands", i), fmt.Errorf("empty command in 'commands' at index %d", i))
+		}
+	}
+	h.validateLimits(c)
+
+	if name, key := h.protectedSettings.StorageAccountName, h.protectedSettings.StorageAccountKey; name != "" && key == "" {
+		c.add(protectedSetting("storageAccountName"), errStoragePartialCredentials)
+	} else if name == "" && key != "" {
+		c.add(protectedSetting("storageAccountKey"), errStoragePartialCredentials)
+	}
+
+	h.validateFileCredentials(c)
+	h.validateDownloadHeaders(c)
+	if n := h.publicSettings.MinSuccessfulDownloads; n > 0 {
+		if !h.publicSettings.ContinueOnDownloadError {
+			c.add(publicSetting("minSuccessfulDownloads"), errMinDownloadsNoContinue)
+		}
+		if n > len(h.publicSettings.FileURLs) && !h.listsMoreFiles() {
+			c.add(publicSetting("minSuccessfulDownloads"), errMinDownloadsTooMany)
+		}
+	}
+
+	if id := h.protectedSettings.ManagedIdentity; id != nil && id.ClientID != "" && id.ObjectID != "" {
+		c.add(protectedSetting("managedIdentity"), errManagedIdentityAmbiguous)
+	}
+
+	for _, env := range []struct {
+		pointer string
+		vars    map[string]string
+	}{
+		{publicSetting("environmentVariables"), h.publicSettings.EnvironmentVariables},
+		{protectedSetting("environmentVariables"), h.protectedSettings.EnvironmentVariables}} {
+		for k := range env.vars {
+			if !envVarNameRe.MatchString(k) {
+				c.add(env.pointer, fmt.Errorf("invalid environment variable name in 'environmentVariables': %q", k))
+			}
+		}
+	}
+
+	if h.publicSettings.ExpandVariablesStrict && !h.publicSettings.ExpandVariables {
+		c.add(publicSetting("expandVariablesStrict"), errExpandStrictNoExpand)
+	}
+	if _, err := h.expandCommand(h.commandToExecute()); err != nil {
+		c.add(eitherSetting(protCmd != "", "commandToExecute"), err)
+	}
+
+	for i, u := range h.publicSettings.FileURLs {
+		if err := validateFileURL(u, h.publicSettings.AllowFileUris); err != nil {
+			c.add(publicSetting("fileUris", i), errors.Wrapf(err, "invalid URL in 'fileUris' at index %d", i))
+		}
+	}
+	if len(h.publicSettings.FileMirrorURLs) > len(h.publicSettings.FileURLs) {
+		c.add(publicSetting("fileUris"), errFileMirrorsTooMany)
+	}
+	for i, urls := range h.publicSettings.FileMirrorURLs {
+		for j, u := range urls {
+			if err := validateFileURL(u, h.publicSettings.AllowFileUris); err != nil {
+				c.add(publicSetting("fileUris", i, "urls", j+1), errors.Wrapf(err, "invalid mirror URL %d in 'fileUris' at index %d", j+1, i))
+			}
+		}
+	}
+
+	h.validateArchiveChecks(c)
+	if len(h.publicSettings.FileOSMatches) > len(h.publicSettings.FileURLs) {
+		c.add(publicSetting("fileUris"), errOSMatchesTooMany)
+	}
+	for i, ms := range h.publicSettings.FileOSMatches {
+		for j, m := range ms {
+			if err := m.validate(); err != nil {
+				c.add(publicSetting("fileUris", i, "osMatch", j), errors.Wrapf(err, "invalid predicate %d of 'osMatch' in 'fileUris' at index %d", j, i))
+			}
+		}
+	}
+
+	if len(h.publicSettings.FileHashes) > len(h.publicSettings.FileURLs) {
+		c.add(publicSetting("fileHashes"), errFileHashesTooMany)
+	}
+	if len(h.publicSettings.ExpectedContentTypes) > len(h.publicSettings.FileURLs) {
+		c.add(publicSetting("expectedContentTypes"), errContentTypesTooMany)
+	}
+	h.validateSignatures(c)
+	h.validateFileNames(c)
+	if h.publicSettings.IoniceLevel != nil && h.publicSettings.IoniceClass != "best-effort" {
+		c.add(publicSetting("ioniceLevel"), errIoniceLevelNoBestEffort)
+	}
+	if m := h.publicSettings.Umask; m != "" {
+		if _, err := parseUmask(m); err != nil {
+			c.add(publicSetting("umask"), errors.Wrap(err, "invalid 'umask'"))
+		}
+	}
+	h.validateFileModes(c)
+	h.validateScriptFile(c)
+	h.validateDestinationDirs(c)
+	for i, m := range h.publicSettings.FileMappings {
+		if err := m.validate(); err != nil {
+			c.add(publicSetting("fileMappings", i), errors.Wrapf(err, "invalid mapping in 'fileMappings' at index %d", i))
+		}
+	}
+
+	if d := h.publicSettings.WorkingDirectory; d != "" && !filepath.IsAbs(d) {
+		c.add(publicSetting("workingDirectory"), errWorkingDirNotAbsolute)
+	}
+	if d := h.publicSettings.ChrootDir; d != "" {
+		if !filepath.IsAbs(d) || filepath.Clean(d) == "/" {
+			c.add(publicSetting("chrootDir"), errChrootDirNotAbsolute)
+		}
+		if h.publicSettings.UseSystemdScope || h.publicSettings.RunInBackground || h.publicSettings.RunAsUser != "" {
+			c.add(publicSetting("chrootDir"), errChrootDirConflict)
+		}
+	}
+
+	if s := h.publicSettings.CACertPEM; s != "" {
+		if _, err := download.ParseCACertificates(s); err != nil {
+			c.add(publicSetting("caCertPem"), errors.Wrap(err, "invalid 'caCertPem'"))
+		}
+	}
+
+	if s := h.publicSettings.DNSServer; s != "" {
+		if _, err := download.ParseResolverAddress(s); err != nil {
+			c.add(publicSetting("dnsServer"), errors.Wrap(err, "invalid 'dnsServer'"))
+		}
+	}
+
+	if h.publicSettings.ProxyURL == "" {
+		if h.protectedSettings.ProxyUsername != "" {
+			c.add(protectedSetting("proxyUsername"), errProxyCredentialsNoURL)
+		} else if h.protectedSettings.ProxyPassword != "" {
+			c.add(protectedSetting("proxyPassword"), errProxyCredentialsNoURL)
+		}
+	} else if _, err := parseProxyURL(h.publicSettings.ProxyURL); err != nil {
+		c.add(publicSetting("proxyUrl"), err)
+	}
+	if h.protectedSettings.ProxyPassword != "" && h.protectedSettings.ProxyUsername == "" {
+		c.add(protectedSetting("proxyPassword"), errProxyPasswordNoUsername)
+	}
+	if h.protectedSettings.HTTPPassword != "" && h.protectedSettings.HTTPUsername == "" {
+		c.add(protectedSetting("httpPassword"), errHTTPPasswordNoUsername)
+	}
+	if u := h.publicSettings.BlobContainerURI; u != "" {
+		if _, err := parseContainerURL(u); err != nil {
+			c.add(publicSetting("blobContainerUri"), errors.Wrap(err, "invalid 'blobContainerUri'"))
+		}
+	} else if h.publicSettings.BlobPrefix != "" {
+		c.add(publicSetting("blobPrefix"), errBlobPrefixNoContainer)
+	} else if h.publicSettings.AllowEmptyBlobList {
+		c.add(publicSetting("allowEmptyBlobList"), errBlobPrefixNoContainer)
+	}
+	if u := h.publicSettings.OutputBlobURI; u != "" {
+		if _, err := blobutil.ParseBlobURL(blobURLUnder(u, "stdout")); err != nil {
+			c.add(publicSetting("outputBlobUri"), errOutputBlobURINotBlob)
+		}
+	}
+	if r := h.publicSettings.GitRepository; r == nil {
+		if h.protectedSettings.GitUsername != "" {
+			c.add(protectedSetting("gitUsername"), errGitCredentialsNoRepo)
+		} else if h.protectedSettings.GitToken != "" {
+			c.add(protectedSetting("gitToken"), errGitCredentialsNoRepo)
+		}
+	} else if err := r.validate(h.publicSettings.AllowFileUris); err != nil {
+		c.add(publicSetting("gitRepository"), errors.Wrap(err, "invalid 'gitRepository'"))
+	}
+	if h.protectedSettings.GitUsername != "" && h.protectedSettings.GitToken == "" {
+		c.add(protectedSetting("gitUsername"), errGitUsernameNoToken)
+	}
+}
 
-	if (h.protectedSettings.StorageAccountName != "") !=
-		(h.protectedSettings.StorageAccountKey != "") {
-		return errStoragePartialCredentials
+// validateScriptFile checks if scriptFile, if specified, is the name of one of
+// the files to be downloaded from fileUris, without the metadata tokens that
+// are only substituted in the commands.
+func (h handlerSettings) validateScriptFile(c *settingChecks) {
+	s := h.publicSettings.ScriptFile
+	if s == "" {
+		return
+	}
+	if len(h.publicSettings.Commands) > 0 || len(h.protectedSettings.Commands) > 0 {
+		c.add(publicSetting("scriptFile"), errScriptFileAndCommands)
 	}
+	if h.publicSettings.SubstituteMetadata && hasMetadataToken(s) {
+		c.add(publicSetting("scriptFile"), errScriptFileMetadata)
+	}
+	if h.scriptFileIndex() < 0 && !h.listsMoreFiles() { // checked after listing
+		c.add(publicSetting("scriptFile"), fmt.Errorf("'scriptFile' %q is not the name of a file downloaded from 'fileUris'", s))
+	}
+}
 
+// validateLimits checks if the number of 'fileUris' and the length of the
+// commands are within their limits, which can be raised in the settings.
+func (h handlerSettings) validateLimits(c *settingChecks) {
+	if n, max := len(h.publicSettings.FileURLs), h.maxFileURIs(); n > max {
+		c.add(publicSetting("fileUris"), fmt.Errorf("'fileUris' has %d items, more than 'maxFileUris' (%d)", n, max))
+	}
+	max := h.maxCommandLength()
+	for _, cmd := range []struct{ pointer, name, cmd string }{
+		{eitherSetting(h.protectedSettings.CommandToExecute != "", "commandToExecute"), "commandToExecute",
+			h.publicSettings.CommandToExecute + h.protectedSettings.CommandToExecute}, // only one is specified
+		{publicSetting("testCommand"), "testCommand", h.publicSettings.TestCommand},
+		{publicSetting("onFailureCommand"), "onFailureCommand", h.publicSettings.OnFailureCommand},
+	} {
+		if len(cmd.cmd) > max {
+			c.add(cmd.pointer, fmt.Errorf("'%s' is %d bytes long, longer than 'maxCommandLength' (%d)", cmd.name, len(cmd.cmd), max))
+		}
+	}
+	for i, cmd := range h.commands() {
+		if len(cmd) > max {
+			c.add(eitherSetting(len(h.protectedSettings.Commands) > 0, "commands", i),
+				fmt.Errorf("'commands' at index %d is %d bytes long, longer than 'maxCommandLength' (%d)", i, len(cmd), max))
+		}
+	}
+	for i, cmd := range h.parallelCommands() {
+		if len(cmd) > max {
+			c.add(eitherSetting(len(h.protectedSettings.ParallelCommands) > 0, "parallelCommands", i),
+				fmt.Errorf("'parallelCommands' at index %d is %d bytes long, longer than 'maxCommandLength' (%d)", i, len(cmd), max))
+		}
+	}
+}
+
+// validateFileCredentials checks if each of the per-file credentials is for a
+// distinct Azure Blob URL in fileUris, or in manifestUri once its files are
+// added to fileUris.
+func (h handlerSettings) validateFileCredentials(c *settingChecks) {
+	seen := make(map[string]bool)
+	for i, f := range h.protectedSettings.FileCredentials {
+		if seen[f.URL] {
+			c.add(protectedSetting("fileCredentials", i), fmt.Errorf("'fileCredentials' at index %d has the same URL as a previous one", i))
+			continue
+		}
+		seen[f.URL] = true
+		if !h.isFileURL(f.URL) && h.publicSettings.ManifestURI == "" { // checked after loading
+			c.add(protectedSetting("fileCredentials", i), fmt.Errorf("'fileCredentials' at index %d is not for a URL in 'fileUris'", i)) // the URL may be secret
+		} else if _, err := blobutil.ParseBlobURL(f.URL); err != nil {
+			c.add(protectedSetting("fileCredentials", i), errors.Wrapf(err, "'fileCredentials' at index %d is not for an Azure Blob URL", i))
+		}
+	}
+}
+
+// isFileURL returns whether u is the URL of one of 'fileUris' or of one of
+// their mirrors.
+func (h handlerSettings) isFileURL(u string) bool {
+	for i, f := range h.publicSettings.FileURLs {
+		if f == u {
+			return true
+		}
+		for _, m := range h.fileMirrors(i) {
+			if m == u {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateDownloadHeaders checks if the headers in 'downloadHeaders' and
+// 'fileDownloadHeaders' can be sent, and if each of 'fileDownloadHeaders' is
+// for a distinct URL in 'fileUris'. The values are never included in the
+// errors.
+func (h handlerSettings) validateDownloadHeaders(c *settingChecks) {
+	if err := validateHeaders(h.protectedSettings.DownloadHeaders); err != nil {
+		c.add(protectedSetting("downloadHeaders"), errors.Wrap(err, "invalid 'downloadHeaders'"))
+	}
+	seen := make(map[string]bool)
+	for i, f := range h.protectedSettings.FileDownloadHeaders {
+		if seen[f.URL] {
+			c.add(protectedSetting("fileDownloadHeaders", i), fmt.Errorf("'fileDownloadHeaders' at index %d has the same URL as a previous one", i))
+			continue
+		}
+		seen[f.URL] = true
+		if !h.isFileURL(f.URL) {
+			c.add(protectedSetting("fileDownloadHeaders", i), fmt.Errorf("'fileDownloadHeaders' at index %d is not for a URL in 'fileUris'", i)) // the URL may be secret
+		}
+		if err := validateHeaders(f.Headers); err != nil {
+			c.add(protectedSetting("fileDownloadHeaders", i), errors.Wrapf(err, "invalid 'fileDownloadHeaders' at index %d", i))
+		}
+	}
+}
+
+// validateHeaders checks if the given headers are valid HTTP headers which are
+// not reserved.
+func validateHeaders(headers map[string]string) error {
+	for k, v := range headers {
+		if !headerNameRe.MatchString(k) {
+			return fmt.Errorf("invalid header name: %q", k)
+		}
+		for _, r := range reservedHeaders {
+			if http.CanonicalHeaderKey(k) == r {
+				return fmt.Errorf("header %q cannot be specified", k)
+			}
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("value of header %q contains a line break", k)
+		}
+	}
 	return nil
 }
 
+// scriptFileIndex returns the index of the file in FileURLs that scriptFile is
+// the name of, or -1 if there is none.
+func (h handlerSettings) scriptFileIndex() int {
+	for i, u := range h.publicSettings.FileURLs {
+		name := h.fileName(i)
+		if name == "" {
+			var err error
+			if name, err = urlToFileName(u); err != nil {
+				continue // reported when downloading
+			}
+		}
+		if name == h.publicSettings.ScriptFile {
+			return i
+		}
+	}
+	return -1
+}
+
+// validateDestinationDirs checks if destinationDir and the directories in
+// destinationDirs are absolute paths outside of the data directory, so that
+// they are never removed along with the downloaded files.
+func (h handlerSettings) validateDestinationDirs(c *settingChecks) {
+	if len(h.publicSettings.DestinationDirs) > len(h.publicSettings.FileURLs) {
+		c.add(publicSetting("destinationDirs"), errDestinationDirsTooMany)
+	}
+	check := func(field, d string) error {
+		if !filepath.IsAbs(d) {
+			return fmt.Errorf("%s must be an absolute path: %q", field, d)
+		}
+		if rel, err := filepath.Rel(dataDir, filepath.Clean(d)); err == nil &&
+			rel != ".." && !strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("%s cannot be in the extension data directory %q: %q", field, dataDir, d)
+		}
+		return nil
+	}
+	if d := h.publicSettings.DestinationDir; d != "" {
+		c.add(publicSetting("destinationDir"), check("'destinationDir'", d))
+	}
+	for i, d := range h.publicSettings.DestinationDirs {
+		if d != "" {
+			c.add(publicSetting("destinationDirs", i), check(fmt.Sprintf("directory in 'destinationDirs' at index %d", i), d))
+		}
+	}
+}
+
+// validateFileModes checks if fileMode and the modes in fileModes are valid
+// octal permission bits.
+func (h handlerSettings) validateFileModes(c *settingChecks) {
+	if m := h.publicSettings.FileMode; m != "" {
+		if _, err := parseFileMode(m); err != nil {
+			c.add(publicSetting("fileMode"), errors.Wrap(err, "invalid 'fileMode'"))
+		}
+	}
+	if len(h.publicSettings.FileModes) > len(h.publicSettings.FileURLs) {
+		c.add(publicSetting("fileModes"), errFileModesTooMany)
+	}
+	for i, m := range h.publicSettings.FileModes {
+		if m == "" {
+			continue
+		}
+		if _, err := parseFileMode(m); err != nil {
+			c.add(publicSetting("fileModes", i), errors.Wrapf(err, "invalid mode in 'fileModes' at index %d", i))
+		}
+	}
+}
+
+// parseFileMode parses the given octal permission bits such as "755" or
+// "0755". The owner must be able to read the file, as the handler reads the
+// downloaded files to verify and post-process them.
+func parseFileMode(s string) (os.FileMode, error) {
+	if !fileModeRe.MatchString(s) {
+		return 0, fmt.Errorf("%q is not an octal file mode such as \"0755\"", s)
+	}
+	v, _ := strconv.ParseUint(s, 8, 32) // cannot fail after the regexp
+	m := os.FileMode(v)
+	if m&0400 == 0 {
+		return 0, fmt.Errorf("file mode %q does not allow the owner to read the file", s)
+	}
+	return m, nil
+}
+
+// parseUmask parses the given octal file mode creation mask such as "022" or
+// "0027".
+func parseUmask(s string) (os.FileMode, error) {
+	if !fileModeRe.MatchString(s) {
+		return 0, fmt.Errorf("%q is not an octal umask such as \"0022\"", s)
+	}
+	v, _ := strconv.ParseUint(s, 8, 32) // cannot fail after the regexp
+	return os.FileMode(v), nil
+}
+
+// validateSignatures checks if the URLs in signatureUrls, manifestUri and
+// manifestSignatureUri are valid and if gpgPublicKey contains ASCII-armored
+// public keys to verify them with.
+func (h handlerSettings) validateSignatures(c *settingChecks) {
+	if u := h.publicSettings.ManifestURI; u != "" {
+		if err := validateFileURL(u, h.publicSettings.AllowFileUris); err != nil {
+			c.add(publicSetting("manifestUri"), errors.Wrap(err, "invalid 'manifestUri'"))
+		}
+		if h.publicSettings.GPGPublicKey == "" {
+			c.add(publicSetting("manifestUri"), errManifestURINoKey)
+		}
+		if s := h.publicSettings.ManifestSignatureURI; s != "" {
+			if err := validateFileURL(s, h.publicSettings.AllowFileUris); err != nil {
+				c.add(publicSetting("manifestSignatureUri"), errors.Wrap(err, "invalid 'manifestSignatureUri'"))
+			}
+		}
+	} else if h.publicSettings.ManifestSignatureURI != "" {
+		c.add(publicSetting("manifestSignatureUri"), errManifestSigNoManifest)
+	}
+	urls, key := h.publicSettings.SignatureURLs, h.publicSettings.GPGPublicKey
+	if len(urls) > len(h.publicSettings.FileURLs) {
+		c.add(publicSetting("signatureUrls"), errSignatureURLsTooMany)
+	}
+	var n int
+	for i, u := range urls {
+		if u == "" {
+			continue
+		}
+		if err := validateFileURL(u, h.publicSettings.AllowFileUris); err != nil {
+			c.add(publicSetting("signatureUrls", i), errors.Wrapf(err, "invalid URL in 'signatureUrls' at index %d", i))
+		}
+		n++
+	}
+	if n > 0 && key == "" {
+		c.add(publicSetting("signatureUrls"), errSignatureURLsNoKey)
+	}
+	if key == "" {
+		return
+	}
+	if n == 0 && h.publicSettings.ManifestURI == "" {
+		c.add(publicSetting("gpgPublicKey"), errGPGPublicKeyNoSignatures)
+	}
+	if _, err := dearmorPublicKey(key); err != nil {
+		c.add(publicSetting("gpgPublicKey"), errors.Wrap(err, "invalid 'gpgPublicKey'"))
+	}
+}
+
+// validateArchiveChecks checks if the expected file counts and extracted sizes
+// in fileUris are only specified for archives extracted with extractArchives.
+func (h handlerSettings) validateArchiveChecks(c *settingChecks) {
+	if len(h.publicSettings.ArchiveChecks) > len(h.publicSettings.FileURLs) {
+		c.add(publicSetting("fileUris"), errArchiveChecksTooMany)
+	}
+	for i, a := range h.publicSettings.ArchiveChecks {
+		if !a.isSet() {
+			continue
+		}
+		if !h.publicSettings.ExtractArchives {
+			c.add(publicSetting("fileUris", i), fmt.Errorf("'expectedFileCount' and 'expectedExtractedSize' in 'fileUris' at index %d can only be specified with 'extractArchives'", i))
+			continue
+		}
+		name := h.fileName(i)
+		if name == "" {
+			name, _ = urlToFileName(h.publicSettings.FileURLs[i]) // reported when downloading
+		}
+		if name != "" && !archive.IsArchive(name) {
+			c.add(publicSetting("fileUris", i), fmt.Errorf("'expectedFileCount' and 'expectedExtractedSize' in 'fileUris' at index %d can only be specified for archives, %q is not one", i, name))
+		}
+	}
+}
+
+// validateFileNames checks if the file names in fileNames are valid names
+// (that do not refer to other directories or collide with the command output
+// files) and unique, including the names derived with indexedFileNames.
+func (h handlerSettings) validateFileNames(c *settingChecks) {
+	names := h.publicSettings.FileNames
+	if len(names) > len(h.publicSettings.FileURLs) {
+		c.add(publicSetting("fileNames"), errFileNamesTooMany)
+	}
+	seen := make(map[string]int)
+	for i, n := range names {
+		if n == "" {
+			continue
+		}
+		var err error
+		if n == "." || n == ".." || strings.ContainsAny(n, "/\x00") {
+			err = fmt.Errorf("invalid file name in 'fileNames' at index %d: %q", i, n)
+		} else if n == "stdout" || n == "stderr" {
+			err = fmt.Errorf("file name in 'fileNames' at index %d is reserved for the command output: %q", i, n)
+		} else if n == manifestFile {
+			err = fmt.Errorf("file name in 'fileNames' at index %d is reserved for the extension: %q", i, n)
+		} else if j, ok := seen[n]; ok {
+			err = fmt.Errorf("file name %q in 'fileNames' is specified more than once (at indexes %d and %d)", n, j, i)
+		} else {
+			seen[n] = i
+		}
+		c.add(publicSetting("fileNames", i), err)
+	}
+	if !h.publicSettings.IndexedFileNames {
+		return
+	}
+	for i := range h.publicSettings.FileURLs {
+		if i < len(names) && names[i] != "" {
+			continue
+		}
+		if n := h.fileName(i); n != "" {
+			if j, ok := seen[n]; ok {
+				c.add(publicSetting("fileNames", j), fmt.Errorf("file name %q in 'fileNames' at index %d is the indexed name of the file at index %d", n, j, i))
+			}
+		}
+	}
+}
+
+// validateFileURL returns an error if fileURL is not an absolute URL with one
+// of the schemes the files can be downloaded from. Azure Blob URLs are https
+// (or http) URLs as well. file:// URLs pointing to the local files are only
+// allowed if allowFile is true.
+func validateFileURL(fileURL string, allowFile bool) error {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse URL")
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		if u.Host == "" {
+			return fmt.Errorf("URL has no host: %q", fileURL)
+		}
+		return nil
+	case "file":
+		if !allowFile {
+			return errFileScheme
+		}
+		return nil
+	case "":
+		return fmt.Errorf("not an absolute URL (local paths are not allowed): %q", fileURL)
+	}
+	return fmt.Errorf("unsupported URL scheme %q (only http and https are allowed)", u.Scheme)
+}
+
+// execOptions returns the constraints the command should be executed with.
+func (h handlerSettings) execOptions() ExecOptions {
+	return ExecOptions{
+		Timeout:     time.Duration(h.publicSettings.TimeoutSeconds) * time.Second,
+		GracePeriod: time.Duration(h.publicSettings.TimeoutGracePeriodSeconds) * time.Second,
+		Env:         h.environmentVariables(),
+		Interpreter: h.publicSettings.Interpreter,
+		WorkingDir:  h.publicSettings.WorkingDirectory,
+		Umask:       h.umask(),
+		Niceness:    h.publicSettings.Niceness,
+		IOPriority:  h.ioPriority(),
+		Background:  h.publicSettings.RunInBackground,
+	}
+}
+
+// systemdProperties returns the unit properties of the systemd scope the
+// commands are run in with useSystemdScope, for the limits of memoryLimitMb
+// and cpuQuota, as those of their cgroup without the scope.
+func (h handlerSettings) systemdProperties() []string {
+	var out []string
+	if m := h.memoryLimitBytes(); m > 0 {
+		out = append(out, fmt.Sprintf("MemoryMax=%d", m), "MemorySwapMax=0")
+	}
+	if c := h.publicSettings.CPUQuota; c > 0 {
+		out = append(out, fmt.Sprintf("CPUQuota=%d%%", c))
+	}
+	return out
+}
+
+// memoryLimitBytes returns the memory limit of the cgroup the commands are
+// executed in from memoryLimitMb, zero if not specified.
+func (h handlerSettings) memoryLimitBytes() int64 {
+	return int64(h.publicSettings.MemoryLimitMB) * 1024 * 1024
+}
+
+// ioPriority returns the I/O priority the commands are executed with as in
+// ioprio_set(2), or zero if they inherit the one of the handler.
+func (h handlerSettings) ioPriority() int {
+	switch h.publicSettings.IoniceClass {
+	case "idle":
+		return ioPriorityIdle << ioPriorityClassShift
+	case "best-effort":
+		level := defaultIoniceLevel
+		if h.publicSettings.IoniceLevel != nil {
+			level = *h.publicSettings.IoniceLevel
+		}
+		return ioPriorityBestEffort<<ioPriorityClassShift | level
+	}
+	return 0
+}
+
+// umask returns the file mode creation mask the commands are executed with,
+// or nil if they inherit the one of the handler. The umask is assumed to be
+// validated.
+func (h handlerSettings) umask() *os.FileMode {
+	if h.publicSettings.Umask == "" {
+		return nil
+	}
+	m, _ := parseUmask(h.publicSettings.Umask)
+	return &m
+}
+
+// environmentVariables returns the environment variables to be injected to
+// the command. Variables in protected settings take precedence over the ones
+// in public settings with the same name. They are not included if
+// 'secretsDeliveryMode' is "file", see secretVariables.
+func (h handlerSettings) environmentVariables() map[string]string {
+	protected := h.protectedSettings.EnvironmentVariables
+	if h.secretsInFile() {
+		protected = nil
+	}
+	if len(h.publicSettings.EnvironmentVariables) == 0 && len(protected) == 0 {
+		return nil
+	}
+	env := make(map[string]string)
+	for k, v := range h.publicSettings.EnvironmentVariables {
+		env[k] = v
+	}
+	for k, v := range protected {
+		env[k] = v
+	}
+	return env
+}
+
+// secretsInFile returns whether the protected environment variables are
+// written to a file for the command instead of its environment, which can be
+// read from /proc/<pid>/environ.
+func (h handlerSettings) secretsInFile() bool {
+	return h.publicSettings.SecretsDeliveryMode == "file"
+}
+
+// secretVariables returns the protected environment variables to be written
+// to the secrets file of the command, or nil if they are in its environment.
+func (h handlerSettings) secretVariables() map[string]string {
+	if !h.secretsInFile() {
+		return nil
+	}
+	return h.protectedSettings.EnvironmentVariables
+}
+
+// maxConcurrentDownloads returns the number of files that can be downloaded
+// at the same time.
+func (h handlerSettings) maxConcurrentDownloads() int {
+	if h.publicSettings.MaxConcurrentDownloads > 0 {
+		return h.publicSettings.MaxConcurrentDownloads
+	}
+	return defaultMaxConcurrentDownloads
+}
+
+// maxFileURIs returns the maximum number of 'fileUris'.
+func (h handlerSettings) maxFileURIs() int {
+	if h.publicSettings.MaxFileURIs > 0 {
+		return h.publicSettings.MaxFileURIs
+	}
+	return defaultMaxFileURIs
+}
+
+// maxCommandLength returns the maximum length of a command in bytes.
+func (h handlerSettings) maxCommandLength() int {
+	if h.publicSettings.MaxCommandLength > 0 {
+		return h.publicSettings.MaxCommandLength
+	}
+	return defaultMaxCommandLength
+}
+
+// maxTotalDownloadBytes returns the maximum total size of the downloaded
+// files in bytes.
+func (h handlerSettings) maxTotalDownloadBytes() int64 {
+	if h.publicSettings.MaxTotalDownloadBytes > 0 {
+		return h.publicSettings.MaxTotalDownloadBytes
+	}
+	return defaultMaxTotalDownloadBytes
+}
+
+// commands returns the sequence of commands to run from either public or
+// protected settings, or nil if a single command is given in
+// 'commandToExecute'.
+func (h handlerSettings) commands() []string {
+	if len(h.publicSettings.Commands) > 0 {
+		return h.publicSettings.Commands
+	}
+	return h.protectedSettings.Commands
+}
+
+// parallelCommands returns the commands to run concurrently from either public
+// or protected settings, or nil if none is given.
+func (h handlerSettings) parallelCommands() []string {
+	if len(h.publicSettings.ParallelCommands) > 0 {
+		return h.publicSettings.ParallelCommands
+	}
+	return h.protectedSettings.ParallelCommands
+}
+
+// numberedCommands returns the name of the setting and the commands in the
+// 'commands' or the 'parallelCommands', whose output is saved to the numbered
+// files, or nil if there are none.
+func (h handlerSettings) numberedCommands() (string, []string) {
+	if cmds := h.parallelCommands(); len(cmds) > 0 {
+		return "parallelCommands", cmds
+	}
+	return "commands", h.commands()
+}
+
+// maxParallelCommands returns how many of the parallelCommands run at a time.
+func (h handlerSettings) maxParallelCommands() int {
+	if n := h.publicSettings.MaxParallelCommands; n > 0 {
+		return n
+	}
+	return len(h.parallelCommands())
+}
+
+// parallelCommandTimeout returns the duration each of the parallelCommands is
+// limited to, or zero if only timeoutSeconds applies.
+func (h handlerSettings) parallelCommandTimeout() time.Duration {
+	return time.Duration(h.publicSettings.ParallelCmdTimeoutSeconds) * time.Second
+}
+
+// commandToExecute returns the command to execute from either public or
+// protected settings, whichever is not empty or only whitespace.
+func (h handlerSettings) commandToExecute() string {
+	if strings.TrimSpace(h.publicSettings.CommandToExecute) != "" {
+		return h.publicSettings.CommandToExecute
+	}
+	return h.protectedSettings.CommandToExecute
+}
+
+// expandCommand returns cmd with the ${NAME} references to the variables in
+// 'environmentVariables' replaced with their values if 'expandVariables' is
+// set, otherwise cmd as is. The references to the protected variables are
+// left as is, for the shell to expand from the environment of the command (or
+// the secrets file), so that their values stay out of its command line, which
+// other users can read. "$${" is replaced with a literal "${". Undefined
+// variables are replaced with empty strings, or cause an error if
+// 'expandVariablesStrict' is set.
+func (h handlerSettings) expandCommand(cmd string) (string, error) {
+	if !h.publicSettings.ExpandVariables {
+		return cmd, nil
+	}
+	public, protected := h.publicSettings.EnvironmentVariables, h.protectedSettings.EnvironmentVariables
+	var undefined []string
+	out := variableRefRe.ReplaceAllStringFunc(cmd, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		name := ref[2 : len(ref)-1]
+		if _, ok := protected[name]; ok {
+			return ref
+		}
+		v, ok := public[name]
+		if !ok {
+			undefined = append(undefined, name)
+		}
+		return v
+	})
+	if len(undefined) > 0 && h.publicSettings.ExpandVariablesStrict {
+		return "", fmt.Errorf("undefined variables referenced in 'commandToExecute' with 'expandVariablesStrict': %s", strings.Join(undefined, ", "))
+	}
+	return out, nil
+}
+
+// fileCredential returns the per-file storage account credentials for the
+// file at fileURL, or nil if the top-level credentials are used.
+func (h handlerSettings) fileCredential(fileURL string) *fileCredential {
+	for i, c := range h.protectedSettings.FileCredentials {
+		if c.URL == fileURL {
+			return &h.protectedSettings.FileCredentials[i]
+		}
+	}
+	return nil
+}
+
+// downloadHeaders returns the custom headers to be sent with the download
+// requests of the file at fileURL: 'downloadHeaders' overridden by the
+// 'fileDownloadHeaders' for the URL, if any. The names are in canonical form.
+func (h handlerSettings) downloadHeaders(fileURL string) map[string]string {
+	out := make(map[string]string)
+	for k, v := range h.protectedSettings.DownloadHeaders {
+		out[http.CanonicalHeaderKey(k)] = v
+	}
+	for _, f := range h.protectedSettings.FileDownloadHeaders {
+		if f.URL == fileURL {
+			for k, v := range f.Headers {
+				out[http.CanonicalHeaderKey(k)] = v
+			}
+		}
+	}
+	return out
+}
+
+// fileHash returns the expected SHA-256 checksum of the i-th file in FileURLs
+// or empty string if the checksum is not specified.
+func (h handlerSettings) fileHash(i int) string {
+	if i < len(h.publicSettings.FileHashes) {
+		return h.publicSettings.FileHashes[i]
+	}
+	return ""
+}
+
+// listsMoreFiles returns whether files are added to FileURLs from
+// blobContainerUri or manifestUri before they are downloaded.
+func (h handlerSettings) listsMoreFiles() bool {
+	return h.publicSettings.BlobContainerURI != "" || h.publicSettings.ManifestURI != ""
+}
+
+// manifestSignatureURL returns the URL of the detached signature of the
+// manifest in manifestUri: manifestSignatureUri, or by default the URL of the
+// manifest with ".sig" appended to its path.
+func (h handlerSettings) manifestSignatureURL() string {
+	if s := h.publicSettings.ManifestSignatureURI; s != "" {
+		return s
+	}
+	u, err := url.Parse(h.publicSettings.ManifestURI)
+	if err != nil {
+		return "" // rejected by the validation
+	}
+	u.Path += ".sig"
+	u.RawPath = ""
+	return u.String()
+}
+
+// fileMirrors returns the URLs of the mirrors of the i-th file in FileURLs, to
+// download it from in order if it fails to be downloaded from its URL.
+func (h handlerSettings) fileMirrors(i int) []string {
+	if i < len(h.publicSettings.FileMirrorURLs) {
+		return h.publicSettings.FileMirrorURLs[i]
+	}
+	return nil
+}
+
+// archiveCheck returns what is expected to be extracted from the i-th file in
+// FileURLs if it is an archive, nothing if it is not specified.
+func (h handlerSettings) archiveCheck(i int) archiveCheck {
+	if i < len(h.publicSettings.ArchiveChecks) {
+		return h.publicSettings.ArchiveChecks[i]
+	}
+	return archiveCheck{}
+}
+
+// fileOSMatch returns the predicates of which the distribution of the VM must
+// match one for the i-th file in FileURLs to be downloaded, nil if it is
+// downloaded on any distribution.
+func (h handlerSettings) fileOSMatch(i int) []osMatch {
+	if i < len(h.publicSettings.FileOSMatches) {
+		return h.publicSettings.FileOSMatches[i]
+	}
+	return nil
+}
+
+// osSkippedFiles returns whether each of the files in FileURLs is skipped as
+// the distribution of the VM matches none of its 'osMatch' predicates, read
+// from os-release only if a file specifies 'osMatch', otherwise nil.
+func (h handlerSettings) osSkippedFiles(ctx *log.Context) ([]bool, error) {
+	if len(h.publicSettings.FileOSMatches) == 0 {
+		return nil, nil
+	}
+	r, err := readOSRelease()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to identify the distribution for 'osMatch'")
+	}
+	ctx.Log("event", "identified distribution", "id", r.ID, "idLike", strings.Join(r.IDLike, " "), "versionId", r.VersionID)
+	out := make([]bool, len(h.publicSettings.FileURLs))
+	for i := range out {
+		out[i] = !matchesAnyOS(h.fileOSMatch(i), r)
+	}
+	return out, nil
+}
+
+// contentType returns the expected media type of the i-th file in FileURLs,
+// or empty string if its Content-Type is not checked.
+func (h handlerSettings) contentType(i int) string {
+	if i < len(h.publicSettings.ExpectedContentTypes) {
+		return h.publicSettings.ExpectedContentTypes[i]
+	}
+	return ""
+}
+
+// signatureURL returns the URL of the detached signature of the i-th file in
+// FileURLs, or empty string if its signature is not verified.
+func (h handlerSettings) signatureURL(i int) string {
+	if i < len(h.publicSettings.SignatureURLs) {
+		return h.publicSettings.SignatureURLs[i]
+	}
+	return ""
+}
+
+// fileName returns the name of the i-th file in FileURLs to be saved as or
+// empty string if the name should be derived from the URL. With
+// indexedFileNames, the names derived from the URLs are prefixed with the
+// index of the file, such as "1_script.sh", so that they are unique.
+func (h handlerSettings) fileName(i int) string {
+	if i < len(h.publicSettings.FileNames) && h.publicSettings.FileNames[i] != "" {
+		return h.publicSettings.FileNames[i]
+	}
+	if h.publicSettings.IndexedFileNames && i < len(h.publicSettings.FileURLs) {
+		if name, err := urlToFileName(h.publicSettings.FileURLs[i]); err == nil { // reported when downloading
+			return fmt.Sprintf("%d_%s", i, name)
+		}
+	}
+	return ""
+}
+
+// fileDir returns the directory the i-th file in FileURLs is saved to,
+// specified in destinationDirs or destinationDir, or empty string if it is
+// saved to the download directory.
+func (h handlerSettings) fileDir(i int) string {
+	if i >= 0 && i < len(h.publicSettings.DestinationDirs) && h.publicSettings.DestinationDirs[i] != "" {
+		return h.publicSettings.DestinationDirs[i]
+	}
+	return h.publicSettings.DestinationDir
+}
+
+// destinationDirs returns the distinct directories, other than the download
+// directory, the files in FileURLs are saved to.
+func (h handlerSettings) destinationDirs() []string {
+	var dirs []string
+	seen := make(map[string]bool)
+	for i := range h.publicSettings.FileURLs {
+		if d := h.fileDir(i); d != "" && !seen[d] {
+			seen[d] = true
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// operationTimeout returns the duration the enable operation is limited to, or
+// zero if it is not limited.
+func (h handlerSettings) operationTimeout() time.Duration {
+	return time.Duration(h.publicSettings.OperationTimeoutSeconds) * time.Second
+}
+
+// fileMode returns the permission bits of the i-th file in FileURLs, specified
+// in fileModes or fileMode, or the default. The modes are assumed to be
+// validated.
+func (h handlerSettings) fileMode(i int) os.FileMode {
+	if i < len(h.publicSettings.FileModes) && h.publicSettings.FileModes[i] != "" {
+		m, _ := parseFileMode(h.publicSettings.FileModes[i])
+		return m
+	}
+	if h.publicSettings.FileMode != "" {
+		m, _ := parseFileMode(h.publicSettings.FileMode)
+		return m
+	}
+	return defaultFileMode
+}
+
+// script returns the decoded body of the base64-encoded script in the
+// protected settings, or nil if not specified.
+func (h handlerSettings) script() ([]byte, error) {
+	if h.protectedSettings.Script == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(h.protectedSettings.Script)
+	return b, errors.Wrap(err, "'script' is not valid base64")
+}
+
+// maxStatusOutputBytes returns how many bytes of the command output tails are
+// reported in the status file.
+func (h handlerSettings) maxStatusOutputBytes() int64 {
+	if h.publicSettings.MaxStatusOutputBytes > 0 {
+		return int64(h.publicSettings.MaxStatusOutputBytes)
+	}
+	if h.statusVerbosity() == statusVerbosityVerbose {
+		return verboseMaxStatusOutputBytes
+	}
+	return defaultMaxStatusOutputBytes
+}
+
+// Levels of statusVerbosity, the details reported in the status file.
+const (
+	statusVerbosityMinimal = "minimal" // only the outcome, without the output or substatuses
+	statusVerbosityNormal  = "normal"  // the output tails, timing substatuses and the outcome of each download
+	statusVerbosityVerbose = "verbose" // longer output tails
+)
+
+// statusVerbosity returns how much detail is reported in the status file.
+func (h handlerSettings) statusVerbosity() string {
+	if v := h.publicSettings.StatusVerbosity; v != "" {
+		return v
+	}
+	return statusVerbosityNormal
+}
+
+// reportedSubstatuses returns the substatuses in sub to be reported in the
+// status file per statusVerbosity.
+func (h handlerSettings) reportedSubstatuses(sub []substatus) []substatus {
+	if h.statusVerbosity() == statusVerbosityMinimal {
+		return nil
+	}
+	return sub
+}
+
+// progressInterval returns how often the download progress is reported.
+func (h handlerSettings) progressInterval() time.Duration {
+	if h.publicSettings.ProgressIntervalSeconds > 0 {
+		return time.Duration(h.publicSettings.ProgressIntervalSeconds) * time.Second
+	}
+	return defaultProgressInterval
+}
+
+// heartbeatInterval returns how often the status is updated while the command
+// is running.
+func (h handlerSettings) heartbeatInterval() time.Duration {
+	if h.publicSettings.HeartbeatIntervalSeconds > 0 {
+		return time.Duration(h.publicSettings.HeartbeatIntervalSeconds) * time.Second
+	}
+	return defaultHeartbeatInterval
+}
+
+// proxyURL returns the proxy specified in the settings with the credentials in
+// the protected settings, or nil if not specified.
+func (h handlerSettings) proxyURL() (*url.URL, error) {
+	if h.publicSettings.ProxyURL == "" {
+		return nil, nil
+	}
+	u, err := parseProxyURL(h.publicSettings.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if user := h.protectedSettings.ProxyUsername; user != "" {
+		if pass := h.protectedSettings.ProxyPassword; pass != "" {
+			u.User = url.UserPassword(user, pass)
+		} else {
+			u.User = url.User(user)
+		}
+	}
+	return u, nil
+}
+
+// convertLineEndings returns true if the downloaded script files should be
+// post-processed to remove BOM and DOS line endings.
+func (h handlerSettings) convertLineEndings() bool {
+	if h.publicSettings.SkipDos2Unix {
+		return false
+	}
+	return h.publicSettings.ConvertLineEndings == nil || *h.publicSettings.ConvertLineEndings
+}
+
+// connectTimeout returns how long establishing a connection for a download may
+// take.
+func (h handlerSettings) connectTimeout() time.Duration {
+	if h.publicSettings.ConnectTimeoutSeconds > 0 {
+		return time.Duration(h.publicSettings.ConnectTimeoutSeconds) * time.Second
+	}
+	return download.DefaultConnectTimeout
+}
+
+// responseHeaderTimeout returns how long to wait for the response headers of a
+// download request.
+func (h handlerSettings) responseHeaderTimeout() time.Duration {
+	if h.publicSettings.ResponseHeaderTimeoutSeconds > 0 {
+		return time.Duration(h.publicSettings.ResponseHeaderTimeoutSeconds) * time.Second
+	}
+	return download.DefaultResponseHeaderTimeout
+}
+
+// retryPolicy returns how failed downloads are retried.
+func (h handlerSettings) retryPolicy() download.RetryPolicy {
+	p := download.DefaultRetryPolicy
+	if h.publicSettings.DownloadRetryCount != nil {
+		p.Retries = *h.publicSettings.DownloadRetryCount
+	}
+	if h.publicSettings.DownloadRetryIntervalSeconds > 0 {
+		p.Interval = time.Duration(h.publicSettings.DownloadRetryIntervalSeconds) * time.Second
+	}
+	return p
+}
+
+// maxReboots returns how many times the command can request a reboot for the
+// same configuration.
+func (h handlerSettings) maxReboots() int {
+	if h.publicSettings.MaxReboots != nil {
+		return *h.publicSettings.MaxReboots
+	}
+	return defaultMaxReboots
+}
+
+// commandRetryInterval returns how long to wait before executing a failed
+// command again.
+func (h handlerSettings) commandRetryInterval() time.Duration {
+	if h.publicSettings.CommandRetryIntervalSeconds > 0 {
+		return time.Duration(h.publicSettings.CommandRetryIntervalSeconds) * time.Second
+	}
+	return defaultCommandRetryInterval
+}
+
+// enableRetryInterval returns how long to wait before running a failed enable
+// operation again.
+func (h handlerSettings) enableRetryInterval() time.Duration {
+	if h.publicSettings.EnableRetryIntervalSeconds > 0 {
+		return time.Duration(h.publicSettings.EnableRetryIntervalSeconds) * time.Second
+	}
+	return defaultEnableRetryInterval
+}
+
 // publicSettings is the type deserialized from public configuration section of
 // the extension handler. This should be in sync with publicSettingsSchema.
 type publicSettings struct {
-	CommandToExecute string   `json:"commandToExecute"`
-	FileURLs         []string `json:"fileUris"`
+	CommandToExecute             string            `json:"commandToExecute"`
+	Commands                     []string          `json:"commands"`
+	ContinueOnError              bool              `json:"continueOnError"`
+	ParallelCommands             []string          `json:"parallelCommands"`
+	MaxParallelCommands          int               `json:"maxParallelCommands"`
+	ParallelCmdTimeoutSeconds    int               `json:"parallelCommandTimeoutSeconds"`
+	ContinueOnDownloadError      bool              `json:"continueOnDownloadError"`
+	MinSuccessfulDownloads       int               `json:"minSuccessfulDownloads"`
+	OnFailureCommand             string            `json:"onFailureCommand"`
+	TestCommand                  string            `json:"testCommand"`
+	ScriptFile                   string            `json:"scriptFile"`
+	FileURLs                     []string          `json:"fileUris"`
+	FileMirrorURLs               [][]string        `json:"-"` // of FileURLs, from the object form of 'fileUris'
+	ArchiveChecks                []archiveCheck    `json:"-"` // of FileURLs, from the object form of 'fileUris'
+	FileOSMatches                [][]osMatch       `json:"-"` // of FileURLs, from the object form of 'fileUris'
+	FileHashes                   []string          `json:"fileHashes"`
+	ExpectedContentTypes         []string          `json:"expectedContentTypes"`
+	SignatureURLs                []string          `json:"signatureUrls"`
+	GPGPublicKey                 string            `json:"gpgPublicKey"`
+	FileNames                    []string          `json:"fileNames"`
+	IndexedFileNames             bool              `json:"indexedFileNames"`
+	FileMode                     string            `json:"fileMode"`
+	FileModes                    []string          `json:"fileModes"`
+	DestinationDir               string            `json:"destinationDir"`
+	DestinationDirs              []string          `json:"destinationDirs"`
+	FileMappings                 []fileMapping     `json:"fileMappings"`
+	TimeoutSeconds               int               `json:"timeoutSeconds"`
+	TimeoutGracePeriodSeconds    int               `json:"timeoutGracePeriodSeconds"`
+	MaxConcurrentDownloads       int               `json:"maxConcurrentDownloads"`
+	DownloadRetryCount           *int              `json:"downloadRetryCount"`
+	DownloadRetryIntervalSeconds int               `json:"downloadRetryIntervalSeconds"`
+	CommandRetryCount            int               `json:"commandRetryCount"`
+	CommandRetryIntervalSeconds  int               `json:"commandRetryIntervalSeconds"`
+	EnableRetryCount             int               `json:"enableRetryCount"`
+	EnableRetryIntervalSeconds   int               `json:"enableRetryIntervalSeconds"`
+	ConnectTimeoutSeconds        int               `json:"connectTimeoutSeconds"`
+	ResponseHeaderTimeoutSeconds int               `json:"responseHeaderTimeoutSeconds"`
+	MaxFileSizeBytes             int64             `json:"maxFileSizeBytes"`
+	MaxTotalDownloadBytes        int64             `json:"maxTotalDownloadBytes"`
+	MaxFileURIs                  int               `json:"maxFileUris"`
+	MaxCommandLength             int               `json:"maxCommandLength"`
+	MaxStatusOutputBytes         int               `json:"maxStatusOutputBytes"`
+	OutputBlobURI                string            `json:"outputBlobUri"`
+	BlobContainerURI             string            `json:"blobContainerUri"`
+	BlobPrefix                   string            `json:"blobPrefix"`
+	AllowEmptyBlobList           bool              `json:"allowEmptyBlobList"`
+	ManifestURI                  string            `json:"manifestUri"`
+	ManifestSignatureURI         string            `json:"manifestSignatureUri"`
+	StatusVerbosity              string            `json:"statusVerbosity"`
+	ProgressIntervalSeconds      int               `json:"progressIntervalSeconds"`
+	HeartbeatIntervalSeconds     int               `json:"heartbeatIntervalSeconds"`
+	EnvironmentVariables         map[string]string `json:"environmentVariables"`
+	ExpandVariables              bool              `json:"expandVariables"`
+	ExpandVariablesStrict        bool              `json:"expandVariablesStrict"`
+	SubstituteMetadata           bool              `json:"substituteMetadata"`
+	SecretsDeliveryMode          string            `json:"secretsDeliveryMode"`
+	Interpreter                  string            `json:"interpreter"`
+	Umask                        string            `json:"umask"`
+	Niceness                     *int              `json:"niceness"`
+	IoniceClass                  string            `json:"ioniceClass"`
+	IoniceLevel                  *int              `json:"ioniceLevel"`
+	ConvertLineEndings           *bool             `json:"convertLineEndings"`
+	SkipDos2Unix                 bool              `json:"skipDos2Unix"`
+	RunAsUser                    string            `json:"runAsUser"`
+	UseSystemdScope              bool              `json:"useSystemdScope"`
+	MemoryLimitMB                int               `json:"memoryLimitMb"`
+	CPUQuota                     int               `json:"cpuQuota"`
+	ChrootDir                    string            `json:"chrootDir"`
+	ForceUpdateTag               string            `json:"forceUpdateTag"`
+	AllowFileUris                bool              `json:"allowFileUris"`
+	ProxyURL                     string            `json:"proxyUrl"`
+	DNSServer                    string            `json:"dnsServer"`
+	CACertPEM                    string            `json:"caCertPem"`
+	InsecureSkipVerify           bool              `json:"insecureSkipVerify"`
+	WorkingDirectory             string            `json:"workingDirectory"`
+	ValidateOnly                 bool              `json:"validateOnly"`
+	SkipExecution                bool              `json:"skipExecution"`
+	RunInBackground              bool              `json:"runInBackground"`
+	CleanupAfterRun              bool              `json:"cleanupAfterRun"`
+	ExtractArchives              bool              `json:"extractArchives"`
+	ForceDownload                bool              `json:"forceDownload"`
+	KeepDownloadDirs             int               `json:"keepDownloadDirs"`
+	AlwaysRun                    bool              `json:"alwaysRun"`
+	RunOnce                      bool              `json:"runOnce"`
+	RunOnceResetTag              string            `json:"runOnceResetTag"`
+	OperationTimeoutSeconds      int               `json:"operationTimeoutSeconds"`
+	CreateWorkingDirectory       bool              `json:"createWorkingDirectory"`
+	RebootExitCode               int               `json:"rebootExitCode"`
+	AllowReboot                  bool              `json:"allowReboot"`
+	MaxReboots                   *int              `json:"maxReboots"`
+	GitRepository                *gitRepository    `json:"gitRepository"`
+}
+
+// fileURI is an item of 'fileUris': either the URL of the file, or an object
+// with the URL of the file followed by the URLs of its mirrors, what is
+// expected to be extracted from it if it is an archive, and the distributions
+// it is downloaded on.
+type fileURI struct {
+	URLs    []string  `json:"urls"`
+	OSMatch []osMatch `json:"osMatch"`
+	archiveCheck
+}
+
+// archiveCheck is what is expected to be extracted from an archive in
+// 'fileUris' with 'extractArchives', to detect corrupted archives that can
+// still be extracted. The fields which are nil are not checked.
+type archiveCheck struct {
+	FileCount *int   `json:"expectedFileCount"`
+	Size      *int64 `json:"expectedExtractedSize"`
+}
+
+// isSet returns whether anything is expected to be extracted.
+func (a archiveCheck) isSet() bool { return a.FileCount != nil || a.Size != nil }
+
+func (f *fileURI) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		f.URLs = []string{s}
+		return nil
+	}
+	type plain fileURI // without this method
+	return json.Unmarshal(b, (*plain)(f))
+}
+
+// UnmarshalJSON deserializes the public settings, with the items of 'fileUris'
+// in either form of fileURI: their first URLs are in FileURLs and the others,
+// if any, in FileMirrorURLs, their archive checks in ArchiveChecks and their
+// distribution predicates in FileOSMatches.
+func (p *publicSettings) UnmarshalJSON(b []byte) error {
+	type plain publicSettings // without this method
+	var v struct {
+		plain
+		FileURIs []fileURI `json:"fileUris"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*p = publicSettings(v.plain)
+	var mirrors [][]string
+	var checks []archiveCheck
+	var osMatches [][]osMatch
+	for i, f := range v.FileURIs {
+		u := "" // rejected by the validation
+		if len(f.URLs) > 0 {
+			u = f.URLs[0]
+		}
+		p.FileURLs = append(p.FileURLs, u)
+		if len(f.URLs) > 1 {
+			padItems(len(mirrors), i, func() { mirrors = append(mirrors, nil) })
+			mirrors = append(mirrors, f.URLs[1:])
+		}
+		if f.archiveCheck.isSet() {
+			padItems(len(checks), i, func() { checks = append(checks, archiveCheck{}) })
+			checks = append(checks, f.archiveCheck)
+		}
+		if f.OSMatch != nil {
+			padItems(len(osMatches), i, func() { osMatches = append(osMatches, nil) })
+			osMatches = append(osMatches, f.OSMatch)
+		}
+	}
+	p.FileMirrorURLs, p.ArchiveChecks, p.FileOSMatches = mirrors, checks, osMatches
+	return nil
+}
+
+// padItems calls pad once for each item missing before index i in a list of n
+// items of the files in 'fileUris', such as with an empty item for the files
+// without mirrors, so that the item appended next is the one of the file at
+// index i.
+func padItems(n, i int, pad func()) {
+	for ; n < i; n++ {
+		pad()
+	}
 }
 
 // protectedSettings is the type decoded and deserialized from protected
 // configuration section. This should be in sync with protectedSettingsSchema.
 type protectedSettings struct {
-	CommandToExecute   string `json:"commandToExecute"`
+	CommandToExecute             string            `json:"commandToExecute"`
+	CommandToExecuteFromKeyVault string            `json:"commandToExecuteFromKeyVault"`
+	Commands                     []string          `json:"-"` // from 'commands', see UnmarshalJSON
+	ParallelCommands             []string          `json:"-"` // from 'parallelCommands', see UnmarshalJSON
+	Script                       string            `json:"script"`
+	StorageAccountName           string            `json:"storageAccountName"`
+	StorageAccountKey            string            `json:"storageAccountKey"`
+	FileCredentials              []fileCredential  `json:"fileCredentials"`
+	ManagedIdentity              *managedIdentity  `json:"managedIdentity"`
+	GitHubToken                  string            `json:"githubToken"`
+	SASToken                     string            `json:"sasToken"`
+	ProxyUsername                string            `json:"proxyUsername"`
+	ProxyPassword                string            `json:"proxyPassword"`
+	HTTPUsername                 string            `json:"httpUsername"`
+	HTTPPassword                 string            `json:"httpPassword"`
+	DownloadHeaders              map[string]string `json:"downloadHeaders"`
+	FileDownloadHeaders          []fileHeaders     `json:"fileDownloadHeaders"`
+	GitUsername                  string            `json:"gitUsername"`
+	GitToken                     string            `json:"gitToken"`
+	EnvironmentVariables         map[string]string `json:"-"` // from 'environmentVariables', see UnmarshalJSON
+}
+
+// UnmarshalJSON deserializes the protected settings. The settings that can
+// also be specified in the public settings are decoded separately, so that
+// their tags are not repeated in handlerSettings, which embeds both.
+func (p *protectedSettings) UnmarshalJSON(b []byte) error {
+	type plain protectedSettings // without this method
+	var v struct {
+		plain
+		Commands             []string          `json:"commands"`
+		ParallelCommands     []string          `json:"parallelCommands"`
+		EnvironmentVariables map[string]string `json:"environmentVariables"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*p = protectedSettings(v.plain)
+	p.Commands, p.ParallelCommands, p.EnvironmentVariables = v.Commands, v.ParallelCommands, v.EnvironmentVariables
+	return nil
+}
+
+// fileCredential describes the storage account credentials used to download
+// the file in fileUris with the URL, instead of the top-level ones.
+type fileCredential struct {
+	URL                string `json:"url"`
 	StorageAccountName string `json:"storageAccountName"`
 	StorageAccountKey  string `json:"storageAccountKey"`
 }
 
+// fileHeaders describes the custom headers sent with the download requests of
+// the file in fileUris with the URL, in addition to 'downloadHeaders'.
+type fileHeaders struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+// fileMapping describes the files in the download directory matching the glob
+// pattern From to be moved to To, relative to the download directory.
+type fileMapping struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// validate checks if the paths of m are relative paths within the download
+// directory and From is a valid glob pattern.
+func (m fileMapping) validate() error {
+	for _, p := range []string{m.From, m.To} {
+		if p == "" {
+			return errors.New("'from' and 'to' must be specified")
+		}
+		if filepath.IsAbs(p) {
+			return fmt.Errorf("path must be relative to the download directory: %q", p)
+		}
+		if c := filepath.Clean(p); c == ".." || strings.HasPrefix(c, "../") {
+			return fmt.Errorf("path must be within the download directory: %q", p)
+		}
+	}
+	if _, err := filepath.Match(m.From, ""); err != nil {
+		return errors.Wrapf(err, "invalid pattern %q", m.From)
+	}
+	return nil
+}
+
+// gitRepository describes the git repository checked out into the download
+// directory, at Commit if specified or otherwise at the tip of Branch.
+type gitRepository struct {
+	URL    string `json:"url"`
+	Branch string `json:"branch"`
+	Commit string `json:"commit"`
+}
+
+// validate checks if the URL of r is a supported git URL (file:// URLs only if
+// allowFile is set), and Branch and Commit are valid.
+func (r gitRepository) validate(allowFile bool) error {
+	if !scpLikeGitURLRe.MatchString(r.URL) {
+		u, err := url.Parse(r.URL)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse url")
+		}
+		switch u.Scheme {
+		case "https", "http", "ssh", "git":
+		case "file":
+			if !allowFile {
+				return errFileScheme
+			}
+		default:
+			return fmt.Errorf("unsupported url scheme %q (expected https, http, ssh or git)", u.Scheme)
+		}
+	}
+	if strings.HasPrefix(r.Branch, "-") || strings.IndexFunc(r.Branch, func(c rune) bool { return c <= ' ' || c == 0x7f }) >= 0 {
+		return fmt.Errorf("invalid branch: %q", r.Branch)
+	}
+	if r.Commit != "" && !gitCommitRe.MatchString(r.Commit) {
+		return fmt.Errorf("invalid commit: %q", r.Commit)
+	}
+	return nil
+}
+
+// managedIdentity describes the managed identity used to download blobs. If
+// neither ID is specified, the system-assigned identity of the VM is used.
+type managedIdentity struct {
+	ClientID string `json:"clientId"`
+	ObjectID string `json:"objectId"`
+}
+
 // parseAndValidateSettings reads configuration from configFolder, decrypts it,
-// runs JSON-schema and logical validation on it and returns it back.
-func parseAndValidateSettings(ctx *log.Context, configFolder string) (h handlerSettings, _ error) {
-	ctx.Log("event", "reading configuration")
+// runs JSON-schema and logical validation on it and returns it back. The errors
+// include the path of the settings file.
+func parseAndValidateSettings(ctx *log.Context, configFolder string) (h handlerSettings, err error) {
+	path, err := settingsFile(ctx, configFolder)
+	if err != nil {
+		return h, err
+	}
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "settings file %s", path)
+		}
+	}()
+
+	ctx.Log("event", "reading configuration", "path", path)
 	pubJSON, protJSON, err := readSettings(configFolder)
 	if err != nil {
 		return h, err
 	}
+	logRedactor.addSettings(protJSON) // before anything derived from them is logged
 	ctx.Log("event", "read configuration")
 
 	ctx.Log("event", "validating json schema")
@@ -76,20 +1720,55 @@ func parseAndValidateSettings(ctx *log.Context, configFolder string) (h handlerS
 	ctx.Log("event", "parsed configuration json")
 
 	ctx.Log("event", "validating configuration logically")
-	if err := h.validate(); err != nil {
-		return h, errors.Wrap(err, "invalid configuration")
+	var c settingChecks
+	if h.check(&c); len(c.problems) > 0 {
+		return h, errors.Wrap(c.problems, "invalid configuration")
 	}
 	ctx.Log("event", "validated configuration")
 	return h, nil
 }
 
+// settingsFile returns the path of the .settings file in configFolder that
+// readSettings reads: the one with the highest sequence number. All the
+// .settings files found and the selected one are logged.
+func settingsFile(ctx log.Logger, configFolder string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(configFolder, "*.settings"))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to list settings files in %s", configFolder)
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = filepath.Base(f)
+	}
+	seqNum, err := vmextension.FindSeqNum(configFolder)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to find settings file in %s", configFolder)
+	}
+	path := filepath.Join(configFolder, fmt.Sprintf("%d.settings", seqNum))
+	ctx.Log("event", "found settings files", "configFolder", configFolder, "files", strings.Join(names, ","),
+		"selected", filepath.Base(path), "message", "the file with the highest sequence number is used")
+	return path, nil
+}
+
 // readSettings uses specified configFolder (comes from HandlerEnvironment) to
 // decrypt and parse the public/protected settings of the extension handler into
-// JSON objects.
+// JSON objects. The protected settings are decrypted with the certificate found
+// by settingsCertificate.
 func readSettings(configFolder string) (pubSettingsJSON, protSettingsJSON map[string]interface{}, err error) {
-	pubSettingsJSON, protSettingsJSON, err = vmextension.ReadSettings(configFolder)
-	err = errors.Wrapf(err, "error reading extension configuration")
-	return
+	defer func() { err = errors.Wrapf(err, "error reading extension configuration") }()
+	seqNum, err := vmextension.FindSeqNum(configFolder)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot find seqnum")
+	}
+	f, err := parseSettingsFile(filepath.Join(configFolder, fmt.Sprintf("%d.settings", seqNum)))
+	if err != nil {
+		return nil, nil, err
+	}
+	protSettingsJSON, err = decryptProtectedSettings(configFolder, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f.PublicSettings, protSettingsJSON, nil
 }
 
 // validateSettings takes publicSettings and protectedSettings as JSON objects
@@ -104,11 +1783,20 @@ func validateSettingsSchema(pubSettingsJSON, protSettingsJSON map[string]interfa
 		return errors.Wrap(err, "failed to unmarshal protected settings into json")
 	}
 
-	if err := validatePublicSettings(pubJSON); err != nil {
-		return err
+	// report the problems with both the public and the protected settings
+	var errs settingErrors
+	for _, err := range []error{validatePublicSettings(pubJSON), validateProtectedSettings(protJSON)} {
+		if err == nil {
+			continue
+		}
+		e, ok := errors.Cause(err).(settingErrors)
+		if !ok {
+			return err
+		}
+		errs = append(errs, e...)
 	}
-	if err := validateProtectedSettings(protJSON); err != nil {
-		return err
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
@@ -1,7 +1,22 @@
 package main
 
-import "testing"
-import "github.com/stretchr/testify/require"
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
 
 func Test_handlerSettingsValidate(t *testing.T) {
 	// commandToExecute not specified
@@ -16,6 +31,83 @@ func Test_handlerSettingsValidate(t *testing.T) {
 		protectedSettings{CommandToExecute: "foo"},
 	}.validate())
 
+	// commands specified twice
+	require.Equal(t, errCommandsTooMany, handlerSettings{
+		publicSettings{Commands: []string{"foo"}},
+		protectedSettings{Commands: []string{"foo"}},
+	}.validate())
+
+	// commandToExecute and commands specified together
+	require.Equal(t, errCmdAndCommands, handlerSettings{
+		publicSettings{Commands: []string{"foo"}},
+		protectedSettings{CommandToExecute: "foo"},
+	}.validate())
+
+	// parallelCommands
+	require.Nil(t, handlerSettings{
+		protectedSettings: protectedSettings{ParallelCommands: []string{"foo", "bar"}},
+	}.validate())
+	require.Equal(t, errParallelCommandsTooMany, handlerSettings{
+		publicSettings{ParallelCommands: []string{"foo"}},
+		protectedSettings{ParallelCommands: []string{"foo"}},
+	}.validate())
+	for _, pub := range []publicSettings{
+		{ParallelCommands: []string{"foo"}, CommandToExecute: "foo"},
+		{ParallelCommands: []string{"foo"}, Commands: []string{"foo"}},
+		{ParallelCommands: []string{"foo"}, ScriptFile: "foo"},
+		{ParallelCommands: []string{"foo"}, RunInBackground: true},
+	} {
+		require.Equal(t, errParallelCommandsConflict, handlerSettings{publicSettings: pub}.validate(), "%+v", pub)
+	}
+	require.EqualError(t, handlerSettings{
+		publicSettings: publicSettings{ParallelCommands: []string{"foo", " "}},
+	}.validate(), "empty command in 'parallelCommands' at index 1")
+	require.Equal(t, errParallelOptionsNoCommands, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "foo", MaxParallelCommands: 2},
+	}.validate())
+
+	// scriptFile only
+	require.Nil(t, handlerSettings{
+		publicSettings: publicSettings{FileURLs: []string{"http://a/run.sh"}, ScriptFile: "run.sh"},
+	}.validate())
+
+	// script only
+	require.Nil(t, handlerSettings{
+		protectedSettings: protectedSettings{Script: "ZWNobyBoaQo="},
+	}.validate())
+
+	// script and commandToExecute specified together
+	require.Equal(t, errScriptAndCmd, handlerSettings{
+		publicSettings{CommandToExecute: "foo"},
+		protectedSettings{Script: "ZWNobyBoaQo="},
+	}.validate())
+
+	// malformed script
+	require.EqualError(t, handlerSettings{
+		protectedSettings: protectedSettings{Script: "echo hi"},
+	}.validate(), "'script' is not valid base64: illegal base64 data at input byte 4")
+
+	// commandToExecuteFromKeyVault only
+	require.Nil(t, handlerSettings{
+		protectedSettings: protectedSettings{CommandToExecuteFromKeyVault: "https://v.vault.azure.net/secrets/cmd"},
+	}.validate())
+
+	// commandToExecuteFromKeyVault and commandToExecute specified together
+	require.Equal(t, errKeyVaultAndCmd, handlerSettings{
+		publicSettings{CommandToExecute: "foo"},
+		protectedSettings{CommandToExecuteFromKeyVault: "https://v.vault.azure.net/secrets/cmd"},
+	}.validate())
+
+	// commandToExecuteFromKeyVault is not a secret URI
+	require.EqualError(t, handlerSettings{
+		protectedSettings: protectedSettings{CommandToExecuteFromKeyVault: "https://example.com/secrets/cmd"},
+	}.validate(), `invalid 'commandToExecuteFromKeyVault': not an Azure Key Vault host: "example.com"`)
+
+	// commands only
+	require.Nil(t, handlerSettings{
+		protectedSettings: protectedSettings{Commands: []string{"foo", "bar"}},
+	}.validate())
+
 	// storageAccount name specified; but not key
 	require.Equal(t, errStoragePartialCredentials, handlerSettings{
 		protectedSettings: protectedSettings{
@@ -31,6 +123,765 @@ func Test_handlerSettingsValidate(t *testing.T) {
 			StorageAccountName: "",
 			StorageAccountKey:  "foo"},
 	}.validate())
+
+	// managedIdentity with both IDs
+	require.Equal(t, errManagedIdentityAmbiguous, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "date"},
+		protectedSettings: protectedSettings{
+			ManagedIdentity: &managedIdentity{ClientID: "a", ObjectID: "b"}},
+	}.validate())
+
+	// invalid environment variable names
+	for _, v := range []string{"", "1A", "A-B", "A=B"} {
+		err := handlerSettings{
+			publicSettings:    publicSettings{CommandToExecute: "date"},
+			protectedSettings: protectedSettings{EnvironmentVariables: map[string]string{v: "val"}},
+		}.validate()
+		require.NotNil(t, err, "name=%q", v)
+		require.Contains(t, err.Error(), "invalid environment variable name")
+	}
+
+	// file:// URLs are not allowed by default
+	err := handlerSettings{
+		publicSettings: publicSettings{
+			CommandToExecute: "date",
+			FileURLs:         []string{"http://a/b", "file:///etc/shadow"}},
+	}.validate()
+	require.NotNil(t, err)
+	require.Equal(t, errFileScheme, errors.Cause(err))
+	require.Contains(t, err.Error(), "at index 1")
+
+	// file:// URLs are allowed with allowFileUris
+	require.Nil(t, handlerSettings{
+		publicSettings: publicSettings{
+			CommandToExecute: "date",
+			FileURLs:         []string{"file:///etc/shadow"},
+			AllowFileUris:    true},
+	}.validate())
+
+	// proxy credentials without proxyUrl
+	require.Equal(t, errProxyCredentialsNoURL, handlerSettings{
+		publicSettings:    publicSettings{CommandToExecute: "date"},
+		protectedSettings: protectedSettings{ProxyUsername: "user"},
+	}.validate())
+
+	// proxy password without username
+	require.Equal(t, errProxyPasswordNoUsername, handlerSettings{
+		publicSettings:    publicSettings{CommandToExecute: "date", ProxyURL: "http://proxy:3128"},
+		protectedSettings: protectedSettings{ProxyPassword: "pass"},
+	}.validate())
+
+	// invalid proxyUrl
+	for _, v := range []string{"proxy:3128", "socks5://proxy:1080", "http://"} {
+		err := handlerSettings{
+			publicSettings: publicSettings{CommandToExecute: "date", ProxyURL: v},
+		}.validate()
+		require.NotNil(t, err, "proxyUrl=%q", v)
+		require.Contains(t, err.Error(), "'proxyUrl'")
+	}
+
+	// DNS server not an IP address
+	err = handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "date", DNSServer: "dns.local"},
+	}.validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid 'dnsServer': invalid DNS server address")
+	require.Nil(t, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "date", DNSServer: "[fd00::53]:53"},
+	}.validate())
+
+	// invalid CA certificates
+	err = handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "date", CACertPEM: "not a certificate"},
+	}.validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid 'caCertPem'")
+
+	// relative workingDirectory
+	require.Equal(t, errWorkingDirNotAbsolute, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "date", WorkingDirectory: "opt/app"},
+	}.validate())
+
+	// more fileHashes than fileUris
+	require.Equal(t, errFileHashesTooMany, handlerSettings{
+		publicSettings: publicSettings{
+			CommandToExecute: "date",
+			FileURLs:         []string{"http://a/b"},
+			FileHashes:       []string{"", ""}},
+	}.validate())
+
+	// more expectedContentTypes than fileUris
+	require.Equal(t, errContentTypesTooMany, handlerSettings{
+		publicSettings: publicSettings{
+			CommandToExecute:     "date",
+			FileURLs:             []string{"http://a/b"},
+			ExpectedContentTypes: []string{"", "text/plain"}},
+	}.validate())
+}
+
+func Test_validateFileURL(t *testing.T) {
+	for _, u := range []string{
+		"http://example.com/a.sh",
+		"https://example.com/a.sh?b=c",
+		"HTTPS://example.com/a.sh",
+		"https://account.blob.core.windows.net/container/blob.sh",
+	} {
+		require.Nil(t, validateFileURL(u, false), "url=%q", u)
+	}
+
+	for _, c := range []struct {
+		url, err string
+	}{
+		{"file:///etc/shadow", "'allowFileUris'"},
+		{"FILE:///etc/shadow", "'allowFileUris'"},
+		{"/etc/shadow", "local paths are not allowed"},
+		{"scripts/a.sh", "local paths are not allowed"},
+		{"ftp://example.com/a.sh", `unsupported URL scheme "ftp"`},
+		{"data:text/plain,echo", `unsupported URL scheme "data"`},
+		{"gopher://example.com/a", `unsupported URL scheme "gopher"`},
+		{"javascript:alert(1)", `unsupported URL scheme "javascript"`},
+		{"https:///a.sh", "URL has no host"},
+		{"http://[::1", "failed to parse URL"},
+	} {
+		err := validateFileURL(c.url, false)
+		require.NotNil(t, err, "url=%q", c.url)
+		require.Contains(t, err.Error(), c.err, "url=%q", c.url)
+	}
+
+	require.Nil(t, validateFileURL("file:///etc/shadow", true))
+	require.NotNil(t, validateFileURL("ftp://example.com/a.sh", true), "only file:// is allowed additionally")
+}
+
+func Test_handlerSettings_validateFileNames(t *testing.T) {
+	cfg := func(names ...string) handlerSettings {
+		return handlerSettings{publicSettings: publicSettings{
+			CommandToExecute: "date",
+			FileURLs:         []string{"http://a/1", "http://a/2", "http://a/3"},
+			FileNames:        names}}
+	}
+	require.Nil(t, cfg().validate())
+	require.Nil(t, cfg("a.sh", "", "b.sh").validate())
+	require.Nil(t, cfg("", "").validate(), "empty names do not collide")
+
+	require.Equal(t, errFileNamesTooMany, cfg("a", "b", "c", "d").validate())
+
+	err := cfg("a.sh", "b.sh", "a.sh").validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), `file name "a.sh" in 'fileNames' is specified more than once (at indexes 0 and 2)`)
+
+	for _, n := range []string{".", "..", "../a.sh", "dir/a.sh", "/etc/a.sh", "a\x00"} {
+		err := cfg(n).validate()
+		require.NotNil(t, err, "name=%q", n)
+		require.Contains(t, err.Error(), "invalid file name in 'fileNames'", "name=%q", n)
+	}
+	for _, n := range []string{"stdout", "stderr"} {
+		err := cfg(n).validate()
+		require.NotNil(t, err, "name=%q", n)
+		require.Contains(t, err.Error(), "reserved for the command output")
+	}
+
+	h := cfg("", "0_1")
+	h.publicSettings.IndexedFileNames = true
+	require.EqualError(t, h.validate(), `file name "0_1" in 'fileNames' at index 1 is the indexed name of the file at index 0`)
+	h = cfg("", "1")
+	h.publicSettings.IndexedFileNames = true
+	require.Nil(t, h.validate())
+}
+
+func Test_handlerSettings_fileName(t *testing.T) {
+	h := handlerSettings{publicSettings: publicSettings{
+		FileURLs:  []string{"http://a/1", "http://a/2", "http://a/3"},
+		FileNames: []string{"", "b"},
+	}}
+	require.Equal(t, "", h.fileName(0))
+	require.Equal(t, "b", h.fileName(1))
+	require.Equal(t, "", h.fileName(2), "missing entry")
+
+	h.publicSettings.IndexedFileNames = true
+	h.publicSettings.FileURLs = append(h.publicSettings.FileURLs, "http://a/")
+	require.Equal(t, "0_1", h.fileName(0))
+	require.Equal(t, "b", h.fileName(1), "specified names are not indexed")
+	require.Equal(t, "2_3", h.fileName(2))
+	require.Equal(t, "", h.fileName(3), "no name in URL")
+
+	h.publicSettings.ScriptFile = "2_3"
+	require.Equal(t, 2, h.scriptFileIndex())
+}
+
+// firstProblem returns the first problem found by check, if any.
+func firstProblem(check func(*settingChecks)) error {
+	var c settingChecks
+	check(&c)
+	return c.err()
+}
+
+func Test_handlerSettings_validateFileModes(t *testing.T) {
+	urls := []string{"http://a/1", "http://a/2"}
+	require.Nil(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, FileMode: "0755", FileModes: []string{"", "644"}}}.validateFileModes))
+
+	require.EqualError(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, FileMode: "0955"}}.validateFileModes),
+		`invalid 'fileMode': "0955" is not an octal file mode such as "0755"`)
+	require.EqualError(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, FileMode: "rwxr-xr-x"}}.validateFileModes),
+		`invalid 'fileMode': "rwxr-xr-x" is not an octal file mode such as "0755"`)
+	require.EqualError(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, FileModes: []string{"", "4755"}}}.validateFileModes),
+		`invalid mode in 'fileModes' at index 1: "4755" is not an octal file mode such as "0755"`)
+	require.EqualError(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, FileModes: []string{"0111"}}}.validateFileModes),
+		`invalid mode in 'fileModes' at index 0: file mode "0111" does not allow the owner to read the file`)
+	require.Equal(t, errFileModesTooMany, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, FileModes: []string{"", "", ""}}}.validateFileModes))
+}
+
+func Test_handlerSettings_validateScriptFile(t *testing.T) {
+	urls := []string{"http://a/dir/setup.sh?sv=1", "http://a/2"}
+	require.Nil(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls}}.validateScriptFile), "not specified")
+	require.Nil(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, ScriptFile: "setup.sh"}}.validateScriptFile), "name from URL")
+	require.Nil(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, FileNames: []string{"", "run.sh"}, ScriptFile: "run.sh"}}.validateScriptFile), "name from fileNames")
+	require.Nil(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, ScriptFile: "setup.sh", CommandToExecute: "date"}}.validateScriptFile), "with commandToExecute")
+
+	require.EqualError(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, FileNames: []string{"other.sh"}, ScriptFile: "setup.sh"}}.validateScriptFile),
+		`'scriptFile' "setup.sh" is not the name of a file downloaded from 'fileUris'`)
+	require.EqualError(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		ScriptFile: "setup.sh"}}.validateScriptFile),
+		`'scriptFile' "setup.sh" is not the name of a file downloaded from 'fileUris'`)
+	require.Equal(t, errScriptFileAndCommands, firstProblem(handlerSettings{
+		publicSettings{FileURLs: urls, ScriptFile: "setup.sh"},
+		protectedSettings{Commands: []string{"date"}}}.validateScriptFile))
+
+	urls = []string{"http://a/{vmName}.sh", "http://a/{{vmName}}.sh"}
+	require.Equal(t, errScriptFileMetadata, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, ScriptFile: "{vmName}.sh", SubstituteMetadata: true}}.validateScriptFile))
+	require.Nil(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, ScriptFile: "{{vmName}}.sh", SubstituteMetadata: true}}.validateScriptFile), "escaped")
+	require.Nil(t, firstProblem(handlerSettings{publicSettings: publicSettings{
+		FileURLs: urls, ScriptFile: "{vmName}.sh"}}.validateScriptFile), "not substituted")
+}
+
+func Test_handlerSettings_fileMode(t *testing.T) {
+	h := handlerSettings{publicSettings: publicSettings{
+		FileURLs:  []string{"http://a/1", "http://a/2", "http://a/3"},
+		FileModes: []string{"", "0644"}}}
+	require.Equal(t, defaultFileMode, h.fileMode(0))
+	require.Equal(t, os.FileMode(0644), h.fileMode(1))
+	require.Equal(t, defaultFileMode, h.fileMode(2), "missing entry")
+
+	h.publicSettings.FileMode = "755"
+	require.Equal(t, os.FileMode(0755), h.fileMode(0))
+	require.Equal(t, os.FileMode(0644), h.fileMode(1), "per-file mode overrides fileMode")
+	require.Equal(t, os.FileMode(0755), h.fileMode(2))
+}
+
+func Test_handlerSettings_fileDir(t *testing.T) {
+	h := handlerSettings{publicSettings: publicSettings{
+		FileURLs:        []string{"http://a/1", "http://a/2", "http://a/3"},
+		DestinationDirs: []string{"", "/opt/b"}}}
+	require.Equal(t, "", h.fileDir(0), "download directory")
+	require.Equal(t, "/opt/b", h.fileDir(1))
+	require.Equal(t, []string{"/opt/b"}, h.destinationDirs())
+
+	h.publicSettings.DestinationDir = "/opt/a"
+	require.Equal(t, "/opt/a", h.fileDir(0))
+	require.Equal(t, "/opt/b", h.fileDir(1), "per-file directory overrides destinationDir")
+	require.Equal(t, "/opt/a", h.fileDir(2), "missing entry")
+	require.Equal(t, []string{"/opt/a", "/opt/b"}, h.destinationDirs())
+}
+
+func Test_handlerSettings_validateDestinationDirs(t *testing.T) {
+	valid := handlerSettings{publicSettings: publicSettings{
+		CommandToExecute: "date",
+		FileURLs:         []string{"http://a/1", "http://a/2"},
+		DestinationDir:   "/opt/app",
+		DestinationDirs:  []string{"", filepath.Join(filepath.Dir(dataDir), "custom-script-assets")}}}
+	require.Nil(t, valid.validate())
+
+	h := valid
+	h.publicSettings.DestinationDirs = []string{"", "", "/opt/c"}
+	require.Equal(t, errDestinationDirsTooMany, h.validate())
+
+	for _, d := range []string{"opt/app", dataDir, filepath.Join(dataDir, "download", "../assets")} {
+		h := valid
+		h.publicSettings.DestinationDir = d
+		require.NotNil(t, h.validate(), d)
+	}
+	h = valid
+	h.publicSettings.DestinationDirs = []string{"", "assets"}
+	require.EqualError(t, h.validate(), `directory in 'destinationDirs' at index 1 must be an absolute path: "assets"`)
+}
+
+func Test_handlerSettings_expandCommand(t *testing.T) {
+	cmd := `echo ${GREETING} ${TOKEN} $HOME $${GREETING} ${MISSING}-x`
+	h := handlerSettings{
+		publicSettings{CommandToExecute: cmd, EnvironmentVariables: map[string]string{"GREETING": "hello", "TOKEN": "public"}},
+		protectedSettings{EnvironmentVariables: map[string]string{"TOKEN": "secret"}},
+	}
+	out, err := h.expandCommand(cmd)
+	require.Nil(t, err)
+	require.Equal(t, cmd, out, "not expanded by default")
+
+	h.publicSettings.ExpandVariables = true
+	require.Nil(t, h.validate())
+	out, err = h.expandCommand(cmd)
+	require.Nil(t, err)
+	require.Equal(t, `echo hello ${TOKEN} $HOME ${GREETING} -x`, out, "protected variables left to the shell")
+
+	h.publicSettings.ExpandVariablesStrict = true
+	_, err = h.expandCommand(cmd)
+	require.EqualError(t, err, "undefined variables referenced in 'commandToExecute' with 'expandVariablesStrict': MISSING")
+	require.NotNil(t, h.validate(), "checked in validation")
+	out, err = h.expandCommand("echo ${GREETING}")
+	require.Nil(t, err)
+	require.Equal(t, "echo hello", out)
+
+	h.publicSettings.ExpandVariables = false
+	require.Equal(t, errExpandStrictNoExpand, h.validate())
+}
+
+func Test_handlerSettings_umask(t *testing.T) {
+	require.Nil(t, handlerSettings{}.umask())
+	for s, m := range map[string]os.FileMode{"0022": 0022, "027": 0027, "000": 0} {
+		h := handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", Umask: s}}
+		require.Nil(t, h.validate(), s)
+		require.Equal(t, m, *h.umask(), s)
+		require.Equal(t, m, *h.execOptions().Umask, s)
+	}
+	for _, s := range []string{"22", "0899", "u=rwx", "00022"} {
+		err := handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", Umask: s}}.validate()
+		require.NotNil(t, err, s)
+		require.Contains(t, err.Error(), "invalid 'umask'", s)
+	}
+}
+
+func Test_handlerSettings_priority(t *testing.T) {
+	n := 10
+	h := handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", Niceness: &n}}
+	require.Nil(t, h.validate())
+	require.Equal(t, 10, *h.execOptions().Niceness)
+	require.Equal(t, 0, h.execOptions().IOPriority, "inherited")
+
+	h.publicSettings.IoniceClass = "idle"
+	require.Equal(t, 3<<13, h.ioPriority())
+	h.publicSettings.IoniceClass = "best-effort"
+	require.Equal(t, 2<<13|4, h.ioPriority())
+	level := 7
+	h.publicSettings.IoniceLevel = &level
+	require.Nil(t, h.validate())
+	require.Equal(t, 2<<13|7, h.execOptions().IOPriority)
+
+	h.publicSettings.IoniceClass = "idle"
+	require.Equal(t, errIoniceLevelNoBestEffort, h.validate())
+}
+
+func Test_handlerSettings_systemdScope(t *testing.T) {
+	h := handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", UseSystemdScope: true}}
+	require.Nil(t, h.validate())
+	require.Nil(t, h.systemdProperties())
+
+	h.publicSettings.MemoryLimitMB, h.publicSettings.CPUQuota = 2048, 200
+	require.Nil(t, h.validate(), "limits of the scope")
+	require.Equal(t, []string{"MemoryMax=2147483648", "MemorySwapMax=0", "CPUQuota=200%"}, h.systemdProperties())
+	h.publicSettings.MemoryLimitMB = 0
+	require.Equal(t, []string{"CPUQuota=200%"}, h.systemdProperties())
+}
+
+func Test_handlerSettings_chrootDir(t *testing.T) {
+	h := handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", ChrootDir: "/mnt/target"}}
+	require.Nil(t, h.validate())
+	for _, d := range []string{"mnt/target", "/", "/mnt/.."} {
+		h.publicSettings.ChrootDir = d
+		require.Equal(t, errChrootDirNotAbsolute, h.validate(), d)
+	}
+
+	h.publicSettings.ChrootDir, h.publicSettings.UseSystemdScope = "/mnt/target", true
+	require.Equal(t, errChrootDirConflict, h.validate())
+	h.publicSettings.UseSystemdScope, h.publicSettings.RunInBackground = false, true
+	require.Equal(t, errChrootDirConflict, h.validate())
+	h.publicSettings.RunInBackground, h.publicSettings.RunAsUser = false, "deploy"
+	require.Equal(t, errChrootDirConflict, h.validate())
+}
+
+func Test_handlerSettings_cgroupLimits(t *testing.T) {
+	h := handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", MemoryLimitMB: 512, CPUQuota: 50}}
+	require.Nil(t, h.validate())
+	require.EqualValues(t, 512<<20, h.memoryLimitBytes())
+	require.EqualValues(t, 0, handlerSettings{}.memoryLimitBytes())
+}
+
+func Test_handlerSettings_validateSkipExecution(t *testing.T) {
+	require.Nil(t, handlerSettings{publicSettings: publicSettings{
+		FileURLs: []string{"http://a/1"}, SkipExecution: true}}.validate(), "command is not required")
+	require.Nil(t, handlerSettings{publicSettings: publicSettings{
+		CommandToExecute: "date", SkipExecution: true}}.validate())
+	require.Equal(t, errSkipExecutionAndCleanup, handlerSettings{publicSettings: publicSettings{
+		CommandToExecute: "date", SkipExecution: true, CleanupAfterRun: true}}.validate())
+}
+
+func Test_handlerSettings_validateRunInBackground(t *testing.T) {
+	require.Nil(t, handlerSettings{publicSettings: publicSettings{
+		CommandToExecute: "./daemon", RunInBackground: true, OperationTimeoutSeconds: 10}}.validate())
+	for _, s := range []handlerSettings{
+		{publicSettings: publicSettings{Commands: []string{"a", "b"}, RunInBackground: true}},
+		{publicSettings: publicSettings{RunInBackground: true}, protectedSettings: protectedSettings{Script: "ZGF0ZQ=="}},
+		{publicSettings: publicSettings{CommandToExecute: "date", RunInBackground: true, TimeoutSeconds: 10}},
+		{publicSettings: publicSettings{CommandToExecute: "date", RunInBackground: true, CommandRetryCount: 1}},
+		{publicSettings: publicSettings{CommandToExecute: "date", RunInBackground: true, CleanupAfterRun: true}},
+		{publicSettings: publicSettings{CommandToExecute: "date", RunInBackground: true, SkipExecution: true}},
+	} {
+		require.Equal(t, errRunInBackgroundConflict, s.validate(), "%+v", s.publicSettings)
+	}
+}
+
+func Test_handlerSettings_validateRunOnce(t *testing.T) {
+	require.Nil(t, handlerSettings{publicSettings: publicSettings{
+		CommandToExecute: "date", RunOnce: true, RunOnceResetTag: "2"}}.validate())
+	require.Equal(t, errRunOnceAndBackground, handlerSettings{publicSettings: publicSettings{
+		CommandToExecute: "./daemon", RunOnce: true, RunInBackground: true}}.validate())
+	require.Equal(t, errRunOnceResetTagNoRunOnce, handlerSettings{publicSettings: publicSettings{
+		CommandToExecute: "date", RunOnceResetTag: "2"}}.validate())
+}
+
+func Test_handlerSettings_validateDownloadHeaders(t *testing.T) {
+	for _, headers := range []map[string]string{
+		{"X Api": "a"},
+		{"": "a"},
+		{"range": "bytes=0-1"},
+		{"Host": "example.com"},
+		{"X-Api-Key": "a\r\nX-Other: b"},
+	} {
+		h := handlerSettings{publicSettings: publicSettings{CommandToExecute: "date"},
+			protectedSettings: protectedSettings{DownloadHeaders: headers}}
+		err := h.validate()
+		require.NotNil(t, err, "%v", headers)
+		require.Contains(t, err.Error(), "invalid 'downloadHeaders'")
+		require.NotContains(t, err.Error(), "X-Other", "value is not included")
+	}
+
+	h := handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", FileURLs: []string{"http://a/1"}},
+		protectedSettings: protectedSettings{DownloadHeaders: map[string]string{"X-Api-Key": "a"},
+			FileDownloadHeaders: []fileHeaders{{URL: "http://a/1", Headers: map[string]string{"X-Api-Key": "b"}}}}}
+	require.Nil(t, h.validate())
+	h.protectedSettings.FileDownloadHeaders = append(h.protectedSettings.FileDownloadHeaders, fileHeaders{URL: "http://a/1"})
+	require.EqualError(t, h.validate(), "'fileDownloadHeaders' at index 1 has the same URL as a previous one")
+	h.protectedSettings.FileDownloadHeaders[1].URL = "http://a/2"
+	require.EqualError(t, h.validate(), "'fileDownloadHeaders' at index 1 is not for a URL in 'fileUris'")
+	h.protectedSettings.FileDownloadHeaders = []fileHeaders{{URL: "http://a/1", Headers: map[string]string{"Content-Length": "1"}}}
+	require.EqualError(t, h.validate(), `invalid 'fileDownloadHeaders' at index 0: header "Content-Length" cannot be specified`)
+}
+
+func Test_publicSettings_fileMirrors(t *testing.T) {
+	var p publicSettings
+	require.Nil(t, json.Unmarshal([]byte(`{"commandToExecute": "date", "fileUris": [
+		"https://a/1.sh", {"urls": ["https://a/2.sh"]}, {"urls": ["https://a/3.sh", "https://b/3.sh", "https://c/3.sh"]}]}`), &p))
+	require.Equal(t, "date", p.CommandToExecute)
+	require.Equal(t, []string{"https://a/1.sh", "https://a/2.sh", "https://a/3.sh"}, p.FileURLs)
+	require.Equal(t, [][]string{nil, nil, {"https://b/3.sh", "https://c/3.sh"}}, p.FileMirrorURLs)
+
+	h := handlerSettings{publicSettings: p}
+	require.Nil(t, h.validate())
+	require.Nil(t, h.fileMirrors(0))
+	require.Equal(t, []string{"https://b/3.sh", "https://c/3.sh"}, h.fileMirrors(2))
+	require.True(t, h.isFileURL("https://c/3.sh"))
+	require.False(t, h.isFileURL("https://c/1.sh"))
+
+	require.Nil(t, json.Unmarshal([]byte(`{"fileUris": ["https://a/1.sh"]}`), &p))
+	require.Nil(t, p.FileMirrorURLs, "no mirrors")
+	require.NotNil(t, json.Unmarshal([]byte(`{"fileUris": [{"urls": "https://a/1.sh"}]}`), &p))
+
+	h.publicSettings.FileMirrorURLs[2][1] = "/c/3.sh"
+	require.EqualError(t, h.validate(), `invalid mirror URL 2 in 'fileUris' at index 2: not an absolute URL (local paths are not allowed): "/c/3.sh"`)
+}
+
+func Test_publicSettings_archiveChecks(t *testing.T) {
+	var p publicSettings
+	require.Nil(t, json.Unmarshal([]byte(`{"commandToExecute": "date", "extractArchives": true, "fileUris": [
+		"https://a/1.sh", {"urls": ["https://a/2.tgz"], "expectedFileCount": 3}, {"urls": ["https://a/3.zip"], "expectedFileCount": 0, "expectedExtractedSize": 1024}]}`), &p))
+	require.Len(t, p.ArchiveChecks, 3)
+	h := handlerSettings{publicSettings: p}
+	require.Nil(t, h.validate())
+	require.False(t, h.archiveCheck(0).isSet())
+	require.Equal(t, 3, *h.archiveCheck(1).FileCount)
+	require.Nil(t, h.archiveCheck(1).Size)
+	require.Equal(t, 0, *h.archiveCheck(2).FileCount)
+	require.Equal(t, int64(1024), *h.archiveCheck(2).Size)
+	require.False(t, h.archiveCheck(3).isSet())
+
+	h.publicSettings.ExtractArchives = false
+	require.EqualError(t, h.validate(), "'expectedFileCount' and 'expectedExtractedSize' in 'fileUris' at index 1 can only be specified with 'extractArchives'")
+	h.publicSettings.ExtractArchives = true
+	h.publicSettings.FileNames = []string{"", "2.sh"}
+	require.EqualError(t, h.validate(), `'expectedFileCount' and 'expectedExtractedSize' in 'fileUris' at index 1 can only be specified for archives, "2.sh" is not one`)
+
+	require.Nil(t, json.Unmarshal([]byte(`{"fileUris": [{"urls": ["https://a/1.tgz"]}]}`), &p))
+	require.Nil(t, p.ArchiveChecks, "no checks")
+}
+
+func Test_publicSettings_osMatch(t *testing.T) {
+	var p publicSettings
+	require.Nil(t, json.Unmarshal([]byte(`{"commandToExecute": "date", "fileUris": [
+		"https://a/1.sh", {"urls": ["https://a/2.sh"], "osMatch": [{"distro": "ubuntu", "version": "22.*"}]}]}`), &p))
+	h := handlerSettings{publicSettings: p}
+	require.Nil(t, h.validate())
+	require.Nil(t, h.fileOSMatch(0))
+	require.Equal(t, []osMatch{{Distro: "ubuntu", Version: "22.*"}}, h.fileOSMatch(1))
+	require.Nil(t, h.fileOSMatch(2))
+
+	h.publicSettings.FileOSMatches[1][0].Version = "22.["
+	require.EqualError(t, h.validate(), `invalid predicate 0 of 'osMatch' in 'fileUris' at index 1: invalid glob "22.[": syntax error in pattern`)
+	h.publicSettings.FileOSMatches = append(h.publicSettings.FileOSMatches, nil)
+	require.Equal(t, errOSMatchesTooMany, h.validate())
+
+	require.Nil(t, json.Unmarshal([]byte(`{"fileUris": [{"urls": ["https://a/1.sh"]}]}`), &p))
+	require.Nil(t, p.FileOSMatches, "no predicates")
+}
+
+func Test_protectedSettings_unmarshal(t *testing.T) {
+	var p protectedSettings
+	require.Nil(t, json.Unmarshal([]byte(`{"storageAccountKey": "key", "commands": ["a", "b"], "parallelCommands": ["c"],
+		"environmentVariables": {"TOKEN": "secret"}}`), &p))
+	require.Equal(t, "key", p.StorageAccountKey)
+	require.Equal(t, []string{"a", "b"}, p.Commands)
+	require.Equal(t, []string{"c"}, p.ParallelCommands)
+	require.Equal(t, map[string]string{"TOKEN": "secret"}, p.EnvironmentVariables)
+
+	h := handlerSettings{protectedSettings: p}
+	require.Equal(t, []string{"a", "b"}, h.commands())
+	require.Equal(t, []string{"c"}, h.parallelCommands())
+	require.NotNil(t, json.Unmarshal([]byte(`{"commands": "a"}`), &p))
+}
+
+func Test_handlerSettings_validateFileCredentials(t *testing.T) {
+	valid := handlerSettings{
+		publicSettings{CommandToExecute: "date", FileURLs: []string{
+			"https://a.blob.core.windows.net/c/a.sh", "https://b.blob.core.windows.net/c/b.sh", "https://example.com/c.sh"}},
+		protectedSettings{FileCredentials: []fileCredential{{URL: "https://b.blob.core.windows.net/c/b.sh"}}}}
+	require.Nil(t, valid.validate())
+	require.Equal(t, "https://b.blob.core.windows.net/c/b.sh", valid.fileCredential("https://b.blob.core.windows.net/c/b.sh").URL)
+	require.Nil(t, valid.fileCredential("https://a.blob.core.windows.net/c/a.sh"))
+
+	for _, c := range []struct {
+		creds []fileCredential
+		err   string
+	}{
+		{[]fileCredential{{URL: "https://b.blob.core.windows.net/c/b.sh"}, {URL: "https://b.blob.core.windows.net/c/b.sh"}},
+			"'fileCredentials' at index 1 has the same URL as a previous one"},
+		{[]fileCredential{{URL: "https://b.blob.core.windows.net/c/other.sh"}},
+			"'fileCredentials' at index 0 is not for a URL in 'fileUris'"},
+		{[]fileCredential{{URL: "https://example.com/c.sh"}},
+			"'fileCredentials' at index 0 is not for an Azure Blob URL"},
+	} {
+		h := valid
+		h.protectedSettings.FileCredentials = c.creds
+		err := h.validate()
+		require.NotNil(t, err, c.err)
+		require.Contains(t, err.Error(), c.err)
+	}
+}
+
+func Test_handlerSettings_validateFileMappings(t *testing.T) {
+	valid := handlerSettings{publicSettings: publicSettings{
+		CommandToExecute: "date",
+		FileMappings:     []fileMapping{{"bundle/bin/*", "bin/"}, {"app-?.conf", "conf/./app.conf"}}}}
+	require.Nil(t, valid.validate())
+
+	for _, m := range []fileMapping{
+		{"", "a"},
+		{"a", ""},
+		{"/etc/passwd", "a"},
+		{"a", "/etc/cron.d/a"},
+		{"a", "../a"},
+		{"../*", "a"},
+		{"a", "b/../../a"},
+		{"[a", "b"},
+	} {
+		h := valid
+		h.publicSettings.FileMappings = []fileMapping{{"a", "b"}, m}
+		err := h.validate()
+		require.NotNil(t, err, "%v", m)
+		require.Contains(t, err.Error(), "invalid mapping in 'fileMappings' at index 1", "%v", m)
+	}
+}
+
+func Test_handlerSettings_validateCommandToExecute(t *testing.T) {
+	for _, c := range []struct {
+		pub, prot string
+		err       error
+		cmd       string
+	}{
+		{"", "", errCmdMissing, ""},
+		{" \n\t", "", errCmdMissing, ""},
+		{"", " ", errCmdMissing, ""},
+		{" ", "\t", errCmdMissing, ""},
+		{"date", "", nil, "date"},
+		{"", "date", nil, "date"},
+		{" ", "date", nil, "date"},
+		{"date", " ", nil, "date"},
+		{"date", "date", errCmdTooMany, ""},
+	} {
+		h := handlerSettings{
+			publicSettings{CommandToExecute: c.pub},
+			protectedSettings{CommandToExecute: c.prot}}
+		require.Equal(t, c.err, h.validate(), "public=%q protected=%q", c.pub, c.prot)
+		if c.err == nil {
+			require.Equal(t, c.cmd, h.commandToExecute(), "public=%q protected=%q", c.pub, c.prot)
+		}
+	}
+
+	// the command is not needed with the alternatives
+	require.Nil(t, handlerSettings{publicSettings: publicSettings{Commands: []string{"date"}}}.validate())
+	require.Nil(t, handlerSettings{protectedSettings: protectedSettings{
+		Script: base64.StdEncoding.EncodeToString([]byte("date"))}}.validate())
+	require.Nil(t, handlerSettings{publicSettings: publicSettings{
+		FileURLs: []string{"http://a/run.sh"}, ScriptFile: "run.sh"}}.validate())
+
+	require.EqualError(t, handlerSettings{protectedSettings: protectedSettings{
+		Commands: []string{"date", " "}}}.validate(), "empty command in 'commands' at index 1")
+}
+
+func Test_parseAndValidateSettings_settingsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "1.settings"), []byte(`{"runtimeSettings": [{"handlerSettings": {
+		"publicSettings": {"commandToExecute": "date"}}}]}`), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "10.settings"), []byte(`{"runtimeSettings": [{"handlerSettings": {
+		"publicSettings": {"commandToExecute": ""}}}]}`), 0600))
+
+	var out bytes.Buffer
+	_, err = parseAndValidateSettings(log.NewContext(log.NewLogfmtLogger(&out)), dir)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "settings file "+filepath.Join(dir, "10.settings")+": invalid configuration")
+	require.Contains(t, out.String(), "files=1.settings,10.settings selected=10.settings")
+
+	require.Nil(t, os.Remove(filepath.Join(dir, "10.settings")))
+	h, err := parseAndValidateSettings(log.NewContext(log.NewNopLogger()), dir)
+	require.Nil(t, err)
+	require.Equal(t, "date", h.commandToExecute())
+
+	require.Nil(t, os.Remove(filepath.Join(dir, "1.settings")))
+	_, err = parseAndValidateSettings(log.NewContext(log.NewNopLogger()), dir)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to find settings file in "+dir)
+}
+
+func Test_handlerSettings_fileHash(t *testing.T) {
+	h := handlerSettings{publicSettings: publicSettings{
+		FileURLs:   []string{"http://a/1", "http://a/2", "http://a/3"},
+		FileHashes: []string{"", "abc"}}}
+	require.Equal(t, "", h.fileHash(0))
+	require.Equal(t, "abc", h.fileHash(1))
+	require.Equal(t, "", h.fileHash(2), "missing entry")
+}
+
+func Test_handlerSettings_maxConcurrentDownloads(t *testing.T) {
+	require.Equal(t, defaultMaxConcurrentDownloads, handlerSettings{}.maxConcurrentDownloads())
+	require.Equal(t, 8, handlerSettings{
+		publicSettings: publicSettings{MaxConcurrentDownloads: 8},
+	}.maxConcurrentDownloads())
+}
+
+func Test_handlerSettings_retryPolicy(t *testing.T) {
+	require.Equal(t, download.DefaultRetryPolicy, handlerSettings{}.retryPolicy())
+
+	n := 0
+	require.Equal(t, download.RetryPolicy{Retries: 0, Interval: 5 * time.Second}, handlerSettings{
+		publicSettings: publicSettings{DownloadRetryCount: &n, DownloadRetryIntervalSeconds: 5},
+	}.retryPolicy())
+}
+
+func Test_handlerSettings_commandRetryInterval(t *testing.T) {
+	require.Equal(t, defaultCommandRetryInterval, handlerSettings{}.commandRetryInterval())
+	require.Equal(t, 30*time.Second, handlerSettings{
+		publicSettings: publicSettings{CommandRetryIntervalSeconds: 30},
+	}.commandRetryInterval())
+}
+
+func Test_handlerSettings_enableRetryInterval(t *testing.T) {
+	require.Equal(t, defaultEnableRetryInterval, handlerSettings{}.enableRetryInterval())
+	require.Equal(t, 5*time.Second, handlerSettings{
+		publicSettings: publicSettings{EnableRetryIntervalSeconds: 5},
+	}.enableRetryInterval())
+}
+
+func Test_handlerSettings_timeouts(t *testing.T) {
+	require.Equal(t, download.DefaultConnectTimeout, handlerSettings{}.connectTimeout())
+	require.Equal(t, download.DefaultResponseHeaderTimeout, handlerSettings{}.responseHeaderTimeout())
+
+	h := handlerSettings{publicSettings: publicSettings{ConnectTimeoutSeconds: 5, ResponseHeaderTimeoutSeconds: 60}}
+	require.Equal(t, 5*time.Second, h.connectTimeout())
+	require.Equal(t, time.Minute, h.responseHeaderTimeout())
+}
+
+func Test_handlerSettings_heartbeatInterval(t *testing.T) {
+	require.Equal(t, defaultHeartbeatInterval, handlerSettings{}.heartbeatInterval())
+	require.Equal(t, 5*time.Second, handlerSettings{
+		publicSettings: publicSettings{HeartbeatIntervalSeconds: 5},
+	}.heartbeatInterval())
+}
+
+func Test_handlerSettings_progressInterval(t *testing.T) {
+	require.Equal(t, defaultProgressInterval, handlerSettings{}.progressInterval())
+	require.Equal(t, 30*time.Second, handlerSettings{
+		publicSettings: publicSettings{ProgressIntervalSeconds: 30},
+	}.progressInterval())
+}
+
+func Test_handlerSettings_statusVerbosity(t *testing.T) {
+	sub := []substatus{newSubstatus("a", "success", "")}
+	require.Equal(t, statusVerbosityNormal, handlerSettings{}.statusVerbosity())
+	require.EqualValues(t, defaultMaxStatusOutputBytes, handlerSettings{}.maxStatusOutputBytes())
+	require.Equal(t, sub, handlerSettings{}.reportedSubstatuses(sub))
+
+	minimal := handlerSettings{publicSettings: publicSettings{StatusVerbosity: statusVerbosityMinimal}}
+	require.Nil(t, minimal.reportedSubstatuses(sub))
+
+	verbose := handlerSettings{publicSettings: publicSettings{StatusVerbosity: statusVerbosityVerbose}}
+	require.EqualValues(t, verboseMaxStatusOutputBytes, verbose.maxStatusOutputBytes())
+	require.Equal(t, sub, verbose.reportedSubstatuses(sub))
+	verbose.publicSettings.MaxStatusOutputBytes = 100
+	require.EqualValues(t, 100, verbose.maxStatusOutputBytes(), "explicit value takes precedence")
+}
+
+func Test_handlerSettings_operationTimeout(t *testing.T) {
+	require.Equal(t, time.Duration(0), handlerSettings{}.operationTimeout())
+	require.Equal(t, 10*time.Minute, handlerSettings{
+		publicSettings: publicSettings{OperationTimeoutSeconds: 600},
+	}.operationTimeout())
+}
+
+func Test_handlerSettings_environmentVariables(t *testing.T) {
+	require.Nil(t, handlerSettings{}.environmentVariables())
+	require.Equal(t, map[string]string{"A": "pub", "B": "prot", "C": "prot"}, handlerSettings{
+		publicSettings:    publicSettings{EnvironmentVariables: map[string]string{"A": "pub", "B": "pub"}},
+		protectedSettings: protectedSettings{EnvironmentVariables: map[string]string{"B": "prot", "C": "prot"}},
+	}.environmentVariables(), "protected settings take precedence")
+}
+
+func Test_handlerSettings_secretsDeliveryMode(t *testing.T) {
+	h := handlerSettings{
+		publicSettings:    publicSettings{CommandToExecute: "echo ${A} ${B}", EnvironmentVariables: map[string]string{"A": "pub", "B": "pub"}, ExpandVariables: true},
+		protectedSettings: protectedSettings{EnvironmentVariables: map[string]string{"B": "prot"}},
+	}
+	require.Nil(t, h.secretVariables(), "in the environment by default")
+
+	h.publicSettings.SecretsDeliveryMode = "file"
+	require.Nil(t, h.validate())
+	require.Equal(t, map[string]string{"A": "pub", "B": "pub"}, h.environmentVariables())
+	require.Equal(t, map[string]string{"B": "prot"}, h.secretVariables())
+	out, err := h.expandCommand(h.commandToExecute())
+	require.Nil(t, err)
+	require.Equal(t, "echo pub ${B}", out, "secrets not in the command line")
+
+	h.publicSettings.ExpandVariables = false
+	h.publicSettings.RunInBackground = true
+	require.Equal(t, errSecretsFileAndBackground, h.validate())
 }
 
 func Test_toJSON_empty(t *testing.T) {
@@ -45,3 +896,128 @@ func Test_toJSON(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, `{"a":3}`, s)
 }
+
+func Test_handlerSettings_validateGitRepository(t *testing.T) {
+	for _, u := range []string{"https://github.com/org/repo.git", "ssh://git@host/repo", "git@github.com:org/repo.git"} {
+		require.Nil(t, handlerSettings{
+			publicSettings: publicSettings{CommandToExecute: "date", GitRepository: &gitRepository{URL: u, Branch: "release/1.0", Commit: "0123abc"}},
+		}.validate(), u)
+	}
+	for _, r := range []gitRepository{
+		{URL: "ext::sh -c id"},
+		{URL: "-uhelp"},
+		{URL: "https://h/r", Branch: "--upload-pack=id"},
+		{URL: "https://h/r", Branch: "a b"},
+		{URL: "https://h/r", Commit: "HEAD~1"},
+	} {
+		err := handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", GitRepository: &r}}.validate()
+		require.NotNil(t, err, "%+v", r)
+		require.Contains(t, err.Error(), "invalid 'gitRepository'")
+	}
+
+	err := handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", GitRepository: &gitRepository{URL: "file:///srv/repo"}}}.validate()
+	require.Equal(t, errFileScheme, errors.Cause(err))
+	require.Nil(t, handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", AllowFileUris: true,
+		GitRepository: &gitRepository{URL: "file:///srv/repo"}}}.validate())
+
+	require.Equal(t, errGitCredentialsNoRepo, handlerSettings{
+		publicSettings:    publicSettings{CommandToExecute: "date"},
+		protectedSettings: protectedSettings{GitToken: "token"},
+	}.validate())
+	require.Equal(t, errGitUsernameNoToken, handlerSettings{
+		publicSettings:    publicSettings{CommandToExecute: "date", GitRepository: &gitRepository{URL: "https://h/r"}},
+		protectedSettings: protectedSettings{GitUsername: "user"},
+	}.validate())
+}
+
+func Test_handlerSettings_validateMinSuccessfulDownloads(t *testing.T) {
+	pub := publicSettings{CommandToExecute: "date", FileURLs: []string{"http://a/1", "http://a/2"}, MinSuccessfulDownloads: 2}
+	require.Equal(t, errMinDownloadsNoContinue, handlerSettings{publicSettings: pub}.validate())
+	pub.ContinueOnDownloadError = true
+	require.Nil(t, handlerSettings{publicSettings: pub}.validate())
+	pub.MinSuccessfulDownloads = 3
+	require.Equal(t, errMinDownloadsTooMany, handlerSettings{publicSettings: pub}.validate())
+}
+
+func Test_handlerSettings_validateLimits(t *testing.T) {
+	pub := publicSettings{CommandToExecute: "date", FileURLs: make([]string, defaultMaxFileURIs+1)}
+	for i := range pub.FileURLs {
+		pub.FileURLs[i] = fmt.Sprintf("https://example.com/%d.sh", i)
+	}
+	require.EqualError(t, handlerSettings{publicSettings: pub}.validate(), "'fileUris' has 1001 items, more than 'maxFileUris' (1000)")
+	pub.MaxFileURIs = 2000
+	require.Nil(t, handlerSettings{publicSettings: pub}.validate(), "raised")
+
+	long := strings.Repeat("x", defaultMaxCommandLength+1)
+	require.EqualError(t, handlerSettings{protectedSettings: protectedSettings{CommandToExecute: long}}.validate(),
+		"'commandToExecute' is 65537 bytes long, longer than 'maxCommandLength' (65536)")
+	require.EqualError(t, handlerSettings{publicSettings: publicSettings{Commands: []string{"date", long}}}.validate(),
+		"'commands' at index 1 is 65537 bytes long, longer than 'maxCommandLength' (65536)")
+	require.EqualError(t, handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", OnFailureCommand: long}}.validate(),
+		"'onFailureCommand' is 65537 bytes long, longer than 'maxCommandLength' (65536)")
+	require.Nil(t, handlerSettings{publicSettings: publicSettings{CommandToExecute: long, MaxCommandLength: 100000}}.validate(), "raised")
+
+	require.EqualValues(t, defaultMaxTotalDownloadBytes, handlerSettings{}.maxTotalDownloadBytes())
+	require.EqualValues(t, 1, handlerSettings{publicSettings: publicSettings{MaxTotalDownloadBytes: 1}}.maxTotalDownloadBytes())
+}
+
+func Test_parseAndValidateSettings_logicalErrorPointer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "0.settings"), []byte(`{"runtimeSettings": [{"handlerSettings": {
+		"publicSettings": {"commandToExecute": "date", "minSuccessfulDownloads": 1}}}]}`), 0600))
+
+	_, err = parseAndValidateSettings(log.NewContext(log.NewNopLogger()), dir)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid configuration: 2 problems with the settings: /publicSettings/minSuccessfulDownloads: 'minSuccessfulDownloads' can only be specified")
+	require.Equal(t, settingErrors{
+		{"/publicSettings/minSuccessfulDownloads", errMinDownloadsNoContinue.Error()},
+		{"/publicSettings/minSuccessfulDownloads", errMinDownloadsTooMany.Error()},
+	}, errors.Cause(err))
+}
+
+func Test_handlerSettings_check(t *testing.T) {
+	var c settingChecks
+	handlerSettings{}.check(&c)
+	require.Equal(t, settingErrors{{"", errCmdMissing.Error()}}, c.problems, "caused by no single setting")
+
+	c = settingChecks{}
+	handlerSettings{
+		publicSettings{Commands: []string{"date", " "}, FileURLs: []string{"http://a/1"},
+			FileModes: []string{"", "0644"}, FileMappings: []fileMapping{{From: "a", To: "/b"}}},
+		protectedSettings{CommandToExecute: "date", HTTPPassword: "p"}}.check(&c)
+	require.Equal(t, []string{
+		"/publicSettings/commands",
+		"/publicSettings/commands/1",
+		"/publicSettings/fileModes",
+		"/publicSettings/fileMappings/0",
+		"/protectedSettings/httpPassword",
+	}, pointers(c.problems), "all the problems")
+	require.Equal(t, errCmdAndCommands, c.err(), "first")
+}
+
+// pointers returns the pointers of the problems in errs.
+func pointers(errs settingErrors) []string {
+	out := make([]string, len(errs))
+	for i, e := range errs {
+		out[i] = e.Pointer
+	}
+	return out
+}
+
+func Test_handlerSettings_validateOutputBlobURI(t *testing.T) {
+	require.Nil(t, handlerSettings{publicSettings: publicSettings{CommandToExecute: "date",
+		OutputBlobURI: "https://a.blob.core.windows.net/logs?sv=1&sig=x"}}.validate())
+	require.Equal(t, errOutputBlobURINotBlob, handlerSettings{publicSettings: publicSettings{CommandToExecute: "date",
+		OutputBlobURI: "https://example.com/logs"}}.validate())
+}
+
+func Test_handlerSettings_validateReboot(t *testing.T) {
+	require.Nil(t, handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", RebootExitCode: 3, AllowReboot: true}}.validate())
+	require.Equal(t, errRebootAndBackground, handlerSettings{publicSettings: publicSettings{CommandToExecute: "date",
+		RebootExitCode: 3, RunInBackground: true}}.validate())
+	require.Equal(t, defaultMaxReboots, handlerSettings{}.maxReboots())
+	n := 0
+	require.Equal(t, 0, handlerSettings{publicSettings: publicSettings{MaxReboots: &n}}.maxReboots())
+}
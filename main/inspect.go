@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// inspectOut is where the status subcommand prints the extension state.
+var inspectOut io.Writer = os.Stdout
+
+// extensionState is the state of the extension on the VM printed by the status
+// subcommand for debugging.
+type extensionState struct {
+	SeqNum            int                    `json:"seqNum"`                      // of the current configuration
+	ProcessedSeqNum   *int                   `json:"processedSeqNum"`             // nil if none is processed
+	ForceUpdateTag    *string                `json:"forceUpdateTag"`              // of the processed configuration
+	StatusFile        string                 `json:"statusFile,omitempty"`        // most recently written
+	Status            json.RawMessage        `json:"status,omitempty"`            // contents of StatusFile
+	Result            json.RawMessage        `json:"result,omitempty"`            // of the last enable operation
+	PublicSettings    map[string]interface{} `json:"publicSettings,omitempty"`    // with the SAS signatures redacted
+	ProtectedSettings map[string]interface{} `json:"protectedSettings,omitempty"` // with all values redacted
+	Errors            []string               `json:"errors,omitempty"`            // for the state that cannot be read
+
+	protected map[string]interface{} // protected settings as is, not printed
+}
+
+// inspect prints the stored state of the extension and its configuration,
+// with the secrets redacted, to inspectOut. It is read-only: the state is
+// printed even if parts of it cannot be read, and the configuration is not
+// processed.
+func inspect(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) (string, []substatus, error) {
+	s := readExtensionState(h, seqNum)
+
+	// the secrets from the protected settings may appear anywhere, such as in
+	// the command output in the status. They are redacted before marshalling
+	// as the JSON encoding escapes some of their characters.
+	r := new(redactor)
+	r.addSettings(s.protected)
+	if err := s.redact(r); err != nil {
+		return "", nil, err
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to marshal extension state")
+	}
+	if _, err := fmt.Fprintln(inspectOut, string(b)); err != nil {
+		return "", nil, errors.Wrap(err, "failed to print extension state")
+	}
+	return "", nil, nil
+}
+
+// redact replaces the secrets registered in r in all the strings of the state.
+func (s *extensionState) redact(r *redactor) error {
+	if s.ForceUpdateTag != nil {
+		tag := r.redact(*s.ForceUpdateTag)
+		s.ForceUpdateTag = &tag
+	}
+	s.StatusFile = r.redact(s.StatusFile)
+	var err error
+	if s.Status, err = redactJSON(s.Status, r); err != nil {
+		return errors.Wrap(err, "failed to redact status")
+	}
+	if s.Result, err = redactJSON(s.Result, r); err != nil {
+		return errors.Wrap(err, "failed to redact result")
+	}
+	s.PublicSettings, _ = redactStrings(s.PublicSettings, r.redact).(map[string]interface{})
+	for i, e := range s.Errors {
+		s.Errors[i] = r.redact(e)
+	}
+	return nil
+}
+
+// redactJSON returns the given JSON document with the secrets registered in r
+// replaced in its strings, keeping the numbers as they are.
+func redactJSON(b json.RawMessage, r *redactor) (json.RawMessage, error) {
+	if b == nil {
+		return nil, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(redactStrings(v, r.redact))
+}
+
+// readExtensionState reads the state of the extension from the data directory
+// and the directories in h. The errors are recorded in the state.
+func readExtensionState(h vmextension.HandlerEnvironment, seqNum int) *extensionState {
+	s := &extensionState{SeqNum: seqNum}
+	fail := func(err error) { s.Errors = append(s.Errors, err.Error()) }
+
+	if b, err := ioutil.ReadFile(filepath.Join(dataDir, seqNumFile)); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			s.ProcessedSeqNum = &n
+		} else {
+			fail(errors.Wrapf(err, "cannot parse processed sequence number %q", b))
+		}
+	} else if !os.IsNotExist(err) {
+		fail(errors.Wrap(err, "failed to read processed sequence number"))
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dataDir, forceUpdateTagFile)); err == nil {
+		tag := string(b)
+		s.ForceUpdateTag = &tag
+	} else if !os.IsNotExist(err) {
+		fail(errors.Wrap(err, "failed to read forceUpdateTag"))
+	}
+
+	if path, err := latestStatusFile(h.HandlerEnvironment.StatusFolder); err != nil {
+		fail(err)
+	} else if path != "" {
+		s.StatusFile = path
+		if s.Status, err = readJSONFile(path); err != nil {
+			fail(errors.Wrap(err, "failed to read status"))
+		}
+	}
+	if b, err := readJSONFile(filepath.Join(dataDir, resultFile)); err == nil {
+		s.Result = b
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		fail(errors.Wrap(err, "failed to read result"))
+	}
+
+	pub, prot, err := readSettings(h.HandlerEnvironment.ConfigFolder)
+	if err != nil {
+		fail(err)
+		return s
+	}
+	s.PublicSettings, _ = redactSAS(pub).(map[string]interface{})
+	s.ProtectedSettings, _ = redactAll(prot).(map[string]interface{})
+	s.protected = prot
+	return s
+}
+
+// latestStatusFile returns the path of the most recently modified .status
+// file in statusFolder, or empty string if there is none.
+func latestStatusFile(statusFolder string) (string, error) {
+	fis, err := ioutil.ReadDir(statusFolder)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "failed to list status files")
+	}
+	var latest os.FileInfo
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || filepath.Ext(fi.Name()) != ".status" {
+			continue
+		}
+		if latest == nil || fi.ModTime().After(latest.ModTime()) {
+			latest = fi
+		}
+	}
+	if latest == nil {
+		return "", nil
+	}
+	return filepath.Join(statusFolder, latest.Name()), nil
+}
+
+// readJSONFile reads the file at path and checks if it contains valid JSON.
+func readJSONFile(path string) (json.RawMessage, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("%s does not contain valid JSON", path)
+	}
+	return json.RawMessage(b), nil
+}
+
+// redactSAS returns the given settings JSON value with the SAS signatures and
+// the passwords of the URLs in its strings redacted.
+func redactSAS(v interface{}) interface{} {
+	return redactStrings(v, redactURLSecrets)
+}
+
+// redactStrings returns the given JSON value with redact applied to all its
+// strings, including the names in the objects.
+func redactStrings(v interface{}, redact func(string) string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return redact(v)
+	case map[string]interface{}:
+		if v == nil {
+			return v
+		}
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[redact(k)] = redactStrings(e, redact)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = redactStrings(e, redact)
+		}
+		return out
+	}
+	return v
+}
+
+// redactAll returns the given settings JSON value with all the values other
+// than the objects and the arrays replaced, keeping the names of the settings.
+func redactAll(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = redactAll(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = redactAll(e)
+		}
+		return out
+	case nil:
+		return nil
+	}
+	return redacted
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_inspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string, w io.Writer) { dataDir, inspectOut = d, w }(dataDir, inspectOut)
+	dataDir = filepath.Join(dir, "data")
+	configDir, statusDir := filepath.Join(dir, "config"), filepath.Join(dir, "status")
+	for _, d := range []string{dataDir, configDir, statusDir} {
+		require.Nil(t, os.Mkdir(d, 0700))
+	}
+	var h vmextension.HandlerEnvironment
+	h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder = configDir, statusDir
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(configDir, "3.settings"), []byte(`{"runtimeSettings": [{"handlerSettings": {
+		"publicSettings": {"commandToExecute": "date", "fileUris": ["https://a.blob.core.windows.net/c/run.sh?sv=2018&sig=secret"]}}}]}`), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dataDir, seqNumFile), []byte("2"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dataDir, resultFile), []byte(`{"seqNum": 2}`), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(statusDir, "1.status"), []byte(`[{"status": "old"}]`), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(statusDir, "2.status"), []byte(`[{"status": "new"}]`), 0600))
+	old := time.Now().Add(-time.Hour)
+	require.Nil(t, os.Chtimes(filepath.Join(statusDir, "1.status"), old, old))
+
+	var out bytes.Buffer
+	inspectOut = &out
+	_, _, err = inspect(log.NewContext(log.NewNopLogger()), h, 3)
+	require.Nil(t, err)
+
+	var s struct {
+		extensionState
+		Status []map[string]interface{} `json:"status"`
+		Result map[string]interface{}   `json:"result"`
+	}
+	require.Nil(t, json.Unmarshal(out.Bytes(), &s), out.String())
+	require.Equal(t, 3, s.SeqNum)
+	require.Equal(t, 2, *s.ProcessedSeqNum)
+	require.Nil(t, s.ForceUpdateTag)
+	require.Equal(t, filepath.Join(statusDir, "2.status"), s.StatusFile, "most recent")
+	require.Equal(t, "new", s.Status[0]["status"])
+	require.EqualValues(t, 2, s.Result["seqNum"])
+	require.Equal(t, "date", s.PublicSettings["commandToExecute"])
+	require.NotContains(t, out.String(), "secret", "SAS signature is redacted")
+	require.Empty(t, s.Errors)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dataDir, seqNumFile), []byte("x"), 0600))
+	out.Reset()
+	_, _, err = inspect(log.NewContext(log.NewNopLogger()), h, 3)
+	require.Nil(t, err, "errors are reported in the output")
+	require.Contains(t, out.String(), "cannot parse processed sequence number")
+}
+
+func Test_redactAll(t *testing.T) {
+	require.Equal(t, map[string]interface{}{
+		"storageAccountKey": redacted,
+		"commands":          []interface{}{redacted, redacted},
+		"managedIdentity":   map[string]interface{}{"clientId": redacted},
+		"script":            nil,
+	}, redactAll(map[string]interface{}{
+		"storageAccountKey": "key",
+		"commands":          []interface{}{"a", "b"},
+		"managedIdentity":   map[string]interface{}{"clientId": "id"},
+		"script":            nil,
+	}))
+}
+
+func Test_inspect_redactsEscapedSecret(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl is not installed")
+	}
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string, w io.Writer) { dataDir, inspectOut = d, w }(dataDir, inspectOut)
+	defer os.Setenv(certDirsEnvVar, os.Getenv(certDirsEnvVar))
+	dataDir = filepath.Join(dir, "data")
+	configDir, statusDir, certDir := filepath.Join(dir, "config"), filepath.Join(dir, "status"), filepath.Join(dir, "certs")
+	for _, d := range []string{dataDir, configDir, statusDir, certDir} {
+		require.Nil(t, os.Mkdir(d, 0700))
+	}
+	os.Setenv(certDirsEnvVar, certDir)
+	var h vmextension.HandlerEnvironment
+	h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder = configDir, statusDir
+
+	// the JSON encoding escapes these characters in the status, the result
+	// and the output
+	const secret = `echo p&ss<w>rd"\`
+	newSettingsCert(t, certDir, "AAAA")
+	protected := encryptSettings(t, certDir, "AAAA", []byte(`{"commandToExecute": "echo p&ss<w>rd\"\\"}`))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(configDir, "3.settings"), []byte(fmt.Sprintf(
+		`{"runtimeSettings": [{"handlerSettings": {"publicSettings": {}, "protectedSettings": %q, "protectedSettingsCertThumbprint": "AAAA"}}]}`,
+		protected)), 0600))
+	b, err := json.Marshal(map[string]interface{}{"output": "+ " + secret, "seqNum": 3})
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dataDir, resultFile), b, 0600))
+	b, err = json.Marshal([]map[string]string{{"message": "Enable failed: " + secret}})
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(statusDir, "3.status"), b, 0600))
+
+	var out bytes.Buffer
+	inspectOut = &out
+	_, _, err = inspect(log.NewContext(log.NewNopLogger()), h, 3)
+	require.Nil(t, err)
+	require.NotContains(t, out.String(), "p&ss")
+	require.NotContains(t, out.String(), `p\u0026ss`)
+	var s struct {
+		extensionState
+		Status []map[string]interface{} `json:"status"`
+		Result map[string]interface{}   `json:"result"`
+	}
+	require.Nil(t, json.Unmarshal(out.Bytes(), &s), out.String())
+	require.Equal(t, "Enable failed: "+redacted, s.Status[0]["message"])
+	require.Equal(t, "+ "+redacted, s.Result["output"])
+	require.EqualValues(t, 3, s.Result["seqNum"])
+	require.Equal(t, redacted, s.ProtectedSettings["commandToExecute"])
+	require.Empty(t, s.Errors)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// getKeyVaultSecret is the function used to read Key Vault secrets, it is a
+// variable to be replaced in tests.
+var getKeyVaultSecret = download.GetKeyVaultSecret
+
+// resolveKeyVaultReferences replaces the Key Vault secret references in the
+// protected settings of cfg with the values of the secrets, read with the
+// managed identity in cfg or the system-assigned identity of the VM. The
+// values are registered to be redacted from the logs before they are used.
+func resolveKeyVaultReferences(ctx log.Logger, cfg *handlerSettings) error {
+	uri := cfg.protectedSettings.CommandToExecuteFromKeyVault
+	if uri == "" {
+		return nil
+	}
+	var id download.ManagedIdentity
+	if mi := cfg.protectedSettings.ManagedIdentity; mi != nil {
+		id = download.ManagedIdentity{ClientID: mi.ClientID, ObjectID: mi.ObjectID}
+	}
+	ctx.Log("event", "reading command from key vault", "uri", uri)
+	v, err := getKeyVaultSecret(uri, id)
+	if err != nil {
+		return errors.Wrap(err, "failed to read 'commandToExecuteFromKeyVault'")
+	}
+	if v == "" {
+		return errors.New("the secret in 'commandToExecuteFromKeyVault' is empty")
+	}
+	logRedactor.add(v) // never log the value
+	cfg.protectedSettings.CommandToExecute = v
+	ctx.Log("event", "read command from key vault")
+	return nil
+}
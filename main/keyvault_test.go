@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_resolveKeyVaultReferences(t *testing.T) {
+	defer func(f func(string, download.ManagedIdentity) (string, error)) { getKeyVaultSecret = f }(getKeyVaultSecret)
+	var gotID download.ManagedIdentity
+	getKeyVaultSecret = func(uri string, id download.ManagedIdentity) (string, error) {
+		gotID = id
+		switch uri {
+		case "https://v.vault.azure.net/secrets/cmd":
+			return "echo kv-secret-value", nil
+		case "https://v.vault.azure.net/secrets/empty":
+			return "", nil
+		}
+		return "", errors.New("unexpected status code: got=403 expected=200")
+	}
+
+	cfg := handlerSettings{protectedSettings: protectedSettings{
+		CommandToExecuteFromKeyVault: "https://v.vault.azure.net/secrets/cmd",
+		ManagedIdentity:              &managedIdentity{ClientID: "foo"}}}
+	var b bytes.Buffer
+	require.Nil(t, resolveKeyVaultReferences(logRedactor.logger(log.NewLogfmtLogger(&b)), &cfg))
+	require.Equal(t, "echo kv-secret-value", cfg.protectedSettings.CommandToExecute)
+	require.Equal(t, download.ManagedIdentity{ClientID: "foo"}, gotID)
+	log.NewContext(logRedactor.logger(log.NewLogfmtLogger(&b))).Log("command", cfg.protectedSettings.CommandToExecute)
+	require.NotContains(t, b.String(), "kv-secret-value", "value should never be logged")
+
+	cfg = handlerSettings{protectedSettings: protectedSettings{CommandToExecuteFromKeyVault: "https://v.vault.azure.net/secrets/empty"}}
+	require.EqualError(t, resolveKeyVaultReferences(log.NewNopLogger(), &cfg), "the secret in 'commandToExecuteFromKeyVault' is empty")
+	require.Equal(t, download.ManagedIdentity{}, gotID, "system-assigned identity")
+
+	cfg = handlerSettings{protectedSettings: protectedSettings{CommandToExecuteFromKeyVault: "https://v.vault.azure.net/secrets/forbidden"}}
+	require.EqualError(t, resolveKeyVaultReferences(log.NewNopLogger(), &cfg),
+		"failed to read 'commandToExecuteFromKeyVault': unexpected status code: got=403 expected=200")
+
+	require.Nil(t, resolveKeyVaultReferences(log.NewNopLogger(), &handlerSettings{}), "no references")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultLockTimeout is how long enable waits for another enable
+	// operation holding the lock to complete before giving up.
+	defaultLockTimeout = 30 * time.Minute
+
+	// lockPollInterval is how often the lock is tried while waiting.
+	lockPollInterval = time.Second
+)
+
+// heldLock is the lock file acquired by this process, kept referenced so that
+// it is not closed (and the lock released) until the process exits.
+var heldLock *os.File
+
+// acquireLock takes an exclusive flock(2) on the file at path, creating it if
+// needed, waiting up to timeout for another process holding it to release it.
+// The process ID of the holder is written to the file for diagnostics.
+//
+// The lock is released when the returned file is closed or the process exits,
+// including when it crashes, so a lock file left behind never blocks the next
+// operation. The file is not inherited by the executed commands.
+func acquireLock(ctx log.Logger, path string, timeout time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open lock file")
+	}
+	deadline := time.Now().Add(timeout)
+	for waiting := false; ; waiting = true {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, errors.Wrap(err, "failed to lock")
+		}
+		holder := lockHolder(path)
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("another enable operation (pid %s) is still running after waiting for %v", holder, timeout)
+		}
+		if !waiting {
+			ctx.Log("event", "waiting for another enable operation to complete", "pid", holder)
+		}
+		time.Sleep(lockPollInterval)
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	}
+	return f, nil
+}
+
+// lockHolder returns the process ID recorded in the lock file at path, or "?"
+// if it cannot be read.
+func lockHolder(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if s := strings.TrimSpace(string(b)); err == nil && s != "" {
+		return s
+	}
+	return "?"
+}
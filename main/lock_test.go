@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_acquireLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, lockFile)
+
+	// left behind by a crashed process, not locked
+	require.Nil(t, ioutil.WriteFile(path, []byte("99999999\n"), 0600))
+	f, err := acquireLock(log.NewNopLogger(), path, time.Second)
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf("%d", os.Getpid()), lockHolder(path))
+
+	_, err = acquireLock(log.NewNopLogger(), path, 0)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("another enable operation (pid %d) is still running", os.Getpid()))
+
+	done := make(chan error, 1)
+	go func() {
+		f2, err := acquireLock(log.NewNopLogger(), path, time.Minute)
+		if err == nil {
+			f2.Close()
+		}
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	require.Nil(t, f.Close())
+	require.Nil(t, <-done, "acquired after released")
+}
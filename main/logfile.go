@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultLogMaxSizeMB is the size in MiB the log file is rotated at,
+	// unless changed with logMaxSizeEnvVar.
+	defaultLogMaxSizeMB = 10
+
+	// defaultLogMaxFiles is how many rotated log files are retained, unless
+	// changed with logMaxFilesEnvVar.
+	defaultLogMaxFiles = 5
+)
+
+// logRotation returns the size in bytes the log file is rotated at and how
+// many rotated files are retained, from the logMaxSizeEnvVar and
+// logMaxFilesEnvVar environment variables or their defaults. A size of zero
+// disables the rotation. It fails if they are not non-negative integers.
+func logRotation() (maxSize int64, maxFiles int, _ error) {
+	size, files := defaultLogMaxSizeMB, defaultLogMaxFiles
+	for _, v := range []struct {
+		name string
+		n    *int
+	}{{logMaxSizeEnvVar, &size}, {logMaxFilesEnvVar, &files}} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return defaultLogMaxSizeMB << 20, defaultLogMaxFiles, fmt.Errorf("%s must be a non-negative integer: %q", v.name, s)
+		}
+		*v.n = n
+	}
+	return int64(size) << 20, files, nil
+}
+
+// rotatingFile is a log file which is rotated once it would grow beyond
+// maxSize: it is renamed with the suffix ".1", the previously rotated files
+// are renamed with the next suffix, and only the maxFiles most recent ones
+// are retained. It can be written to concurrently by several processes, such
+// as the enable running in the background and a disable: the writes and the
+// rotations are serialized with a flock(2) on a lock file next to it, and
+// each process reopens the file if another one rotated it.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64 // zero to never rotate
+	maxFiles int
+	lock     *os.File // path + ".lock"
+	f        *os.File // opened from path, may have been rotated since
+}
+
+// openRotatingFile opens the log file at path for appending, creating it and
+// its lock file if needed.
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open log lock file")
+	}
+	f, err := openLogFile(path)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles, lock: lock, f: f}, nil
+}
+
+func openLogFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	return f, errors.Wrap(err, "failed to open log file")
+}
+
+// Write appends b to the log file, after rotating it if it would grow beyond
+// the maximum size. A failure to rotate the file does not fail the write.
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := syscall.Flock(int(r.lock.Fd()), syscall.LOCK_EX); err == nil {
+		defer syscall.Flock(int(r.lock.Fd()), syscall.LOCK_UN)
+	}
+
+	if err := r.reopen(); err != nil {
+		return 0, err
+	}
+	if fi, err := r.f.Stat(); err == nil && r.maxSize > 0 && fi.Size() > 0 && fi.Size()+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate log file: %v\n", err)
+		}
+	}
+	return r.f.Write(b)
+}
+
+// reopen opens the file at the path again if it is not the open file, such
+// as after another process rotated it.
+func (r *rotatingFile) reopen() error {
+	cur, err := r.f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat log file")
+	}
+	if fi, err := os.Stat(r.path); err == nil && os.SameFile(cur, fi) {
+		return nil
+	}
+	f, err := openLogFile(r.path)
+	if err != nil {
+		return err
+	}
+	r.f.Close()
+	r.f = f
+	return nil
+}
+
+// rotate renames the log file and the rotated files with the next suffixes,
+// removing the oldest one, and opens a new log file.
+func (r *rotatingFile) rotate() error {
+	rotated := func(i int) string { return fmt.Sprintf("%s.%d", r.path, i) }
+	if err := os.Remove(rotated(r.maxFiles)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove oldest log file")
+	}
+	for i := r.maxFiles - 1; i > 0; i-- {
+		if err := os.Rename(rotated(i), rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to rename log file")
+		}
+	}
+	var err error
+	if r.maxFiles > 0 {
+		err = os.Rename(r.path, rotated(1))
+	} else {
+		err = os.Remove(r.path)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to rotate log file")
+	}
+	return r.reopen()
+}
+
+// Close closes the log file and its lock file.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lock.Close()
+	return r.f.Close()
+}
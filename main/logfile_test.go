@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_logRotation(t *testing.T) {
+	defer os.Setenv(logMaxSizeEnvVar, os.Getenv(logMaxSizeEnvVar))
+	defer os.Setenv(logMaxFilesEnvVar, os.Getenv(logMaxFilesEnvVar))
+	require.Nil(t, os.Setenv(logMaxSizeEnvVar, ""))
+	require.Nil(t, os.Setenv(logMaxFilesEnvVar, ""))
+	size, files, err := logRotation()
+	require.Nil(t, err)
+	require.EqualValues(t, 10<<20, size)
+	require.Equal(t, 5, files)
+
+	require.Nil(t, os.Setenv(logMaxSizeEnvVar, "2"))
+	require.Nil(t, os.Setenv(logMaxFilesEnvVar, "0"))
+	size, files, err = logRotation()
+	require.Nil(t, err)
+	require.EqualValues(t, 2<<20, size)
+	require.Equal(t, 0, files)
+
+	require.Nil(t, os.Setenv(logMaxFilesEnvVar, "-1"))
+	size, files, err = logRotation()
+	require.EqualError(t, err, logMaxFilesEnvVar+` must be a non-negative integer: "-1"`)
+	require.EqualValues(t, 10<<20, size, "defaults")
+	require.Equal(t, 5, files)
+}
+
+func Test_rotatingFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handler.log")
+
+	f, err := openRotatingFile(path, 10, 2)
+	require.Nil(t, err)
+	defer f.Close()
+	for _, s := range []string{"1234\n", "5678\n", "abcd\n", "efgh\n", "ijkl\n", "mnopqrstuvwxyz\n"} {
+		_, err := f.Write([]byte(s))
+		require.Nil(t, err)
+	}
+	require.Equal(t, "mnopqrstuvwxyz\n", readFileString(t, path), "written even if larger than the maximum size")
+	require.Equal(t, "ijkl\n", readFileString(t, path+".1"))
+	require.Equal(t, "abcd\nefgh\n", readFileString(t, path+".2"))
+	_, err = os.Stat(path + ".3")
+	require.True(t, os.IsNotExist(err), "oldest removed")
+}
+
+func Test_rotatingFile_noRetainedFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handler.log")
+
+	f, err := openRotatingFile(path, 6, 0)
+	require.Nil(t, err)
+	defer f.Close()
+	for _, s := range []string{"1234\n", "5678\n"} {
+		_, err := f.Write([]byte(s))
+		require.Nil(t, err)
+	}
+	require.Equal(t, "5678\n", readFileString(t, path))
+	matches, err := filepath.Glob(path + ".[0-9]*")
+	require.Nil(t, err)
+	require.Empty(t, matches)
+}
+
+func Test_rotatingFile_concurrent(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handler.log")
+
+	// each opened separately, as by several processes
+	const writers, lines = 4, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		f, err := openRotatingFile(path, 1000, 100)
+		require.Nil(t, err)
+		defer f.Close()
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				fmt.Fprintf(f, "writer=%d line=%03d\n", w, i)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	files, err := filepath.Glob(path + "*")
+	require.Nil(t, err)
+	seen := map[string]bool{}
+	for _, p := range files {
+		if strings.HasSuffix(p, ".lock") {
+			continue
+		}
+		b, err := ioutil.ReadFile(p)
+		require.Nil(t, err)
+		require.True(t, len(b) <= 1000, "%s is rotated at the maximum size", p)
+		for _, l := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+			require.Regexp(t, `^writer=\d line=\d{3}$`, l, "not interleaved")
+			seen[l] = true
+		}
+	}
+	require.Len(t, seen, writers*lines, "no line lost")
+}
@@ -2,37 +2,184 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/Azure/azure-docker-extension/pkg/vmextension"
 	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
 	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
 )
 
 var (
 	// dataDir is where we store the downloaded files, logs and state for
-	// the extension handler
-	dataDir    = "/var/lib/waagent/custom-script"
-	dataDirOld = "/var/lib/azure/custom-script" // used for migration, if present
+	// the extension handler. It is defaultDataDir unless overridden with the
+	// dataDirEnvVar environment variable.
+	defaultDataDir = "/var/lib/waagent/custom-script"
+	dataDir        = defaultDataDir
+	dataDirOld     = "/var/lib/azure/custom-script" // used for migration, if present
+
+	// dataDirEnvVar is the environment variable containing the absolute path
+	// of the data directory to be used instead of defaultDataDir, such as on a
+	// data disk.
+	dataDirEnvVar = "CUSTOM_SCRIPT_DATA_DIR"
 
 	// seqNumFile holds the processed highest sequence number to make
 	// sure we do not run the command more than once for the same sequence
 	// number. Stored under dataDir.
 	seqNumFile = "seqnum"
 
+	// forceUpdateTagFile holds the forceUpdateTag of the configuration
+	// processed last, to run the command again if the tag changes even if the
+	// sequence number does not. Stored under dataDir.
+	forceUpdateTagFile = "forceupdatetag"
+
+	// stateVersionFile holds the version of the format of the state, saved
+	// by update after migrating the state of the previous version. Stored
+	// under dataDir.
+	stateVersionFile = "stateversion"
+
+	// resultFile holds the machine-readable result of the last enable
+	// operation. Stored under dataDir.
+	resultFile = "result.json"
+
+	// healthFile holds the outcome and the end time of the last enable
+	// operation in a "key=value" line format for monitoring tools. Stored
+	// under dataDir.
+	healthFile = "health"
+
 	// downloadDir is where we store the downloaded files in the "{downloadDir}/{seqnum}/file"
 	// format and the logs as "{downloadDir}/{seqnum}/std(out|err)". Stored under dataDir
 	downloadDir = "download"
+
+	// logFormatEnvVar is the environment variable selecting the format of
+	// the handler logs: "json" for newline-delimited JSON objects, or logfmt
+	// otherwise.
+	logFormatEnvVar = "CUSTOM_SCRIPT_LOG_FORMAT"
+
+	// logFileEnvVar is the environment variable containing the path of the
+	// file the handler logs are appended to, rotated by size, instead of
+	// stdout. It is set by the shim.
+	logFileEnvVar = "CUSTOM_SCRIPT_LOG_FILE"
+
+	// logMaxSizeEnvVar is the environment variable containing the size in
+	// MiB the log file is rotated at, zero to never rotate it.
+	logMaxSizeEnvVar = "CUSTOM_SCRIPT_LOG_MAX_SIZE_MB"
+
+	// logMaxFilesEnvVar is the environment variable containing how many
+	// rotated log files are retained.
+	logMaxFilesEnvVar = "CUSTOM_SCRIPT_LOG_MAX_FILES"
+
+	// certDirsEnvVar is the environment variable containing the directories,
+	// separated by colons, searched for the certificate to decrypt the
+	// protected settings with after the directory of the agent.
+	certDirsEnvVar = "CUSTOM_SCRIPT_CERT_DIRS"
+
+	// certThumbprintsEnvVar is the environment variable mapping the
+	// thumbprints of the protected settings to the ones of the certificates
+	// to decrypt them with instead, as "FROM=TO" pairs separated by commas.
+	certThumbprintsEnvVar = "CUSTOM_SCRIPT_CERT_THUMBPRINTS"
+
+	// statusDirEnvVar is the environment variable containing the directory
+	// the status files are saved to instead of the status folder of the
+	// handler environment, for agents expecting them elsewhere.
+	statusDirEnvVar = "CUSTOM_SCRIPT_STATUS_DIR"
+
+	// seqNumEnvVar is the environment variable containing the sequence number
+	// the operations are run with instead of the one found in the config
+	// folder, so that tests can drive them deterministically.
+	seqNumEnvVar = "CUSTOM_SCRIPT_SEQNUM"
+
+	// runOnceFile holds the state of the command completed with runOnce, so
+	// that it is not executed again for any sequence number. Stored under
+	// dataDir.
+	runOnceFile = "runonce.json"
+
+	// lockFile is locked by the enable operation while it runs, so that
+	// concurrent invocations run one after the other. Stored under dataDir.
+	lockFile = "enable.lock"
+
+	// resumeFile holds the state to resume the command after the reboot it
+	// requested, for the enable after the reboot. Stored under dataDir.
+	resumeFile = "resume.json"
+
+	// rebootRequiredFile is created in the download directory by the command to
+	// request a reboot, then run again in the next phase.
+	rebootRequiredFile = "reboot-required"
+
+	// scriptFilePrefix and secretsFilePrefix are the prefixes of the names of
+	// the files the script in the protected settings and the secrets are
+	// written to in the download directory, followed by random digits.
+	scriptFilePrefix  = "script"
+	secretsFilePrefix = ".secrets"
+
+	// rebootRequiredFileEnvVar is the environment variable containing the path
+	// of the rebootRequiredFile.
+	rebootRequiredFileEnvVar = "CUSTOM_SCRIPT_REBOOT_REQUIRED_FILE"
+
+	// phaseEnvVar is the environment variable containing the phase of the
+	// command: 1 at first, incremented after each reboot it requests.
+	phaseEnvVar = "CUSTOM_SCRIPT_PHASE"
+
+	// pidFile holds the process ID of the running command, so that disable
+	// and other tools can find it. Stored under dataDir.
+	pidFile = "command.pid"
+
+	// downloadDirEnvVar is the environment variable containing the directory
+	// of the downloaded files, set if the command is run in another working
+	// directory.
+	downloadDirEnvVar = "CUSTOM_SCRIPT_DOWNLOAD_DIR"
+
+	// destinationDirEnvVar is the environment variable containing the
+	// destinationDir the files are saved to, set if it is specified. The
+	// directory in destinationDirs at index i, if specified, is in the
+	// variable of this name followed by "_i".
+	destinationDirEnvVar = "CUSTOM_SCRIPT_DESTINATION_DIR"
+
+	// secretsFileEnvVar is the environment variable containing the path of
+	// the file with the protected environment variables, set if
+	// secretsDeliveryMode is "file".
+	secretsFileEnvVar = "CUSTOM_SCRIPT_SECRETS_FILE"
 )
 
 func main() {
-	ctx := log.NewContext(log.NewSyncLogger(log.NewLogfmtLogger(
-		os.Stdout))).With("time", log.DefaultTimestamp).With("version", VersionString())
-
 	// parse command line arguments
 	cmd := parseCmd(os.Args)
+
+	// the status and checkcredentials subcommands print their results to
+	// stdout
+	var logOut io.Writer = os.Stdout
+	if cmd.readOnly() {
+		logOut = os.Stderr
+	}
+	maxSize, maxFiles, rotationErr := logRotation()
+	var logFileErr error
+	if path := os.Getenv(logFileEnvVar); path != "" {
+		f, err := openRotatingFile(path, maxSize, maxFiles)
+		if err != nil {
+			logFileErr = errors.Wrapf(err, "cannot write logs to %s", path)
+		} else {
+			defer f.Close()
+			logOut = f
+		}
+	}
+	ctx := log.NewContext(logRedactor.logger(log.NewSyncLogger(newLogger(
+		logOut, os.Getenv(logFormatEnvVar))))).With("time", log.DefaultTimestamp).With("version", VersionString())
 	ctx = ctx.With("operation", strings.ToLower(cmd.name))
+	if rotationErr != nil {
+		ctx.Log("warning", "invalid log rotation, using the defaults", "error", rotationErr)
+	}
+	if logFileErr != nil {
+		ctx.Log("warning", "not logging to file", "error", logFileErr)
+	}
+
+	// the read-only subcommands do not create or modify the data directory
+	if err := configureDataDir(ctx, !cmd.readOnly()); err != nil {
+		ctx.Log("message", "failed to configure data directory", "error", err)
+		os.Exit(1)
+	}
 
 	// parse extension environment
 	hEnv, err := vmextension.GetHandlerEnv()
@@ -40,29 +187,45 @@ func main() {
 		ctx.Log("message", "failed to parse handlerenv", "error", err)
 		os.Exit(1)
 	}
+	if err := configureStatusDir(ctx, &hEnv, !cmd.readOnly()); err != nil {
+		ctx.Log("message", "failed to configure status directory", "error", err)
+		os.Exit(1)
+	}
 	seqNum, err := vmextension.FindSeqNum(hEnv.HandlerEnvironment.ConfigFolder)
 	if err != nil {
 		ctx.Log("messsage", "failed to find sequence number", "error", err)
 	}
+	if n, ok, err := seqNumOverride(); err != nil {
+		ctx.Log("message", "invalid sequence number override", "error", err)
+		os.Exit(1)
+	} else if ok {
+		ctx.Log("message", "using sequence number from environment", "seq", n, "found", seqNum)
+		seqNum = n
+	}
 	ctx = ctx.With("seq", seqNum)
 
 	// check sub-command preconditions, if any, before executing
 	ctx.Log("event", "start")
 	if cmd.pre != nil {
 		ctx.Log("event", "pre-check")
-		if err := cmd.pre(ctx, seqNum); err != nil {
+		if err := cmd.pre(ctx, hEnv, seqNum); err != nil {
 			ctx.Log("event", "pre-check failed", "error", err)
 			os.Exit(1)
 		}
 	}
+	// stop the enable operation cleanly if the handler is terminated
+	if cmd.name == cmdEnable.name {
+		defer shutdown.notify(ctx)()
+	}
 	// execute the subcommand
 	reportStatus(ctx, hEnv, seqNum, status.StatusTransitioning, cmd, "")
-	if err := cmd.f(ctx, hEnv, seqNum); err != nil {
-		ctx.Log("event", "failed to handle", "error", err)
-		reportStatus(ctx, hEnv, seqNum, status.StatusError, cmd, err.Error())
-		os.Exit(1)
+	msg, sub, err := cmd.f(ctx, hEnv, seqNum)
+	if err != nil {
+		ctx.Log("event", "failed to handle", "error", err, "category", categoryOf(err))
+		reportStatus(ctx, hEnv, seqNum, status.StatusError, cmd, err.Error()+msg, sub...)
+		os.Exit(exitCode(err))
 	}
-	reportStatus(ctx, hEnv, seqNum, status.StatusSuccess, cmd, "")
+	reportStatus(ctx, hEnv, seqNum, status.StatusSuccess, cmd, msg, sub...)
 	ctx.Log("event", "end")
 }
 
@@ -84,13 +247,28 @@ func parseCmd(args []string) cmd {
 	return cmd
 }
 
+// seqNumOverride returns the sequence number in the seqNumEnvVar environment
+// variable, and whether it is set. It fails if it is not a non-negative
+// integer.
+func seqNumOverride() (int, bool, error) {
+	v := os.Getenv(seqNumEnvVar)
+	if v == "" {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false, fmt.Errorf("%s must be a non-negative integer: %q", seqNumEnvVar, v)
+	}
+	return n, true, nil
+}
+
 // printUsage prints the help string and version of the program to stdout with a
 // trailing new line.
 func printUsage(args []string) {
 	fmt.Printf("Usage: %s ", os.Args[0])
 	i := 0
 	for k := range cmds {
-		fmt.Printf(k)
+		fmt.Print(k)
 		if i != len(cmds)-1 {
 			fmt.Printf("|")
 		}
@@ -99,3 +277,18 @@ func printUsage(args []string) {
 	fmt.Println()
 	fmt.Println(DetailedVersionString())
 }
+
+// newLogger returns a logger writing to w in the given format, "json" for a
+// JSON object per line, or logfmt if empty or unknown. Errors are written as
+// their messages in both formats.
+func newLogger(w io.Writer, format string) log.Logger {
+	l := log.NewLogfmtLogger(w)
+	switch strings.ToLower(format) {
+	case "json":
+		return log.NewJSONLogger(w)
+	case "", "logfmt":
+	default:
+		l.Log("warning", "unknown log format, using logfmt", "format", format)
+	}
+	return l
+}
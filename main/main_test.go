@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// the commands write their pidfile to the data directory, which only
+	// exists on a VM with the extension installed
+	dir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		panic(err)
+	}
+	dataDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func Test_newLogger_json(t *testing.T) {
+	var b bytes.Buffer
+	l := logRedactor.logger(newLogger(&b, "JSON"))
+	require.Nil(t, l.Log("event", "failed", "error", errors.New("boom"), "timeout", 30*time.Second, "index", 2))
+	require.Nil(t, l.Log("event", "end"))
+
+	lines := bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2, "one object per line")
+	var v map[string]interface{}
+	require.Nil(t, json.Unmarshal(lines[0], &v))
+	require.Equal(t, map[string]interface{}{
+		"event": "failed", "error": "boom", "timeout": "30s", "index": float64(2)}, v)
+}
+
+func Test_newLogger_logfmt(t *testing.T) {
+	var b bytes.Buffer
+	require.Nil(t, newLogger(&b, "").Log("event", "end", "error", errors.New("boom")))
+	require.Equal(t, "event=end error=boom\n", b.String())
+
+	b.Reset()
+	require.Nil(t, newLogger(&b, "xml").Log("event", "end"))
+	require.Equal(t, "warning=\"unknown log format, using logfmt\" format=xml\nevent=end\n", b.String())
+}
+
+func Test_seqNumOverride(t *testing.T) {
+	defer os.Setenv(seqNumEnvVar, os.Getenv(seqNumEnvVar))
+	require.Nil(t, os.Setenv(seqNumEnvVar, ""))
+	_, ok, err := seqNumOverride()
+	require.Nil(t, err)
+	require.False(t, ok, "not set")
+
+	require.Nil(t, os.Setenv(seqNumEnvVar, "7"))
+	n, ok, err := seqNumOverride()
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, 7, n)
+
+	for _, v := range []string{"x", "-1", "1.5"} {
+		require.Nil(t, os.Setenv(seqNumEnvVar, v))
+		_, _, err = seqNumOverride()
+		require.EqualError(t, err, seqNumEnvVar+` must be a non-negative integer: "`+v+`"`, v)
+	}
+}
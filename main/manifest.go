@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// manifestFile is the name of the download manifest in the download directory
+// of a sequence number, reserved in fileNames.
+const manifestFile = ".download-manifest.json"
+
+// downloadManifest records the files downloaded for a sequence number, so that
+// they are not downloaded again when the same configuration is processed
+// again, such as after the agent restarts. It is safe for concurrent use.
+type downloadManifest struct {
+	mu    sync.Mutex
+	path  string
+	Files map[string]manifestEntry `json:"files"` // by file name
+
+	// previous is the manifest of the download directory of a previous
+	// sequence number the unchanged files are copied from, if not nil
+	previous *downloadManifest
+}
+
+// manifestEntry describes a downloaded file as it was saved, after it was
+// post-processed.
+type manifestEntry struct {
+	URLHash string `json:"urlHash"` // SHA-256 of the URL, which may contain secrets
+	Size    int64  `json:"size"`
+	ETag    string `json:"etag,omitempty"`
+	SHA256  string `json:"sha256,omitempty"` // expected checksum verified after the download
+}
+
+// loadManifest reads the download manifest for the given download directory.
+// If it does not exist or cannot be read, an empty manifest is returned, so
+// that all files are downloaded.
+func loadManifest(ctx log.Logger, dir string) *downloadManifest {
+	m := &downloadManifest{path: filepath.Join(dir, manifestFile), Files: make(map[string]manifestEntry)}
+	b, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return m
+	} else if err != nil {
+		ctx.Log("event", "failed to read download manifest", "error", err)
+		return m
+	}
+	if err := json.Unmarshal(b, m); err != nil || m.Files == nil {
+		ctx.Log("event", "ignoring invalid download manifest", "error", err)
+		m.Files = make(map[string]manifestEntry)
+	}
+	return m
+}
+
+func hashURL(fileURL string) string {
+	h := sha256.Sum256([]byte(fileURL))
+	return hex.EncodeToString(h[:])
+}
+
+// unchanged determines if the file at path, named name, was downloaded from
+// fileURL before and has not changed since: it has the recorded size and, if
+// an ETag was recorded, the resource at d still has the same ETag.
+func (m *downloadManifest) unchanged(ctx log.Logger, opCtx context.Context, name, path, fileURL string, d download.Downloader) bool {
+	m.mu.Lock()
+	e, ok := m.Files[name]
+	m.mu.Unlock()
+	if !ok || e.URLHash != hashURL(fileURL) {
+		return false
+	}
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() != e.Size {
+		return false
+	}
+	if e.ETag == "" {
+		return true
+	}
+	etag, err := download.ETag(opCtx, d)
+	if err != nil {
+		ctx.Log("event", "failed to check ETag, downloading file again", "error", err)
+		return false
+	}
+	return etag == e.ETag
+}
+
+// reuse copies the file named name from the download directory of the previous
+// manifest to path if it was downloaded from fileURL, verified against the
+// given checksum, if any, and has not changed since. It returns the recorded
+// ETag of the file and whether it is copied. The files saved outside of the
+// download directory are already at path.
+func (m *downloadManifest) reuse(ctx log.Logger, opCtx context.Context, name, path, fileURL, sha256 string, d download.Downloader) (etag string, ok bool) {
+	prev := m.previous
+	if prev == nil {
+		return "", false
+	}
+	prev.mu.Lock()
+	e, found := prev.Files[name]
+	prev.mu.Unlock()
+	if !found || e.SHA256 != sha256 {
+		return "", false
+	}
+	src := name
+	if !filepath.IsAbs(name) {
+		src = filepath.Join(filepath.Dir(prev.path), name)
+	}
+	if !prev.unchanged(ctx, opCtx, name, src, fileURL, d) {
+		return "", false
+	}
+	if src != path {
+		if err := copyFile(src, path); err != nil {
+			ctx.Log("event", "failed to copy previously downloaded file, downloading file again", "error", err)
+			os.Remove(path)
+			return "", false
+		}
+	}
+	return e.ETag, true
+}
+
+// copyFile copies the contents of the file at src to a new file at dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create file")
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Wrap(err, "failed to copy file")
+}
+
+// record adds the file at path, named name and downloaded from fileURL with
+// the given ETag and verified against the given checksum, if any, to the
+// manifest.
+func (m *downloadManifest) record(name, path, fileURL, etag, sha256 string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to record '%s' in the download manifest", name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Files[name] = manifestEntry{URLHash: hashURL(fileURL), Size: fi.Size(), ETag: etag, SHA256: sha256}
+	return nil
+}
+
+// save writes the manifest to its path.
+func (m *downloadManifest) save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal download manifest")
+	}
+	return errors.Wrap(ioutil.WriteFile(m.path, b, 0600), "failed to save download manifest")
+}
+
+// downloadDirs returns the sequence numbers of the download directories in
+// root, the most recent first, followed by current, unless it does not exist.
+// The entries which are not named after a sequence number are ignored.
+func downloadDirs(root string, current int) ([]int, error) {
+	fis, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to list download directories")
+	}
+	var seqNums []int
+	hasCurrent := false
+	for _, fi := range fis {
+		n, err := strconv.Atoi(fi.Name())
+		if err != nil || n < 0 || !fi.IsDir() || strconv.Itoa(n) != fi.Name() {
+			continue
+		}
+		if n == current {
+			hasCurrent = true
+		} else {
+			seqNums = append(seqNums, n)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(seqNums)))
+	if hasCurrent {
+		seqNums = append(seqNums, current)
+	}
+	return seqNums, nil
+}
+
+// previousDownloadDir returns the most recent download directory other than
+// dir, the download directory of the current sequence number, in the same
+// parent directory, or empty string if there is none.
+func previousDownloadDir(dir string) string {
+	root := filepath.Dir(dir)
+	current, err := strconv.Atoi(filepath.Base(dir))
+	if err != nil {
+		return ""
+	}
+	seqNums, err := downloadDirs(root, current)
+	if err != nil || len(seqNums) == 0 || seqNums[0] == current {
+		return ""
+	}
+	return filepath.Join(root, strconv.Itoa(seqNums[0]))
+}
+
+// pruneDownloadDirs removes the download directories in root other than the
+// one of the current sequence number and the most recent keep-1 others. The
+// directory of the current sequence number is never removed.
+func pruneDownloadDirs(ctx log.Logger, root string, current, keep int) error {
+	seqNums, err := downloadDirs(root, current)
+	if err != nil {
+		return err
+	}
+	kept := 1 // current, whether it exists yet or not
+	for _, n := range seqNums {
+		if n == current {
+			continue
+		}
+		if kept < keep {
+			kept++
+			continue
+		}
+		dir := filepath.Join(root, strconv.Itoa(n))
+		ctx.Log("event", "removing old download directory", "path", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return errors.Wrapf(err, "failed to remove old download directory %s", dir)
+		}
+	}
+	return nil
+}
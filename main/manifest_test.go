@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_downloadManifest_unchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	etag := `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+	}))
+	defer srv.Close()
+	d := download.NewURLDownload(srv.URL + "/a.sh")
+
+	fp := filepath.Join(dir, "a.sh")
+	require.Nil(t, ioutil.WriteFile(fp, []byte("echo a"), 0600))
+	m := loadManifest(log.NewNopLogger(), dir)
+	unchanged := func() bool {
+		return m.unchanged(log.NewNopLogger(), context.Background(), "a.sh", fp, srv.URL+"/a.sh", d)
+	}
+	require.False(t, unchanged(), "not recorded")
+
+	require.Nil(t, m.record("a.sh", fp, srv.URL+"/a.sh", `"v1"`, ""))
+	require.True(t, unchanged())
+	require.False(t, m.unchanged(log.NewNopLogger(), context.Background(), "a.sh", fp, srv.URL+"/b.sh", d), "URL changed")
+
+	etag = `"v2"`
+	require.False(t, unchanged(), "ETag changed")
+	etag = `"v1"`
+
+	require.Nil(t, ioutil.WriteFile(fp, []byte("echo b; echo c"), 0600))
+	require.False(t, unchanged(), "size changed")
+
+	require.Nil(t, m.record("a.sh", fp, srv.URL+"/a.sh", "", ""))
+	etag = `"v2"`
+	require.True(t, unchanged(), "ETag not recorded")
+
+	require.Nil(t, os.Remove(fp))
+	require.False(t, unchanged(), "file missing")
+}
+
+func Test_pruneDownloadDirs(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	for _, d := range []string{"1", "2", "3", "10", "11", "x", "07"} {
+		require.Nil(t, os.Mkdir(filepath.Join(root, d), 0700))
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "4"), nil, 0600))
+
+	require.Equal(t, filepath.Join(root, "11"), previousDownloadDir(filepath.Join(root, "3")))
+	require.Equal(t, filepath.Join(root, "10"), previousDownloadDir(filepath.Join(root, "11")))
+
+	require.Nil(t, pruneDownloadDirs(log.NewNopLogger(), root, 3, 3))
+	names := func() (out []string) {
+		fis, err := ioutil.ReadDir(root)
+		require.Nil(t, err)
+		for _, fi := range fis {
+			out = append(out, fi.Name())
+		}
+		return out
+	}
+	require.Equal(t, []string{"07", "10", "11", "3", "4", "x"}, names(), "current and the 2 most recent others kept")
+
+	require.Nil(t, pruneDownloadDirs(log.NewNopLogger(), root, 3, 1))
+	require.Equal(t, []string{"07", "3", "4", "x"}, names(), "current is never removed")
+	require.Equal(t, "", previousDownloadDir(filepath.Join(root, "3")))
+
+	require.Nil(t, pruneDownloadDirs(log.NewNopLogger(), filepath.Join(root, "missing"), 1, 1))
+}
+
+func Test_downloadManifest_save(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fp := filepath.Join(dir, "a.sh")
+	require.Nil(t, ioutil.WriteFile(fp, []byte("echo a"), 0600))
+	m := loadManifest(log.NewNopLogger(), dir)
+	require.Nil(t, m.record("a.sh", fp, "http://a/a.sh?sig=secret", `"v1"`, ""))
+	require.Nil(t, m.save())
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	require.Nil(t, err)
+	require.NotContains(t, string(b), "secret", "URLs are not saved")
+
+	m = loadManifest(log.NewNopLogger(), dir)
+	require.Equal(t, map[string]manifestEntry{
+		"a.sh": {URLHash: hashURL("http://a/a.sh?sig=secret"), Size: 6, ETag: `"v1"`}}, m.Files)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, manifestFile), []byte("{"), 0600))
+	require.Empty(t, loadManifest(log.NewNopLogger(), dir).Files, "invalid manifest is ignored")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// getInstanceMetadata is the function used to read the instance metadata, it
+// is a variable to be replaced in tests.
+var getInstanceMetadata = download.GetInstanceMetadata
+
+// metadataTokenRe matches the {name} metadata tokens substituted in the
+// command, the escaped "{{" and "}}" sequences, and the ${NAME} variable
+// references, which are left to expandVariables and the shell.
+var metadataTokenRe = regexp.MustCompile(`\{\{|\}\}|\$?\{([A-Za-z]+)\}`)
+
+// metadataTokens are the values of the instance metadata substituted for each
+// token name with 'substituteMetadata'.
+var metadataTokens = map[string]func(download.InstanceMetadata) string{
+	"vmName":         func(m download.InstanceMetadata) string { return m.Name },
+	"computerName":   func(m download.InstanceMetadata) string { return m.OSProfile.ComputerName },
+	"resourceGroup":  func(m download.InstanceMetadata) string { return m.ResourceGroupName },
+	"subscriptionId": func(m download.InstanceMetadata) string { return m.SubscriptionID },
+	"location":       func(m download.InstanceMetadata) string { return m.Location },
+	"zone":           func(m download.InstanceMetadata) string { return m.Zone },
+	"vmId":           func(m download.InstanceMetadata) string { return m.VMID },
+	"vmSize":         func(m download.InstanceMetadata) string { return m.VMSize },
+	"osType":         func(m download.InstanceMetadata) string { return m.OSType },
+}
+
+// instanceMetadataCache holds the instance metadata once it is read, so that
+// the Instance Metadata Service is queried once per process.
+var instanceMetadataCache struct {
+	sync.Mutex
+	m  download.InstanceMetadata
+	ok bool
+}
+
+// cachedInstanceMetadata returns the instance metadata, read from the
+// Instance Metadata Service the first time it succeeds.
+func cachedInstanceMetadata(ctx log.Logger) (download.InstanceMetadata, error) {
+	instanceMetadataCache.Lock()
+	defer instanceMetadataCache.Unlock()
+	if instanceMetadataCache.ok {
+		return instanceMetadataCache.m, nil
+	}
+	ctx.Log("event", "reading instance metadata")
+	m, err := getInstanceMetadata()
+	if err != nil {
+		return m, err
+	}
+	instanceMetadataCache.m, instanceMetadataCache.ok = m, true
+	ctx.Log("event", "read instance metadata", "vmName", m.Name)
+	return m, nil
+}
+
+// substituteMetadata returns cmd with the {name} tokens of metadataTokens
+// replaced with the values from the instance metadata if 'substituteMetadata'
+// is set, otherwise cmd as is. "{{" and "}}" are replaced with literal "{" and
+// "}", other tokens and ${NAME} references are left as is. It fails if the
+// Instance Metadata Service cannot be reached.
+func (h handlerSettings) substituteMetadata(ctx log.Logger, cmd string) (string, error) {
+	if !h.publicSettings.SubstituteMetadata {
+		return cmd, nil
+	}
+	m, err := cachedInstanceMetadata(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the instance metadata for 'substituteMetadata'")
+	}
+	return metadataTokenRe.ReplaceAllStringFunc(cmd, func(tok string) string {
+		switch {
+		case tok == "{{":
+			return "{"
+		case tok == "}}":
+			return "}"
+		case tok[0] == '$':
+			return tok
+		}
+		if f, ok := metadataTokens[tok[1:len(tok)-1]]; ok {
+			return f(m)
+		}
+		return tok
+	}), nil
+}
+
+// substituteMetadataAll returns the commands in cmds with the metadata
+// substituted as with 'substituteMetadata', or cmds as is if it is not set.
+func (h handlerSettings) substituteMetadataAll(ctx log.Logger, cmds []string) ([]string, error) {
+	if !h.publicSettings.SubstituteMetadata || len(cmds) == 0 {
+		return cmds, nil
+	}
+	out := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		var err error
+		if out[i], err = h.substituteMetadata(ctx, cmd); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// hasMetadataToken returns whether s contains one of the {name} tokens of
+// metadataTokens, which is not escaped as "{{name}}".
+func hasMetadataToken(s string) bool {
+	for _, m := range metadataTokenRe.FindAllStringSubmatch(s, -1) {
+		if _, ok := metadataTokens[m[1]]; ok && m[0][0] != '$' {
+			return true
+		}
+	}
+	return false
+}
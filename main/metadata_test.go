@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_substituteMetadata(t *testing.T) {
+	defer func(f func() (download.InstanceMetadata, error)) { getInstanceMetadata = f }(getInstanceMetadata)
+	defer func() { instanceMetadataCache.ok = false }()
+	instanceMetadataCache.ok = false
+	reads := 0
+	getInstanceMetadata = func() (download.InstanceMetadata, error) {
+		reads++
+		m := download.InstanceMetadata{Name: "vm1", ResourceGroupName: "rg", Location: "westus2"}
+		m.OSProfile.ComputerName = "host1"
+		return m, nil
+	}
+
+	cfg := handlerSettings{publicSettings: publicSettings{SubstituteMetadata: true}}
+	for _, c := range []struct{ in, out string }{
+		{"echo {vmName} {resourceGroup} {location} {computerName}", "echo vm1 rg westus2 host1"},
+		{"echo {zone}.", "echo ."},
+		{"echo {{vmName}} {{ }} {{{vmName}}}", "echo {vmName} { } {vm1}"},
+		{"echo ${vmName} $HOME {unknown} {a,b} 'f() { x; }'", "echo ${vmName} $HOME {unknown} {a,b} 'f() { x; }'"},
+	} {
+		out, err := cfg.substituteMetadata(log.NewNopLogger(), c.in)
+		require.Nil(t, err)
+		require.Equal(t, c.out, out, c.in)
+	}
+	require.Equal(t, 1, reads, "read once")
+
+	out, err := handlerSettings{}.substituteMetadata(log.NewNopLogger(), "echo {vmName}")
+	require.Nil(t, err)
+	require.Equal(t, "echo {vmName}", out, "not set")
+}
+
+func Test_runCmd_substituteMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(f func() (download.InstanceMetadata, error)) { getInstanceMetadata = f }(getInstanceMetadata)
+	defer func() { instanceMetadataCache.ok = false }()
+	instanceMetadataCache.ok = false
+	getInstanceMetadata = func() (download.InstanceMetadata, error) {
+		return download.InstanceMetadata{}, errors.New("instance metadata request failed: connection refused")
+	}
+
+	cfg := handlerSettings{publicSettings: publicSettings{CommandToExecute: "echo {vmName}", SubstituteMetadata: true}}
+	err = runCmd(log.NewNopLogger(), context.Background(), dir, cfg)
+	require.NotNil(t, err)
+	require.Equal(t, errCommandFailed, categoryOf(err))
+	require.Contains(t, err.Error(), "failed to read the instance metadata for 'substituteMetadata': instance metadata request failed")
+	_, err = os.Stat(filepath.Join(dir, "stdout"))
+	require.True(t, os.IsNotExist(err), "not executed")
+
+	getInstanceMetadata = func() (download.InstanceMetadata, error) {
+		return download.InstanceMetadata{Name: "vm1"}, nil
+	}
+	cfg.publicSettings.EnvironmentVariables = map[string]string{"A": "a"}
+	cfg.publicSettings.ExpandVariables = true
+	cfg.publicSettings.CommandToExecute = "echo {vmName}-${A}"
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, cfg))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "vm1-a\n", string(b))
+
+	cfg = handlerSettings{publicSettings: publicSettings{Commands: []string{"echo {vmName}", "echo {{vmName}}"}, SubstituteMetadata: true}}
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, cfg))
+	require.Equal(t, "vm1\n", readFileString(t, filepath.Join(dir, "stdout.0")))
+	require.Equal(t, "{vmName}\n", readFileString(t, filepath.Join(dir, "stdout.1")))
+
+	cfg = handlerSettings{publicSettings: publicSettings{ParallelCommands: []string{"echo {vmName}"}, SubstituteMetadata: true}}
+	require.Nil(t, runCmd(log.NewNopLogger(), context.Background(), dir, cfg))
+	require.Equal(t, "vm1\n", readFileString(t, filepath.Join(dir, "stdout.0")))
+}
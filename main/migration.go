@@ -9,8 +9,8 @@ import (
 	"github.com/pkg/errors"
 )
 
-// migrateDataDir moves oldDir to newDir, if oldDir exists by shelling out to
-// 'mv -f'.
+// migrateDataDir moves the contents of oldDir to newDir (created if missing),
+// if oldDir exists by shelling out to 'mv -f'.
 func migrateDataDir(ctx log.Logger, oldDir, newDir string) error {
 	ok, err := dirExists(oldDir)
 	if err != nil {
@@ -20,12 +20,15 @@ func migrateDataDir(ctx log.Logger, oldDir, newDir string) error {
 		ctx.Log("message", "no old state found to migrate")
 		return nil
 	}
-	ctx.Log("message", "migrating old state")
+	ctx.Log("message", "migrating old state", "from", oldDir, "to", newDir)
+	if err := os.MkdirAll(newDir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create new state directory")
+	}
 
 	var b bytes.Buffer
 	var bc = bufferCloser{&b}
 	stdout, stderr := bc, bc
-	if exitCode, err := Exec(fmt.Sprintf(`mv -f '%s'/* '%s'`, oldDir, newDir), "", stdout, stderr); err != nil {
+	if exitCode, err := Exec(fmt.Sprintf(`mv -f '%s'/* '%s'`, oldDir, newDir), "", stdout, stderr, ExecOptions{}); err != nil {
 		output := string(b.Bytes())
 		return errors.Wrapf(err, "failed to migrate with mv, exit status: %d, output: %q", exitCode, output)
 	}
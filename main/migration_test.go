@@ -53,3 +53,16 @@ func Test_migrateDataDir(t *testing.T) {
 	require.Nil(t, err)
 	require.False(t, ok, "old directory must be gone")
 }
+
+func Test_migrateDataDir_createsNewDir(t *testing.T) {
+	d1, d2 := tempDir(t), tempDir(t)
+	defer os.RemoveAll(d1)
+	defer os.RemoveAll(d2)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(d1, seqNumFile), []byte("3"), 0644))
+
+	newDir := filepath.Join(d2, "data", "custom-script")
+	require.Nil(t, migrateDataDir(log.NewNopLogger(), d1, newDir))
+	b, err := ioutil.ReadFile(filepath.Join(newDir, seqNumFile))
+	require.Nil(t, err)
+	require.Equal(t, "3", string(b))
+}
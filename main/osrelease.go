@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// osReleasePaths are the files identifying the distribution of the VM, read
+// in order until one exists. It is a variable to be replaced in tests.
+var osReleasePaths = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+// osRelease identifies the distribution of the VM, from os-release(5).
+type osRelease struct {
+	ID        string   // such as "ubuntu" or "rhel"
+	IDLike    []string // of the distributions it is derived from, such as "debian"
+	VersionID string   // such as "22.04" or "8.6", empty on rolling releases
+}
+
+// osMatch is a predicate of 'osMatch' in the object form of 'fileUris', which
+// the distribution of the VM matches if its ID or one of its ID_LIKE matches
+// the Distro glob, and its VERSION_ID the Version glob if specified (such as
+// "22.*"). The globs are in the syntax of path.Match and case-insensitive.
+type osMatch struct {
+	Distro  string `json:"distro"`
+	Version string `json:"version"`
+}
+
+// validate returns an error if the globs of m are invalid.
+func (m osMatch) validate() error {
+	for _, g := range []string{m.Distro, m.Version} {
+		if _, err := path.Match(g, ""); err != nil {
+			return errors.Wrapf(err, "invalid glob %q", g)
+		}
+	}
+	return nil
+}
+
+// matches returns whether the distribution r matches m.
+func (m osMatch) matches(r osRelease) bool {
+	if m.Version != "" && !globMatch(m.Version, r.VersionID) {
+		return false
+	}
+	for _, id := range append([]string{r.ID}, r.IDLike...) {
+		if id != "" && globMatch(m.Distro, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func globMatch(pattern, s string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(s)) // validated
+	return ok
+}
+
+// matchesAnyOS returns whether the distribution r matches one of ms, or true
+// if ms is empty.
+func matchesAnyOS(ms []osMatch, r osRelease) bool {
+	if len(ms) == 0 {
+		return true
+	}
+	for _, m := range ms {
+		if m.matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// readOSRelease reads the distribution of the VM from the first of the
+// osReleasePaths which exists.
+func readOSRelease() (osRelease, error) {
+	for _, p := range osReleasePaths {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return osRelease{}, errors.Wrap(err, "failed to open os-release")
+		}
+		defer f.Close()
+		r, err := parseOSRelease(f)
+		return r, errors.Wrapf(err, "failed to read %s", p)
+	}
+	return osRelease{}, errors.Errorf("none of %s exists", strings.Join(osReleasePaths, ", "))
+}
+
+// parseOSRelease parses the os-release(5) variables in r, "NAME=value" lines
+// whose values may be quoted.
+func parseOSRelease(r io.Reader) (osRelease, error) {
+	var out osRelease
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		i := strings.Index(line, "=")
+		if line == "" || strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		name, v := line[:i], unquoteOSReleaseValue(line[i+1:])
+		switch name {
+		case "ID":
+			out.ID = v
+		case "ID_LIKE":
+			out.IDLike = strings.Fields(v)
+		case "VERSION_ID":
+			out.VersionID = v
+		}
+	}
+	return out, s.Err()
+}
+
+// unquoteOSReleaseValue returns the value v of an os-release variable without
+// its quotes and with its backslash escapes resolved.
+func unquoteOSReleaseValue(v string) string {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		v = v[1 : len(v)-1]
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
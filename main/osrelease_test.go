@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ahmetalpbalkan/go-httpbin"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+const ubuntuOSRelease = `NAME="Ubuntu"
+VERSION="22.04.3 LTS (Jammy Jellyfish)"
+ID=ubuntu
+ID_LIKE=debian
+PRETTY_NAME="Ubuntu 22.04.3 LTS"
+VERSION_ID="22.04"
+`
+
+// mockOSRelease makes readOSRelease read content, until the returned function
+// is called.
+func mockOSRelease(t *testing.T, content string) (restore func()) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	p := filepath.Join(dir, "os-release")
+	require.Nil(t, ioutil.WriteFile(p, []byte(content), 0644))
+	old := osReleasePaths
+	osReleasePaths = []string{filepath.Join(dir, "missing"), p}
+	return func() {
+		osReleasePaths = old
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_parseOSRelease(t *testing.T) {
+	r, err := parseOSRelease(strings.NewReader(ubuntuOSRelease))
+	require.Nil(t, err)
+	require.Equal(t, osRelease{ID: "ubuntu", IDLike: []string{"debian"}, VersionID: "22.04"}, r)
+
+	r, err = parseOSRelease(strings.NewReader("# comment\n\nID='rocky'\nID_LIKE=\"rhel centos fedora\"\nVERSION_ID=\"8.\\\"6\"\ninvalid\n"))
+	require.Nil(t, err)
+	require.Equal(t, osRelease{ID: "rocky", IDLike: []string{"rhel", "centos", "fedora"}, VersionID: `8."6`}, r)
+}
+
+func Test_osMatch(t *testing.T) {
+	ubuntu := osRelease{ID: "ubuntu", IDLike: []string{"debian"}, VersionID: "22.04"}
+	arch := osRelease{ID: "arch"}
+	for _, c := range []struct {
+		m  osMatch
+		r  osRelease
+		ok bool
+	}{
+		{osMatch{Distro: "ubuntu"}, ubuntu, true},
+		{osMatch{Distro: "Ubuntu", Version: "22.*"}, ubuntu, true},
+		{osMatch{Distro: "debian"}, ubuntu, true},
+		{osMatch{Distro: "*"}, ubuntu, true},
+		{osMatch{Distro: "ubuntu", Version: "20.04"}, ubuntu, false},
+		{osMatch{Distro: "rhel"}, ubuntu, false},
+		{osMatch{Distro: "arch"}, arch, true},
+		{osMatch{Distro: "arch", Version: "*"}, arch, true},
+		{osMatch{Distro: "arch", Version: "1"}, arch, false},
+	} {
+		require.Equal(t, c.ok, c.m.matches(c.r), "%+v %+v", c.m, c.r)
+	}
+	require.True(t, matchesAnyOS(nil, ubuntu))
+	require.True(t, matchesAnyOS([]osMatch{{Distro: "rhel"}, {Distro: "debian"}}, ubuntu))
+	require.False(t, matchesAnyOS([]osMatch{{Distro: "rhel"}}, ubuntu))
+
+	require.Nil(t, osMatch{Distro: "rhel", Version: "8.[0-9]"}.validate())
+	require.EqualError(t, osMatch{Distro: "rhel", Version: "8.["}.validate(), `invalid glob "8.[": syntax error in pattern`)
+}
+
+func Test_readOSRelease(t *testing.T) {
+	defer mockOSRelease(t, ubuntuOSRelease)()
+	r, err := readOSRelease()
+	require.Nil(t, err)
+	require.Equal(t, "ubuntu", r.ID)
+
+	osReleasePaths = osReleasePaths[:1]
+	_, err = readOSRelease()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "missing exists")
+}
+
+func Test_downloadFiles_osMatch(t *testing.T) {
+	defer mockOSRelease(t, ubuntuOSRelease)()
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
+
+	var p publicSettings
+	require.Nil(t, json.Unmarshal([]byte(`{"commandToExecute": "date", "fileUris": [
+		"`+srv.URL+`/bytes/10",
+		{"urls": ["`+srv.URL+`/bytes/20"], "osMatch": [{"distro": "rhel"}, {"distro": "debian", "version": "22.*"}]},
+		{"urls": ["`+srv.URL+`/bytes/30"], "osMatch": [{"distro": "ubuntu", "version": "20.04"}]}]}`), &p))
+	cfg := handlerSettings{publicSettings: p}
+	require.Nil(t, cfg.validate())
+	progress := newDownloadProgress(3)
+	require.Nil(t, downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(), dir, cfg, progress))
+	for _, n := range []string{"10", "20"} {
+		_, err = os.Stat(filepath.Join(dir, n))
+		require.Nil(t, err, "downloaded %s", n)
+	}
+	_, err = os.Stat(filepath.Join(dir, "30"))
+	require.True(t, os.IsNotExist(err), "skipped")
+	require.Equal(t, "skipped "+srv.URL+"/bytes/30: the distribution matches no 'osMatch' predicate", progress.substatuses()[2].FormattedMessage.Message)
+	res := progress.results(cfg.FileURLs)
+	require.Equal(t, "success", res[1].Status)
+	require.Equal(t, "skipped", res[2].Status)
+
+	// skipped files are not counted by minSuccessfulDownloads
+	cfg.publicSettings.FileURLs[0] = srv.URL + "/status/404"
+	cfg.publicSettings.ContinueOnDownloadError = true
+	cfg.publicSettings.MinSuccessfulDownloads = 2
+	err = downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(), dir, cfg, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "only 1 of 2 file(s) downloaded")
+
+	osReleasePaths = nil
+	err = downloadFiles(log.NewContext(log.NewNopLogger()), context.Background(), dir, cfg, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to identify the distribution for 'osMatch'")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
+)
+
+const (
+	// phaseConfigure, phaseDownload, phaseTestCommand and phaseCommand are
+	// the phases of the enable operation, reported as the "phase <name>"
+	// substatuses. The download phase includes the extraction of the
+	// archives, the git checkout and the fileMappings.
+	phaseConfigure   = "configure"
+	phaseDownload    = "download"
+	phaseTestCommand = "testCommand"
+	phaseCommand     = "command"
+)
+
+// enablePhases are the phases of the enable operation in the order they run.
+var enablePhases = []string{phaseConfigure, phaseDownload, phaseTestCommand, phaseCommand}
+
+// phaseTracker tracks the state of the phases of an operation and provides
+// them as substatuses to be reported, so that the progress through the phases
+// can be followed from the transitioning statuses. It is safe for concurrent
+// use.
+type phaseTracker struct {
+	mu     sync.Mutex
+	phases []phaseState
+}
+
+type phaseState struct {
+	name       string
+	state      status.Type // empty until the phase starts
+	msg        string      // of a skipped phase
+	start, end time.Time
+}
+
+// newPhaseTracker returns a tracker for the phases with the given names, in
+// the order they run.
+func newPhaseTracker(names []string) *phaseTracker {
+	p := &phaseTracker{phases: make([]phaseState, len(names))}
+	for i, n := range names {
+		p.phases[i].name = n
+	}
+	return p
+}
+
+// start records that the phase with the given name has started, and that the
+// phase running before it, if any, has completed.
+func (p *phaseTracker) start(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.endRunning(now, nil)
+	if ph := p.phase(name); ph != nil {
+		*ph = phaseState{name: name, state: status.StatusTransitioning, start: now}
+	}
+}
+
+// skip records that the phase with the given name is not run for the given
+// reason, such as it is not specified in the settings.
+func (p *phaseTracker) skip(name, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ph := p.phase(name); ph != nil {
+		*ph = phaseState{name: name, state: status.StatusSuccess, msg: "skipped: " + reason}
+	}
+}
+
+// finish records that the running phase, if any, has completed, failed if err
+// is not nil, at the end of the operation.
+func (p *phaseTracker) finish(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endRunning(time.Now(), err)
+}
+
+func (p *phaseTracker) endRunning(now time.Time, err error) {
+	for i := range p.phases {
+		ph := &p.phases[i]
+		if ph.state != status.StatusTransitioning {
+			continue
+		}
+		ph.state, ph.end = status.StatusSuccess, now
+		if err != nil {
+			ph.state = status.StatusError
+		}
+	}
+}
+
+func (p *phaseTracker) phase(name string) *phaseState {
+	for i := range p.phases {
+		if p.phases[i].name == name {
+			return &p.phases[i]
+		}
+	}
+	return nil
+}
+
+// substatuses returns the state of each phase as a substatus, in order. The
+// phases which have not started are "pending", unless final is set, in which
+// case they are omitted as the operation ended before them.
+func (p *phaseTracker) substatuses(final bool) []substatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []substatus
+	for _, ph := range p.phases {
+		name := "phase " + ph.name
+		switch {
+		case ph.state == "":
+			if !final {
+				out = append(out, newSubstatus(name, status.StatusTransitioning, "pending"))
+			}
+		case ph.msg != "":
+			out = append(out, newSubstatus(name, ph.state, ph.msg))
+		case ph.state == status.StatusTransitioning:
+			out = append(out, newSubstatus(name, ph.state, "in progress"))
+		case ph.state == status.StatusError:
+			out = append(out, newSubstatus(name, ph.state, fmt.Sprintf("failed after %v", roundDuration(ph.end.Sub(ph.start)))))
+		default:
+			out = append(out, newSubstatus(name, ph.state, fmt.Sprintf("completed in %v", roundDuration(ph.end.Sub(ph.start)))))
+		}
+	}
+	return out
+}
+
+// roundDuration rounds d to milliseconds for the messages.
+func roundDuration(d time.Duration) time.Duration {
+	return (d + time.Millisecond/2) / time.Millisecond * time.Millisecond
+}
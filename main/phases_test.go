@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_phaseTracker(t *testing.T) {
+	p := newPhaseTracker([]string{"a", "b", "c", "d"})
+	messages := func(final bool) []string {
+		var out []string
+		for _, s := range p.substatuses(final) {
+			out = append(out, s.Name+": "+string(s.Status)+": "+strings.Split(s.FormattedMessage.Message, " in ")[0])
+		}
+		return out
+	}
+	require.Equal(t, []string{
+		"phase a: transitioning: pending",
+		"phase b: transitioning: pending",
+		"phase c: transitioning: pending",
+		"phase d: transitioning: pending"}, messages(false))
+
+	p.start("a")
+	p.skip("b", "not specified")
+	require.Equal(t, []string{
+		"phase a: transitioning: in progress",
+		"phase b: success: skipped: not specified",
+		"phase c: transitioning: pending",
+		"phase d: transitioning: pending"}, messages(false))
+
+	p.start("c")
+	require.Equal(t, "phase a: success: completed", messages(false)[0], "ended by the next phase")
+	p.finish(errors.New("failed"))
+	require.Equal(t, []string{
+		"phase a: success: completed",
+		"phase b: success: skipped: not specified",
+		"phase c: error: failed after 0s"}, messages(true), "not started phases are omitted")
+}
+
+func Test_roundDuration(t *testing.T) {
+	require.Equal(t, "1.5s", roundDuration(1500400000).String())
+	require.Equal(t, "2ms", roundDuration(1500000).String())
+}
+
+func Test_phaseTracker_unknownPhase(t *testing.T) {
+	p := newPhaseTracker(enablePhases)
+	p.start("other")
+	p.skip("other", "")
+	for _, s := range p.substatuses(false) {
+		require.Equal(t, status.StatusTransitioning, s.Status)
+	}
+}
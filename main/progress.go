@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+)
+
+// downloadProgress tracks the number of bytes downloaded for each file and
+// provides them as substatuses to be reported. It is safe for concurrent use.
+type downloadProgress struct {
+	mu    sync.Mutex
+	files []fileProgress
+}
+
+type fileProgress struct {
+	state          status.Type // empty until the download starts
+	written, total int64       // total is -1 if not known
+	err            error       // set if the download failed
+	skipped        string      // why the file is not downloaded, if it is skipped
+
+	url, path  string // of the file, set when it starts
+	size       int64  // of the saved file, once downloaded
+	start, end time.Time
+}
+
+// newDownloadProgress returns a tracker for n file downloads.
+func newDownloadProgress(n int) *downloadProgress {
+	return &downloadProgress{files: make([]fileProgress, n)}
+}
+
+// progressFunc returns a function that records the progress of the i-th file.
+func (p *downloadProgress) progressFunc(i int) download.ProgressFunc {
+	return func(written, total int64) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		f := &p.files[i]
+		f.state, f.written, f.total = status.StatusTransitioning, written, total
+	}
+}
+
+// start records that the download of the i-th file from url to path is
+// starting.
+func (p *downloadProgress) start(i int, url, path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := &p.files[i]
+	f.url, f.path, f.start = url, path, time.Now()
+}
+
+// skip records that the i-th file, from url, is not downloaded for reason.
+func (p *downloadProgress) skip(i int, url, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := &p.files[i]
+	f.state, f.url, f.skipped = status.StatusSuccess, url, reason
+}
+
+// done records that the download of the i-th file is completed, failed if err
+// is not nil.
+func (p *downloadProgress) done(i int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := &p.files[i]
+	f.end = time.Now()
+	if err != nil {
+		f.state = status.StatusError
+		f.err = err
+		return
+	}
+	f.state = status.StatusSuccess
+	f.size = f.written
+	if fi, err := os.Stat(f.path); err == nil {
+		f.size = fi.Size() // also if it was not downloaded again
+	}
+}
+
+// substatuses returns the current progress of each file as a substatus, or
+// its outcome once it is downloaded: its redacted URL, the path it is saved
+// to, its size and the duration of the download, or the error if it failed.
+func (p *downloadProgress) substatuses() []substatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]substatus, len(p.files))
+	for i, f := range p.files {
+		name := fmt.Sprintf("download file[%d]", i)
+		url := logRedactor.redact(redactURLSecrets(f.url))
+		d := roundDuration(f.end.Sub(f.start))
+		switch {
+		case f.skipped != "":
+			out[i] = newSubstatus(name, f.state, fmt.Sprintf("skipped %s: %s", url, f.skipped))
+		case f.state == status.StatusSuccess:
+			out[i] = newSubstatus(name, f.state, fmt.Sprintf("downloaded %s to %s: %d bytes in %v", url, f.path, f.size, d))
+		case f.state == status.StatusError:
+			out[i] = newSubstatus(name, f.state, fmt.Sprintf("failed to download %s to %s after %v: %s", url, f.path, d, logRedactor.redact(f.err.Error())))
+		case f.state == "":
+			out[i] = newSubstatus(name, status.StatusTransitioning, "waiting to start")
+		case f.total < 0:
+			out[i] = newSubstatus(name, f.state, fmt.Sprintf("downloaded %d bytes", f.written))
+		default:
+			out[i] = newSubstatus(name, f.state, fmt.Sprintf("downloaded %d of %d bytes", f.written, f.total))
+		}
+	}
+	return out
+}
+
+// failures returns the redacted errors of the failed downloads, such as
+// "file[1]: <error>", in order.
+func (p *downloadProgress) failures() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []string
+	for i, f := range p.files {
+		if f.state == status.StatusError {
+			out = append(out, fmt.Sprintf("file[%d]: %s", i, logRedactor.redact(f.err.Error())))
+		}
+	}
+	return out
+}
+
+// results returns the outcome of the download of each file, whose URLs are
+// given in fileURLs, to be saved in the result of the operation.
+func (p *downloadProgress) results(fileURLs []string) []fileResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]fileResult, len(p.files))
+	for i, f := range p.files {
+		r := fileResult{Status: "notStarted", BytesDownloaded: f.written}
+		if i < len(fileURLs) {
+			r.URL = logRedactor.redact(fileURLs[i])
+		}
+		switch {
+		case f.skipped != "":
+			r.Status = "skipped"
+		case f.state == status.StatusSuccess:
+			r.Status = "success"
+		case f.state == status.StatusError:
+			r.Status = "error"
+			r.Error = logRedactor.redact(f.err.Error())
+		case f.state == status.StatusTransitioning:
+			r.Status = "inProgress"
+		}
+		out[i] = r
+	}
+	return out
+}
+
+// reportEvery calls report with the current substatuses every interval until
+// the returned stop function is called. stop waits for an ongoing report to
+// complete, so that it does not override a status saved afterwards.
+func (p *downloadProgress) reportEvery(interval time.Duration, report func([]substatus)) (stop func()) {
+	return every(interval, func() { report(p.substatuses()) })
+}
+
+// every calls f every interval until the returned stop function is called.
+// stop waits for an ongoing call to complete.
+func every(interval time.Duration, f func()) (stop func()) {
+	var (
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				f()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_downloadProgress_substatuses(t *testing.T) {
+	p := newDownloadProgress(4)
+	p.progressFunc(0)(5, 10)
+	p.progressFunc(1)(7, -1)
+	p.start(2, "https://a.blob.core.windows.net/c/x.sh?sv=2018&sig=secret", "/d/x.sh")
+	p.progressFunc(2)(10, 10)
+	p.done(2, nil)
+	p.start(3, "https://example.com/y.sh", "/d/y.sh")
+	p.done(3, errors.New("failed"))
+
+	s := p.substatuses()
+	require.Len(t, s, 4)
+	require.Equal(t, newSubstatus("download file[0]", status.StatusTransitioning, "downloaded 5 of 10 bytes"), s[0])
+	require.Equal(t, newSubstatus("download file[1]", status.StatusTransitioning, "downloaded 7 bytes"), s[1], "unknown total")
+	require.Equal(t, status.StatusSuccess, s[2].Status)
+	require.Regexp(t, `^downloaded https://a\.blob\.core\.windows\.net/c/x\.sh\?sv=2018&sig=\*\*\* to /d/x\.sh: 10 bytes in [0-9.]+m?s$`, s[2].FormattedMessage.Message)
+	require.Equal(t, status.StatusError, s[3].Status)
+	require.Regexp(t, `^failed to download https://example\.com/y\.sh to /d/y\.sh after [0-9.]+m?s: failed$`, s[3].FormattedMessage.Message)
+}
+
+func Test_downloadProgress_waiting(t *testing.T) {
+	s := newDownloadProgress(1).substatuses()
+	require.Equal(t, []substatus{newSubstatus("download file[0]", status.StatusTransitioning, "waiting to start")}, s)
+}
+
+func Test_downloadProgress_reportEvery(t *testing.T) {
+	var n int32
+	stop := newDownloadProgress(1).reportEvery(time.Millisecond, func(s []substatus) {
+		require.Len(t, s, 1)
+		atomic.AddInt32(&n, 1)
+	})
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	reported := atomic.LoadInt32(&n)
+	require.True(t, reported > 0, "should have reported")
+
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, reported, atomic.LoadInt32(&n), "should not report after stop")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/url"
+	"os"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// proxyEnvVars are the environment variables specifying the proxy to be used,
+// honored unless a proxy is specified in the settings.
+var proxyEnvVars = []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "NO_PROXY", "no_proxy"}
+
+// configureProxy makes the downloads go through the proxy specified in cfg, if
+// any, and logs which proxy is used with the credentials redacted.
+func configureProxy(ctx log.Logger, cfg handlerSettings) error {
+	u, err := cfg.proxyURL()
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		for _, k := range proxyEnvVars {
+			if v := os.Getenv(k); v != "" {
+				ctx.Log("event", "using proxy from environment", "var", k, "value", redactProxy(v))
+			}
+		}
+		download.SetProxy(nil)
+		return nil
+	}
+	ctx.Log("event", "using proxy from settings", "proxy", redactURL(u))
+	download.SetProxy(u)
+	return nil
+}
+
+// redactProxy returns the given proxy specification with the credentials
+// redacted. It is returned as is if it is not a URL with credentials, such as
+// the NO_PROXY list.
+func redactProxy(v string) string {
+	u, err := url.Parse(v)
+	if err != nil || u.User == nil {
+		return v
+	}
+	return redactURL(u)
+}
+
+// redactURL returns the string form of u with the password replaced, if any.
+func redactURL(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	r := *u
+	if _, ok := u.User.Password(); ok {
+		r.User = url.UserPassword(u.User.Username(), "redacted")
+	}
+	return r.String()
+}
+
+// parseProxyURL parses the proxy URL and returns an error if it is not an
+// absolute http or https URL.
+func parseProxyURL(v string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse 'proxyUrl'")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("'proxyUrl' must be an http or https URL with a host")
+	}
+	return u, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultMaxReboots is how many times the command can request a reboot
+	// for the same configuration, unless specified otherwise.
+	defaultMaxReboots = 3
+
+	// rebootDelay is the argument of shutdown scheduling the reboot, late
+	// enough for the VM agent to report the status of enable.
+	rebootDelay = "+1"
+)
+
+var (
+	// commandPhase is the phase of the command executed by this process: 1
+	// unless it is resumed after the reboot it requested.
+	commandPhase = 1
+
+	// bootIDPath contains the random ID of the current boot, which changes
+	// when the VM reboots.
+	bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+	// scheduleReboot schedules the reboot of the VM requested by the command.
+	scheduleReboot = func() error {
+		b, err := exec.Command("shutdown", "-r", rebootDelay, "reboot requested by the custom script").CombinedOutput()
+		return errors.Wrapf(err, "shutdown failed: %s", strings.TrimSpace(string(b)))
+	}
+)
+
+// resumeState is saved to resumeFile when the command requests a reboot, so
+// that the enable after the reboot runs the next phase of the command for the
+// same configuration, instead of exiting as it is already processed.
+type resumeState struct {
+	SeqNum int    `json:"seqNum"`
+	Phase  int    `json:"phase"`  // of the command to run after the reboot
+	BootID string `json:"bootId"` // of the boot the reboot was requested in
+}
+
+// currentBootID returns the ID of the current boot of the VM.
+func currentBootID() (string, error) {
+	b, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read boot ID")
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// resumePhase returns the phase of the command to resume for seqNum, if the
+// command requested a reboot in the configuration with seqNum and the VM has
+// rebooted since, or 0 otherwise.
+func resumePhase(ctx log.Logger, seqNum int) int {
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, resumeFile))
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		ctx.Log("event", "failed to read resume state", "error", err)
+		return 0
+	}
+	var s resumeState
+	if err := json.Unmarshal(b, &s); err != nil {
+		ctx.Log("event", "failed to parse resume state", "error", err)
+		return 0
+	}
+	if s.SeqNum != seqNum {
+		return 0
+	}
+	boot, err := currentBootID()
+	if err != nil {
+		ctx.Log("event", "cannot check if rebooted", "error", err)
+		return 0
+	}
+	if boot == s.BootID {
+		ctx.Log("event", "waiting for the requested reboot", "phase", s.Phase)
+		return 0
+	}
+	return s.Phase
+}
+
+// saveResumeState records that the command requested a reboot in the given
+// phase for seqNum, to run the next phase after the reboot.
+func saveResumeState(seqNum, phase int) error {
+	boot, err := currentBootID()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(resumeState{SeqNum: seqNum, Phase: phase + 1, BootID: boot})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal resume state")
+	}
+	return errors.Wrap(writeFileAtomic(filepath.Join(dataDir, resumeFile), b), "failed to save resume state")
+}
+
+// clearResumeState removes the saved resume state, if any.
+func clearResumeState(ctx log.Logger) {
+	if err := os.Remove(filepath.Join(dataDir, resumeFile)); err != nil && !os.IsNotExist(err) {
+		ctx.Log("event", "failed to remove resume state", "error", err)
+	}
+}
+
+// rebootRequested returns true if the command executed in dir requested a
+// reboot, by creating the rebootRequiredFile or exiting with rebootExitCode
+// in cfg, which runErr of the command is checked for.
+func rebootRequested(dir string, cfg handlerSettings, runErr error) bool {
+	if code := cfg.publicSettings.RebootExitCode; code > 0 {
+		if exitErr, ok := errors.Cause(runErr).(ExitError); ok && exitErr.Code == code {
+			return true
+		}
+	}
+	if runErr != nil {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(dir, rebootRequiredFile))
+	return err == nil
+}
+
+// handleRebootRequest saves the state to resume the command after the reboot
+// it requested in the given phase, schedules the reboot if allowReboot in cfg
+// is set and returns the message reporting it.
+func handleRebootRequest(ctx log.Logger, seqNum, phase int, cfg handlerSettings) (string, error) {
+	if max := cfg.maxReboots(); phase > max {
+		return "", fmt.Errorf("the command requested a reboot again after %d reboot(s) (maxReboots)", max)
+	}
+	if err := saveResumeState(seqNum, phase); err != nil {
+		return "", err
+	}
+	ctx.Log("event", "reboot requested by the command", "phase", phase)
+	if !cfg.publicSettings.AllowReboot {
+		return fmt.Sprintf("reboot required: the command requested a reboot in phase %d, the next phase runs in the first enable after the VM is rebooted\n", phase), nil
+	}
+	if err := scheduleReboot(); err != nil {
+		return "", errors.Wrap(err, "failed to schedule reboot")
+	}
+	ctx.Log("event", "scheduled reboot", "delay", rebootDelay)
+	return fmt.Sprintf("reboot required: the command requested a reboot in phase %d, the VM is rebooting in a minute (allowReboot) and the next phase runs after the reboot\n", phase), nil
+}
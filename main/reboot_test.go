@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_enable_rebootAndResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d, p string, f func() error, n int) {
+		dataDir, bootIDPath, scheduleReboot, commandPhase = d, p, f, n
+	}(dataDir, bootIDPath, scheduleReboot, commandPhase)
+	dataDir, bootIDPath = filepath.Join(dir, "data"), filepath.Join(dir, "boot_id")
+	reboots := 0
+	scheduleReboot = func() error { reboots++; return nil }
+	var h vmextension.HandlerEnvironment
+	h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder = filepath.Join(dir, "config"), filepath.Join(dir, "status")
+	for _, d := range []string{dataDir, h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder} {
+		require.Nil(t, os.Mkdir(d, 0700))
+	}
+	require.Nil(t, ioutil.WriteFile(bootIDPath, []byte("boot-1\n"), 0600))
+	phases := filepath.Join(dir, "phases")
+	settings := func(maxReboots int) {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(h.HandlerEnvironment.ConfigFolder, "1.settings"), []byte(fmt.Sprintf(
+			`{"runtimeSettings": [{"handlerSettings": {"publicSettings": {"commandToExecute": "echo $CUSTOM_SCRIPT_PHASE >> %s; if [ $CUSTOM_SCRIPT_PHASE = 1 ]; then exit 42; fi", "rebootExitCode": 42, "allowReboot": true, "maxReboots": %d}}}]}`,
+			phases, maxReboots)), 0600))
+	}
+	settings(1)
+
+	msg, _, err := enable(log.NewContext(log.NewNopLogger()), h, 1)
+	require.Nil(t, err, "reboot request is not a failure")
+	require.Contains(t, msg, "reboot required: the command requested a reboot in phase 1, the VM is rebooting")
+	require.Equal(t, 1, reboots)
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, resultFile))
+	require.Nil(t, err)
+	require.Contains(t, string(b), `"rebootRequired": true`)
+	require.Contains(t, string(b), `"exitCode": 42`)
+
+	require.Equal(t, 0, resumePhase(log.NewNopLogger(), 1), "not rebooted yet")
+	require.Nil(t, ioutil.WriteFile(bootIDPath, []byte("boot-2\n"), 0600))
+	require.Equal(t, 0, resumePhase(log.NewNopLogger(), 2), "another configuration")
+	require.Equal(t, 2, resumePhase(log.NewNopLogger(), 1))
+
+	msg, _, err = enable(log.NewContext(log.NewNopLogger()), h, 1)
+	require.Nil(t, err)
+	require.NotContains(t, msg, "reboot required")
+	require.Equal(t, 1, reboots)
+	b, err = ioutil.ReadFile(phases)
+	require.Nil(t, err)
+	require.Equal(t, "1\n2\n", string(b), "next phase after the reboot")
+	_, err = os.Stat(filepath.Join(dataDir, resumeFile))
+	require.True(t, os.IsNotExist(err), "resume state is cleared")
+
+	// requesting more reboots than allowed
+	settings(0)
+	_, _, err = enable(log.NewContext(log.NewNopLogger()), h, 1)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "requested a reboot again after 0 reboot(s) (maxReboots)")
+	require.Equal(t, 1, reboots)
+}
+
+func Test_enable_resumeRetried(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d, p string, f func() error, n int) {
+		dataDir, bootIDPath, scheduleReboot, commandPhase = d, p, f, n
+	}(dataDir, bootIDPath, scheduleReboot, commandPhase)
+	dataDir, bootIDPath = filepath.Join(dir, "data"), filepath.Join(dir, "boot_id")
+	scheduleReboot = func() error { return nil }
+	var h vmextension.HandlerEnvironment
+	h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder = filepath.Join(dir, "config"), filepath.Join(dir, "status")
+	for _, d := range []string{dataDir, h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder} {
+		require.Nil(t, os.Mkdir(d, 0700))
+	}
+	require.Nil(t, ioutil.WriteFile(bootIDPath, []byte("boot-1\n"), 0600))
+	phases, failed := filepath.Join(dir, "phases"), filepath.Join(dir, "failed")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(h.HandlerEnvironment.ConfigFolder, "1.settings"), []byte(fmt.Sprintf(
+		`{"runtimeSettings": [{"handlerSettings": {"publicSettings": {"commandToExecute": "echo $CUSTOM_SCRIPT_PHASE >> %s; if [ $CUSTOM_SCRIPT_PHASE = 1 ]; then exit 42; fi; if [ ! -e %s ]; then : > %s; exit 1; fi", "rebootExitCode": 42, "allowReboot": true, "enableRetryCount": 1, "enableRetryIntervalSeconds": 1}}}]}`,
+		phases, failed, failed)), 0600))
+
+	_, _, err = enable(log.NewContext(log.NewNopLogger()), h, 1)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(bootIDPath, []byte("boot-2\n"), 0600))
+
+	// phase 2 fails once, the retry runs phase 2 again
+	msg, _, err := enable(log.NewContext(log.NewNopLogger()), h, 1)
+	require.Nil(t, err)
+	require.Contains(t, msg, "enable attempt 2 of 2 (enableRetryCount)")
+	b, err := ioutil.ReadFile(phases)
+	require.Nil(t, err)
+	require.Equal(t, "1\n2\n2\n", string(b))
+}
+
+func Test_rebootRequested(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cfg := handlerSettings{publicSettings: publicSettings{RebootExitCode: 3}}
+
+	require.False(t, rebootRequested(dir, cfg, nil))
+	require.True(t, rebootRequested(dir, cfg, ExitError{Code: 3}))
+	require.False(t, rebootRequested(dir, cfg, ExitError{Code: 1}))
+	require.False(t, rebootRequested(dir, handlerSettings{}, ExitError{Code: 3}), "rebootExitCode not specified")
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, rebootRequiredFile), nil, 0600))
+	require.True(t, rebootRequested(dir, handlerSettings{}, nil))
+	require.False(t, rebootRequested(dir, handlerSettings{}, ExitError{Code: 1}), "failed command")
+}
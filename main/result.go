@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// resultSchemaVersion is the version of the enableResult format. It is
+// incremented on incompatible changes to the format.
+const resultSchemaVersion = 1
+
+// enableResult is the outcome of the last enable operation, saved to
+// resultFile as a stable machine-readable alternative to the status file.
+type enableResult struct {
+	SchemaVersion   int          `json:"schemaVersion"`
+	SeqNum          int          `json:"seqNum"`
+	Command         string       `json:"command,omitempty"` // with the secrets redacted
+	ExitCode        *int         `json:"exitCode"`          // nil if the command did not exit on its own
+	DurationSeconds float64      `json:"durationSeconds"`
+	Success         bool         `json:"success"`
+	Skipped         bool         `json:"skipped"`        // the command was skipped due to testCommand, skipExecution or runOnce
+	RebootRequired  bool         `json:"rebootRequired"` // the command requested a reboot to run its next phase
+	Error           string       `json:"error,omitempty"`
+	Files           []fileResult `json:"files"`
+
+	start, end time.Time
+}
+
+// fileResult is the outcome of downloading one of the files in fileUris.
+type fileResult struct {
+	URL             string `json:"url"`    // with the secrets redacted
+	Status          string `json:"status"` // "success", "error", "inProgress", "notStarted" or "skipped"
+	BytesDownloaded int64  `json:"bytesDownloaded"`
+	Error           string `json:"error,omitempty"`
+}
+
+// newEnableResult returns the result of the enable operation for seqNum
+// starting now.
+func newEnableResult(seqNum int) *enableResult {
+	return &enableResult{
+		SchemaVersion: resultSchemaVersion,
+		SeqNum:        seqNum,
+		Files:         []fileResult{},
+		start:         time.Now()}
+}
+
+// setCommand records the command to be executed according to cfg.
+func (r *enableResult) setCommand(cfg handlerSettings) {
+	cmd := cfg.commandToExecute()
+	switch {
+	case cfg.protectedSettings.Script != "":
+		cmd = "(script)"
+	case cfg.publicSettings.ScriptFile != "":
+		cmd = cfg.publicSettings.ScriptFile
+	case len(cfg.commands()) > 0:
+		cmd = strings.Join(cfg.commands(), "; ")
+	case len(cfg.parallelCommands()) > 0:
+		cmd = strings.Join(cfg.parallelCommands(), " & ")
+	}
+	r.Command = logRedactor.redact(cmd)
+}
+
+// setFiles records the results of downloading the files in fileURLs tracked by
+// progress.
+func (r *enableResult) setFiles(fileURLs []string, progress *downloadProgress) {
+	r.Files = progress.results(fileURLs)
+}
+
+// setExitCode records the exit code of the command from err returned from
+// executing it.
+func (r *enableResult) setExitCode(err error) {
+	code := 0
+	if err != nil {
+		exitErr, ok := errors.Cause(err).(ExitError)
+		if !ok {
+			return
+		}
+		code = exitErr.Code
+	}
+	r.ExitCode = &code
+}
+
+// finish records the end of the operation, which failed if err is not nil.
+func (r *enableResult) finish(err error) {
+	r.end = time.Now()
+	r.DurationSeconds = r.end.Sub(r.start).Seconds()
+	r.Success = err == nil
+	if err != nil {
+		r.Error = logRedactor.redact(err.Error())
+	}
+}
+
+// save writes the result to path, replacing the existing file atomically.
+func (r *enableResult) save(path string) error {
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "result: failed to marshal into json")
+	}
+	return errors.Wrap(writeFileAtomic(path, b), "result")
+}
+
+// health returns the contents of healthFile for the finished result: the
+// status ("success", "skipped" or "failed"), the sequence number, the end time
+// in UTC and the exit code of the command if it exited, one "key=value" per
+// line.
+func (r *enableResult) health() []byte {
+	s := "failed"
+	if r.Success && r.Skipped {
+		s = "skipped"
+	} else if r.Success {
+		s = "success"
+	}
+	out := fmt.Sprintf("status=%s\nseqNum=%d\ntimestamp=%s\n", s, r.SeqNum, r.end.UTC().Format(time.RFC3339))
+	if r.ExitCode != nil {
+		out += fmt.Sprintf("exitCode=%d\n", *r.ExitCode)
+	}
+	return []byte(out)
+}
+
+// writeFileAtomic writes b to the file at path, replacing the existing file
+// atomically so that readers never see a partially written file.
+func writeFileAtomic(path string, b []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	tmpFile.Close()
+	if err := ioutil.WriteFile(tmpFile.Name(), b, 0644); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrapf(err, "failed to write path=%s", tmpFile.Name())
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrapf(err, "failed to move to path=%s", path)
+	}
+	return nil
+}
+
+// saveResult finishes and saves the result of the enable operation and its
+// health summary under dataDir. Failures are logged, as they do not affect the
+// outcome of the operation.
+func saveResult(ctx log.Logger, r *enableResult, err error) {
+	r.finish(err)
+	path := filepath.Join(dataDir, resultFile)
+	if err := r.save(path); err != nil {
+		ctx.Log("event", "failed to save result", "error", err)
+	} else {
+		ctx.Log("event", "saved result", "path", path)
+	}
+	path = filepath.Join(dataDir, healthFile)
+	if err := writeFileAtomic(path, r.health()); err != nil {
+		ctx.Log("event", "failed to save health file", "error", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_enableResult_setCommand(t *testing.T) {
+	r := newEnableResult(1)
+	r.setCommand(handlerSettings{publicSettings: publicSettings{CommandToExecute: "date"}})
+	require.Equal(t, "date", r.Command)
+
+	r.setCommand(handlerSettings{publicSettings: publicSettings{Commands: []string{"a", "b"}}})
+	require.Equal(t, "a; b", r.Command)
+
+	r.setCommand(handlerSettings{
+		publicSettings{CommandToExecute: "date", ScriptFile: "run.sh"}, protectedSettings{}})
+	require.Equal(t, "run.sh", r.Command, "scriptFile takes precedence")
+
+	r.setCommand(handlerSettings{protectedSettings: protectedSettings{Script: "ZGF0ZQo="}})
+	require.Equal(t, "(script)", r.Command)
+}
+
+func Test_enableResult_setExitCode(t *testing.T) {
+	r := newEnableResult(1)
+	r.setExitCode(errors.New("terminated"))
+	require.Nil(t, r.ExitCode, "did not exit on its own")
+
+	r.setExitCode(nil)
+	require.Equal(t, 0, *r.ExitCode)
+
+	r.setExitCode(categorize(errCommandFailed, ExitError{Code: 3}))
+	require.Equal(t, 3, *r.ExitCode)
+}
+
+func Test_enableResult_save(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, resultFile)
+
+	p := newDownloadProgress(2)
+	p.progressFunc(0)(10, 10)
+	p.done(0, nil)
+	p.done(1, errors.New("http error"))
+
+	r := newEnableResult(5)
+	r.setCommand(handlerSettings{publicSettings: publicSettings{CommandToExecute: "exit 2"}})
+	r.setFiles([]string{"http://a/1", "http://a/2?sig=secret"}, p)
+	r.setExitCode(ExitError{Code: 2})
+	r.finish(errors.New("command failed"))
+	require.Nil(t, r.save(path))
+	r.finish(nil)
+	require.Nil(t, r.save(path), "overwrites the existing file")
+
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	var out map[string]interface{}
+	require.Nil(t, json.Unmarshal(b, &out))
+	require.EqualValues(t, resultSchemaVersion, out["schemaVersion"])
+	require.EqualValues(t, 5, out["seqNum"])
+	require.Equal(t, "exit 2", out["command"])
+	require.EqualValues(t, 2, out["exitCode"])
+	require.Equal(t, true, out["success"])
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"url": "http://a/1", "status": "success", "bytesDownloaded": float64(10)},
+		map[string]interface{}{"url": "http://a/2?sig=***", "status": "error", "bytesDownloaded": float64(0), "error": "http error"},
+	}, out["files"])
+
+	fis, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, fis, 1, "no temporary files are left behind")
+}
+
+func Test_enableResult_health(t *testing.T) {
+	r := newEnableResult(5)
+	r.setExitCode(ExitError{Code: 2})
+	r.finish(errors.New("command failed"))
+	ts := r.end.UTC().Format(time.RFC3339)
+	require.Equal(t, "status=failed\nseqNum=5\ntimestamp="+ts+"\nexitCode=2\n", string(r.health()))
+
+	r = newEnableResult(6)
+	r.Skipped = true
+	r.finish(nil)
+	require.Equal(t, "status=skipped\nseqNum=6\ntimestamp="+r.end.UTC().Format(time.RFC3339)+"\n", string(r.health()), "no exit code")
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = dir
+	r = newEnableResult(7)
+	r.setExitCode(nil)
+	saveResult(log.NewNopLogger(), r, nil)
+	b, err := ioutil.ReadFile(filepath.Join(dir, healthFile))
+	require.Nil(t, err)
+	require.Contains(t, string(b), "status=success\nseqNum=7\n")
+	require.Contains(t, string(b), "exitCode=0\n")
+}
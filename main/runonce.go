@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// runOnceState is saved to runOnceFile when the command completes with
+// runOnce, so that it is never executed again, whatever the sequence number
+// of the following configurations is.
+type runOnceState struct {
+	SeqNum    int       `json:"seqNum"`    // of the configuration the command completed in
+	Completed time.Time `json:"completed"` // when the command completed
+	Tag       string    `json:"resetTag"`  // the runOnceResetTag it completed with
+}
+
+// runOnceCompleted returns the saved state of the command completed with
+// runOnce, if any. A state saved with another runOnceResetTag than tag is
+// removed, as the configuration requests the command to run again.
+func runOnceCompleted(ctx log.Logger, tag string) (runOnceState, bool) {
+	var s runOnceState
+	path := filepath.Join(dataDir, runOnceFile)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, false
+	} else if err != nil {
+		// rather run again than never run
+		ctx.Log("event", "failed to read runOnce state", "error", err)
+		return s, false
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		ctx.Log("event", "failed to parse runOnce state", "error", err)
+		return s, false
+	}
+	if s.Tag != tag {
+		ctx.Log("event", "runOnceResetTag changed, clearing runOnce state", "old", s.Tag, "new", tag)
+		clearRunOnceState(ctx)
+		return s, false
+	}
+	return s, true
+}
+
+// saveRunOnceState records that the command completed with runOnce in the
+// configuration with seqNum and the given runOnceResetTag.
+func saveRunOnceState(seqNum int, tag string) error {
+	b, err := json.Marshal(runOnceState{SeqNum: seqNum, Completed: time.Now().UTC(), Tag: tag})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal runOnce state")
+	}
+	return errors.Wrap(writeFileAtomic(filepath.Join(dataDir, runOnceFile), b), "failed to save runOnce state")
+}
+
+// clearRunOnceState removes the saved runOnce state, if any.
+func clearRunOnceState(ctx log.Logger) {
+	if err := os.Remove(filepath.Join(dataDir, runOnceFile)); err != nil && !os.IsNotExist(err) {
+		ctx.Log("event", "failed to remove runOnce state", "error", err)
+	}
+}
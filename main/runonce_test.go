@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_enable_runOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = filepath.Join(dir, "data")
+	var h vmextension.HandlerEnvironment
+	h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder = filepath.Join(dir, "config"), filepath.Join(dir, "status")
+	for _, d := range []string{dataDir, h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder} {
+		require.Nil(t, os.Mkdir(d, 0700))
+	}
+	runs := filepath.Join(dir, "runs")
+	settings := func(seqNum int, exit int, tag string) {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(h.HandlerEnvironment.ConfigFolder, fmt.Sprintf("%d.settings", seqNum)), []byte(fmt.Sprintf(
+			`{"runtimeSettings": [{"handlerSettings": {"publicSettings": {"commandToExecute": "echo %d >> %s; exit %d", "runOnce": true, "runOnceResetTag": %q}}}]}`,
+			seqNum, runs, exit, tag)), 0600))
+	}
+	readRuns := func() string {
+		b, err := ioutil.ReadFile(runs)
+		require.Nil(t, err)
+		return string(b)
+	}
+
+	settings(1, 1, "")
+	_, _, err = enable(log.NewContext(log.NewNopLogger()), h, 1)
+	require.NotNil(t, err)
+	_, err = os.Stat(filepath.Join(dataDir, runOnceFile))
+	require.True(t, os.IsNotExist(err), "failed command is not completed")
+
+	settings(2, 0, "")
+	_, _, err = enable(log.NewContext(log.NewNopLogger()), h, 2)
+	require.Nil(t, err)
+	require.Equal(t, "1\n2\n", readRuns())
+
+	settings(3, 0, "")
+	msg, sub, err := enable(log.NewContext(log.NewNopLogger()), h, 3)
+	require.Nil(t, err)
+	require.Contains(t, msg, "skipped: the command already completed at ")
+	require.Contains(t, msg, "with sequence number 2, it is not executed again (runOnce)")
+	require.Equal(t, "1\n2\n", readRuns(), "not executed again for another seqnum")
+	require.Equal(t, "skipped: runOnce", sub[len(sub)-1].FormattedMessage.Message)
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, resultFile))
+	require.Nil(t, err)
+	require.Contains(t, string(b), `"skipped": true`)
+
+	settings(4, 0, "again")
+	_, _, err = enable(log.NewContext(log.NewNopLogger()), h, 4)
+	require.Nil(t, err)
+	require.Equal(t, "1\n2\n4\n", readRuns(), "executed again with another runOnceResetTag")
+	settings(5, 0, "again")
+	_, _, err = enable(log.NewContext(log.NewNopLogger()), h, 5)
+	require.Nil(t, err)
+	require.Equal(t, "1\n2\n4\n", readRuns())
+}
+
+func Test_runOnceCompleted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = dir
+
+	_, ok := runOnceCompleted(log.NewNopLogger(), "")
+	require.False(t, ok, "no state")
+	require.Nil(t, saveRunOnceState(3, "a"))
+	s, ok := runOnceCompleted(log.NewNopLogger(), "a")
+	require.True(t, ok)
+	require.Equal(t, 3, s.SeqNum)
+	require.False(t, s.Completed.IsZero())
+
+	_, ok = runOnceCompleted(log.NewNopLogger(), "b")
+	require.False(t, ok, "another tag")
+	_, err = os.Stat(filepath.Join(dataDir, runOnceFile))
+	require.True(t, os.IsNotExist(err), "state is cleared")
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dataDir, runOnceFile), []byte("{"), 0600))
+	_, ok = runOnceCompleted(log.NewNopLogger(), "")
+	require.False(t, ok, "invalid state")
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
 	"github.com/pkg/errors"
 	"github.com/xeipuuv/gojsonschema"
 )
@@ -19,17 +21,529 @@ const (
       "description": "Command to be executed",
       "type": "string"
     },
+    "commands": {
+      "description": "Commands to be executed in order, instead of commandToExecute",
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "string",
+        "minLength": 1
+      }
+    },
+    "parallelCommands": {
+      "description": "Commands to be executed concurrently, instead of commandToExecute",
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "string",
+        "minLength": 1
+      }
+    },
+    "maxParallelCommands": {
+      "description": "Maximum number of parallelCommands executed at a time (default: all of them)",
+      "type": "integer",
+      "minimum": 1
+    },
+    "parallelCommandTimeoutSeconds": {
+      "description": "Time limit in seconds of each of the parallelCommands",
+      "type": "integer",
+      "minimum": 1
+    },
+    "continueOnError": {
+      "description": "Whether to run the remaining commands after one of the commands fails",
+      "type": "boolean"
+    },
+    "rebootExitCode": {
+      "description": "Exit code of the command requesting a reboot, after which the next phase of the command runs",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 255
+    },
+    "allowReboot": {
+      "description": "Whether to reboot the VM when the command requests a reboot",
+      "type": "boolean"
+    },
+    "maxReboots": {
+      "description": "How many times the command can request a reboot for the same configuration (default: 3)",
+      "type": "integer",
+      "minimum": 0
+    },
+    "continueOnDownloadError": {
+      "description": "Whether to skip the files in fileUris which failed to download, instead of failing the operation",
+      "type": "boolean"
+    },
+    "minSuccessfulDownloads": {
+      "description": "Number of files in fileUris that must be downloaded for the command to be executed with continueOnDownloadError (default: 0)",
+      "type": "integer",
+      "minimum": 0
+    },
+    "testCommand": {
+      "description": "Command to be executed before the command, which is skipped if it exits with 0",
+      "type": "string",
+      "minLength": 1
+    },
+    "onFailureCommand": {
+      "description": "Command to be executed if the command fails",
+      "type": "string",
+      "minLength": 1
+    },
+    "scriptFile": {
+      "description": "Name of a downloaded file to be executed instead of commandToExecute",
+      "type": "string",
+      "minLength": 1
+    },
     "fileUris": {
-      "description": "List of files to be downloaded",
+      "description": "List of files to be downloaded, each the URL of the file or an object with the URL of the file followed by the URLs of its mirrors, what is expected to be extracted from it if it is an archive, and the distributions it is downloaded on",
+      "type": "array",
+      "items": {
+        "oneOf": [
+          {
+            "type": "string",
+            "format": "uri"
+          },
+          {
+            "type": "object",
+            "properties": {
+              "urls": {
+                "type": "array",
+                "minItems": 1,
+                "items": {
+                  "type": "string",
+                  "format": "uri"
+                }
+              },
+              "expectedFileCount": {
+                "description": "Number of files the archive must contain, with extractArchives",
+                "type": "integer",
+                "minimum": 0
+              },
+              "expectedExtractedSize": {
+                "description": "Total size in bytes of the files the archive must contain, with extractArchives",
+                "type": "integer",
+                "minimum": 0
+              },
+              "osMatch": {
+                "description": "Predicates of which the distribution of the VM must match one for the file to be downloaded",
+                "type": "array",
+                "items": {
+                  "type": "object",
+                  "properties": {
+                    "distro": {
+                      "description": "Glob matched against the ID or ID_LIKE of /etc/os-release, such as ubuntu or rhel",
+                      "type": "string",
+                      "minLength": 1
+                    },
+                    "version": {
+                      "description": "Glob matched against the VERSION_ID of /etc/os-release, such as 22.*",
+                      "type": "string"
+                    }
+                  },
+                  "required": ["distro"],
+                  "additionalProperties": false
+                }
+              }
+            },
+            "required": ["urls"],
+            "additionalProperties": false
+          }
+        ]
+      }
+    },
+    "fileHashes": {
+      "description": "List of hex-encoded SHA-256 checksums of the files in fileUris, in the same order (empty string skips verification)",
+      "type": "array",
+      "items": {
+        "type": "string",
+        "pattern": "^([a-fA-F0-9]{64})?$"
+      }
+    },
+    "expectedContentTypes": {
+      "description": "List of the media types the Content-Type of the responses of the files in fileUris must be, in the same order, such as application/x-sh or text/* (empty string skips the check)",
       "type": "array",
       "items": {
         "type": "string",
-        "format": "uri"
+        "pattern": "^([A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*/([A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*|\\*))?$"
+      }
+    },
+    "signatureUrls": {
+      "description": "List of URLs of the detached OpenPGP signatures of the files in fileUris, in the same order (empty string skips verification)",
+      "type": "array",
+      "items": {
+        "type": "string"
+      }
+    },
+    "gpgPublicKey": {
+      "description": "ASCII-armored OpenPGP public keys the signatures in signatureUrls and of the manifest in manifestUri are verified with",
+      "type": "string"
+    },
+    "fileNames": {
+      "description": "List of names to save the files in fileUris as, in the same order (empty string uses the name in the URL)",
+      "type": "array",
+      "items": {
+        "type": "string"
+      }
+    },
+    "indexedFileNames": {
+      "description": "Whether the files in fileUris without a name in fileNames are saved as their index followed by an underscore and the name in the URL, such as 0_script.sh",
+      "type": "boolean"
+    },
+    "umask": {
+      "description": "Octal file mode creation mask the command is executed with, such as 0022",
+      "type": "string",
+      "pattern": "^0?[0-7]{3}$"
+    },
+    "niceness": {
+      "description": "Nice value the command is executed with, from -20 (highest priority) to 19 (lowest priority)",
+      "type": "integer",
+      "minimum": -20,
+      "maximum": 19
+    },
+    "ioniceClass": {
+      "description": "I/O scheduling class the command is executed with",
+      "type": "string",
+      "enum": ["best-effort", "idle"]
+    },
+    "ioniceLevel": {
+      "description": "Priority within the best-effort I/O scheduling class, from 0 (highest) to 7 (lowest)",
+      "type": "integer",
+      "minimum": 0,
+      "maximum": 7
+    },
+    "useSystemdScope": {
+      "description": "Run the commands in transient systemd scope units with systemd-run, if systemd is available",
+      "type": "boolean"
+    },
+    "chrootDir": {
+      "description": "Absolute path of the directory the commands are chrooted into, with the downloaded files copied in; the files the commands write to the copy are discarded once they exit",
+      "type": "string"
+    },
+    "memoryLimitMb": {
+      "description": "Memory limit in MiB of the cgroup (or the systemd scope with useSystemdScope) of the commands",
+      "type": "integer",
+      "minimum": 1
+    },
+    "cpuQuota": {
+      "description": "CPU time limit of the cgroup (or the systemd scope with useSystemdScope) of the commands as a percentage of one CPU, such as 50",
+      "type": "integer",
+      "minimum": 1
+    },
+    "fileMode": {
+      "description": "Octal permission bits of the downloaded files, such as 0755 (default: 0500)",
+      "type": "string"
+    },
+    "destinationDir": {
+      "description": "Absolute path of the directory to save the downloaded files to, instead of the download directory",
+      "type": "string",
+      "minLength": 1
+    },
+    "destinationDirs": {
+      "description": "Absolute paths of the directories to save the files in fileUris to, in the same order, overriding destinationDir",
+      "type": "array",
+      "items": {
+        "type": "string"
+      }
+    },
+    "fileModes": {
+      "description": "List of octal permission bits of the files in fileUris, in the same order (empty string uses fileMode)",
+      "type": "array",
+      "items": {
+        "type": "string"
+      }
+    },
+    "fileMappings": {
+      "description": "List of files in the download directory, matching the glob pattern in from, to be moved to to, applied in order after the downloads",
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "from": {
+            "description": "Glob pattern of the files to move, relative to the download directory",
+            "type": "string",
+            "minLength": 1
+          },
+          "to": {
+            "description": "Path to move the file, or the directory to move the files, to, relative to the download directory",
+            "type": "string",
+            "minLength": 1
+          }
+        },
+        "required": ["from", "to"],
+        "additionalProperties": false
       }
     },
+    "gitRepository": {
+      "description": "Git repository to check out into the download directory before the command is executed",
+      "type": "object",
+      "properties": {
+        "url": {
+          "description": "URL of the repository, such as https://github.com/org/repo.git",
+          "type": "string",
+          "minLength": 1
+        },
+        "branch": {
+          "description": "Branch (or tag) to check out (default: the default branch of the repository)",
+          "type": "string",
+          "minLength": 1
+        },
+        "commit": {
+          "description": "Commit to check out, which should be reachable from branch",
+          "type": "string",
+          "pattern": "^[0-9a-fA-F]{7,40}$"
+        }
+      },
+      "required": ["url"],
+      "additionalProperties": false
+    },
     "timestamp": {
       "description": "An integer, intended to trigger re-execution of the script when changed",
       "type": "integer"
+    },
+    "timeoutSeconds": {
+      "description": "Duration in seconds after which the command is terminated, 0 means no timeout",
+      "type": "integer",
+      "minimum": 0
+    },
+    "operationTimeoutSeconds": {
+      "description": "Duration in seconds after which the enable operation (downloading the files and executing the command) is aborted, 0 means no timeout",
+      "type": "integer",
+      "minimum": 0
+    },
+    "timeoutGracePeriodSeconds": {
+      "description": "Duration in seconds to wait for the command to exit after it is sent SIGTERM on timeout, before sending SIGKILL",
+      "type": "integer",
+      "minimum": 0
+    },
+    "maxConcurrentDownloads": {
+      "description": "Maximum number of files to be downloaded at the same time",
+      "type": "integer",
+      "minimum": 1
+    },
+    "downloadRetryCount": {
+      "description": "Number of times a download is retried on transient failures",
+      "type": "integer",
+      "minimum": 0
+    },
+    "downloadRetryIntervalSeconds": {
+      "description": "Base duration in seconds to wait before retrying a download, doubled after each retry",
+      "type": "integer",
+      "minimum": 1
+    },
+    "commandRetryCount": {
+      "description": "Number of times the command is executed again if it exits with a non-zero code",
+      "type": "integer",
+      "minimum": 0
+    },
+    "commandRetryIntervalSeconds": {
+      "description": "Duration in seconds to wait before executing a failed command again",
+      "type": "integer",
+      "minimum": 1
+    },
+    "enableRetryCount": {
+      "description": "Number of times the whole enable operation (downloads and the command) is run again if it fails for a retriable reason",
+      "type": "integer",
+      "minimum": 0
+    },
+    "enableRetryIntervalSeconds": {
+      "description": "Duration in seconds to wait before running a failed enable operation again",
+      "type": "integer",
+      "minimum": 1
+    },
+    "maxFileSizeBytes": {
+      "description": "Maximum size of a downloaded file in bytes",
+      "type": "integer",
+      "minimum": 1
+    },
+    "maxTotalDownloadBytes": {
+      "description": "Maximum total size of the downloaded files in bytes",
+      "type": "integer",
+      "minimum": 1
+    },
+    "maxFileUris": {
+      "description": "Maximum number of files in fileUris",
+      "type": "integer",
+      "minimum": 1
+    },
+    "maxCommandLength": {
+      "description": "Maximum length of a command in bytes",
+      "type": "integer",
+      "minimum": 1
+    },
+    "connectTimeoutSeconds": {
+      "description": "Duration in seconds establishing a connection for a download, including the DNS resolution, may take",
+      "type": "integer",
+      "minimum": 1
+    },
+    "responseHeaderTimeoutSeconds": {
+      "description": "Duration in seconds to wait for the response headers of a download request",
+      "type": "integer",
+      "minimum": 1
+    },
+    "maxStatusOutputBytes": {
+      "description": "Number of bytes from the end of the command stdout and stderr to be reported in the status",
+      "type": "integer",
+      "minimum": 1
+    },
+    "blobContainerUri": {
+      "description": "URL of the Azure Blob Storage container whose blobs are downloaded along with fileUris",
+      "type": "string",
+      "format": "uri"
+    },
+    "blobPrefix": {
+      "description": "Prefix of the names of the blobs downloaded from blobContainerUri",
+      "type": "string"
+    },
+    "allowEmptyBlobList": {
+      "description": "Proceed if no blob in blobContainerUri matches blobPrefix",
+      "type": "boolean"
+    },
+    "manifestUri": {
+      "description": "URL of a signed JSON manifest listing files to download with their SHA-256 checksums, verified with gpgPublicKey",
+      "type": "string",
+      "format": "uri"
+    },
+    "manifestSignatureUri": {
+      "description": "URL of the detached signature of the manifest in manifestUri (default: the URL of the manifest with .sig appended to its path)",
+      "type": "string",
+      "format": "uri"
+    },
+    "outputBlobUri": {
+      "description": "URL of the Azure Blob Storage container or virtual directory to upload the stdout and stderr files to after the command completes",
+      "type": "string",
+      "format": "uri"
+    },
+    "statusVerbosity": {
+      "description": "How much detail is reported in the status: only the outcome (minimal), the output tails, timings and the outcome of each download (normal) or also longer output tails (verbose)",
+      "type": "string",
+      "enum": ["minimal", "normal", "verbose"]
+    },
+    "progressIntervalSeconds": {
+      "description": "Duration in seconds between the download progress updates in the status",
+      "type": "integer",
+      "minimum": 1
+    },
+    "heartbeatIntervalSeconds": {
+      "description": "Duration in seconds between the status updates while the command is running",
+      "type": "integer",
+      "minimum": 1
+    },
+    "environmentVariables": {
+      "description": "Environment variables to be set for the command",
+      "type": "object",
+      "additionalProperties": {
+        "type": "string"
+      }
+    },
+    "expandVariables": {
+      "description": "Whether to replace the ${NAME} references to environmentVariables in commandToExecute with their values before executing it",
+      "type": "boolean"
+    },
+    "expandVariablesStrict": {
+      "description": "Whether references to undefined variables fail the operation instead of being replaced with empty strings, with expandVariables",
+      "type": "boolean"
+    },
+    "substituteMetadata": {
+      "description": "Whether to replace the {vmName}, {resourceGroup}, {location} and other tokens in commandToExecute, commands and parallelCommands with the instance metadata of the VM",
+      "type": "boolean"
+    },
+    "secretsDeliveryMode": {
+      "description": "How the protected environmentVariables are passed to the command: in its environment (env), or in a file whose path is in CUSTOM_SCRIPT_SECRETS_FILE (file)",
+      "type": "string",
+      "enum": ["env", "file"]
+    },
+    "interpreter": {
+      "description": "Name or absolute path of the program used to run the command (default: /bin/sh)",
+      "type": "string",
+      "minLength": 1
+    },
+    "convertLineEndings": {
+      "description": "Remove BOM and convert DOS line endings of the downloaded script files (default: true)",
+      "type": "boolean"
+    },
+    "skipDos2Unix": {
+      "description": "Do not modify the downloaded files at all, overrides convertLineEndings",
+      "type": "boolean"
+    },
+    "runAsUser": {
+      "description": "Name of the user to execute the command as (default: root)",
+      "type": "string",
+      "minLength": 1
+    },
+    "forceUpdateTag": {
+      "description": "An arbitrary string, intended to trigger re-execution of the script when changed",
+      "type": "string"
+    },
+    "allowFileUris": {
+      "description": "Allow file:// URLs in fileUris to copy files from the local file system",
+      "type": "boolean"
+    },
+    "validateOnly": {
+      "description": "Only validate the configuration and check if the files can be downloaded, without executing the command",
+      "type": "boolean"
+    },
+    "skipExecution": {
+      "description": "Only download the files, without executing the command",
+      "type": "boolean"
+    },
+    "runInBackground": {
+      "description": "Start the command in the background and report success without waiting for it to exit",
+      "type": "boolean"
+    },
+    "extractArchives": {
+      "description": "Whether to extract the downloaded .tar, .tar.gz, .tgz and .zip files into the download directory",
+      "type": "boolean"
+    },
+    "keepDownloadDirs": {
+      "description": "Number of the download directories of the most recent sequence numbers to keep, including the current one",
+      "type": "integer",
+      "minimum": 1
+    },
+    "forceDownload": {
+      "description": "Whether to download the files again even if they are already downloaded for the sequence number",
+      "type": "boolean"
+    },
+    "alwaysRun": {
+      "description": "Whether to execute the command every time the extension is enabled, even if the configuration is already processed",
+      "type": "boolean"
+    },
+    "runOnce": {
+      "description": "Whether to never execute the command again once it completed successfully, whatever the sequence number of the configuration is",
+      "type": "boolean"
+    },
+    "runOnceResetTag": {
+      "description": "Changing this value clears the record of the command completed with runOnce, so that it is executed again",
+      "type": "string"
+    },
+    "cleanupAfterRun": {
+      "description": "Whether to delete the downloaded files and the command output after the command is executed",
+      "type": "boolean"
+    },
+    "workingDirectory": {
+      "description": "Absolute path of the directory the command is executed in (default: the download directory)",
+      "type": "string",
+      "minLength": 1
+    },
+    "createWorkingDirectory": {
+      "description": "Create workingDirectory if it does not exist",
+      "type": "boolean"
+    },
+    "proxyUrl": {
+      "description": "URL of the HTTP proxy used for the downloads, overrides the proxy environment variables",
+      "type": "string",
+      "minLength": 1
+    },
+    "caCertPem": {
+      "description": "PEM-encoded certificates of the certificate authorities trusted for the downloads in addition to the system roots",
+      "type": "string",
+      "minLength": 1
+    },
+    "insecureSkipVerify": {
+      "description": "Disables the TLS certificate verification of the downloads, for debugging only",
+      "type": "boolean"
+    },
+    "dnsServer": {
+      "description": "IP address of the DNS server, optionally with a port, used to resolve the hosts of the downloads instead of the system resolver",
+      "type": "string",
+      "minLength": 1
     }
   },
   "additionalProperties": false
@@ -44,6 +558,34 @@ const (
       "description": "Command to be executed",
       "type": "string"
     },
+    "commands": {
+      "description": "Commands to be executed in order, instead of commandToExecute",
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "string",
+        "minLength": 1
+      }
+    },
+    "parallelCommands": {
+      "description": "Commands to be executed concurrently, instead of commandToExecute",
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "string",
+        "minLength": 1
+      }
+    },
+    "commandToExecuteFromKeyVault": {
+      "description": "URI of an Azure Key Vault secret containing the command to be executed",
+      "type": "string",
+      "format": "uri"
+    },
+    "script": {
+      "description": "Base64-encoded script to be executed instead of commandToExecute",
+      "type": "string",
+      "minLength": 1
+    },
     "storageAccountName": {
       "description": "Name of the Azure Storage Account (3-24 characters of lowercase letters or digits)",
       "type": "string",
@@ -53,16 +595,177 @@ const (
       "description": "Key for the Azure Storage Account (a base64 encoded string)",
       "type": "string",
       "pattern": "^(?:[A-Za-z0-9+/]{4})*(?:[A-Za-z0-9+/]{2}==|[A-Za-z0-9+/]{3}=|[A-Za-z0-9+/]{4})$"
+    },
+    "fileCredentials": {
+      "description": "Storage account credentials used to download the files in fileUris with the given URLs instead of storageAccountName and storageAccountKey",
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "url": {
+            "description": "URL of the file in fileUris",
+            "type": "string",
+            "format": "uri"
+          },
+          "storageAccountName": {
+            "description": "Name of the Azure Storage Account (3-24 characters of lowercase letters or digits)",
+            "type": "string",
+            "pattern": "^[a-z0-9]{3,24}$"
+          },
+          "storageAccountKey": {
+            "description": "Key for the Azure Storage Account (a base64 encoded string)",
+            "type": "string",
+            "pattern": "^(?:[A-Za-z0-9+/]{4})*(?:[A-Za-z0-9+/]{2}==|[A-Za-z0-9+/]{3}=|[A-Za-z0-9+/]{4})$"
+          }
+        },
+        "required": ["url", "storageAccountName", "storageAccountKey"],
+        "additionalProperties": false
+      }
+    },
+    "downloadHeaders": {
+      "description": "HTTP headers sent with the requests to download the files in fileUris",
+      "type": "object",
+      "additionalProperties": {
+        "type": "string"
+      }
+    },
+    "fileDownloadHeaders": {
+      "description": "HTTP headers sent with the requests to download the files in fileUris with the given URLs, overriding downloadHeaders",
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "url": {
+            "description": "URL of the file in fileUris",
+            "type": "string",
+            "format": "uri"
+          },
+          "headers": {
+            "description": "HTTP headers sent with the requests to download the file",
+            "type": "object",
+            "additionalProperties": {
+              "type": "string"
+            }
+          }
+        },
+        "required": ["url", "headers"],
+        "additionalProperties": false
+      }
+    },
+    "sasToken": {
+      "description": "Shared Access Signature token appended to the Azure Blob URLs in fileUris which do not have one",
+      "type": "string",
+      "minLength": 1
+    },
+    "proxyUsername": {
+      "description": "User name to authenticate to the proxy in proxyUrl",
+      "type": "string"
+    },
+    "proxyPassword": {
+      "description": "Password to authenticate to the proxy in proxyUrl",
+      "type": "string"
+    },
+    "httpUsername": {
+      "description": "User name to authenticate with HTTP Basic authentication to the servers of the fileUris which are not Azure Blob URLs",
+      "type": "string",
+      "minLength": 1
+    },
+    "httpPassword": {
+      "description": "Password to authenticate with HTTP Basic authentication to the servers of the fileUris which are not Azure Blob URLs",
+      "type": "string"
+    },
+    "gitUsername": {
+      "description": "Username to authenticate to the server of the gitRepository with gitToken (default: git)",
+      "type": "string"
+    },
+    "gitToken": {
+      "description": "Token or password to authenticate to the server of the gitRepository over HTTP",
+      "type": "string"
+    },
+    "githubToken": {
+      "description": "Personal access token used to download files from private GitHub repositories",
+      "type": "string",
+      "minLength": 1
+    },
+    "managedIdentity": {
+      "description": "Managed identity of the VM used to download Azure Blobs (system-assigned, if clientId or objectId is not specified)",
+      "type": "object",
+      "properties": {
+        "clientId": {
+          "description": "Client ID of the user-assigned managed identity",
+          "type": "string"
+        },
+        "objectId": {
+          "description": "Object ID of the user-assigned managed identity",
+          "type": "string"
+        }
+      },
+      "additionalProperties": false
+    },
+    "environmentVariables": {
+      "description": "Environment variables to be set for the command, use this field for variables containing secrets",
+      "type": "object",
+      "additionalProperties": {
+        "type": "string"
+      }
     }
   },
   "additionalProperties": false
 }`
 )
 
-// validateObjectJSON validates the specified json with schemaJSON.
-// If json is empty string, it will be converted into an empty JSON object
-// before being validated.
-func validateObjectJSON(schema *gojsonschema.Schema, json string) error {
+// settingError is a problem with one of the settings, identified by its JSON
+// pointer (RFC 6901) in the settings, such as "/publicSettings/fileUris/0".
+// The pointer is empty if the problem is not with a particular setting.
+type settingError struct {
+	Pointer string
+	Message string
+}
+
+func (e settingError) Error() string {
+	if e.Pointer == "" {
+		return e.Message
+	}
+	return e.Pointer + ": " + e.Message
+}
+
+// settingErrors are all the problems found with the settings.
+type settingErrors []settingError
+
+func (e settingErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d problems with the settings: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// settingSubstatuses returns a substatus for each of the problems with the
+// settings causing err, if any, to be reported individually.
+func settingSubstatuses(err error) []substatus {
+	errs, ok := errors.Cause(err).(settingErrors)
+	if !ok {
+		return nil
+	}
+	out := make([]substatus, len(errs))
+	for i, e := range errs {
+		name := "invalid settings"
+		if e.Pointer != "" {
+			name = "invalid setting " + e.Pointer
+		}
+		out[i] = newSubstatus(name, status.StatusError, e.Message)
+	}
+	return out
+}
+
+// validateObjectJSON validates the specified json with schemaJSON and returns
+// all the problems found as settingErrors, with the pointers prefixed with
+// root. If json is empty string, it will be converted into an empty JSON
+// object before being validated.
+func validateObjectJSON(schema *gojsonschema.Schema, json, root string) error {
 	if json == "" {
 		json = "{}"
 	}
@@ -72,21 +775,36 @@ func validateObjectJSON(schema *gojsonschema.Schema, json string) error {
 	if err != nil {
 		return err
 	}
-	if !res.Valid() {
-		for _, err := range res.Errors() {
-			// return with the first error
-			return fmt.Errorf("%s", err)
+	var errs settingErrors
+	for _, e := range res.Errors() {
+		if e.Type() == "number_one_of" {
+			continue // followed by the errors of the closest alternative, which tell more
 		}
+		errs = append(errs, settingError{Pointer: schemaErrorPointer(e, root), Message: e.Description()})
+	}
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
 
+// schemaErrorPointer returns the JSON pointer of the value with the schema
+// validation error e, prefixed with root. The context of the errors about a
+// property, such as an unknown or a missing one, is the containing object.
+func schemaErrorPointer(e gojsonschema.ResultError, root string) string {
+	p := root + strings.TrimPrefix(e.Context().String("/"), gojsonschema.STRING_CONTEXT_ROOT)
+	if prop, ok := e.Details()["property"].(string); ok {
+		p += "/" + prop
+	}
+	return p
+}
+
 func validateSettingsObject(settingsType, schemaJSON, docJSON string) error {
 	schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schemaJSON))
 	if err != nil {
 		return errors.Wrapf(err, "failed to load %s settings schema", settingsType)
 	}
-	if err := validateObjectJSON(schema, docJSON); err != nil {
+	if err := validateObjectJSON(schema, docJSON, "/"+settingsType+"Settings"); err != nil {
 		return errors.Wrapf(err, "invalid %s settings JSON", settingsType)
 	}
 	return nil
@@ -3,6 +3,8 @@ package main
 import (
 	"testing"
 
+	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -32,12 +34,150 @@ func TestValidatePublicSettings_fileUris(t *testing.T) {
 	err = validatePublicSettings(`{"commandToExecute": "date", "fileUris":["https://a.b/c.txt?d=e&f=g", 0]}`)
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), "Expected: string, given: integer")
+
+	// mirrors
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "fileUris":["https://a/1.sh", {"urls": ["https://a/2.sh", "https://b/2.sh"]}]}`))
+	err = validatePublicSettings(`{"commandToExecute": "date", "fileUris":[{"urls": []}]}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Array must have at least 1 items")
+	err = validatePublicSettings(`{"commandToExecute": "date", "fileUris":[{"urls": ["a"]}]}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Does not match format 'uri'")
+
+	// archive checks
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "fileUris":[{"urls": ["https://a/1.tgz"], "expectedFileCount": 0, "expectedExtractedSize": 10}]}`))
+	err = validatePublicSettings(`{"commandToExecute": "date", "fileUris":[{"urls": ["https://a/1.tgz"], "expectedFileCount": -1}]}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Must be greater than or equal to 0")
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "fileUris":[{"urls": ["https://a/1.tgz"], "expectedExtractedSize": "10"}]}`))
+
+	// os predicates
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "fileUris":[{"urls": ["https://a/1.sh"], "osMatch": [{"distro": "ubuntu", "version": "22.*"}, {"distro": "rhel"}]}]}`))
+	err = validatePublicSettings(`{"commandToExecute": "date", "fileUris":[{"urls": ["https://a/1.sh"], "osMatch": [{"version": "22.*"}]}]}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "distro is required")
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "fileUris":[{"urls": ["https://a/1.sh"], "osMatch": [{"distro": "ubuntu", "arch": "x64"}]}]}`))
+}
+
+func TestValidatePublicSettings_expectedContentTypes(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "expectedContentTypes":["", "application/x-sh", "text/*", "application/vnd.api+json"]}`))
+	for _, s := range []string{`"text"`, `"*/*"`, `"text/html; charset=utf-8"`, `"text/"`} {
+		err := validatePublicSettings(`{"commandToExecute": "date", "expectedContentTypes":[` + s + `]}`)
+		require.NotNil(t, err, s)
+		require.Contains(t, err.Error(), "Does not match pattern", s)
+	}
+}
+
+func TestValidatePublicSettings_fileHashes(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "fileHashes":["", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"]}`))
+
+	err := validatePublicSettings(`{"commandToExecute": "date", "fileHashes":["abc"]}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Does not match pattern")
 }
 
 func TestValidatePublicSettings_timestampSupported(t *testing.T) {
 	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "timestamp": 1}`))
 }
 
+func TestValidatePublicSettings_timeoutSeconds(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "timeoutSeconds": 60, "timeoutGracePeriodSeconds": 5}`))
+
+	err := validatePublicSettings(`{"commandToExecute": "date", "timeoutSeconds": -1}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "timeoutSeconds: Must be greater than or equal to 0")
+
+	err = validatePublicSettings(`{"commandToExecute": "date", "timeoutSeconds": "60"}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Expected: integer, given: string")
+}
+
+func TestValidatePublicSettings_scriptFile(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"fileUris": ["http://a/run.sh"], "scriptFile": "run.sh"}`))
+
+	err := validatePublicSettings(`{"fileUris": ["http://a/run.sh"], "scriptFile": ""}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "scriptFile: String length must be greater than or equal to 1")
+}
+
+func TestValidatePublicSettings_operationTimeoutSeconds(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "operationTimeoutSeconds": 600}`))
+
+	err := validatePublicSettings(`{"commandToExecute": "date", "operationTimeoutSeconds": -1}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "operationTimeoutSeconds: Must be greater than or equal to 0")
+}
+
+func TestValidatePublicSettings_destinationDirs(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"fileUris": ["http://a/1", "http://a/2"], "destinationDir": "/opt/a", "destinationDirs": ["", "/opt/b"]}`))
+
+	err := validatePublicSettings(`{"fileUris": ["http://a/1"], "destinationDirs": "/opt/b"}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "destinationDirs: Invalid type")
+}
+
+func TestValidatePublicSettings_fileMappings(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "fileMappings": [{"from": "bin/*", "to": "."}]}`))
+
+	for _, s := range []string{
+		`{"commandToExecute": "date", "fileMappings": [{"from": "bin/*"}]}`,
+		`{"commandToExecute": "date", "fileMappings": [{"from": "", "to": "."}]}`,
+		`{"commandToExecute": "date", "fileMappings": [{"from": "a", "to": "b", "mode": "0755"}]}`,
+		`{"commandToExecute": "date", "fileMappings": {"from": "a", "to": "b"}}`,
+	} {
+		require.NotNil(t, validatePublicSettings(s), s)
+	}
+}
+
+func TestValidatePublicSettings_commandRetry(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "commandRetryCount": 3, "commandRetryIntervalSeconds": 5}`))
+
+	err := validatePublicSettings(`{"commandToExecute": "date", "commandRetryCount": -1}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "commandRetryCount: Must be greater than or equal to 0")
+	err = validatePublicSettings(`{"commandToExecute": "date", "commandRetryIntervalSeconds": 0}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "commandRetryIntervalSeconds: Must be greater than or equal to 1")
+}
+
+func TestValidateProtectedSettings_fileCredentials(t *testing.T) {
+	require.Nil(t, validateProtectedSettings(`{"fileCredentials": [{"url": "https://acct.blob.core.windows.net/c/a.sh", "storageAccountName": "acct", "storageAccountKey": "a2V5"}]}`))
+
+	for _, s := range []string{
+		`{"fileCredentials": [{"url": "https://a.blob.core.windows.net/c/a.sh", "storageAccountName": "a"}]}`,
+		`{"fileCredentials": [{"url": "https://a.blob.core.windows.net/c/a.sh", "storageAccountName": "A!", "storageAccountKey": "a2V5"}]}`,
+		`{"fileCredentials": [{"url": "https://acct.blob.core.windows.net/c/a.sh", "storageAccountName": "acct", "storageAccountKey": "a2V5", "sasToken": "x"}]}`,
+	} {
+		require.NotNil(t, validateProtectedSettings(s), s)
+	}
+}
+
+func TestValidatePublicSettings_keepDownloadDirs(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "keepDownloadDirs": 3}`))
+
+	err := validatePublicSettings(`{"commandToExecute": "date", "keepDownloadDirs": 0}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "keepDownloadDirs: Must be greater than or equal to 1")
+}
+
+func TestValidatePublicSettings_statusVerbosity(t *testing.T) {
+	for _, v := range []string{"minimal", "normal", "verbose"} {
+		require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "statusVerbosity": "`+v+`"}`), v)
+	}
+
+	err := validatePublicSettings(`{"commandToExecute": "date", "statusVerbosity": "debug"}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "statusVerbosity")
+}
+
+func TestValidatePublicSettings_maxFileSizeBytes(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "maxFileSizeBytes": 1073741824}`))
+
+	err := validatePublicSettings(`{"commandToExecute": "date", "maxFileSizeBytes": 0}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "maxFileSizeBytes: Must be greater than or equal to 1")
+}
+
 func TestValidateProtectedSettings_empty(t *testing.T) {
 	require.Nil(t, validateProtectedSettings(""), "empty string")
 	require.Nil(t, validateProtectedSettings("{}"), "empty string")
@@ -108,3 +248,193 @@ func TestValidateProtectedSettings_storageAccountKey(t *testing.T) {
 	require.Nil(t, validateProtectedSettings(`{"storageAccountKey": "A+hMRrsZQ6COPXTYX/EiKiF2HVtfhCfLDo3Dkc3ekKoX3jA58zXVG2QRe/C1+zdEFSrVX6FZsKyivsSlnwmWOw=="}`), "ok")
 	require.Nil(t, validateProtectedSettings(`{"storageAccountKey": "/yGnx6KyxQ8Pjzk0QXeY+66Du0BeTWaCt83la59w72hu/81e6TzskXXvL/IlO3q6g0k0kJrR9MYQNi+cNR3SXA=="}`), "ok")
 }
+
+func TestValidateProtectedSettings_managedIdentity(t *testing.T) {
+	require.Nil(t, validateProtectedSettings(`{"managedIdentity": {}}`))
+	require.Nil(t, validateProtectedSettings(`{"managedIdentity": {"clientId": "31b403aa-c364-4240-a7ff-d85fb6cd7232"}}`))
+	require.Nil(t, validateProtectedSettings(`{"managedIdentity": {"objectId": "31b403aa-c364-4240-a7ff-d85fb6cd7232"}}`))
+
+	err := validateProtectedSettings(`{"managedIdentity": {"foo": "bar"}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Additional property foo is not allowed")
+}
+
+func TestValidateProtectedSettings_sasToken(t *testing.T) {
+	require.Nil(t, validateProtectedSettings(`{"sasToken": "?sv=2015-04-05&sig=abc"}`))
+	require.NotNil(t, validateProtectedSettings(`{"sasToken": ""}`))
+}
+
+func TestValidateProtectedSettings_githubToken(t *testing.T) {
+	require.Nil(t, validateProtectedSettings(`{"githubToken": "ghp_abc"}`))
+	require.NotNil(t, validateProtectedSettings(`{"githubToken": ""}`))
+	require.NotNil(t, validateProtectedSettings(`{"githubToken": 1}`))
+}
+
+func TestValidateSettings_environmentVariables(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "environmentVariables": {"A": "1"}}`))
+	require.Nil(t, validateProtectedSettings(`{"environmentVariables": {"SECRET": "foo"}}`))
+
+	err := validateProtectedSettings(`{"environmentVariables": {"A": 1}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Expected: string, given: integer")
+}
+
+func TestValidateSettings_commands(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commands": ["apt-get update", "./setup.sh"], "continueOnError": true}`))
+	require.Nil(t, validateProtectedSettings(`{"commands": ["./setup.sh --password=foo"]}`))
+	require.NotNil(t, validatePublicSettings(`{"commands": []}`))
+	require.NotNil(t, validatePublicSettings(`{"commands": [""]}`))
+	require.NotNil(t, validatePublicSettings(`{"commands": "date"}`))
+	require.NotNil(t, validatePublicSettings(`{"commands": ["date"], "continueOnError": "yes"}`))
+	require.NotNil(t, validateProtectedSettings(`{"continueOnError": true}`), "continueOnError is a public setting")
+}
+
+func TestValidatePublicSettings_cleanupAfterRun(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "cleanupAfterRun": true}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "cleanupAfterRun": "true"}`))
+}
+
+func TestValidatePublicSettings_alwaysRun(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "alwaysRun": true}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "alwaysRun": 1}`))
+}
+
+func TestValidatePublicSettings_extractArchives(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "extractArchives": true}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "extractArchives": "yes"}`))
+}
+
+func TestValidatePublicSettings_fileModes(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "fileMode": "0755", "fileModes": ["", "0644"]}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "fileMode": 755}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "fileModes": [644]}`))
+}
+
+func TestValidatePublicSettings_gitRepository(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "./deploy.sh", "gitRepository": {"url": "https://h/r.git", "branch": "main", "commit": "0123456789abcdef0123456789abcdef01234567"}}`))
+	for _, s := range []string{
+		`{"commandToExecute": "date", "gitRepository": "https://h/r.git"}`,
+		`{"commandToExecute": "date", "gitRepository": {"branch": "main"}}`,
+		`{"commandToExecute": "date", "gitRepository": {"url": "https://h/r.git", "commit": "main"}}`,
+		`{"commandToExecute": "date", "gitRepository": {"url": "https://h/r.git", "tag": "v1"}}`,
+	} {
+		require.NotNil(t, validatePublicSettings(s), s)
+	}
+	require.Nil(t, validateProtectedSettings(`{"gitUsername": "user", "gitToken": "token"}`))
+}
+
+func TestValidatePublicSettings_continueOnDownloadError(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "continueOnDownloadError": true, "minSuccessfulDownloads": 1}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "minSuccessfulDownloads": -1}`))
+}
+
+func TestValidatePublicSettings_priority(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "niceness": -20, "ioniceClass": "best-effort", "ioniceLevel": 7}`))
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "niceness": 19, "ioniceClass": "idle"}`))
+	for _, s := range []string{`"niceness": 20`, `"niceness": -21`, `"ioniceClass": "realtime"`, `"ioniceLevel": 8`} {
+		require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", `+s+`}`), s)
+	}
+}
+
+func TestValidatePublicSettings_systemdScope(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "useSystemdScope": true, "memoryLimitMb": 512, "cpuQuota": 150}`))
+	for _, s := range []string{`"useSystemdScope": "yes"`, `"systemdMemoryMax": "512M"`, `"systemdCpuQuota": "50%"`} {
+		require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", `+s+`}`), s)
+	}
+}
+
+func TestValidatePublicSettings_chrootDir(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "chrootDir": "/mnt/target"}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "chrootDir": true}`))
+}
+
+func TestValidatePublicSettings_cgroupLimits(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "memoryLimitMb": 512, "cpuQuota": 150}`))
+	for _, s := range []string{`"memoryLimitMb": 0`, `"memoryLimitMb": "512M"`, `"cpuQuota": 0`, `"cpuQuota": "50%"`} {
+		require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", `+s+`}`), s)
+	}
+}
+
+func TestValidatePublicSettings_secretsDeliveryMode(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "secretsDeliveryMode": "env"}`))
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "secretsDeliveryMode": "file"}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "secretsDeliveryMode": "argv"}`))
+}
+
+func TestValidatePublicSettings_enableRetry(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "enableRetryCount": 3, "enableRetryIntervalSeconds": 60}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "enableRetryCount": -1}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "enableRetryIntervalSeconds": 0}`))
+}
+
+func TestValidatePublicSettings_runOnce(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "runOnce": true, "runOnceResetTag": "2"}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "runOnce": "yes"}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "runOnce": true, "runOnceResetTag": 2}`))
+}
+
+func TestValidatePublicSettings_limits(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "maxFileUris": 5000, "maxCommandLength": 100000, "maxTotalDownloadBytes": 53687091200}`))
+	for _, s := range []string{"maxFileUris", "maxCommandLength", "maxTotalDownloadBytes"} {
+		err := validatePublicSettings(`{"commandToExecute": "date", "` + s + `": 0}`)
+		require.NotNil(t, err, s)
+		require.Contains(t, err.Error(), s+": Must be greater than or equal to 1")
+	}
+}
+
+func TestValidatePublicSettings_blobContainer(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "blobContainerUri": "https://a.blob.core.windows.net/c", "blobPrefix": "setup/", "allowEmptyBlobList": true}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "blobContainerUri": 1}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "allowEmptyBlobList": "yes"}`))
+}
+
+func TestValidatePublicSettings_manifest(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "manifestUri": "https://a/manifest.json", "manifestSignatureUri": "https://a/manifest.asc", "gpgPublicKey": "key"}`))
+	err := validatePublicSettings(`{"commandToExecute": "date", "manifestUri": "manifest.json"}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Does not match format 'uri'")
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "manifestSignatureUri": 1}`))
+}
+
+func TestValidatePublicSettings_parallelCommands(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"parallelCommands": ["a", "b"], "maxParallelCommands": 1, "parallelCommandTimeoutSeconds": 60}`))
+	require.NotNil(t, validatePublicSettings(`{"parallelCommands": []}`), "empty")
+	require.NotNil(t, validatePublicSettings(`{"parallelCommands": [""]}`), "empty command")
+	require.NotNil(t, validatePublicSettings(`{"parallelCommands": ["a"], "maxParallelCommands": 0}`))
+	require.Nil(t, validateProtectedSettings(`{"parallelCommands": ["a"]}`))
+}
+
+func TestValidateSettingsSchema_allErrors(t *testing.T) {
+	err := validateSettingsSchema(map[string]interface{}{
+		"commandToExecute": "date",
+		"fileUris":         []interface{}{"http://a/1", 2},
+		"alien":            true,
+		"gitRepository":    map[string]interface{}{"branch": "main"},
+	}, map[string]interface{}{
+		"storageAccountKey": false,
+	})
+	require.NotNil(t, err)
+	errs, ok := errors.Cause(err).(settingErrors)
+	require.True(t, ok, "%v", err)
+	pointers := map[string]string{}
+	for _, e := range errs {
+		pointers[e.Pointer] = e.Message
+	}
+	require.Equal(t, map[string]string{
+		"/publicSettings/alien":                "Additional property alien is not allowed",
+		"/publicSettings/fileUris/1":           "Invalid type. Expected: string, given: integer",
+		"/publicSettings/gitRepository/url":    "url is required",
+		"/protectedSettings/storageAccountKey": "Invalid type. Expected: string, given: boolean",
+	}, pointers)
+	require.Contains(t, err.Error(), "4 problems with the settings: ")
+
+	sub := settingSubstatuses(errors.Wrap(err, "failed"))
+	require.Len(t, sub, 4)
+	require.Contains(t, sub, newSubstatus("invalid setting /publicSettings/alien", status.StatusError, "Additional property alien is not allowed"))
+	require.Nil(t, settingSubstatuses(errors.New("failed")))
+}
+
+func TestValidatePublicSettings_substituteMetadata(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "echo {vmName}", "substituteMetadata": true}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "echo {vmName}", "substituteMetadata": "yes"}`))
+}
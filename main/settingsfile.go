@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// settingsFileFormat is the format of the .settings files written by the agent.
+type settingsFileFormat struct {
+	RuntimeSettings []struct {
+		HandlerSettings runtimeSettings `json:"handlerSettings"`
+	} `json:"runtimeSettings"`
+}
+
+// runtimeSettings are the settings in a .settings file, with the protected
+// settings encrypted.
+type runtimeSettings struct {
+	PublicSettings          map[string]interface{} `json:"publicSettings"`
+	ProtectedSettingsBase64 string                 `json:"protectedSettings"`
+	SettingsCertThumbprint  string                 `json:"protectedSettingsCertThumbprint"`
+}
+
+// parseSettingsFile parses the .settings file at path. An empty file has no
+// settings.
+func parseSettingsFile(path string) (s runtimeSettings, _ error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, errors.Wrap(err, "failed to read settings file")
+	}
+	if len(bytes.TrimSpace(b)) == 0 { // if no config is specified, we get an empty file
+		return s, nil
+	}
+	var f settingsFileFormat
+	if err := json.Unmarshal(b, &f); err != nil {
+		return s, errors.Wrap(err, "error parsing settings file")
+	}
+	if len(f.RuntimeSettings) != 1 {
+		return s, fmt.Errorf("error parsing settings file: wrong runtimeSettings count. expected:1, got:%d", len(f.RuntimeSettings))
+	}
+	return f.RuntimeSettings[0].HandlerSettings, nil
+}
+
+// decryptProtectedSettings decrypts the protected settings in s with the
+// certificate found by settingsCertificate and parses them into a JSON
+// object, or returns nil if there are none. The errors tell whether the
+// certificate is missing, the decryption failed or the decrypted settings
+// could not be parsed.
+func decryptProtectedSettings(configFolder string, s runtimeSettings) (map[string]interface{}, error) {
+	if s.ProtectedSettingsBase64 == "" {
+		return nil, nil
+	}
+	if s.SettingsCertThumbprint == "" {
+		return nil, errors.New("the settings have 'protectedSettings' but no 'protectedSettingsCertThumbprint'")
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(s.ProtectedSettingsBase64)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode base64 of 'protectedSettings'")
+	}
+	crt, prv, err := settingsCertificate(configFolder, s.SettingsCertThumbprint)
+	if err != nil {
+		return nil, err
+	}
+
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		return nil, errors.New("openssl is not installed, it is required to decrypt 'protectedSettings'")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(openssl, "smime", "-inform", "DER", "-decrypt", "-recip", crt, "-inkey", prv)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(encrypted), &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to decrypt 'protectedSettings' with the certificate %s, it may not be the one they were encrypted for: %v: %s",
+			crt, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var out map[string]interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, errors.Wrap(err, "decrypted 'protectedSettings' are not a valid JSON object") // never include the contents
+	}
+	return out, nil
+}
+
+// settingsCertificate returns the paths of the certificate and of the private
+// key ("<thumbprint>.crt" and "<thumbprint>.prv") to decrypt the protected
+// settings encrypted for the given thumbprint with, mapped with
+// certThumbprintsEnvVar if specified. They are searched in the directory of
+// the agent, two levels up from configFolder, then in the directories in
+// certDirsEnvVar.
+func settingsCertificate(configFolder, thumbprint string) (crt, prv string, _ error) {
+	mapped, err := mapThumbprint(thumbprint, os.Getenv(certThumbprintsEnvVar))
+	if err != nil {
+		return "", "", err
+	}
+	dirs := []string{filepath.Clean(filepath.Join(configFolder, "..", ".."))}
+	for _, d := range strings.Split(os.Getenv(certDirsEnvVar), ":") {
+		if d != "" {
+			dirs = append(dirs, d)
+		}
+	}
+	var missingKey []string
+	for _, d := range dirs {
+		crt, prv = filepath.Join(d, mapped+".crt"), filepath.Join(d, mapped+".prv")
+		if _, err := os.Stat(crt); err != nil {
+			continue
+		}
+		if _, err := os.Stat(prv); err != nil {
+			missingKey = append(missingKey, d)
+			continue
+		}
+		return crt, prv, nil
+	}
+
+	what := "thumbprint " + thumbprint
+	if mapped != thumbprint {
+		what += fmt.Sprintf(" (mapped to %s with %s)", mapped, certThumbprintsEnvVar)
+	}
+	if len(missingKey) > 0 {
+		return "", "", fmt.Errorf("cannot decrypt 'protectedSettings': the private key %s.prv of the certificate for %s is not found in %s",
+			mapped, what, strings.Join(missingKey, ", "))
+	}
+	return "", "", fmt.Errorf("cannot decrypt 'protectedSettings': the certificate %s.crt for %s is not found in %s (set %s to search other directories)",
+		mapped, what, strings.Join(dirs, ", "), certDirsEnvVar)
+}
+
+// mapThumbprint returns the thumbprint that thumbprint is mapped to in
+// mapping, the certThumbprintsEnvVar format, or thumbprint if it is not
+// mapped. Thumbprints are compared case-insensitively.
+func mapThumbprint(thumbprint, mapping string) (string, error) {
+	if mapping == "" {
+		return thumbprint, nil
+	}
+	for _, pair := range strings.Split(mapping, ",") {
+		kv := strings.Split(strings.TrimSpace(pair), "=")
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" || strings.ContainsAny(kv[1], `/\`) {
+			return "", fmt.Errorf("invalid %s: %q is not a FROM=TO pair of thumbprints", certThumbprintsEnvVar, pair)
+		}
+		if strings.EqualFold(kv[0], thumbprint) {
+			return kv[1], nil
+		}
+	}
+	return thumbprint, nil
+}
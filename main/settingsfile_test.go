@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newSettingsCert creates the certificate and the private key named after
+// thumbprint in dir, as the agent does.
+func newSettingsCert(t *testing.T, dir, thumbprint string) {
+	out, err := exec.Command("openssl", "req", "-x509", "-nodes", "-newkey", "rsa:2048", "-days", "1", "-subj", "/CN=settings",
+		"-keyout", filepath.Join(dir, thumbprint+".prv"), "-out", filepath.Join(dir, thumbprint+".crt")).CombinedOutput()
+	require.Nil(t, err, "%s", out)
+}
+
+// encryptSettings encrypts b for the certificate named after thumbprint in
+// dir, and returns it in base64 as in the .settings files.
+func encryptSettings(t *testing.T, dir, thumbprint string, b []byte) string {
+	cmd := exec.Command("openssl", "smime", "-encrypt", "-binary", "-outform", "DER", "-aes256", filepath.Join(dir, thumbprint+".crt"))
+	var out, stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(b), &out, &stderr
+	require.Nil(t, cmd.Run(), stderr.String())
+	return base64.StdEncoding.EncodeToString(out.Bytes())
+}
+
+func Test_readSettings_protected(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl is not installed")
+	}
+	defer os.Setenv(certDirsEnvVar, os.Getenv(certDirsEnvVar))
+	defer os.Setenv(certThumbprintsEnvVar, os.Getenv(certThumbprintsEnvVar))
+	os.Setenv(certDirsEnvVar, "")
+	os.Setenv(certThumbprintsEnvVar, "")
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	agentDir, otherDir := filepath.Join(dir, "waagent"), filepath.Join(dir, "certs")
+	configFolder := filepath.Join(agentDir, "extension", "config")
+	for _, d := range []string{configFolder, otherDir} {
+		require.Nil(t, os.MkdirAll(d, 0700))
+	}
+	newSettingsCert(t, agentDir, "AAAA")
+	newSettingsCert(t, otherDir, "BBBB")
+
+	writeSettings := func(thumbprint, protected string) {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(configFolder, "0.settings"), []byte(fmt.Sprintf(
+			`{"runtimeSettings": [{"handlerSettings": {"publicSettings": {"commandToExecute": "date"}, "protectedSettings": %q, "protectedSettingsCertThumbprint": %q}}]}`,
+			protected, thumbprint)), 0600))
+	}
+
+	// in the directory of the agent
+	writeSettings("AAAA", encryptSettings(t, agentDir, "AAAA", []byte(`{"storageAccountKey": "secret"}`)))
+	pub, prot, err := readSettings(configFolder)
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{"commandToExecute": "date"}, pub)
+	require.Equal(t, map[string]interface{}{"storageAccountKey": "secret"}, prot)
+
+	// in another directory
+	writeSettings("BBBB", encryptSettings(t, otherDir, "BBBB", []byte(`{"storageAccountKey": "secret"}`)))
+	_, _, err = readSettings(configFolder)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "the certificate BBBB.crt for thumbprint BBBB is not found in "+agentDir+" (set "+certDirsEnvVar)
+	os.Setenv(certDirsEnvVar, "/nonexistent:"+otherDir)
+	_, prot, err = readSettings(configFolder)
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{"storageAccountKey": "secret"}, prot)
+
+	// with a thumbprint mapped to another certificate
+	writeSettings("CCCC", encryptSettings(t, otherDir, "BBBB", []byte(`{"storageAccountKey": "secret"}`)))
+	os.Setenv(certThumbprintsEnvVar, "dddd=AAAA, cccc=BBBB")
+	_, prot, err = readSettings(configFolder)
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{"storageAccountKey": "secret"}, prot)
+	os.Setenv(certThumbprintsEnvVar, "CCCC")
+	_, _, err = readSettings(configFolder)
+	require.EqualError(t, err, `error reading extension configuration: invalid `+certThumbprintsEnvVar+`: "CCCC" is not a FROM=TO pair of thumbprints`)
+
+	// with the wrong certificate
+	os.Setenv(certThumbprintsEnvVar, "CCCC=AAAA")
+	_, _, err = readSettings(configFolder)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to decrypt 'protectedSettings' with the certificate "+filepath.Join(agentDir, "AAAA.crt"))
+	os.Setenv(certThumbprintsEnvVar, "")
+
+	// without the private key
+	require.Nil(t, os.Remove(filepath.Join(otherDir, "BBBB.prv")))
+	writeSettings("BBBB", encryptSettings(t, otherDir, "BBBB", []byte(`{}`)))
+	_, _, err = readSettings(configFolder)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "the private key BBBB.prv of the certificate for thumbprint BBBB is not found in "+otherDir)
+
+	// decrypted but not JSON
+	writeSettings("AAAA", encryptSettings(t, agentDir, "AAAA", []byte(`storageAccountKey=secret`)))
+	_, _, err = readSettings(configFolder)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "decrypted 'protectedSettings' are not a valid JSON object")
+	require.NotContains(t, err.Error(), "secret")
+}
+
+func Test_parseSettingsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "0.settings")
+
+	require.Nil(t, ioutil.WriteFile(path, nil, 0600))
+	s, err := parseSettingsFile(path)
+	require.Nil(t, err, "empty")
+	require.Nil(t, s.PublicSettings)
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(`{"runtimeSettings": []}`), 0600))
+	_, err = parseSettingsFile(path)
+	require.EqualError(t, err, "error parsing settings file: wrong runtimeSettings count. expected:1, got:0")
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(`{"runtimeSettings": [{"handlerSettings": {"protectedSettings": "not base64"}}]}`), 0600))
+	s, err = parseSettingsFile(path)
+	require.Nil(t, err)
+	_, err = decryptProtectedSettings(dir, s)
+	require.EqualError(t, err, "the settings have 'protectedSettings' but no 'protectedSettingsCertThumbprint'")
+	s.SettingsCertThumbprint = "AAAA"
+	_, err = decryptProtectedSettings(dir, s)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to decode base64 of 'protectedSettings'")
+}
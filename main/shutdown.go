@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// shutdown is aborted when the handler receives SIGTERM or SIGINT during the
+// enable operation, such as on VM shutdown or agent restart, so that the
+// downloads and the command are stopped and an error status is reported
+// before the handler exits.
+var shutdown = newShutdownState()
+
+// shutdownState tracks whether the handler is aborted by a signal. Its context
+// is canceled when it is. It is safe for concurrent use.
+type shutdownState struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	sig os.Signal // the first signal received, nil unless aborted
+}
+
+func newShutdownState() *shutdownState {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &shutdownState{ctx: ctx, cancel: cancel}
+}
+
+// notify aborts s when the process receives SIGTERM or SIGINT, until the
+// returned function is called.
+func (s *shutdownState) notify(ctx log.Logger) (stop func()) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-ch:
+				s.abort(ctx, sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
+
+// abort records that the handler is aborted by sig and cancels the context of
+// s. Only the first signal aborts, the others are logged and ignored while the
+// operation is stopped.
+func (s *shutdownState) abort(ctx log.Logger, sig os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sig != nil {
+		ctx.Log("event", "already aborting", "signal", shutdownSignalName(sig))
+		return
+	}
+	ctx.Log("event", "aborting", "signal", shutdownSignalName(sig))
+	s.sig = sig
+	s.cancel()
+}
+
+// signal returns the signal which aborted s, or nil if it is not aborted.
+func (s *shutdownState) signal() os.Signal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sig
+}
+
+// aborted returns err as caused by the abort of s, categorized as errAborted
+// whatever its category is, if s is aborted, otherwise err as is.
+func (s *shutdownState) aborted(err error) error {
+	sig := s.signal()
+	if err == nil || sig == nil {
+		return err
+	}
+	return categorizedError{errAborted, errors.Wrapf(err, "enable operation aborted by %s", shutdownSignalName(sig))}
+}
+
+func shutdownSignalName(sig os.Signal) string {
+	if s, ok := sig.(syscall.Signal); ok {
+		return signalName(s)
+	}
+	return sig.String()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_shutdownState_abort(t *testing.T) {
+	s := newShutdownState()
+	err := categorize(errCommandFailed, errors.New("boom"))
+	require.Nil(t, s.signal())
+	require.Equal(t, err, s.aborted(err), "not aborted")
+
+	s.abort(log.NewNopLogger(), syscall.SIGTERM)
+	s.abort(log.NewNopLogger(), syscall.SIGINT)
+	require.Equal(t, syscall.SIGTERM, s.signal(), "first signal")
+	require.NotNil(t, s.ctx.Err(), "canceled")
+	require.Nil(t, s.aborted(nil))
+	err = s.aborted(err)
+	require.EqualError(t, err, "enable operation aborted by SIGTERM: boom")
+	require.Equal(t, errAborted, categoryOf(err), "takes precedence")
+	require.Equal(t, 10, exitCode(err))
+}
+
+func Test_shutdownState_notify(t *testing.T) {
+	s := newShutdownState()
+	stop := s.notify(log.NewNopLogger())
+	defer stop()
+	require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGINT))
+	select {
+	case <-s.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not aborted by the signal")
+	}
+	require.Equal(t, syscall.SIGINT, s.signal())
+	stop()
+	stop() // idempotent
+}
+
+func Test_enable_aborted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string, s *shutdownState) { dataDir, shutdown = d, s }(dataDir, shutdown)
+	dataDir, shutdown = filepath.Join(dir, "data"), newShutdownState()
+	var h vmextension.HandlerEnvironment
+	h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder = filepath.Join(dir, "config"), filepath.Join(dir, "status")
+	for _, d := range []string{dataDir, h.HandlerEnvironment.ConfigFolder, h.HandlerEnvironment.StatusFolder} {
+		require.Nil(t, os.Mkdir(d, 0700))
+	}
+	started, onFailure := filepath.Join(dir, "started"), filepath.Join(dir, "onfailure")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(h.HandlerEnvironment.ConfigFolder, "1.settings"), []byte(fmt.Sprintf(
+		`{"runtimeSettings": [{"handlerSettings": {"publicSettings": {"commandToExecute": "touch %s; sleep 30", "onFailureCommand": "touch %s", "enableRetryCount": 1, "timeoutGracePeriodSeconds": 1}}}]}`,
+		started, onFailure)), 0600))
+
+	go func() {
+		for _, err := os.Stat(started); err != nil; _, err = os.Stat(started) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		shutdown.abort(log.NewNopLogger(), syscall.SIGTERM)
+	}()
+	start := time.Now()
+	_, _, err = enable(log.NewContext(log.NewNopLogger()), h, 1)
+	require.NotNil(t, err)
+	require.True(t, time.Since(start) < 10*time.Second, "command is terminated")
+	require.Equal(t, errAborted, categoryOf(err))
+	require.Contains(t, err.Error(), "enable operation aborted by SIGTERM")
+	require.False(t, fileExists(t, onFailure), "onFailureCommand is not executed")
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, resultFile))
+	require.Nil(t, err)
+	require.Contains(t, string(b), `"error": "enable operation aborted by SIGTERM: `)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxSignatureSize is the maximum size of the signature files in
+	// signatureUrls, which are much smaller.
+	maxSignatureSize = 1 << 20
+
+	armorPublicKeyBegin = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	armorPublicKeyEnd   = "-----END PGP PUBLIC KEY BLOCK-----"
+)
+
+var errGPGVNotInstalled = errors.New("gpgv is not installed, it is required to verify the signatures in 'signatureUrls'")
+
+// verifyFileSignature downloads the detached OpenPGP signature of the file at
+// path from sigURL, with the credentials in cfg, and verifies it with the
+// public keys in gpgPublicKey in cfg. The download is canceled when opCtx is
+// done. Failures to download the signature are download failures, others are
+// categorized as errSignatureInvalid.
+func verifyFileSignature(ctx *log.Context, opCtx context.Context, path, sigURL string, cfg handlerSettings) error {
+	gpgv, err := exec.LookPath("gpgv")
+	if err != nil {
+		return categorize(errSignatureInvalid, errGPGVNotInstalled)
+	}
+	keyring, err := dearmorPublicKey(cfg.publicSettings.GPGPublicKey)
+	if err != nil {
+		return categorize(errSignatureInvalid, errors.Wrap(err, "invalid 'gpgPublicKey'"))
+	}
+
+	// gpgv only reads the keyring in the temporary directory, which is also
+	// its home directory so that it does not use the one of the user
+	dir, err := ioutil.TempDir("", "signature")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	keyringPath, sigPath := filepath.Join(dir, "keyring.gpg"), filepath.Join(dir, "file.sig")
+	if err := ioutil.WriteFile(keyringPath, keyring, 0600); err != nil {
+		return errors.Wrap(err, "failed to write keyring")
+	}
+
+	dl, err := getDownloader(ctx, sigURL, cfg)
+	if err != nil {
+		return err
+	}
+	if _, err := download.SaveTo(ctx, dl, sigPath, download.SaveOptions{
+		Mode:    0600,
+		Retry:   cfg.retryPolicy(),
+		Context: opCtx,
+		MaxSize: maxSignatureSize}); err != nil {
+		return errors.Wrap(err, "failed to download signature")
+	}
+
+	name := filepath.Base(path)
+	ctx.Log("event", "verifying signature", "file", name)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(opCtx, gpgv, "--homedir", dir, "--keyring", keyringPath, "--status-fd", "1", sigPath, path)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return categorize(errSignatureInvalid, fmt.Errorf("invalid signature of '%s': %s", name, gpgvFailure(stdout.String(), stderr.String(), err)))
+	}
+	fingerprint, ok := statusField(stdout.String(), "VALIDSIG")
+	if !ok {
+		return categorize(errSignatureInvalid, fmt.Errorf("invalid signature of '%s': no valid signature found", name))
+	}
+	ctx.Log("event", "verified signature", "file", name, "key", fingerprint)
+	return nil
+}
+
+// gpgvFailure describes why gpgv failed with err, from its status output on
+// stdout or otherwise its messages on stderr.
+func gpgvFailure(stdout, stderr string, err error) string {
+	if key, ok := statusField(stdout, "BADSIG"); ok {
+		return "bad signature from key " + key
+	}
+	if key, ok := statusField(stdout, "NO_PUBKEY"); ok {
+		return "signed with key " + key + " which is not in 'gpgPublicKey'"
+	}
+	if _, ok := statusField(stdout, "EXPKEYSIG"); ok {
+		return "signed with an expired key"
+	}
+	if _, ok := statusField(stdout, "REVKEYSIG"); ok {
+		return "signed with a revoked key"
+	}
+	if s := strings.TrimSpace(stderr); s != "" {
+		return fmt.Sprintf("%v: %s", err, s)
+	}
+	return err.Error()
+}
+
+// statusField returns the first argument of the first gpg status line with
+// the given keyword in out, such as the key of "[GNUPG:] BADSIG <key> <user>".
+func statusField(out, keyword string) (string, bool) {
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) >= 2 && f[0] == "[GNUPG:]" && f[1] == keyword {
+			if len(f) > 2 {
+				return f[2], true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// dearmorPublicKey decodes the ASCII-armored OpenPGP public key blocks in s
+// into the binary keyring gpgv reads. The packets are not parsed: invalid keys
+// fail the verification.
+func dearmorPublicKey(s string) ([]byte, error) {
+	var (
+		out             []byte
+		body            bytes.Buffer
+		inBlock, inBody bool
+		blocks, lineNum int
+	)
+	for _, line := range strings.Split(s, "\n") {
+		lineNum++
+		line = strings.TrimSpace(line)
+		switch {
+		case !inBlock:
+			if line == armorPublicKeyBegin {
+				inBlock, inBody = true, false
+				body.Reset()
+			}
+		case line == armorPublicKeyEnd:
+			b, err := base64.StdEncoding.DecodeString(body.String())
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot decode public key block ending at line %d", lineNum)
+			}
+			out = append(out, b...)
+			inBlock = false
+			blocks++
+		case !inBody:
+			// armor headers, such as "Version: ...", until an empty line
+			if line == "" {
+				inBody = true
+			} else if !strings.Contains(line, ": ") {
+				return nil, fmt.Errorf("invalid armor header at line %d", lineNum)
+			}
+		case strings.HasPrefix(line, "="):
+			// checksum of the body, the packets are verified by gpgv
+		default:
+			body.WriteString(line)
+		}
+	}
+	if inBlock {
+		return nil, errors.New("public key block is not terminated")
+	}
+	if blocks == 0 {
+		return nil, fmt.Errorf("no ASCII-armored public key block (%s) found", armorPublicKeyBegin)
+	}
+	return out, nil
+}
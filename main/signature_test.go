@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// testGPGPublicKey is the public key testSignature is made with, of the
+// contents testSignedScript.
+const (
+	testGPGPublicKey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mDMEas+esxYJKwYBBAHaRw8BAQdAmZscOGuBSvZHFpFbDTXjwahUa538AenQd9/M
+0kQuiNK0EHRlc3RAZXhhbXBsZS5jb22IkAQTFggAOBYhBHybTn+UQeWK5izNCrTS
+gppbU8VfBQJqz56zAhsDBQsJCAcCBhUKCQgLAgQWAgMBAh4BAheAAAoJELTSgppb
+U8VfL0IBANzM0rBcKf8IRRVANaJ83Gxle9d3/wW0HWDNVNCtUc2aAPoD34+ysDH0
+9sN3dNcgwuAVKhh6WlUIrTdWXNPytEQqBw==
+=4frY
+-----END PGP PUBLIC KEY BLOCK-----
+`
+	testSignature = `-----BEGIN PGP SIGNATURE-----
+
+iHUEABYIAB0WIQR8m05/lEHliuYszQq00oKaW1PFXwUCas+e0gAKCRC00oKaW1PF
+XxYXAQC/MM6CTw0yi5YgylZRnZt1wpYcT/3ooTWLXiloHbSieAEAwyQbLOgxsPKk
+/lELj3F8bVANRCJ4YgUWvI1LCqvEiAw=
+=QqPW
+-----END PGP SIGNATURE-----
+`
+	testSignedScript = "echo hello\n"
+)
+
+func Test_downloadFiles_signatures(t *testing.T) {
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		t.Skip("gpgv is not installed")
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.sh":
+			fmt.Fprint(w, testSignedScript)
+		case "/tampered.sh":
+			fmt.Fprint(w, testSignedScript+"rm -rf /\n")
+		case "/a.sh.asc":
+			fmt.Fprint(w, testSignature)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	cfg := func(file, sig string) handlerSettings {
+		return handlerSettings{publicSettings: publicSettings{
+			FileURLs:      []string{srv.URL + file},
+			SignatureURLs: []string{srv.URL + sig},
+			GPGPublicKey:  testGPGPublicKey,
+		}}
+	}
+	ctx := log.NewContext(log.NewNopLogger())
+
+	require.Nil(t, downloadFiles(ctx, context.Background(), dir, cfg("/a.sh", "/a.sh.asc"), nil))
+
+	err := downloadFiles(ctx, context.Background(), dir, cfg("/tampered.sh", "/a.sh.asc"), nil)
+	require.NotNil(t, err)
+	require.Equal(t, errSignatureInvalid, categoryOf(err))
+	require.Contains(t, err.Error(), "failed to verify file[0]: invalid signature of 'tampered.sh': bad signature from key B4D2829A5B53C55F")
+	_, err = os.Stat(filepath.Join(dir, "tampered.sh"))
+	require.True(t, os.IsNotExist(err), "file is removed")
+
+	c := cfg("/tampered.sh", "/a.sh.asc")
+	c.publicSettings.ContinueOnDownloadError = true
+	err = downloadFiles(ctx, context.Background(), dir, c, nil)
+	require.Equal(t, errSignatureInvalid, categoryOf(err), "not skipped with continueOnDownloadError")
+
+	err = downloadFiles(ctx, context.Background(), dir, cfg("/a.sh", "/missing.asc"), nil)
+	require.NotNil(t, err)
+	require.Equal(t, errorCategory(""), categoryOf(err), "download failure")
+	require.Contains(t, err.Error(), "failed to download signature")
+
+	// a valid armored block whose contents are not the key of the signature
+	c = cfg("/a.sh", "/a.sh.asc")
+	c.publicSettings.GPGPublicKey = armorPublicKeyBegin + "\n\nAAAA\n" + armorPublicKeyEnd
+	err = downloadFiles(ctx, context.Background(), dir, c, nil)
+	require.Equal(t, errSignatureInvalid, categoryOf(err))
+	require.Contains(t, err.Error(), "invalid signature of 'a.sh'")
+}
+
+func Test_dearmorPublicKey(t *testing.T) {
+	b, err := dearmorPublicKey(testGPGPublicKey)
+	require.Nil(t, err)
+	require.Equal(t, byte(0x98), b[0], "public key packet")
+
+	two, err := dearmorPublicKey("Key 1:\r\n" + strings.Replace(testGPGPublicKey, "\n", "\r\n", -1) +
+		strings.Replace(testGPGPublicKey, "\n\n", "\nVersion: GnuPG\n\n", 1))
+	require.Nil(t, err)
+	require.Equal(t, append(b, b...), two, "multiple blocks, CRLF and headers")
+
+	for in, msg := range map[string]string{
+		"":                                      "no ASCII-armored public key block",
+		testSignature:                           "no ASCII-armored public key block",
+		strings.Split(testGPGPublicKey, "=")[0]: "public key block is not terminated",
+		armorPublicKeyBegin + "\n\n!!\n" + armorPublicKeyEnd:         "cannot decode public key block ending at line 4",
+		armorPublicKeyBegin + "\nmDMEas+esxYJ\n" + armorPublicKeyEnd: "invalid armor header at line 2",
+	} {
+		_, err := dearmorPublicKey(in)
+		require.NotNil(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func Test_handlerSettings_validateSignatures(t *testing.T) {
+	cfg := func(key string, sigs ...string) handlerSettings {
+		return handlerSettings{publicSettings: publicSettings{
+			CommandToExecute: "date",
+			FileURLs:         []string{"http://a/1", "http://a/2"},
+			SignatureURLs:    sigs,
+			GPGPublicKey:     key}}
+	}
+	require.Nil(t, cfg("").validate())
+	require.Nil(t, cfg(testGPGPublicKey, "", "http://a/2.sig").validate())
+
+	require.Equal(t, errSignatureURLsTooMany, cfg(testGPGPublicKey, "http://a/1.sig", "http://a/2.sig", "http://a/3.sig").validate())
+	require.Equal(t, errSignatureURLsNoKey, cfg("", "http://a/1.sig").validate())
+	require.Equal(t, errGPGPublicKeyNoSignatures, cfg(testGPGPublicKey, "").validate())
+	require.EqualError(t, cfg(testGPGPublicKey, "ftp://a/1.sig").validate(),
+		`invalid URL in 'signatureUrls' at index 0: unsupported URL scheme "ftp" (only http and https are allowed)`)
+	err := cfg("a key", "http://a/1.sig").validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid 'gpgPublicKey': no ASCII-armored public key block")
+
+	// the manifest in manifestUri is also verified with gpgPublicKey
+	manifest := func(key, uri, sig string) handlerSettings {
+		h := cfg(key)
+		h.publicSettings.ManifestURI, h.publicSettings.ManifestSignatureURI = uri, sig
+		return h
+	}
+	require.Nil(t, manifest(testGPGPublicKey, "http://a/manifest.json", "").validate())
+	require.Nil(t, manifest(testGPGPublicKey, "http://a/manifest.json", "http://a/manifest.asc").validate())
+	require.Equal(t, errManifestURINoKey, manifest("", "http://a/manifest.json", "").validate())
+	require.Equal(t, errManifestSigNoManifest, manifest(testGPGPublicKey, "", "http://a/manifest.asc").validate())
+	require.EqualError(t, manifest(testGPGPublicKey, "ftp://a/manifest.json", "").validate(),
+		`invalid 'manifestUri': unsupported URL scheme "ftp" (only http and https are allowed)`)
+	require.EqualError(t, manifest(testGPGPublicKey, "http://a/manifest.json", "ftp://a/manifest.asc").validate(),
+		`invalid 'manifestSignatureUri': unsupported URL scheme "ftp" (only http and https are allowed)`)
+	h := manifest(testGPGPublicKey, "http://a/manifest.json", "")
+	h.publicSettings.ScriptFile = "listed.sh"
+	require.Nil(t, h.validate(), "scriptFile is checked once the manifest is downloaded")
+}
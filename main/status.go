@@ -1,24 +1,144 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
 	"github.com/Azure/azure-docker-extension/pkg/vmextension"
 	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
+// substatus is a named status reported along with the operation status, such
+// as the progress of an individual file download.
+type substatus struct {
+	Name             string                  `json:"name"`
+	Status           status.Type             `json:"status"`
+	FormattedMessage status.FormattedMessage `json:"formattedMessage"`
+}
+
+// newSubstatus returns a substatus with the given name, type and message.
+func newSubstatus(name string, t status.Type, msg string) substatus {
+	return substatus{
+		Name:             name,
+		Status:           t,
+		FormattedMessage: status.FormattedMessage{Lang: "en", Message: msg}}
+}
+
+const (
+	// downloadTimingName and commandTimingName are the names of the
+	// substatuses reporting the timing of downloading the files and
+	// executing the command.
+	downloadTimingName = "download timing"
+	commandTimingName  = "command timing"
+)
+
+// timing is the wall-clock timing of a step of an operation. It is reported as
+// the JSON message of a substatus so that it can be parsed by tools.
+type timing struct {
+	StartTime       string  `json:"startTime"`
+	EndTime         string  `json:"endTime"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// newTimingSubstatus returns a substatus with the given name reporting the
+// timing of a step from start to end, which failed if err is not nil.
+func newTimingSubstatus(name string, start, end time.Time, err error) substatus {
+	t := status.StatusSuccess
+	if err != nil {
+		t = status.StatusError
+	}
+	b, _ := json.Marshal(timing{
+		StartTime:       start.UTC().Format(time.RFC3339Nano),
+		EndTime:         end.UTC().Format(time.RFC3339Nano),
+		DurationSeconds: end.Sub(start).Seconds()})
+	return newSubstatus(name, t, string(b))
+}
+
+// statusReport is the status file format of status.StatusReport extended with
+// substatuses, which the vmextension/status package does not support.
+type statusReport []statusItem
+
+type statusItem struct {
+	Version      float64             `json:"version"`
+	TimestampUTC string              `json:"timestampUTC"`
+	Status       statusWithSubstatus `json:"status"`
+}
+
+type statusWithSubstatus struct {
+	status.Status
+	Substatus []substatus `json:"substatus,omitempty"`
+}
+
+// newStatusReport returns a status report with the given substatuses.
+func newStatusReport(t status.Type, operation, msg string, sub []substatus) statusReport {
+	var r statusReport
+	for _, s := range status.NewStatus(t, operation, msg) {
+		r = append(r, statusItem{
+			Version:      s.Version,
+			TimestampUTC: s.TimestampUTC,
+			Status:       statusWithSubstatus{s.Status, sub}})
+	}
+	return r
+}
+
+// save persists the status report to the specified status folder using the
+// sequence number, in the same way status.StatusReport.Save does: by writing
+// to a temporary file in the same folder and moving it to the final
+// destination for atomicity.
+func (r statusReport) save(statusFolder string, seqNum int) error {
+	fn := fmt.Sprintf("%d.status", seqNum)
+	path := filepath.Join(statusFolder, fn)
+	tmpFile, err := ioutil.TempFile(statusFolder, fn)
+	if err != nil {
+		return errors.Wrap(err, "status: failed to create temporary file")
+	}
+	tmpFile.Close()
+
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "status: failed to marshal into json")
+	}
+	if err := ioutil.WriteFile(tmpFile.Name(), b, 0644); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrapf(err, "status: failed to write path=%s", tmpFile.Name())
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrapf(err, "status: failed to move to path=%s", path)
+	}
+	return nil
+}
+
 // reportStatus saves operation status to the status file for the extension
-// handler with the optional given message, if the given cmd requires reporting
-// status.
+// handler with the optional given message and substatuses, if the given cmd
+// requires reporting status.
 //
 // If an error occurs reporting the status, it will be logged and returned.
-func reportStatus(ctx *log.Context, hEnv vmextension.HandlerEnvironment, seqNum int, t status.Type, c cmd, msg string) error {
+func reportStatus(ctx *log.Context, hEnv vmextension.HandlerEnvironment, seqNum int, t status.Type, c cmd, msg string, sub ...substatus) error {
 	if !c.shouldReportStatus {
 		ctx.Log("status", "not reported for operation (by design)")
 		return nil
 	}
-	s := status.NewStatus(t, c.name, statusMsg(c, t, msg))
-	if err := s.Save(hEnv.HandlerEnvironment.StatusFolder, seqNum); err != nil {
+	return saveStatus(ctx, hEnv, seqNum, newStatusReport(t, c.name, statusMsg(c, t, msg), sub))
+}
+
+// reportProgress saves a transitioning status for the given operation with the
+// given message and substatuses. It is used by the operations that report
+// status to update it while they are still in progress.
+func reportProgress(ctx *log.Context, hEnv vmextension.HandlerEnvironment, seqNum int, operation, msg string, sub ...substatus) error {
+	t := status.StatusTransitioning
+	return saveStatus(ctx, hEnv, seqNum, newStatusReport(t, operation, statusMsg(cmd{name: operation}, t, msg), sub))
+}
+
+func saveStatus(ctx *log.Context, hEnv vmextension.HandlerEnvironment, seqNum int, s statusReport) error {
+	if err := s.save(hEnv.HandlerEnvironment.StatusFolder, seqNum); err != nil {
 		ctx.Log("event", "failed to save handler status", "error", err)
 		return errors.Wrap(err, "failed to save handler status")
 	}
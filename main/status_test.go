@@ -1,14 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-docker-extension/pkg/vmextension"
 	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
 	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -72,3 +75,59 @@ func Test_reportStatus_checksIfShouldBeReported(t *testing.T) {
 		}
 	}
 }
+
+func Test_reportProgress_substatus(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	fakeEnv := vmextension.HandlerEnvironment{}
+	fakeEnv.HandlerEnvironment.StatusFolder = tmpDir
+
+	require.Nil(t, reportProgress(log.NewContext(log.NewNopLogger()), fakeEnv, 1, "Enable", "downloading files",
+		newSubstatus("download file[0]", status.StatusTransitioning, "downloaded 5 of 10 bytes")))
+
+	b, err := ioutil.ReadFile(filepath.Join(tmpDir, "1.status"))
+	require.Nil(t, err, ".status file exists")
+	var r statusReport
+	require.Nil(t, json.Unmarshal(b, &r))
+	require.Len(t, r, 1)
+	require.Equal(t, status.StatusTransitioning, r[0].Status.Status.Status)
+	require.Equal(t, "Enable in progress: downloading files", r[0].Status.FormattedMessage.Message)
+	require.Equal(t, []substatus{{
+		Name:             "download file[0]",
+		Status:           status.StatusTransitioning,
+		FormattedMessage: status.FormattedMessage{Lang: "en", Message: "downloaded 5 of 10 bytes"},
+	}}, r[0].Status.Substatus)
+}
+
+func Test_reportStatus_noSubstatus(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	fakeEnv := vmextension.HandlerEnvironment{}
+	fakeEnv.HandlerEnvironment.StatusFolder = tmpDir
+
+	require.Nil(t, reportStatus(log.NewContext(log.NewNopLogger()), fakeEnv, 1, status.StatusSuccess, cmdEnable, ""))
+	b, err := ioutil.ReadFile(filepath.Join(tmpDir, "1.status"))
+	require.Nil(t, err)
+	require.NotContains(t, string(b), "substatus")
+}
+
+func Test_newTimingSubstatus(t *testing.T) {
+	start := time.Date(2017, 1, 2, 3, 4, 5, 0, time.FixedZone("PST", -8*3600))
+	s := newTimingSubstatus(commandTimingName, start, start.Add(1500*time.Millisecond), nil)
+	require.Equal(t, "command timing", s.Name)
+	require.Equal(t, status.StatusSuccess, s.Status)
+
+	var v timing
+	require.Nil(t, json.Unmarshal([]byte(s.FormattedMessage.Message), &v))
+	require.Equal(t, timing{
+		StartTime:       "2017-01-02T11:04:05Z",
+		EndTime:         "2017-01-02T11:04:06.5Z",
+		DurationSeconds: 1.5}, v)
+
+	s = newTimingSubstatus(downloadTimingName, start, start, errors.New("failed"))
+	require.Equal(t, status.StatusError, s.Status)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+)
+
+// The files the system snapshot is read from, variables to be replaced in
+// tests.
+var (
+	memInfoPath = "/proc/meminfo"
+	loadAvgPath = "/proc/loadavg"
+)
+
+// systemSnapshot is the state of the resources of the VM, reported with the
+// failures of the enable operation as they are often caused by exhausting
+// them. The sizes are -1 if they cannot be determined.
+type systemSnapshot struct {
+	dir                 string // whose file system is reported
+	diskFree, diskTotal int64  // of the file system of dir, free to unprivileged users
+	memAvail, memTotal  int64
+	loadAvg             string // over 1, 5 and 15 minutes, such as "0.52 0.58 0.59"
+}
+
+// takeSystemSnapshot reads the free disk space of the file system of dir, the
+// available memory and the load average. It only reads from /proc and calls
+// statfs(2), so it is cheap enough to take on every failure.
+func takeSystemSnapshot(dir string) systemSnapshot {
+	s := systemSnapshot{dir: dir, diskFree: -1, diskTotal: -1, memAvail: -1, memTotal: -1}
+	for p := dir; ; p = filepath.Dir(p) {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(p, &st); err == nil {
+			s.diskFree, s.diskTotal = int64(st.Bavail)*int64(st.Bsize), int64(st.Blocks)*int64(st.Bsize)
+			break
+		}
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+	if f, err := os.Open(memInfoPath); err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			// such as "MemAvailable:    8041496 kB"
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			n, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			switch fields[0] {
+			case "MemTotal:":
+				s.memTotal = n * 1024
+			case "MemAvailable:":
+				s.memAvail = n * 1024
+			}
+		}
+	}
+	if b, err := ioutil.ReadFile(loadAvgPath); err == nil {
+		if fields := strings.Fields(string(b)); len(fields) >= 3 {
+			s.loadAvg = strings.Join(fields[:3], " ")
+		}
+	}
+	return s
+}
+
+// String returns the snapshot as one line for each resource, omitting those
+// that could not be determined.
+func (s systemSnapshot) String() string {
+	var lines []string
+	if s.diskFree >= 0 {
+		lines = append(lines, fmt.Sprintf("free disk space on %s: %s of %s", s.dir, mebibytes(s.diskFree), mebibytes(s.diskTotal)))
+	}
+	if s.memAvail >= 0 && s.memTotal >= 0 {
+		lines = append(lines, fmt.Sprintf("available memory: %s of %s", mebibytes(s.memAvail), mebibytes(s.memTotal)))
+	}
+	if s.loadAvg != "" {
+		lines = append(lines, "load average: "+s.loadAvg)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func mebibytes(n int64) string { return fmt.Sprintf("%d MiB", n/(1024*1024)) }
+
+// systemSnapshotMsg returns a message describing the resources of the VM to
+// be appended to the status message of the enable operation, which ended with
+// err: if it failed, or in any case with statusVerbosity set to verbose. It is
+// empty otherwise, and with statusVerbosity set to minimal.
+func (h handlerSettings) systemSnapshotMsg(ctx log.Logger, err error) string {
+	v := h.statusVerbosity()
+	if v == statusVerbosityMinimal || (err == nil && v != statusVerbosityVerbose) {
+		return ""
+	}
+	s := takeSystemSnapshot(dataDir)
+	ctx.Log("event", "system snapshot", "diskFree", s.diskFree, "memAvailable", s.memAvail, "loadAverage", s.loadAvg)
+	if str := s.String(); str != "" {
+		return "\n[system]\n" + str
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_takeSystemSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(m, l string) { memInfoPath, loadAvgPath = m, l }(memInfoPath, loadAvgPath)
+	memInfoPath, loadAvgPath = filepath.Join(dir, "meminfo"), filepath.Join(dir, "loadavg")
+	require.Nil(t, ioutil.WriteFile(memInfoPath, []byte("MemTotal:        4194304 kB\nMemFree:          102400 kB\nMemAvailable:     524288 kB\nHugePages_Total:       0\n"), 0644))
+	require.Nil(t, ioutil.WriteFile(loadAvgPath, []byte("0.52 0.58 0.59 2/412 12345\n"), 0644))
+
+	s := takeSystemSnapshot(filepath.Join(dir, "missing", "dir"))
+	require.True(t, s.diskFree >= 0, "from the closest existing parent")
+	require.True(t, s.diskTotal >= s.diskFree)
+	require.Equal(t, int64(512*1024*1024), s.memAvail)
+	require.Equal(t, int64(4096*1024*1024), s.memTotal)
+	require.Equal(t, "0.52 0.58 0.59", s.loadAvg)
+	require.Regexp(t, `^free disk space on .*/missing/dir: \d+ MiB of \d+ MiB
+available memory: 512 MiB of 4096 MiB
+load average: 0.52 0.58 0.59$`, s.String())
+
+	os.Remove(memInfoPath)
+	os.Remove(loadAvgPath)
+	s = takeSystemSnapshot(dir)
+	require.Equal(t, int64(-1), s.memAvail)
+	require.Equal(t, "", s.loadAvg)
+	require.NotContains(t, s.String(), "memory")
+	require.Equal(t, "", systemSnapshot{diskFree: -1, memAvail: -1, memTotal: -1}.String())
+}
+
+func Test_handlerSettings_systemSnapshotMsg(t *testing.T) {
+	errFailed := categorize(errCommandFailed, os.ErrNotExist)
+	normal := handlerSettings{}
+	require.Equal(t, "", normal.systemSnapshotMsg(log.NewNopLogger(), nil), "omitted on success")
+	require.Contains(t, normal.systemSnapshotMsg(log.NewNopLogger(), errFailed), "\n[system]\nfree disk space on ")
+
+	verbose := handlerSettings{publicSettings: publicSettings{StatusVerbosity: statusVerbosityVerbose}}
+	require.Contains(t, verbose.systemSnapshotMsg(log.NewNopLogger(), nil), "\n[system]\n")
+
+	minimal := handlerSettings{publicSettings: publicSettings{StatusVerbosity: statusVerbosityMinimal}}
+	require.Equal(t, "", minimal.systemSnapshotMsg(log.NewNopLogger(), errFailed))
+}
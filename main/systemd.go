@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// systemdBootedPath exists if the system is booted with systemd, as checked by
+// sd_booted(3). It is a variable to be replaced in tests.
+var systemdBootedPath = "/run/systemd/system"
+
+// SystemdScope describes the transient systemd scope unit a command is run
+// in with systemd-run --scope, to account the resources of all its processes
+// in their own control group and to limit them.
+type SystemdScope struct {
+	// Properties are the unit properties set on the scope, such as
+	// "MemoryMax=512M" or "CPUQuota=50%".
+	Properties []string
+}
+
+// args returns the systemd-run command line that runs the command line cmd
+// in the scope s, as the user of cred if it is not nil: systemd-run must run
+// as root to create the scope, and switches to the user once it is created.
+func (s SystemdScope) args(cmd []string, cred *syscall.Credential) ([]string, error) {
+	path, err := exec.LookPath("systemd-run")
+	if err != nil {
+		return nil, errors.Wrap(err, "systemd-run is not found or not executable")
+	}
+	args := []string{path, "--scope", "--quiet"}
+	if cred != nil {
+		args = append(args, fmt.Sprintf("--uid=%d", cred.Uid), fmt.Sprintf("--gid=%d", cred.Gid))
+	}
+	for _, p := range s.Properties {
+		args = append(args, "--property="+p)
+	}
+	return append(append(args, "--"), cmd...), nil
+}
+
+// systemdAvailable returns an error describing why the commands cannot be run
+// in systemd scopes, if the system is not booted with systemd or systemd-run
+// is not installed.
+func systemdAvailable() error {
+	if fi, err := os.Stat(systemdBootedPath); err != nil || !fi.IsDir() {
+		return errors.New("the system is not booted with systemd")
+	}
+	if _, err := exec.LookPath("systemd-run"); err != nil {
+		return errors.New("systemd-run is not installed")
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// mockSystemdRun puts a systemd-run in the PATH which saves its arguments to
+// the returned file and executes the command after "--", and makes the system
+// look booted with systemd, until the returned function is called.
+func mockSystemdRun(t *testing.T) (argsFile string, restore func()) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	argsFile = filepath.Join(dir, "args")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "systemd-run"), []byte(`#!/bin/sh
+echo "$@" > `+argsFile+`
+while [ "$1" != "--" ]; do shift; done
+shift
+exec "$@"
+`), 0755))
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "booted"), 0755))
+	oldPath, oldBooted := os.Getenv("PATH"), systemdBootedPath
+	os.Setenv("PATH", dir+":"+oldPath)
+	systemdBootedPath = filepath.Join(dir, "booted")
+	return argsFile, func() {
+		os.Setenv("PATH", oldPath)
+		systemdBootedPath = oldBooted
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExec_systemdScope(t *testing.T) {
+	argsFile, restore := mockSystemdRun(t)
+	defer restore()
+
+	o := new(mockFile)
+	_, err := Exec(`echo "in scope $$"`, "/", o, new(mockFile), ExecOptions{
+		SystemdScope: &SystemdScope{Properties: []string{"MemoryMax=512M", "CPUQuota=50%"}}})
+	require.Nil(t, err)
+	require.Contains(t, string(o.b.Bytes()), "in scope ")
+	b, err := ioutil.ReadFile(argsFile)
+	require.Nil(t, err)
+	require.Equal(t, "--scope --quiet --property=MemoryMax=512M --property=CPUQuota=50% -- /bin/sh -c echo \"in scope $$\"\n", string(b))
+
+	_, err = Exec("exit 3", "/", new(mockFile), new(mockFile), ExecOptions{SystemdScope: &SystemdScope{}})
+	require.Equal(t, ExitError{Code: 3}, err, "exit status of the command")
+}
+
+func TestSystemdScope_args(t *testing.T) {
+	_, restore := mockSystemdRun(t)
+	defer restore()
+
+	args, err := SystemdScope{}.args([]string{"/bin/sh", "-c", "date"}, &syscall.Credential{Uid: 1000, Gid: 100})
+	require.Nil(t, err)
+	require.Equal(t, []string{"--scope", "--quiet", "--uid=1000", "--gid=100", "--", "/bin/sh", "-c", "date"}, args[1:])
+	require.Equal(t, "systemd-run", filepath.Base(args[0]))
+
+	os.Setenv("PATH", "/non/existing")
+	_, err = SystemdScope{}.args([]string{"date"}, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "systemd-run is not found or not executable")
+}
+
+func Test_systemdAvailable(t *testing.T) {
+	_, restore := mockSystemdRun(t)
+	defer restore()
+	require.Nil(t, systemdAvailable())
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", "/non/existing")
+	require.EqualError(t, systemdAvailable(), "systemd-run is not installed")
+	os.Setenv("PATH", path)
+
+	systemdBootedPath = "/non/existing"
+	require.EqualError(t, systemdAvailable(), "the system is not booted with systemd")
+}
+
+func Test_commandExecOptions_systemdScope(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	_, restore := mockSystemdRun(t)
+	defer restore()
+	defer func(d string) { cgroupRoot = d }(cgroupRoot)
+	cgroupRoot = "/non/existing"
+	cfg := handlerSettings{publicSettings: publicSettings{UseSystemdScope: true, MemoryLimitMB: 1024}}
+
+	opts, cleanup, err := commandExecOptions(log.NewNopLogger(), context.Background(), dir, cfg)
+	cleanup()
+	require.Nil(t, err)
+	require.Equal(t, &SystemdScope{Properties: []string{"MemoryMax=1073741824", "MemorySwapMax=0"}}, opts.SystemdScope)
+	require.Equal(t, "", opts.CgroupDir, "limited in the scope")
+
+	// executed directly if systemd is not available
+	systemdBootedPath = "/non/existing"
+	opts, cleanup, err = commandExecOptions(log.NewNopLogger(), context.Background(), dir, cfg)
+	cleanup()
+	require.Nil(t, err)
+	require.Nil(t, opts.SystemdScope)
+	o := new(mockFile)
+	_, err = Exec("echo direct", dir, o, new(mockFile), opts)
+	require.Nil(t, err)
+	require.Equal(t, "direct\n", string(o.b.Bytes()))
+}
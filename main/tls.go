@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+)
+
+// configureTLS makes the downloads trust the certificate authorities in cfg,
+// if any, in addition to the system roots, or skip the certificate
+// verification if insecureSkipVerify is set, which is logged as a warning.
+func configureTLS(ctx log.Logger, cfg handlerSettings) error {
+	if cfg.InsecureSkipVerify {
+		ctx.Log("warning", "TLS CERTIFICATE VERIFICATION IS DISABLED by insecureSkipVerify",
+			"message", "downloads are not protected against man-in-the-middle attacks, use caCertPem instead")
+	}
+	if cfg.CACertPEM != "" {
+		ctx.Log("event", "trusting certificate authorities from caCertPem")
+	}
+	return download.SetTLSConfig(cfg.CACertPEM, cfg.InsecureSkipVerify)
+}
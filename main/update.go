@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
+	"github.com/Azure/custom-script-extension-linux/pkg/seqnum"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// stateVersion is the version of the format of the state stored in dataDir,
+// saved to stateVersionFile by update. It is incremented on changes to the
+// format, along with a migration step converting the previous format.
+const stateVersion = 1
+
+// migrationStep migrates a part of the state saved by a previous version of
+// the extension, or verifies that it can be read, and returns a description
+// of what is done. The steps are idempotent, as they run on every update: the
+// versions before stateVersion 1 did not save the version of their state.
+type migrationStep struct {
+	name string
+	f    func(ctx *log.Context, h vmextension.HandlerEnvironment) (string, error)
+}
+
+var migrationSteps = []migrationStep{
+	{"data directory", migrateDataDirs},
+	{"seqnum", migrateSeqNum},
+	{"result", checkResultFile},
+	{"status", checkStatusFiles},
+}
+
+// update runs the migration steps on the state left by the previous version
+// of the extension, which this version takes over, and reports each of them
+// as a substatus. It fails if any of the steps fails, after running all of
+// them. The state saved by a newer version of the extension, such as before a
+// rollback, is left as is.
+func update(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) (string, []substatus, error) {
+	// run after the enable of the previous version, if it is still running
+	if ok, err := dirExists(dataDir); err != nil {
+		return "", nil, err
+	} else if ok {
+		lock, err := acquireLock(ctx, filepath.Join(dataDir, lockFile), defaultLockTimeout)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "failed to acquire enable lock")
+		}
+		defer lock.Close()
+	}
+
+	stateVersionPath := filepath.Join(dataDir, stateVersionFile)
+	prev, err := readStateVersion(stateVersionPath)
+	if err != nil {
+		return "", nil, err
+	}
+	ctx.Log("event", "migrating state", "from", prev, "to", stateVersion)
+	if prev > stateVersion {
+		ctx.Log("event", "skipped migration", "message", "state is saved by a newer version", "stateVersion", prev)
+		return fmt.Sprintf("state version %d is newer than %d, not migrated", prev, stateVersion), nil, nil
+	}
+
+	var (
+		sub      []substatus
+		failures []string
+	)
+	for _, step := range migrationSteps {
+		ctx := ctx.With("step", step.name)
+		name := "migrate " + step.name
+		msg, err := step.f(ctx, h)
+		if err != nil {
+			ctx.Log("event", "migration step failed", "error", err)
+			failures = append(failures, fmt.Sprintf("%s: %v", step.name, err))
+			sub = append(sub, newSubstatus(name, status.StatusError, err.Error()))
+			continue
+		}
+		ctx.Log("event", "migration step completed", "message", msg)
+		sub = append(sub, newSubstatus(name, status.StatusSuccess, msg))
+	}
+	if len(failures) > 0 {
+		return "", sub, fmt.Errorf("failed to migrate state from version %d: %s", prev, strings.Join(failures, "; "))
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return "", sub, errors.Wrap(err, "failed to create data dir")
+	}
+	if err := writeFileAtomic(stateVersionPath, []byte(strconv.Itoa(stateVersion))); err != nil {
+		return "", sub, errors.Wrap(err, "failed to save state version")
+	}
+	ctx.Log("event", "migrated state", "stateVersion", stateVersion)
+	return fmt.Sprintf("migrated state from version %d to %d", prev, stateVersion), sub, nil
+}
+
+// readStateVersion returns the state version stored at path, or 0 if it is
+// not stored, as by the versions of the extension before stateVersion 1.
+func readStateVersion(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "failed to read state version")
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot parse state version %q", b)
+	}
+	return v, nil
+}
+
+// migrateDataDirs moves the state from dataDirOld (introduced in v2.0.0) to
+// dataDir (introduced in v2.0.1), and from defaultDataDir to dataDir if it is
+// configured otherwise, so that the processed sequence number is not lost.
+func migrateDataDirs(ctx *log.Context, _ vmextension.HandlerEnvironment) (string, error) {
+	oldDirs := []string{dataDirOld}
+	if dataDir != defaultDataDir {
+		if err := checkDataDirOverlap(dataDir); err != nil {
+			return "", err // never moved into itself
+		}
+		oldDirs = append(oldDirs, defaultDataDir)
+	}
+	var moved []string
+	for _, d := range oldDirs {
+		ok, err := dirExists(d)
+		if err != nil {
+			return "", errors.Wrap(err, "could not check old directory")
+		}
+		if !ok {
+			continue
+		}
+		if err := migrateDataDir(ctx, d, dataDir); err != nil {
+			return "", errors.Wrapf(err, "state directory %s could not be migrated", d)
+		}
+		moved = append(moved, d)
+	}
+	if len(moved) == 0 {
+		return "no old data directory found", nil
+	}
+	return fmt.Sprintf("moved %s to %s", strings.Join(moved, ", "), dataDir), nil
+}
+
+// migrateSeqNum verifies that the processed sequence number can be read, and
+// rewrites it in the current format if needed.
+func migrateSeqNum(ctx *log.Context, _ vmextension.HandlerEnvironment) (string, error) {
+	path := filepath.Join(dataDir, seqNumFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return "no processed sequence number found", nil
+	}
+	rewritten, err := seqnum.Normalize(path)
+	if err != nil {
+		return "", err
+	}
+	if rewritten {
+		return "rewrote processed sequence number in the current format", nil
+	}
+	return "processed sequence number is valid", nil
+}
+
+// checkResultFile verifies that the result of the last enable operation can
+// be read. It is not migrated, as the next enable replaces it.
+func checkResultFile(ctx *log.Context, _ vmextension.HandlerEnvironment) (string, error) {
+	b, err := readJSONFile(filepath.Join(dataDir, resultFile))
+	if os.IsNotExist(errors.Cause(err)) {
+		return "no result found", nil
+	} else if err != nil {
+		return "", err
+	}
+	var r enableResult
+	if err := json.Unmarshal(b, &r); err != nil {
+		return "", errors.Wrap(err, "failed to parse result")
+	}
+	if r.SchemaVersion > resultSchemaVersion {
+		return fmt.Sprintf("result is saved with newer schemaVersion %d, will be replaced by the next enable", r.SchemaVersion), nil
+	}
+	return "result is valid", nil
+}
+
+// checkStatusFiles verifies that the status files can be read. They are not
+// migrated, as the next operation reports a new status, so the ones which
+// cannot be read are only reported.
+func checkStatusFiles(ctx *log.Context, h vmextension.HandlerEnvironment) (string, error) {
+	fis, err := ioutil.ReadDir(h.HandlerEnvironment.StatusFolder)
+	if os.IsNotExist(err) {
+		return "no status found", nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "failed to list status files")
+	}
+	var valid int
+	var invalid []string
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || filepath.Ext(fi.Name()) != ".status" {
+			continue
+		}
+		var r statusReport
+		b, err := readJSONFile(filepath.Join(h.HandlerEnvironment.StatusFolder, fi.Name()))
+		if err == nil {
+			err = json.Unmarshal(b, &r)
+		}
+		if err != nil {
+			ctx.Log("event", "cannot read status file", "file", fi.Name(), "error", err)
+			invalid = append(invalid, fi.Name())
+			continue
+		}
+		valid++
+	}
+	msg := fmt.Sprintf("%d status file(s) are valid", valid)
+	if len(invalid) > 0 {
+		msg += fmt.Sprintf(", cannot read %s", strings.Join(invalid, ", "))
+	}
+	return msg, nil
+}
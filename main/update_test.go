@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_update(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer func(d, o string) { dataDir, dataDirOld = d, o }(dataDir, dataDirOld)
+	dataDir, dataDirOld = filepath.Join(dir, "data"), filepath.Join(dir, "old")
+	statusDir := filepath.Join(dir, "status")
+	for _, d := range []string{dataDirOld, statusDir} {
+		require.Nil(t, os.Mkdir(d, 0700))
+	}
+	var h vmextension.HandlerEnvironment
+	h.HandlerEnvironment.StatusFolder = statusDir
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dataDirOld, seqNumFile), []byte("3\n"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dataDirOld, resultFile), []byte(`{"schemaVersion": 1, "seqNum": 3}`), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(statusDir, "2.status"), []byte(`[{"version": 1, "status": {"status": "success"}}]`), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(statusDir, "3.status"), []byte(`[{`), 0600))
+
+	msg, sub, err := update(log.NewContext(log.NewNopLogger()), h, 3)
+	require.Nil(t, err)
+	require.Equal(t, "migrated state from version 0 to 1", msg)
+	require.Len(t, sub, len(migrationSteps))
+	for _, s := range sub {
+		require.Equal(t, status.StatusSuccess, s.Status, s.Name)
+	}
+	require.Equal(t, "migrate data directory", sub[0].Name)
+	require.Equal(t, "moved "+dataDirOld+" to "+dataDir, sub[0].FormattedMessage.Message)
+	require.Equal(t, "rewrote processed sequence number in the current format", sub[1].FormattedMessage.Message)
+	require.Equal(t, "result is valid", sub[2].FormattedMessage.Message)
+	require.Equal(t, "1 status file(s) are valid, cannot read 3.status", sub[3].FormattedMessage.Message)
+
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, seqNumFile))
+	require.Nil(t, err)
+	require.Equal(t, "3", string(b))
+	b, err = ioutil.ReadFile(filepath.Join(dataDir, stateVersionFile))
+	require.Nil(t, err)
+	require.Equal(t, "1", string(b))
+
+	msg, sub, err = update(log.NewContext(log.NewNopLogger()), h, 3)
+	require.Nil(t, err, "idempotent")
+	require.Equal(t, "migrated state from version 1 to 1", msg)
+	require.Equal(t, "no old data directory found", sub[0].FormattedMessage.Message)
+	require.Equal(t, "processed sequence number is valid", sub[1].FormattedMessage.Message)
+}
+
+func Test_update_fails(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer func(d, o string) { dataDir, dataDirOld = d, o }(dataDir, dataDirOld)
+	dataDir, dataDirOld = filepath.Join(dir, "data"), filepath.Join(dir, "old")
+	require.Nil(t, os.Mkdir(dataDir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dataDir, seqNumFile), []byte("x"), 0600))
+
+	_, sub, err := update(log.NewContext(log.NewNopLogger()), vmextension.HandlerEnvironment{}, 3)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), `failed to migrate state from version 0: seqnum: seqnum: cannot parse number "x"`)
+	require.Equal(t, status.StatusError, sub[1].Status)
+	require.Equal(t, status.StatusSuccess, sub[2].Status, "other steps run")
+	_, err = os.Stat(filepath.Join(dataDir, stateVersionFile))
+	require.True(t, os.IsNotExist(err), "state version is not saved")
+}
+
+func Test_update_newerState(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = dir
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dataDir, stateVersionFile), []byte("99"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dataDir, seqNumFile), []byte("3\n"), 0600))
+
+	msg, sub, err := update(log.NewContext(log.NewNopLogger()), vmextension.HandlerEnvironment{}, 3)
+	require.Nil(t, err)
+	require.Equal(t, "state version 99 is newer than 1, not migrated", msg)
+	require.Empty(t, sub)
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, seqNumFile))
+	require.Nil(t, err)
+	require.Equal(t, "3\n", string(b), "left as is")
+}
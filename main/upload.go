@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/blobutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// maxOutputUploadBytes is the largest number of bytes uploaded to
+// outputBlobUri from each output file, the last ones of larger files: the
+// largest blob a single request can upload. It limits every file on its own,
+// not the sum of all the files uploaded.
+const maxOutputUploadBytes = 256 * 1024 * 1024
+
+var errOutputBlobNoCredentials = errors.New("no credentials to upload to 'outputBlobUri': it must have a SAS, or 'sasToken', the storage account credentials or 'managedIdentity' must be specified")
+
+// uploadOutput uploads the output files of the command in dir to the blobs
+// under outputBlobUri in cfg named after the files. The failures are only
+// logged, they do not change the outcome of the command.
+func uploadOutput(ctx *log.Context, dir string, cfg handlerSettings) {
+	for _, path := range outputFiles(dir, cfg) {
+		name := filepath.Base(path)
+		ctx := ctx.With("blob", name)
+		d, err := getUploader(ctx, blobURLUnder(cfg.OutputBlobURI, name), cfg)
+		if err == nil {
+			err = download.UploadBlob(d, path, maxOutputUploadBytes)
+		}
+		if err != nil {
+			ctx.Log("event", "failed to upload output", "error", err)
+			continue
+		}
+		ctx.Log("event", "uploaded output")
+	}
+}
+
+// outputFiles returns the paths of the output files of the command, the
+// 'commands' and the onFailureCommand in dir which exist.
+func outputFiles(dir string, cfg handlerSettings) []string {
+	var paths []string
+	add := func(stdout, stderr string) {
+		for _, p := range []string{stdout, stderr} {
+			if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+				paths = append(paths, p)
+			}
+		}
+	}
+	add(logPaths(dir))
+	_, cmds := cfg.numberedCommands()
+	for i := range cmds {
+		add(commandLogPaths(dir, i))
+	}
+	add(onFailureLogPaths(dir))
+	return paths
+}
+
+// blobURLUnder returns the URL of the blob with the given name under the
+// container or the virtual directory at uri, keeping its query (such as a SAS).
+func blobURLUnder(uri, name string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+	u.RawPath = ""
+	return u.String()
+}
+
+// getUploader returns the Downloader whose requests are authorized to write
+// the blob at blobURL, to be used with download.UploadBlob, with the SAS in
+// the URL or the storage credentials in cfg.
+func getUploader(ctx *log.Context, blobURL string, cfg handlerSettings) (download.Downloader, error) {
+	if blobutil.HasSASSignature(blobURL) {
+		return download.NewURLDownload(blobURL), nil
+	}
+	if cfg.SASToken != "" {
+		ctx.Log("event", "using SAS token for upload") // never log the token
+		return download.NewURLDownload(blobutil.AppendSASToken(blobURL, cfg.SASToken)), nil
+	}
+	if cfg.StorageAccountName != "" && cfg.StorageAccountKey != "" {
+		blob, err := blobutil.ParseBlobURL(blobURL)
+		if err != nil {
+			return nil, err
+		}
+		return download.NewBlobUpload(cfg.StorageAccountName, cfg.StorageAccountKey, blob), nil
+	}
+	if cfg.ManagedIdentity != nil {
+		return getManagedIdentityDownloader(ctx, blobURL, *cfg.ManagedIdentity)
+	}
+	return nil, errOutputBlobNoCredentials
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_blobURLUnder(t *testing.T) {
+	require.Equal(t, "https://a.blob.core.windows.net/logs/vm1/stdout?sv=1&sig=x%2By",
+		blobURLUnder("https://a.blob.core.windows.net/logs/vm1/?sv=1&sig=x%2By", "stdout"))
+	require.Equal(t, "https://a.blob.core.windows.net/logs/stderr.0",
+		blobURLUnder("https://a.blob.core.windows.net/logs", "stderr.0"))
+}
+
+func Test_getUploader(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	blob := "https://a.blob.core.windows.net/logs/stdout"
+
+	d, err := getUploader(ctx, blob+"?sv=1&sig=x", handlerSettings{protectedSettings: protectedSettings{SASToken: "?sv=2&sig=y"}})
+	require.Nil(t, err)
+	req, err := d.GetRequest()
+	require.Nil(t, err)
+	require.Equal(t, "sv=1&sig=x", req.URL.RawQuery, "SAS in the URL takes precedence")
+
+	d, err = getUploader(ctx, blob, handlerSettings{protectedSettings: protectedSettings{SASToken: "?sv=2&sig=y"}})
+	require.Nil(t, err)
+	req, err = d.GetRequest()
+	require.Nil(t, err)
+	require.Equal(t, "sv=2&sig=y", req.URL.RawQuery)
+
+	d, err = getUploader(ctx, blob, handlerSettings{protectedSettings: protectedSettings{StorageAccountName: "a", StorageAccountKey: "Zm9vCg=="}})
+	require.Nil(t, err)
+	req, err = d.GetRequest()
+	require.Nil(t, err)
+	require.Equal(t, "cw", req.URL.Query().Get("sp"), "SAS allows writing the blob")
+
+	_, err = getUploader(ctx, blob, handlerSettings{})
+	require.Equal(t, errOutputBlobNoCredentials, err)
+}
+
+func Test_uploadOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"stdout", "stderr", "stdout.onfailure", "stderr.onfailure", "stdout.test"} {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0600))
+	}
+
+	var (
+		mu       sync.Mutex
+		uploaded = map[string]string{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		uploaded[r.URL.Path] = string(b)
+		mu.Unlock()
+		if r.URL.Path == "/logs/vm1/stderr" {
+			w.WriteHeader(http.StatusForbidden) // does not stop the other uploads
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	uploadOutput(log.NewContext(log.NewNopLogger()), dir, handlerSettings{
+		publicSettings: publicSettings{OutputBlobURI: srv.URL + "/logs/vm1?sig=x"}})
+	require.Equal(t, map[string]string{
+		"/logs/vm1/stdout":           "stdout",
+		"/logs/vm1/stderr":           "stderr",
+		"/logs/vm1/stdout.onfailure": "stdout.onfailure",
+		"/logs/vm1/stderr.onfailure": "stderr.onfailure",
+	}, uploaded)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// runAsUser describes a user account the command can be executed as.
+type runAsUser struct {
+	name       string
+	home       string
+	credential *syscall.Credential
+}
+
+// lookupUser resolves the user with the given name from the user database.
+func lookupUser(name string) (runAsUser, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if _, ok := err.(user.UnknownUserError); ok {
+			return runAsUser{}, fmt.Errorf("user %q does not exist", name)
+		}
+		return runAsUser{}, errors.Wrapf(err, "failed to look up user %q", name)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return runAsUser{}, errors.Wrapf(err, "failed to parse uid of user %q", name)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return runAsUser{}, errors.Wrapf(err, "failed to parse gid of user %q", name)
+	}
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if groupIDs, err := u.GroupIds(); err == nil { // best effort for supplementary groups
+		for _, v := range groupIDs {
+			if g, err := strconv.ParseUint(v, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(g))
+			}
+		}
+	}
+	return runAsUser{name: u.Username, home: u.HomeDir, credential: cred}, nil
+}
+
+// env returns the login environment variables for the user.
+func (u runAsUser) env() map[string]string {
+	return map[string]string{
+		"HOME":    u.home,
+		"USER":    u.name,
+		"LOGNAME": u.name,
+	}
+}
+
+// chownR changes the owner of the directory at path and everything under it
+// to the given user without following symbolic links.
+func chownR(path string, uid, gid int) error {
+	return filepath.Walk(path, func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return errors.Wrapf(os.Lchown(p, uid, gid), "failed to change owner of %q", p)
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_lookupUser(t *testing.T) {
+	u, err := lookupUser("root")
+	require.Nil(t, err)
+	require.Equal(t, "root", u.name)
+	require.EqualValues(t, 0, u.credential.Uid)
+	require.EqualValues(t, 0, u.credential.Gid)
+	require.Equal(t, "root", u.env()["USER"])
+}
+
+func Test_lookupUser_notFound(t *testing.T) {
+	_, err := lookupUser("non-existing-user")
+	require.NotNil(t, err)
+	require.EqualError(t, err, `user "non-existing-user" does not exist`)
+}
+
+func Test_chownR(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Skipping: test requires root")
+	}
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.sh"), []byte("date"), 0500))
+
+	require.Nil(t, chownR(dir, 65534, 65534))
+	for _, p := range []string{dir, filepath.Join(dir, "a.sh")} {
+		fi, err := os.Stat(p)
+		require.Nil(t, err)
+		require.EqualValues(t, 65534, fi.Sys().(*syscall.Stat_t).Uid, "path=%s", p)
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+// containsString returns whether s is one of the strings in l.
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
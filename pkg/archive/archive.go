@@ -0,0 +1,364 @@
+// Package archive provides utilities to safely extract tar, gzipped tar and zip
+// archives into a directory.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type format int
+
+const (
+	formatNone format = iota
+	formatTar
+	formatTarGz
+	formatZip
+)
+
+// extensions maps the supported archive file extensions to their formats.
+var extensions = []struct {
+	ext string
+	f   format
+}{
+	{".tar.gz", formatTarGz},
+	{".tgz", formatTarGz},
+	{".tar", formatTar},
+	{".zip", formatZip},
+}
+
+func formatOf(name string) format {
+	name = strings.ToLower(name)
+	for _, e := range extensions {
+		if strings.HasSuffix(name, e.ext) {
+			return e.f
+		}
+	}
+	return formatNone
+}
+
+// IsArchive determines if the file at path is an archive that can be extracted,
+// based on its file extension (.tar, .tar.gz, .tgz or .zip).
+func IsArchive(path string) bool {
+	return formatOf(path) != formatNone
+}
+
+// Stats describes the contents extracted from an archive.
+type Stats struct {
+	Files int   // regular files, including hard links
+	Bytes int64 // total size of the regular files
+}
+
+// Limits bounds the contents extracted from an archive, so that an archive
+// expanding to far more than its own size (an archive bomb) cannot fill the
+// disk. Zero values are no limit.
+type Limits struct {
+	Entries int   // entries of any type
+	Bytes   int64 // total size of the regular files
+}
+
+// ErrLimitExceeded is the cause of the error returned when an archive exceeds
+// the limits it is extracted with.
+var ErrLimitExceeded = errors.New("archive exceeds the extraction limits")
+
+// Extract extracts the archive at path, in the format determined by its file
+// extension, into the existing directory dir. Existing files are overwritten.
+//
+// Entries with absolute paths or paths outside dir (such as "../file"),
+// symbolic and hard links pointing outside dir and entries that would be
+// written through a symbolic link are rejected with an error. Entries other
+// than files, directories and links (such as devices) are skipped.
+func Extract(path, dir string) error {
+	_, err := ExtractWithStats(path, dir, Limits{})
+	return err
+}
+
+// ExtractWithStats extracts the archive at path into dir like Extract, and
+// returns the number and the total size of the files it extracted, to be
+// compared with the expected ones. The extraction stops with an error caused
+// by ErrLimitExceeded as soon as the archive exceeds the limits l, leaving the
+// entries extracted until then.
+func ExtractWithStats(path, dir string, l Limits) (Stats, error) {
+	var s Stats
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return s, errors.Wrap(err, "failed to resolve target directory")
+	}
+	x := &extractor{dir: dir, stats: &s, limits: l}
+	switch formatOf(path) {
+	case formatTar:
+		f, err := os.Open(path)
+		if err != nil {
+			return s, errors.Wrap(err, "failed to open archive")
+		}
+		defer f.Close()
+		return s, x.tar(f)
+	case formatTarGz:
+		f, err := os.Open(path)
+		if err != nil {
+			return s, errors.Wrap(err, "failed to open archive")
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return s, errors.Wrap(err, "failed to read gzip stream")
+		}
+		defer gz.Close()
+		return s, x.tar(gz)
+	case formatZip:
+		return s, x.zip(path)
+	}
+	return s, fmt.Errorf("unsupported archive format: %s", filepath.Base(path))
+}
+
+// extractor creates the entries of an archive under dir.
+type extractor struct {
+	dir     string // absolute and clean
+	stats   *Stats // of the extracted entries
+	limits  Limits
+	entries int // read so far
+}
+
+// next counts the entry with the given name, and returns an error if there
+// are more entries than the limit.
+func (x *extractor) next(name string) error {
+	if x.entries++; x.limits.Entries > 0 && x.entries > x.limits.Entries {
+		return errors.Wrapf(ErrLimitExceeded, "archive has more than %d entries, at %q", x.limits.Entries, name)
+	}
+	return nil
+}
+
+// checkBytes returns an error if the files extracted so far are larger in
+// total than the limit.
+func (x *extractor) checkBytes(name string) error {
+	if x.limits.Bytes > 0 && x.stats.Bytes > x.limits.Bytes {
+		return errors.Wrapf(ErrLimitExceeded, "archive expands to more than %d bytes, at %q", x.limits.Bytes, name)
+	}
+	return nil
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read tar archive")
+		}
+		if err := x.next(h.Name); err != nil {
+			return err
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = x.mkdir(h.Name, h.FileInfo().Mode())
+		case tar.TypeReg, tar.TypeRegA:
+			err = x.file(h.Name, h.FileInfo().Mode(), tr)
+		case tar.TypeSymlink:
+			err = x.symlink(h.Name, h.Linkname)
+		case tar.TypeLink:
+			err = x.hardlink(h.Name, h.Linkname)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) zip(path string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read zip archive")
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if err := x.next(f.Name); err != nil {
+			return err
+		}
+		if err := x.zipEntry(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) zipEntry(f *zip.File) error {
+	mode := f.Mode()
+	if mode.IsDir() || strings.HasSuffix(f.Name, "/") {
+		return x.mkdir(f.Name, mode)
+	}
+	if !mode.IsRegular() && mode&os.ModeSymlink == 0 {
+		return nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read zip entry %q", f.Name)
+	}
+	defer rc.Close()
+	if mode&os.ModeSymlink != 0 {
+		target, err := readLinkname(rc)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read zip entry %q", f.Name)
+		}
+		return x.symlink(f.Name, target)
+	}
+	return x.file(f.Name, mode, rc)
+}
+
+// readLinkname reads the target of a symbolic link stored as the contents of a
+// zip entry.
+func readLinkname(r io.Reader) (string, error) {
+	const max = 4096
+	b := make([]byte, max+1)
+	n, err := io.ReadFull(r, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if n > max {
+		return "", errors.New("symlink target is too long")
+	}
+	return string(b[:n]), nil
+}
+
+// target returns the path the entry with the given name is extracted to, or an
+// error if it is outside dir or can be reached only through a symbolic link.
+func (x *extractor) target(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("archive entry %q has an absolute path", name)
+	}
+	p := filepath.Join(x.dir, name)
+	if !x.within(p) {
+		return "", fmt.Errorf("archive entry %q is outside the target directory", name)
+	}
+	// refuse to write through symbolic links created by the previous entries
+	// or present in dir
+	rel, _ := filepath.Rel(x.dir, filepath.Dir(p))
+	cur := x.dir
+	for _, c := range strings.Split(rel, string(filepath.Separator)) {
+		if c == "." {
+			continue
+		}
+		cur = filepath.Join(cur, c)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", errors.Wrapf(err, "failed to check path of archive entry %q", name)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("archive entry %q is inside a symbolic link", name)
+		}
+	}
+	return p, nil
+}
+
+// within determines if p is dir or a path under it.
+func (x *extractor) within(p string) bool {
+	rel, err := filepath.Rel(x.dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// replaceable removes the existing file or symbolic link at p, if any, so that
+// a new entry does not modify the target of a link or the file itself, which
+// may be a hard link or read-only. Existing directories are kept.
+func replaceable(p string) error {
+	if fi, err := os.Lstat(p); err == nil && !fi.IsDir() {
+		return errors.Wrapf(os.Remove(p), "failed to replace %q", p)
+	}
+	return nil
+}
+
+func (x *extractor) mkdir(name string, mode os.FileMode) error {
+	p, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if err := replaceable(p); err != nil {
+		return err
+	}
+	// keep the directory writable to extract the rest of the entries into it
+	return errors.Wrapf(os.MkdirAll(p, mode.Perm()|0700), "failed to create directory %q", name)
+}
+
+func (x *extractor) file(name string, mode os.FileMode, r io.Reader) error {
+	p, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory for %q", name)
+	}
+	if err := replaceable(p); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return errors.Wrapf(err, "failed to create file %q", name)
+	}
+	if x.limits.Bytes > 0 {
+		// one byte more than the limit is enough to know it is exceeded
+		r = io.LimitReader(r, x.limits.Bytes-x.stats.Bytes+1)
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to extract file %q", name)
+	}
+	x.stats.Files++
+	x.stats.Bytes += n
+	if err := x.checkBytes(name); err != nil {
+		f.Close()
+		return err
+	}
+	return errors.Wrapf(f.Close(), "failed to extract file %q", name)
+}
+
+func (x *extractor) symlink(name, linkname string) error {
+	p, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if filepath.IsAbs(linkname) || !x.within(filepath.Join(filepath.Dir(p), linkname)) {
+		return fmt.Errorf("symbolic link %q points outside the target directory: %q", name, linkname)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory for %q", name)
+	}
+	if err := replaceable(p); err != nil {
+		return err
+	}
+	return errors.Wrapf(os.Symlink(linkname, p), "failed to create symbolic link %q", name)
+}
+
+func (x *extractor) hardlink(name, linkname string) error {
+	p, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	src, err := x.target(linkname)
+	if err != nil {
+		return fmt.Errorf("hard link %q points outside the target directory: %q", name, linkname)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory for %q", name)
+	}
+	if err := replaceable(p); err != nil {
+		return err
+	}
+	if err := os.Link(src, p); err != nil {
+		return errors.Wrapf(err, "failed to create hard link %q", name)
+	}
+	x.stats.Files++
+	if fi, err := os.Stat(p); err == nil {
+		x.stats.Bytes += fi.Size()
+	}
+	return x.checkBytes(name)
+}
@@ -0,0 +1,217 @@
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/archive/archivetest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type entry = archivetest.Entry
+
+func tempDir(t *testing.T) (archiveDir, dir string, cleanup func()) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	archiveDir, dir = filepath.Join(root, "archives"), filepath.Join(root, "out")
+	require.Nil(t, os.Mkdir(archiveDir, 0700))
+	require.Nil(t, os.Mkdir(dir, 0700))
+	return archiveDir, dir, func() { os.RemoveAll(root) }
+}
+
+var validEntries = []entry{
+	{Name: "bin/", Mode: 0755},
+	{Name: "bin/run.sh", Body: "#!/bin/sh\necho hi\n", Mode: 0755},
+	{Name: "conf/app.conf", Body: "key=value\n", Mode: 0640},
+	{Name: "conf/current", Link: "app.conf"},
+	{Name: "./README", Body: "readme", Mode: 0644},
+}
+
+func requireValidEntries(t *testing.T, dir string) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "bin", "run.sh"))
+	require.Nil(t, err)
+	require.Equal(t, "#!/bin/sh\necho hi\n", string(b))
+	fi, err := os.Stat(filepath.Join(dir, "bin", "run.sh"))
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "conf", "current"))
+	require.Nil(t, err, "symlink should be followed")
+	require.Equal(t, "key=value\n", string(b))
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "README"))
+	require.Nil(t, err)
+	require.Equal(t, "readme", string(b))
+}
+
+func TestIsArchive(t *testing.T) {
+	for _, name := range []string{"a.tar", "a.tar.gz", "a.TGZ", "dir/a.zip"} {
+		require.True(t, IsArchive(name), name)
+	}
+	for _, name := range []string{"", "a.sh", "a.gz", "a.tar.bz2", "zip"} {
+		require.False(t, IsArchive(name), name)
+	}
+}
+
+func TestExtract_unsupported(t *testing.T) {
+	require.EqualError(t, Extract("/dir/a.rar", "/tmp"), "unsupported archive format: a.rar")
+}
+
+func TestExtract_tar(t *testing.T) {
+	archiveDir, dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(archiveDir, "a.tar")
+	archivetest.WriteTar(t, path, false, append(validEntries, entry{Name: "conf/copy", Link: "conf/app.conf", Hardlink: true})...)
+	require.Nil(t, Extract(path, dir))
+	requireValidEntries(t, dir)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "conf", "copy"))
+	require.Nil(t, err)
+	require.Equal(t, "key=value\n", string(b))
+}
+
+func TestExtract_tarGz(t *testing.T) {
+	archiveDir, dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(archiveDir, "a.tar.gz")
+	archivetest.WriteTar(t, path, true, validEntries...)
+	require.Nil(t, Extract(path, dir))
+	requireValidEntries(t, dir)
+}
+
+func TestExtract_zip(t *testing.T) {
+	archiveDir, dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(archiveDir, "a.zip")
+	archivetest.WriteZip(t, path, validEntries...)
+	require.Nil(t, Extract(path, dir))
+	requireValidEntries(t, dir)
+}
+
+func TestExtractWithStats(t *testing.T) {
+	archiveDir, dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(archiveDir, "a.tar")
+	archivetest.WriteTar(t, path, false, append(validEntries, entry{Name: "conf/copy", Link: "conf/app.conf", Hardlink: true})...)
+	s, err := ExtractWithStats(path, dir, Limits{})
+	require.Nil(t, err)
+	require.Equal(t, Stats{Files: 4, Bytes: 44}, s, "directories and symbolic links are not counted")
+
+	path = filepath.Join(archiveDir, "a.zip")
+	archivetest.WriteZip(t, path, validEntries...)
+	s, err = ExtractWithStats(path, dir, Limits{})
+	require.Nil(t, err)
+	require.Equal(t, Stats{Files: 3, Bytes: 34}, s)
+}
+
+func TestExtractWithStats_limits(t *testing.T) {
+	archiveDir, dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for _, format := range []string{"a.tar", "a.zip"} {
+		path := filepath.Join(archiveDir, format)
+		if format == "a.zip" {
+			archivetest.WriteZip(t, path, validEntries...)
+		} else {
+			archivetest.WriteTar(t, path, false, validEntries...)
+		}
+		_, err := ExtractWithStats(path, dir, Limits{Entries: 5, Bytes: 34})
+		require.Nil(t, err, "%s: at the limits", format)
+
+		s, err := ExtractWithStats(path, dir, Limits{Entries: 4})
+		require.EqualError(t, err, `archive has more than 4 entries, at "./README": archive exceeds the extraction limits`, format)
+		require.Equal(t, ErrLimitExceeded, errors.Cause(err))
+		require.Equal(t, 2, s.Files, "%s: extracted until the limit", format)
+
+		s, err = ExtractWithStats(path, dir, Limits{Bytes: 20})
+		require.EqualError(t, err, `archive expands to more than 20 bytes, at "conf/app.conf": archive exceeds the extraction limits`, format)
+		require.Equal(t, int64(21), s.Bytes, "%s: not read beyond the limit", format)
+	}
+
+	path := filepath.Join(archiveDir, "a.tar")
+	archivetest.WriteTar(t, path, false, entry{Name: "a", Body: "1234", Mode: 0644}, entry{Name: "b", Link: "a", Hardlink: true})
+	_, err := ExtractWithStats(path, dir, Limits{Bytes: 7})
+	require.EqualError(t, err, `archive expands to more than 7 bytes, at "b": archive exceeds the extraction limits`, "hard links count")
+}
+
+func TestExtract_overwrites(t *testing.T) {
+	archiveDir, dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("old"), 0400))
+	path := filepath.Join(archiveDir, "a.tar")
+	archivetest.WriteTar(t, path, false, entry{Name: "a.txt", Body: "new", Mode: 0644})
+	require.Nil(t, Extract(path, dir))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	require.Nil(t, err)
+	require.Equal(t, "new", string(b))
+}
+
+func TestExtract_reportsGzipError(t *testing.T) {
+	archiveDir, dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(archiveDir, "a.tgz")
+	require.Nil(t, ioutil.WriteFile(path, []byte("not gzip"), 0600))
+	err := Extract(path, dir)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to read gzip stream")
+}
+
+func TestExtract_rejectsUnsafeEntries(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []entry
+		err     string
+	}{
+		{"zip slip", []entry{{Name: "../evil.sh", Body: "x", Mode: 0644}},
+			`archive entry "../evil.sh" is outside the target directory`},
+		{"nested zip slip", []entry{{Name: "a/../../evil.sh", Body: "x", Mode: 0644}},
+			`archive entry "a/../../evil.sh" is outside the target directory`},
+		{"absolute path", []entry{{Name: "/tmp/evil.sh", Body: "x", Mode: 0644}},
+			`archive entry "/tmp/evil.sh" has an absolute path`},
+		{"symlink escape", []entry{{Name: "link", Link: "../../etc"}},
+			`symbolic link "link" points outside the target directory: "../../etc"`},
+		{"absolute symlink", []entry{{Name: "link", Link: "/etc/passwd"}},
+			`symbolic link "link" points outside the target directory: "/etc/passwd"`},
+		{"write through symlink", []entry{
+			{Name: "sub/", Mode: 0755},
+			{Name: "link", Link: "sub"},
+			{Name: "link/file", Body: "x", Mode: 0644}},
+			`archive entry "link/file" is inside a symbolic link`},
+	}
+	for _, c := range cases {
+		for _, format := range []string{"a.tar", "a.zip"} {
+			func() {
+				archiveDir, dir, cleanup := tempDir(t)
+				defer cleanup()
+
+				path := filepath.Join(archiveDir, format)
+				if format == "a.zip" {
+					archivetest.WriteZip(t, path, c.entries...)
+				} else {
+					archivetest.WriteTar(t, path, false, c.entries...)
+				}
+				require.EqualError(t, Extract(path, dir), c.err, "%s (%s)", c.name, format)
+				_, err := os.Stat(filepath.Join(filepath.Dir(dir), "evil.sh"))
+				require.True(t, os.IsNotExist(err), "%s (%s): file outside dir", c.name, format)
+			}()
+		}
+	}
+}
+
+func TestExtract_rejectsUnsafeHardlink(t *testing.T) {
+	archiveDir, dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(archiveDir, "a.tar")
+	archivetest.WriteTar(t, path, false, entry{Name: "passwd", Link: "../../etc/passwd", Hardlink: true})
+	require.EqualError(t, Extract(path, dir), `hard link "passwd" points outside the target directory: "../../etc/passwd"`)
+}
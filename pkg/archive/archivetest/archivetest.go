@@ -0,0 +1,91 @@
+// Package archivetest provides utilities to create the archives extracted in
+// the tests.
+package archivetest
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Entry is an archive entry. Directories end with "/" and symbolic links
+// have a link target.
+type Entry struct {
+	Name, Body, Link string
+	Mode             os.FileMode
+	Hardlink         bool
+}
+
+// Tar returns a tar archive with the given entries, gzipped if gz is true.
+func Tar(t testing.TB, gz bool, entries ...Entry) []byte {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.Name, Mode: int64(e.Mode), Size: int64(len(e.Body)), Typeflag: tar.TypeReg}
+		switch {
+		case e.Hardlink:
+			h.Typeflag, h.Linkname, h.Size = tar.TypeLink, e.Link, 0
+		case e.Link != "":
+			h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, e.Link, 0
+		case e.Name[len(e.Name)-1] == '/':
+			h.Typeflag, h.Size = tar.TypeDir, 0
+		}
+		check(t, tw.WriteHeader(h))
+		_, err := tw.Write([]byte(e.Body))
+		check(t, err)
+	}
+	check(t, tw.Close())
+	if !gz {
+		return b.Bytes()
+	}
+
+	var z bytes.Buffer
+	zw := gzip.NewWriter(&z)
+	_, err := zw.Write(b.Bytes())
+	check(t, err)
+	check(t, zw.Close())
+	return z.Bytes()
+}
+
+// Zip returns a zip archive with the given entries.
+func Zip(t testing.TB, entries ...Entry) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.Name, Method: zip.Deflate}
+		mode, body := e.Mode, e.Body
+		if e.Link != "" {
+			mode, body = os.ModeSymlink|0777, e.Link
+		} else if e.Name[len(e.Name)-1] == '/' {
+			mode |= os.ModeDir
+		}
+		h.SetMode(mode)
+		w, err := zw.CreateHeader(h)
+		check(t, err)
+		_, err = w.Write([]byte(body))
+		check(t, err)
+	}
+	check(t, zw.Close())
+	return b.Bytes()
+}
+
+// WriteTar writes the tar archive with the given entries to path.
+func WriteTar(t testing.TB, path string, gz bool, entries ...Entry) {
+	check(t, ioutil.WriteFile(path, Tar(t, gz, entries...), 0600))
+}
+
+// WriteZip writes the zip archive with the given entries to path.
+func WriteZip(t testing.TB, path string, entries ...Entry) {
+	check(t, ioutil.WriteFile(path, Zip(t, entries...), 0600))
+}
+
+func check(t testing.TB, err error) {
+	if err != nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,37 @@
+package blobutil
+
+import (
+	"net/url"
+	"strings"
+)
+
+// HasSASSignature returns true if the given URL carries a Shared Access
+// Signature in its query string, in which case it can be downloaded as is.
+func HasSASSignature(blobURL string) bool {
+	u, err := url.Parse(blobURL)
+	if err != nil {
+		return false
+	}
+	return u.Query().Get("sig") != ""
+}
+
+// AppendSASToken appends the given Shared Access Signature token (with or
+// without the leading "?") to the query string of blobURL, preserving the
+// existing query parameters and the fragment, if any.
+func AppendSASToken(blobURL, token string) string {
+	token = strings.TrimLeft(token, "?&")
+	if token == "" {
+		return blobURL
+	}
+	base, fragment := blobURL, ""
+	if i := strings.Index(blobURL, "#"); i >= 0 {
+		base, fragment = blobURL[:i], blobURL[i:]
+	}
+	switch {
+	case !strings.Contains(base, "?"):
+		base += "?"
+	case !strings.HasSuffix(base, "?") && !strings.HasSuffix(base, "&"):
+		base += "&"
+	}
+	return base + token + fragment
+}
@@ -0,0 +1,31 @@
+package blobutil_test
+
+import (
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/blobutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHasSASSignature(t *testing.T) {
+	require.True(t, blobutil.HasSASSignature("https://a.blob.core.windows.net/c/b.sh?sv=2015-04-05&sr=b&sig=abc%3D&se=2030-01-01&sp=r"))
+	require.True(t, blobutil.HasSASSignature("https://a.blob.core.windows.net/c/b.sh?sig=abc"))
+	require.False(t, blobutil.HasSASSignature("https://a.blob.core.windows.net/c/b.sh"))
+	require.False(t, blobutil.HasSASSignature("https://a.blob.core.windows.net/c/b.sh?snapshot=2011-03-09T01:42:34Z"))
+	require.False(t, blobutil.HasSASSignature("https://a.blob.core.windows.net/c/b.sh?sig="))
+	require.False(t, blobutil.HasSASSignature("http://[::1"))
+}
+
+func TestAppendSASToken(t *testing.T) {
+	for _, c := range []struct{ url, token, expected string }{
+		{"https://a.blob.core.windows.net/c/b.sh", "sv=1&sig=x", "https://a.blob.core.windows.net/c/b.sh?sv=1&sig=x"},
+		{"https://a.blob.core.windows.net/c/b.sh", "?sv=1&sig=x", "https://a.blob.core.windows.net/c/b.sh?sv=1&sig=x"},
+		{"https://a.blob.core.windows.net/c/b.sh?", "sv=1&sig=x", "https://a.blob.core.windows.net/c/b.sh?sv=1&sig=x"},
+		{"https://a.blob.core.windows.net/c/b.sh?snapshot=t", "sv=1&sig=x", "https://a.blob.core.windows.net/c/b.sh?snapshot=t&sv=1&sig=x"},
+		{"https://a.blob.core.windows.net/c/b.sh?snapshot=t&", "?sv=1&sig=x", "https://a.blob.core.windows.net/c/b.sh?snapshot=t&sv=1&sig=x"},
+		{"https://a.blob.core.windows.net/c/b.sh#frag", "sv=1&sig=x", "https://a.blob.core.windows.net/c/b.sh?sv=1&sig=x#frag"},
+		{"https://a.blob.core.windows.net/c/b.sh", "", "https://a.blob.core.windows.net/c/b.sh"},
+	} {
+		require.Equal(t, c.expected, blobutil.AppendSASToken(c.url, c.token), "url=%q token=%q", c.url, c.token)
+	}
+}
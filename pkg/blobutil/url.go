@@ -2,6 +2,7 @@ package blobutil
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 	"strings"
 
@@ -38,6 +39,9 @@ func ParseBlobURL(blobURL string) (v AzureBlobRef, err error) {
 		return v, fmt.Errorf("unsupported scheme in URL: %q", blobURL)
 	}
 
+	if net.ParseIP(u.Hostname()) != nil {
+		return v, fmt.Errorf("blob host is an IP address, not in *.blob.* format: %q", blobURL)
+	}
 	hostParts := strings.Split(u.Host, ".") // {account}.blob.{storageBase}
 	if len(hostParts) < 3 {
 		return v, fmt.Errorf("cannot parse azure blob URL: %q", blobURL)
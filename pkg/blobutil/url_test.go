@@ -25,6 +25,9 @@ func TestParseBlobURL_badHost(t *testing.T) {
 		"http://1.blob./c/blob.txt",
 		"http://1..blob./c/blob.txt",
 		"http://1.notblob.a/c/blob.txt",
+		"http://10.0.0.1/c/blob.txt",
+		"http://[fd00::1]:10000/c/blob.txt",
+		"http://[::ffff:10.0.0.1]/c/blob.txt",
 	} {
 		_, err := blobutil.ParseBlobURL(v)
 		require.NotNil(t, err, "bad host: %q", v)
@@ -0,0 +1,30 @@
+package download
+
+import (
+	"net/http"
+)
+
+// basicAuthDownload describes a URL to download with HTTP Basic
+// authentication, such as from an artifact server.
+type basicAuthDownload struct {
+	url, username, password string
+}
+
+// NewBasicAuthDownload creates a new Downloader for the URL authenticated with
+// the given username and password in the Authorization header.
+func NewBasicAuthDownload(url, username, password string) Downloader {
+	return basicAuthDownload{url, username, password}
+}
+
+// GetRequest returns a new request to download the URL with the Authorization
+// header set. The user info in the URL, if any, is removed from the request so
+// that it does not appear in the errors.
+func (b basicAuthDownload) GetRequest() (*http.Request, error) {
+	req, err := http.NewRequest("GET", b.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.User = nil
+	req.SetBasicAuth(b.username, b.password)
+	return req, nil
+}
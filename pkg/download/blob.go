@@ -18,6 +18,7 @@ const (
 type blobDownload struct {
 	accountName, accountKey string
 	blob                    blobutil.AzureBlobRef
+	permissions             string // of the generated Shared Access Signature
 }
 
 func (b blobDownload) GetRequest() (*http.Request, error) {
@@ -37,9 +38,8 @@ func (b blobDownload) getURL() (string, error) {
 		return "", errors.Wrap(err, "failed to initialize azure storage client")
 	}
 
-	// get read-only
 	sasURL, err := cl.GetBlobService().GetBlobSASURI(b.blob.Container, b.blob.Blob,
-		time.Now().UTC().Add(blobSASDuration), "r")
+		time.Now().UTC().Add(blobSASDuration), b.permissions)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to generate SAS key for blob")
 	}
@@ -48,5 +48,11 @@ func (b blobDownload) getURL() (string, error) {
 
 // NewBlobDownload creates a new Downloader for a blob hosted in Azure Blob Storage.
 func NewBlobDownload(accountName, accountKey string, blob blobutil.AzureBlobRef) Downloader {
-	return blobDownload{accountName, accountKey, blob}
+	return blobDownload{accountName, accountKey, blob, "r"} // read-only
+}
+
+// NewBlobUpload creates a new Downloader whose requests are authorized to
+// create or overwrite a blob in Azure Blob Storage, to be used with UploadBlob.
+func NewBlobUpload(accountName, accountKey string, blob blobutil.AzureBlobRef) Downloader {
+	return blobDownload{accountName, accountKey, blob, "cw"}
 }
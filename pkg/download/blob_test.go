@@ -121,10 +121,10 @@ func Test_blobDownload_actualBlob(t *testing.T) {
 		Blob:        name,
 		StorageBase: base,
 	})
-	body, err := Download(d)
+	resp, err := Download(d)
 	require.Nil(t, err)
-	defer body.Close()
-	b, err := ioutil.ReadAll(body)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
 	require.EqualValues(t, chunk, b, "retrieved body is different body=%d chunk=%d", len(b), len(chunk))
 }
@@ -0,0 +1,170 @@
+package download
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/blobutil"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// containerSASVersion is the version of the Shared Access Signatures generated
+// to list the blobs of a container with the storage account key.
+const containerSASVersion = "2015-02-21"
+
+// ListedBlob is a blob returned by ListBlobs.
+type ListedBlob struct {
+	Name string // relative to the container, may contain slashes (/)
+	Size int64  // in bytes
+}
+
+// blobListResponse is the response of the List Blobs operation.
+type blobListResponse struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			ContentLength int64 `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// ListBlobs lists the blobs in the container whose names start with prefix,
+// following the pagination of the results, with the List Blobs requests made
+// from the request of d, with its URL (the container URL) and headers (such as
+// the credentials). Each page is retried as described in p. It fails if there
+// are more than max blobs, if max is greater than zero.
+func ListBlobs(ctx *log.Context, d Downloader, prefix string, p RetryPolicy, max int) ([]ListedBlob, error) {
+	var out []ListedBlob
+	marker := ""
+	for page := 1; ; page++ {
+		var resp blobListResponse
+		err := retry(ctx.With("page", page), p, ActualSleep, func() error {
+			r, err := Download(blobListDownload{d, prefix, marker, 0})
+			if err != nil {
+				return err
+			}
+			defer r.Body.Close()
+			resp = blobListResponse{}
+			if err := xml.NewDecoder(r.Body).Decode(&resp); err != nil {
+				if IsTransient(err) {
+					return err // failed reading the body from the connection
+				}
+				return errors.Wrap(err, "failed to parse blob list")
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list blobs")
+		}
+		for _, b := range resp.Blobs {
+			out = append(out, ListedBlob{b.Name, b.Properties.ContentLength})
+		}
+		if max > 0 && len(out) > max {
+			return nil, fmt.Errorf("more than %d blobs with prefix %q", max, prefix)
+		}
+		if resp.NextMarker == "" {
+			return out, nil
+		}
+		marker = resp.NextMarker
+	}
+}
+
+// ProbeBlobList checks if the blobs in the container can be listed with d, as
+// with ListBlobs, without listing them all: it requests the first blob whose
+// name starts with prefix, canceled when c is done. The container may be
+// empty.
+func ProbeBlobList(c context.Context, d Downloader, prefix string) error {
+	r, err := Download(contextDownloader{blobListDownload{d, prefix, "", 1}, c})
+	if err != nil {
+		return errors.Wrap(err, "failed to list blobs")
+	}
+	r.Body.Close()
+	return nil
+}
+
+// blobListDownload wraps a Downloader of a container URL to request a page of
+// the list of its blobs.
+type blobListDownload struct {
+	Downloader
+	prefix, marker string
+	maxResults     int // of the page, the default of the service if zero
+}
+
+func (b blobListDownload) GetRequest() (*http.Request, error) {
+	req, err := b.Downloader.GetRequest()
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Set("restype", "container")
+	q.Set("comp", "list")
+	if b.prefix != "" {
+		q.Set("prefix", b.prefix)
+	}
+	if b.marker != "" {
+		q.Set("marker", b.marker)
+	}
+	if b.maxResults > 0 {
+		q.Set("maxresults", strconv.Itoa(b.maxResults))
+	}
+	req.URL.RawQuery = q.Encode()
+	if req.Header.Get("x-ms-version") == "" {
+		req.Header.Set("x-ms-version", storageAPIVersion)
+	}
+	return req, nil
+}
+
+// containerListDownload describes an Azure Blob Storage container whose blobs
+// are listed with a Shared Access Signature generated with the storage account
+// key.
+type containerListDownload struct {
+	accountName, accountKey string
+	container               blobutil.AzureBlobRef
+}
+
+// NewContainerListDownload creates a new Downloader of the URL of the container
+// of the given blob (whose name is ignored), authorized to list its blobs with
+// ListBlobs.
+func NewContainerListDownload(accountName, accountKey string, container blobutil.AzureBlobRef) Downloader {
+	return containerListDownload{accountName, accountKey, container}
+}
+
+func (c containerListDownload) GetRequest() (*http.Request, error) {
+	key, err := base64.StdEncoding.DecodeString(c.accountKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode storage account key")
+	}
+	expiry := time.Now().UTC().Add(blobSASDuration).Format(time.RFC3339)
+	// permissions, start, expiry, resource, identifier, version and the
+	// response headers
+	stringToSign := strings.Join([]string{"l", "", expiry,
+		fmt.Sprintf("/blob/%s/%s", c.accountName, c.container.Container), "",
+		containerSASVersion, "", "", "", "", ""}, "\n")
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(stringToSign))
+	sas := url.Values{
+		"sv":  {containerSASVersion},
+		"se":  {expiry},
+		"sr":  {"c"},
+		"sp":  {"l"},
+		"sig": {base64.StdEncoding.EncodeToString(h.Sum(nil))},
+	}
+	u := url.URL{
+		Scheme:   c.container.Scheme,
+		Host:     fmt.Sprintf("%s.blob.%s", c.accountName, c.container.StorageBase),
+		Path:     "/" + c.container.Container,
+		RawQuery: sas.Encode(),
+	}
+	return http.NewRequest("GET", u.String(), nil)
+}
@@ -0,0 +1,106 @@
+package download
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/blobutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/download/downloadtest"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListBlobs(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		require.Equal(t, storageAPIVersion, r.Header.Get("x-ms-version"))
+		switch r.URL.Query().Get("marker") {
+		case "":
+			fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>
+				<Blob><Name>setup/a.sh</Name><Properties><Content-Length>10</Content-Length></Properties></Blob>
+				<Blob><Name>setup/app/b.sh</Name><Properties><Content-Length>20</Content-Length></Properties></Blob>
+				</Blobs><NextMarker>page2</NextMarker></EnumerationResults>`)
+		case "page2":
+			fmt.Fprint(w, `<EnumerationResults><Blobs><Blob><Name>setup/c.sh</Name></Blob></Blobs><NextMarker /></EnumerationResults>`)
+		}
+	}))
+	defer srv.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	blobs, err := ListBlobs(ctx, NewURLDownload(srv.URL+"/c?sig=x"), "setup/", DefaultRetryPolicy, 0)
+	require.Nil(t, err)
+	require.Equal(t, []ListedBlob{{"setup/a.sh", 10}, {"setup/app/b.sh", 20}, {"setup/c.sh", 0}}, blobs)
+	require.Equal(t, []string{
+		"comp=list&prefix=setup%2F&restype=container&sig=x",
+		"comp=list&marker=page2&prefix=setup%2F&restype=container&sig=x"}, queries)
+
+	_, err = ListBlobs(ctx, NewURLDownload(srv.URL+"/c"), "", DefaultRetryPolicy, 2)
+	require.EqualError(t, err, `more than 2 blobs with prefix ""`)
+}
+
+func TestListBlobs_fails(t *testing.T) {
+	srv := downloadtest.NewCountingServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/invalid" {
+			fmt.Fprint(w, "<EnumerationResults><Blobs></EnumerationResults>")
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	})
+	defer srv.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	_, err := ListBlobs(ctx, NewURLDownload(srv.URL+"/c"), "", DefaultRetryPolicy, 0)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to list blobs: unexpected status code: got=403")
+	require.Equal(t, 1, srv.Requests(), "not retried")
+
+	_, err = ListBlobs(ctx, NewURLDownload(srv.URL+"/invalid"), "", DefaultRetryPolicy, 0)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to parse blob list")
+}
+
+func TestProbeBlobList(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		if r.URL.Path == "/denied" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `<EnumerationResults><Blobs /><NextMarker /></EnumerationResults>`)
+	}))
+	defer srv.Close()
+
+	require.Nil(t, ProbeBlobList(context.Background(), NewURLDownload(srv.URL+"/c?sig=x"), "setup/"), "empty container")
+	require.Equal(t, []string{"comp=list&maxresults=1&prefix=setup%2F&restype=container&sig=x"}, queries)
+
+	err := ProbeBlobList(context.Background(), NewURLDownload(srv.URL+"/denied"), "")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to list blobs: unexpected status code: got=403")
+}
+
+func TestContainerListDownload(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("key"))
+	req, err := NewContainerListDownload("account", key, blobutil.AzureBlobRef{
+		StorageBase: "core.windows.net", Container: "scripts", Blob: "x", Scheme: "https"}).GetRequest()
+	require.Nil(t, err)
+	require.Equal(t, "account.blob.core.windows.net", req.URL.Host)
+	require.Equal(t, "/scripts", req.URL.Path)
+	q := req.URL.Query()
+	require.Equal(t, "c", q.Get("sr"))
+	require.Equal(t, "l", q.Get("sp"), "only allowed to list")
+
+	h := hmac.New(sha256.New, []byte("key"))
+	h.Write([]byte("l\n\n" + q.Get("se") + "\n/blob/account/scripts\n\n2015-02-21\n\n\n\n\n"))
+	require.Equal(t, base64.StdEncoding.EncodeToString(h.Sum(nil)), q.Get("sig"))
+
+	_, err = NewContainerListDownload("account", "not base64!", blobutil.AzureBlobRef{}).GetRequest()
+	require.NotNil(t, err)
+}
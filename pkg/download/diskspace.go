@@ -0,0 +1,96 @@
+package download
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// DiskSpaceError is returned when a file cannot be written because the file
+// system is full or the disk quota of the user is exceeded.
+type DiskSpaceError struct {
+	Path      string // of the file or directory being written
+	Required  int64  // bytes needed, -1 if not known
+	Available int64  // bytes available, -1 if not known
+}
+
+func (e DiskSpaceError) Error() string {
+	var details []string
+	if e.Required >= 0 {
+		details = append(details, fmt.Sprintf("required=%d bytes", e.Required))
+	}
+	if e.Available >= 0 {
+		details = append(details, fmt.Sprintf("available=%d bytes", e.Available))
+	}
+	s := fmt.Sprintf("insufficient disk space to write %s", e.Path)
+	if len(details) > 0 {
+		s += ": " + strings.Join(details, " ")
+	}
+	return s
+}
+
+// IsDiskFull returns true if err is caused by the file system being full
+// (ENOSPC) or the disk quota being exceeded (EDQUOT).
+func IsDiskFull(err error) bool {
+	for err != nil {
+		switch e := errors.Cause(err).(type) {
+		case DiskSpaceError:
+			return true
+		case *os.PathError:
+			err = e.Err
+		case *os.LinkError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.ENOSPC || e == syscall.EDQUOT
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// WrapDiskFull returns a DiskSpaceError for writing to path, which requires
+// the given number of bytes (-1 if not known), if err is caused by the disk
+// being full. Otherwise it returns err as is.
+func WrapDiskFull(err error, path string, required int64) error {
+	if err == nil || !IsDiskFull(err) {
+		return err
+	}
+	if e, ok := errors.Cause(err).(DiskSpaceError); ok {
+		return e
+	}
+	return DiskSpaceError{Path: path, Required: required, Available: availableSpace(path)}
+}
+
+// checkDiskSpace returns a DiskSpaceError if the file system of path has fewer
+// than required bytes available to unprivileged users. It does nothing if the
+// available space cannot be determined.
+func checkDiskSpace(path string, required int64) error {
+	if avail := availableSpace(path); avail >= 0 && required > avail {
+		return DiskSpaceError{Path: path, Required: required, Available: avail}
+	}
+	return nil
+}
+
+// availableSpace returns the number of bytes available to unprivileged users
+// in the file system of path, or of its closest existing parent directory.
+// It returns -1 if it cannot be determined.
+func availableSpace(path string) int64 {
+	for {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(path, &st); err == nil {
+			return int64(st.Bavail) * int64(st.Bsize)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return -1
+		}
+		path = parent
+	}
+}
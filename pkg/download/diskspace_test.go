@@ -0,0 +1,42 @@
+package download
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsDiskFull(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.ENOSPC, syscall.EDQUOT} {
+		err := errors.Wrap(&os.PathError{Op: "write", Path: "/a", Err: errno}, "failed to write")
+		require.True(t, IsDiskFull(err), "%v", errno)
+	}
+	require.True(t, IsDiskFull(&os.SyscallError{Syscall: "close", Err: syscall.ENOSPC}))
+	require.True(t, IsDiskFull(errors.Wrap(DiskSpaceError{Path: "/a"}, "x")))
+	require.False(t, IsDiskFull(&os.PathError{Op: "open", Path: "/a", Err: syscall.EACCES}))
+	require.False(t, IsDiskFull(errors.New("no space")))
+	require.False(t, IsDiskFull(nil))
+}
+
+func TestWrapDiskFull(t *testing.T) {
+	dir := os.TempDir()
+	err := WrapDiskFull(&os.PathError{Op: "mkdir", Path: dir + "/a/b", Err: syscall.ENOSPC}, dir+"/a/b", -1)
+	e, ok := err.(DiskSpaceError)
+	require.True(t, ok, "%T", err)
+	require.Equal(t, dir+"/a/b", e.Path)
+	require.EqualValues(t, -1, e.Required)
+	require.True(t, e.Available >= 0, "determined from the existing parent")
+
+	other := errors.New("permission denied")
+	require.Equal(t, other, WrapDiskFull(other, "/a", 1))
+	require.Nil(t, WrapDiskFull(nil, "/a", 1))
+}
+
+func TestDiskSpaceError(t *testing.T) {
+	require.EqualError(t, DiskSpaceError{"/a", -1, -1}, "insufficient disk space to write /a")
+	require.EqualError(t, DiskSpaceError{"/a", 10, 2}, "insufficient disk space to write /a: required=10 bytes available=2 bytes")
+	require.EqualError(t, DiskSpaceError{"/a", -1, 2}, "insufficient disk space to write /a: available=2 bytes")
+}
@@ -1,10 +1,17 @@
 package download
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,39 +23,331 @@ type Downloader interface {
 	GetRequest() (*http.Request, error)
 }
 
+const (
+	// DefaultConnectTimeout is how long establishing a connection (including
+	// the DNS resolution) may take, unless changed with SetTimeouts.
+	DefaultConnectTimeout = 30 * time.Second
+
+	// DefaultResponseHeaderTimeout is how long to wait for the response
+	// headers after sending a request, unless changed with SetTimeouts.
+	DefaultResponseHeaderTimeout = 20 * time.Second
+
+	// dnsPort is the port of a DNS server unless specified otherwise.
+	dnsPort = "53"
+)
+
 var (
+	// connectTimeout and resolver are used by the dialer of httpTransport. If
+	// resolver is nil, the system resolver is used.
+	connectTimeout = DefaultConnectTimeout
+	resolver       *net.Resolver
+
+	// httpTransport is the transport used for downloading files from the
+	// Internet. It uses the proxy specified in the environment, unless changed
+	// with SetProxy.
+	httpTransport = &http.Transport{
+		Dial:                  dialer(DefaultConnectTimeout, nil),
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: DefaultResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
 	// httpClient is the default client to be used in downloading files from
 	// Internet. http.Get() uses a client without timeouts (http.DefaultClient)
 	// so it is dangerous to use it for downloading files from the Internet.
-	httpClient = &http.Client{
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			Proxy:                 http.ProxyFromEnvironment,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ResponseHeaderTimeout: 20 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		}}
+	httpClient = &http.Client{Transport: httpTransport}
+
+	// fileClient is used for file:// URLs pointing to the local file system.
+	// It is separate from httpClient, so that HTTP servers cannot redirect to
+	// local files.
+	fileClient = &http.Client{Transport: http.NewFileTransport(http.Dir("/"))}
 )
 
-// Download retrieves a response body and checks the response status code to see
-// if it is 200 OK and then returns the response body. It issues a new request
-// every time called. It is caller's responsibility to close the response body.
-func Download(d Downloader) (io.ReadCloser, error) {
+// SetProxy makes the downloads go through the proxy at proxyURL (which may
+// contain the proxy credentials) instead of the proxy specified in HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables. It should be called before
+// the downloads start. If proxyURL is nil, the environment is used again.
+func SetProxy(proxyURL *url.URL) {
+	if proxyURL == nil {
+		httpTransport.Proxy = http.ProxyFromEnvironment
+		return
+	}
+	httpTransport.Proxy = http.ProxyURL(proxyURL)
+}
+
+// SetTimeouts changes how long establishing a connection and waiting for the
+// response headers may take for the downloads. It should be called before the
+// downloads start.
+func SetTimeouts(connect, responseHeader time.Duration) {
+	connectTimeout = connect
+	httpTransport.Dial = dialer(connectTimeout, resolver)
+	httpTransport.ResponseHeaderTimeout = responseHeader
+}
+
+// SetResolver makes the downloads resolve host names with the DNS server at
+// addr, an IP address optionally followed by a port (see
+// ParseResolverAddress), instead of the system resolver. It should be called
+// before the downloads start. If addr is empty, the system resolver is used
+// again.
+func SetResolver(addr string) error {
+	if addr == "" {
+		resolver = nil
+	} else {
+		hostport, err := ParseResolverAddress(addr)
+		if err != nil {
+			return err
+		}
+		resolver = newResolver(hostport)
+	}
+	httpTransport.Dial = dialer(connectTimeout, resolver)
+	return nil
+}
+
+// SetTLSConfig changes how the TLS certificates of the servers are verified
+// for the downloads. The certificate authorities in caCertPEM, PEM-encoded
+// certificates, are trusted in addition to the system roots. If
+// insecureSkipVerify is true, the certificates are not verified at all. It
+// should be called before the downloads start. If caCertPEM is empty and
+// insecureSkipVerify is false, the system roots are used again.
+func SetTLSConfig(caCertPEM string, insecureSkipVerify bool) error {
+	var c *tls.Config
+	if caCertPEM != "" || insecureSkipVerify {
+		c = &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	}
+	if caCertPEM != "" {
+		certs, err := ParseCACertificates(caCertPEM)
+		if err != nil {
+			return err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool() // only the given certificate authorities
+		}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+		c.RootCAs = pool
+	}
+
+	// the connections pooled by the old transport were verified with the old
+	// config, so they are not reused by the new one
+	t := httpTransport.Clone()
+	t.TLSClientConfig = c
+	old := httpTransport
+	httpTransport, httpClient.Transport = t, t
+	old.CloseIdleConnections()
+	return nil
+}
+
+// ParseCACertificates parses the PEM-encoded certificates in s, which must
+// contain at least one certificate and nothing else.
+func ParseCACertificates(s string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(s)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		var b *pem.Block
+		if b, rest = pem.Decode(rest); b == nil {
+			return nil, errors.New("invalid PEM data after the certificates")
+		}
+		if b.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block type %q (expected CERTIFICATE)", b.Type)
+		}
+		cert, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse certificate[%d]", len(certs))
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+// ParseResolverAddress checks if addr is the address of a DNS server, such as
+// "10.0.0.53", "10.0.0.53:5353", "fd00::53" or "[fd00::53]:5353", and returns
+// it in the host:port form, with the default DNS port if not specified.
+func ParseResolverAddress(addr string) (string, error) {
+	host, port := addr, dnsPort
+	if ip := net.ParseIP(strings.Trim(addr, "[]")); ip == nil {
+		h, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", fmt.Errorf("invalid DNS server address (expected an IP address with an optional port): %q", addr)
+		}
+		host, port = h, p
+	}
+	host = strings.Trim(host, "[]")
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("DNS server address is not an IP address: %q", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port in DNS server address: %q", addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// newResolver returns a resolver that sends the DNS queries to the server at
+// hostport.
+func newResolver(hostport string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true, // the cgo resolver only uses the system configuration
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, hostport)
+		},
+	}
+}
+
+func dialer(timeout time.Duration, r *net.Resolver) func(network, addr string) (net.Conn, error) {
+	return (&net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Resolver:  r,
+	}).Dial
+}
+
+// Download retrieves a response and checks the response status code to see
+// if it is 200 OK (or 206 Partial Content for range requests) and then returns
+// the response. It issues a new request every time called. It is caller's
+// responsibility to close the response body.
+func Download(d Downloader) (*http.Response, error) {
 	req, err := d.GetRequest()
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create the request")
 	}
 
-	resp, err := httpClient.Do(req)
+	client := httpClient
+	if req.URL.Scheme == "file" {
+		client = fileClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, errors.Wrapf(err, "http request failed")
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: got=%d expected=%d", resp.StatusCode, http.StatusOK)
+	partial := resp.StatusCode == http.StatusPartialContent && req.Header.Get("Range") != ""
+	if resp.StatusCode != http.StatusOK && !partial {
+		resp.Body.Close()
+		return nil, statusCodeError{
+			got:      resp.StatusCode,
+			expected: http.StatusOK,
+			url:      redactedURL(req.URL),
+			headers:  diagnosticHeaders(resp.Header),
+		}
+	}
+	return resp, nil
+}
+
+// contextDownloader wraps a Downloader to issue its requests with a context,
+// so that they are canceled when the context is done.
+type contextDownloader struct {
+	Downloader
+	c context.Context
+}
+
+func (d contextDownloader) GetRequest() (*http.Request, error) {
+	req, err := d.Downloader.GetRequest()
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(d.c), nil
+}
+
+// errorHeaders are the response headers included in statusCodeError, which
+// tell the reason of the failure, such as the Azure Storage error code, or
+// identify the request for the support of the server.
+var errorHeaders = []string{"x-ms-error-code", "x-ms-request-id", "Retry-After"}
+
+// statusCodeError is returned from Download when the response status code is
+// not the expected one.
+type statusCodeError struct {
+	got, expected int
+	url           string   // of the request, with the query redacted
+	headers       []string // errorHeaders in the response as "Name=value"
+}
+
+func (e statusCodeError) Error() string {
+	s := fmt.Sprintf("unexpected status code: got=%d expected=%d", e.got, e.expected)
+	if text := http.StatusText(e.got); text != "" {
+		s += " (" + text + ")"
+	}
+	if e.url != "" {
+		s += " url=" + e.url
+	}
+	for _, h := range e.headers {
+		s += " " + h
+	}
+	return s
+}
+
+// redactedURL returns u without the user info and with the query, which may
+// contain a Shared Access Signature, redacted.
+func redactedURL(u *url.URL) string {
+	r := *u
+	r.User = nil
+	if r.RawQuery != "" {
+		r.RawQuery = "***"
+	}
+	r.Fragment = ""
+	return r.String()
+}
+
+// diagnosticHeaders returns the errorHeaders present in h as "Name=value".
+func diagnosticHeaders(h http.Header) []string {
+	var out []string
+	for _, k := range errorHeaders {
+		if v := h.Get(k); v != "" {
+			out = append(out, k+"="+v)
+		}
+	}
+	return out
+}
+
+// Probe checks if the resource can be downloaded with d, without downloading
+// it, by issuing a HEAD request and checking if the response status code is
+// 200 OK. If the server does not allow HEAD requests, a GET request is issued
+// and its response body is discarded unread.
+func Probe(d Downloader) error {
+	resp, err := Download(headDownloader{d})
+	if err == nil {
+		resp.Body.Close()
+		return nil
+	}
+	if e, ok := errors.Cause(err).(statusCodeError); !ok ||
+		(e.got != http.StatusMethodNotAllowed && e.got != http.StatusNotImplemented) {
+		return err
+	}
+	resp, err = Download(d)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ETag returns the ETag of the resource to be downloaded with d, without
+// downloading it, by issuing a HEAD request canceled when c is done. An empty
+// string is returned if the server does not provide an ETag.
+func ETag(c context.Context, d Downloader) (string, error) {
+	resp, err := Download(contextDownloader{headDownloader{d}, c})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// headDownloader wraps a Downloader to issue HEAD requests instead.
+type headDownloader struct {
+	Downloader
+}
+
+func (h headDownloader) GetRequest() (*http.Request, error) {
+	req, err := h.Downloader.GetRequest()
+	if err != nil {
+		return nil, err
 	}
-	return resp.Body, nil
+	req.Method = "HEAD"
+	return req, nil
 }
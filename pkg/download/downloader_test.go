@@ -1,12 +1,20 @@
 package download_test
 
 import (
+	"context"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Azure/custom-script-extension-linux/pkg/download"
 	"github.com/ahmetalpbalkan/go-httpbin"
@@ -32,6 +40,59 @@ func TestDownload_wrapsHTTPError(t *testing.T) {
 	require.Contains(t, err.Error(), "http request failed:")
 }
 
+func TestDownload_fileURL(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("hello")
+	require.Nil(t, err)
+	f.Close()
+
+	resp, err := download.Download(download.NewURLDownload("file://" + f.Name()))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "hello", string(b))
+
+	_, err = download.Download(download.NewURLDownload("file:///nonexistent/file"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "got=404")
+}
+
+func TestDownload_redirectToFileURLFails(t *testing.T) {
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
+
+	_, err := download.Download(download.NewURLDownload(srv.URL + "/redirect-to?url=file:///etc/hostname"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "http request failed")
+}
+
+func TestDownload_proxy(t *testing.T) {
+	var host, auth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, auth = r.URL.Host, r.Header.Get("Proxy-Authorization")
+		fmt.Fprint(w, "proxied")
+	}))
+	defer proxy.Close()
+
+	u, err := url.Parse(proxy.URL)
+	require.Nil(t, err)
+	u.User = url.UserPassword("user", "pass")
+	download.SetProxy(u)
+	defer download.SetProxy(nil)
+
+	resp, err := download.Download(download.NewURLDownload("http://example.invalid/a.sh"))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "proxied", string(b))
+	require.Equal(t, "example.invalid", host)
+	require.Equal(t, "Basic dXNlcjpwYXNz", auth)
+}
+
 func TestDownload_badStatusCodeFails(t *testing.T) {
 	srv := httptest.NewServer(httpbin.GetMux())
 	defer srv.Close()
@@ -50,24 +111,38 @@ func TestDownload_badStatusCodeFails(t *testing.T) {
 	}
 }
 
+func TestDownload_badStatusCodeDetails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+		w.Header().Set("x-ms-request-id", "req-1")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	_, err := download.Download(download.NewURLDownload(srv.URL + "/c/a.sh?sv=2018&sig=secret"))
+	require.EqualError(t, err, "unexpected status code: got=403 expected=200 (Forbidden) url="+srv.URL+
+		"/c/a.sh?*** x-ms-error-code=AuthenticationFailed x-ms-request-id=req-1")
+	require.NotContains(t, err.Error(), "secret", "query is redacted")
+}
+
 func TestDownload_statusOKSucceeds(t *testing.T) {
 	srv := httptest.NewServer(httpbin.GetMux())
 	defer srv.Close()
 
-	body, err := download.Download(download.NewURLDownload(srv.URL + "/status/200"))
+	resp, err := download.Download(download.NewURLDownload(srv.URL + "/status/200"))
 	require.Nil(t, err)
-	defer body.Close()
-	require.NotNil(t, body)
+	defer resp.Body.Close()
+	require.NotNil(t, resp.Body)
 }
 
 func TestDownload_retrievesBody(t *testing.T) {
 	srv := httptest.NewServer(httpbin.GetMux())
 	defer srv.Close()
 
-	body, err := download.Download(download.NewURLDownload(srv.URL + "/bytes/65536"))
+	resp, err := download.Download(download.NewURLDownload(srv.URL + "/bytes/65536"))
 	require.Nil(t, err)
-	defer body.Close()
-	b, err := ioutil.ReadAll(body)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
 	require.EqualValues(t, 65536, len(b))
 }
@@ -76,7 +151,246 @@ func TestDownload_bodyClosesWithoutError(t *testing.T) {
 	srv := httptest.NewServer(httpbin.GetMux())
 	defer srv.Close()
 
-	body, err := download.Download(download.NewURLDownload(srv.URL + "/get"))
+	resp, err := download.Download(download.NewURLDownload(srv.URL + "/get"))
+	require.Nil(t, err)
+	require.Nil(t, resp.Body.Close(), "body should close fine")
+}
+
+func TestProbe(t *testing.T) {
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		switch r.URL.Path {
+		case "/ok":
+			fmt.Fprint(w, "hello")
+		case "/nohead":
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			fmt.Fprint(w, "hello")
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	require.Nil(t, download.Probe(download.NewURLDownload(srv.URL+"/ok")))
+	require.Equal(t, []string{"HEAD"}, methods)
+
+	methods = nil
+	require.Nil(t, download.Probe(download.NewURLDownload(srv.URL+"/nohead")))
+	require.Equal(t, []string{"HEAD", "GET"}, methods, "falls back to GET")
+
+	methods = nil
+	err := download.Probe(download.NewURLDownload(srv.URL + "/forbidden"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "got=403")
+	require.Equal(t, []string{"HEAD"}, methods)
+
+	require.NotNil(t, download.Probe(new(badDownloader)))
+}
+
+func TestETag(t *testing.T) {
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		switch r.URL.Path {
+		case "/etag":
+			w.Header().Set("ETag", `"v1"`)
+		case "/noetag":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	defer srv.Close()
+
+	etag, err := download.ETag(context.Background(), download.NewURLDownload(srv.URL+"/etag"))
 	require.Nil(t, err)
-	require.Nil(t, body.Close(), "body should close fine")
+	require.Equal(t, `"v1"`, etag)
+	require.Equal(t, []string{"HEAD"}, methods)
+
+	etag, err = download.ETag(context.Background(), download.NewURLDownload(srv.URL+"/noetag"))
+	require.Nil(t, err)
+	require.Equal(t, "", etag)
+
+	_, err = download.ETag(context.Background(), download.NewURLDownload(srv.URL+"/missing"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "got=404")
+}
+
+func TestSetTimeouts_responseHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer srv.Close()
+
+	download.SetTimeouts(download.DefaultConnectTimeout, 100*time.Millisecond)
+	defer download.SetTimeouts(download.DefaultConnectTimeout, download.DefaultResponseHeaderTimeout)
+	s := time.Now()
+	_, err := download.Download(download.NewURLDownload(srv.URL))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "timeout awaiting response headers")
+	require.True(t, time.Since(s) < time.Second, "request should time out")
+}
+
+func TestParseResolverAddress(t *testing.T) {
+	for addr, hostport := range map[string]string{
+		"10.0.0.53":        "10.0.0.53:53",
+		"10.0.0.53:5353":   "10.0.0.53:5353",
+		"fd00::53":         "[fd00::53]:53",
+		"[fd00::53]":       "[fd00::53]:53",
+		"[fd00::53]:5353":  "[fd00::53]:5353",
+		"::ffff:10.0.0.53": "[::ffff:10.0.0.53]:53",
+	} {
+		v, err := download.ParseResolverAddress(addr)
+		require.Nil(t, err, addr)
+		require.Equal(t, hostport, v, addr)
+	}
+
+	for addr, msg := range map[string]string{
+		"dns.local":       "invalid DNS server address",
+		"dns.local:53":    "DNS server address is not an IP address",
+		"10.0.0.53:dns":   "invalid port in DNS server address",
+		"[fd00::53]:0":    "invalid port in DNS server address",
+		"10.0.0.53:65536": "invalid port in DNS server address",
+	} {
+		_, err := download.ParseResolverAddress(addr)
+		require.NotNil(t, err, addr)
+		require.Contains(t, err.Error(), msg, addr)
+	}
+}
+
+// serveDNS answers the DNS queries received on c for A records with
+// 127.0.0.1 and the other queries with no records, until c is closed. It
+// reports the number of queries received in n.
+func serveDNS(c net.PacketConn, n *int32) {
+	buf := make([]byte, 512)
+	for {
+		l, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if l < 12 {
+			continue
+		}
+		atomic.AddInt32(n, 1)
+		// the question ends with the name, the type and the class
+		end := 12
+		for end < l && buf[end] != 0 {
+			end += int(buf[end]) + 1
+		}
+		end += 5
+		if end > l {
+			continue
+		}
+		resp := append([]byte{}, buf[:end]...)
+		resp[2], resp[3] = 0x81, 0x80 // response, recursion available, no error
+		resp[6], resp[7], resp[8], resp[9], resp[10], resp[11] = 0, 0, 0, 0, 0, 0
+		if qtype := buf[end-4 : end-2]; qtype[0] == 0 && qtype[1] == 1 { // A
+			resp[7] = 1
+			resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+		}
+		c.WriteTo(resp, addr)
+	}
+}
+
+func TestSetResolver(t *testing.T) {
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer dns.Close()
+	var queries int32
+	go serveDNS(dns, &queries)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host)
+	}))
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.Nil(t, err)
+
+	require.Nil(t, download.SetResolver(dns.LocalAddr().String()))
+	defer download.SetResolver("")
+	resp, err := download.Download(download.NewURLDownload("http://files.internal.test:" + port + "/a.sh"))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "files.internal.test:"+port, string(b))
+	require.True(t, atomic.LoadInt32(&queries) > 0, "custom DNS server is used")
+
+	require.NotNil(t, download.SetResolver("dns.local"))
+}
+
+func TestDownload_ipv6Host(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+	srv := &httptest.Server{Listener: l, Config: &http.Server{Handler: httpbin.GetMux()}}
+	srv.Start()
+	defer srv.Close()
+	require.Contains(t, srv.URL, "[::1]")
+
+	resp, err := download.Download(download.NewURLDownload(srv.URL + "/bytes/16"))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Len(t, b, 16)
+}
+
+func TestSetTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	defer download.SetTLSConfig("", false)
+
+	_, err := download.Download(download.NewURLDownload(srv.URL))
+	require.NotNil(t, err, "not trusted by default")
+
+	require.Nil(t, download.SetTLSConfig(caPEM, false))
+	resp, err := download.Download(download.NewURLDownload(srv.URL))
+	require.Nil(t, err)
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	require.Nil(t, download.SetTLSConfig("", false))
+	_, err = download.Download(download.NewURLDownload(srv.URL))
+	require.NotNil(t, err, "system roots are used again")
+
+	require.Nil(t, download.SetTLSConfig("", true))
+	resp, err = download.Download(download.NewURLDownload(srv.URL))
+	require.Nil(t, err)
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	require.NotNil(t, download.SetTLSConfig("not a certificate", false))
+}
+
+func TestParseCACertificates(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	certs, err := download.ParseCACertificates(caPEM + "\n" + caPEM)
+	require.Nil(t, err)
+	require.Len(t, certs, 2)
+
+	for s, msg := range map[string]string{
+		"":                "no certificates found",
+		"  \n":            "no certificates found",
+		caPEM + "garbage": "invalid PEM data after the certificates",
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("k")})): "unexpected PEM block type",
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("c")})): "failed to parse certificate[0]",
+	} {
+		_, err := download.ParseCACertificates(s)
+		require.NotNil(t, err, s)
+		require.Contains(t, err.Error(), msg, s)
+	}
 }
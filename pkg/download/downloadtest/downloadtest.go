@@ -0,0 +1,34 @@
+// Package downloadtest provides utilities to serve the files downloaded in the
+// tests.
+package downloadtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+)
+
+// CountingServer is a test HTTP server which counts the requests it handles.
+// The count can be read while the requests are handled concurrently.
+type CountingServer struct {
+	*httptest.Server
+	requests int32
+}
+
+// NewCountingServer starts a CountingServer handling the requests with h,
+// which is called once the request is counted. It must be closed once done.
+func NewCountingServer(h http.HandlerFunc) *CountingServer {
+	s := new(CountingServer)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		h(w, r)
+	}))
+	return s
+}
+
+// Requests returns the number of requests received since the server started
+// or the count was reset.
+func (s *CountingServer) Requests() int { return int(atomic.LoadInt32(&s.requests)) }
+
+// Reset sets the count of requests to zero.
+func (s *CountingServer) Reset() { atomic.StoreInt32(&s.requests, 0) }
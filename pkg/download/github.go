@@ -0,0 +1,48 @@
+package download
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gitHubHosts are the hosts serving the files in GitHub repositories, which
+// accept GitHub access tokens.
+var gitHubHosts = []string{"github.com", "raw.githubusercontent.com"}
+
+// IsGitHubURL returns true if the given URL points to a file hosted on GitHub.
+func IsGitHubURL(fileURL string) bool {
+	u, err := url.Parse(fileURL)
+	if err != nil || !strings.EqualFold(u.Scheme, "https") {
+		return false
+	}
+	for _, h := range gitHubHosts {
+		if strings.EqualFold(u.Host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// gitHubDownload describes a file in a (possibly private) GitHub repository to
+// be downloaded with an access token.
+type gitHubDownload struct {
+	url, token string
+}
+
+// NewGitHubDownload creates a new Downloader for a file hosted on GitHub
+// authenticated with the given personal access token.
+func NewGitHubDownload(url, token string) Downloader {
+	return gitHubDownload{url, token}
+}
+
+// GetRequest returns a new request to download the file with the
+// Authorization header set.
+func (g gitHubDownload) GetRequest() (*http.Request, error) {
+	req, err := http.NewRequest("GET", g.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "token "+g.token)
+	return req, nil
+}
@@ -0,0 +1,34 @@
+package download
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsGitHubURL(t *testing.T) {
+	for _, u := range []string{
+		"https://github.com/org/repo/raw/master/script.sh",
+		"https://raw.githubusercontent.com/org/repo/master/script.sh",
+		"https://RAW.GitHubUserContent.com/org/repo/master/script.sh",
+	} {
+		require.True(t, IsGitHubURL(u), "url=%q", u)
+	}
+	for _, u := range []string{
+		"http://raw.githubusercontent.com/org/repo/master/script.sh", // token not sent over plain http
+		"https://github.com.example.com/script.sh",
+		"https://example.com/github.com/script.sh",
+		"https://gist.github.com/org/id/raw/script.sh",
+		"https://account.blob.core.windows.net/container/script.sh",
+		"::",
+	} {
+		require.False(t, IsGitHubURL(u), "url=%q", u)
+	}
+}
+
+func TestGitHubDownload_GetRequest(t *testing.T) {
+	r, err := NewGitHubDownload("https://raw.githubusercontent.com/org/repo/master/a.sh", "tkn").GetRequest()
+	require.Nil(t, err)
+	require.Equal(t, "token tkn", r.Header.Get("Authorization"))
+	require.Equal(t, "https://raw.githubusercontent.com/org/repo/master/a.sh", r.URL.String())
+}
@@ -0,0 +1,34 @@
+package download
+
+import (
+	"net/http"
+)
+
+// headerDownload adds custom headers to the requests of another Downloader,
+// such as the API keys required by artifact services.
+type headerDownload struct {
+	d       Downloader
+	headers map[string]string
+}
+
+// NewHeaderDownload creates a new Downloader sending the given headers with
+// the requests of d. The headers set by d, such as the Authorization header
+// with its credentials, take precedence.
+func NewHeaderDownload(d Downloader, headers map[string]string) Downloader {
+	return headerDownload{d, headers}
+}
+
+// GetRequest returns the request of the wrapped Downloader with the headers
+// added.
+func (h headerDownload) GetRequest() (*http.Request, error) {
+	req, err := h.d.GetRequest()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h.headers {
+		if req.Header.Get(k) == "" {
+			req.Header.Set(k, v)
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,23 @@
+package download
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderDownload_GetRequest(t *testing.T) {
+	d := NewHeaderDownload(NewGitHubDownload("https://github.com/org/repo/raw/master/a.sh", "tkn"), map[string]string{
+		"X-Api-Key":     "key",
+		"x-tenant-id":   "tenant",
+		"Authorization": "Bearer other",
+	})
+	r, err := d.GetRequest()
+	require.Nil(t, err)
+	require.Equal(t, "key", r.Header.Get("X-Api-Key"))
+	require.Equal(t, "tenant", r.Header.Get("X-Tenant-Id"))
+	require.Equal(t, "token tkn", r.Header.Get("Authorization"), "not overridden")
+
+	_, err = NewHeaderDownload(NewURLDownload("http://a b/%zz"), nil).GetRequest()
+	require.NotNil(t, err)
+}
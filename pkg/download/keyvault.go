@@ -0,0 +1,109 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// keyVaultAPIVersion is the Azure Key Vault API version used to read secrets.
+const keyVaultAPIVersion = "7.0"
+
+// keyVaultDNSSuffixes are the DNS suffixes of the Azure Key Vault endpoints in
+// the Azure clouds. The AAD resource of a vault is its suffix as an https URL.
+var keyVaultDNSSuffixes = []string{
+	"vault.azure.net",
+	"vault.azure.cn",
+	"vault.usgovcloudapi.net",
+	"vault.microsoftazure.de",
+}
+
+// ParseKeyVaultSecretURI checks if secretURI is the URI of an Azure Key Vault
+// secret, such as "https://myvault.vault.azure.net/secrets/name" optionally
+// followed by the version of the secret, and returns the AAD resource for which
+// the access token to read it should be acquired.
+func ParseKeyVaultSecretURI(secretURI string) (resource string, _ error) {
+	u, err := url.Parse(secretURI)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse Key Vault secret URI")
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("Key Vault secret URI must be an https URL: %q", secretURI)
+	}
+	host := strings.ToLower(u.Host)
+	for _, suffix := range keyVaultDNSSuffixes {
+		if strings.HasSuffix(host, "."+suffix) {
+			resource = "https://" + suffix
+		}
+	}
+	if resource == "" {
+		return "", fmt.Errorf("not an Azure Key Vault host: %q", u.Host)
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != "secrets" || parts[1] == "" {
+		return "", fmt.Errorf("not a Key Vault secret URI (expected https://<vault>/secrets/<name>[/<version>]): %q", secretURI)
+	}
+	return resource, nil
+}
+
+// GetKeyVaultSecret reads the value of the Azure Key Vault secret at secretURI
+// with an access token acquired for the given managed identity from the
+// Instance Metadata Service. The value is never included in the errors.
+func GetKeyVaultSecret(secretURI string, id ManagedIdentity) (string, error) {
+	resource, err := ParseKeyVaultSecretURI(secretURI)
+	if err != nil {
+		return "", err
+	}
+	token, err := getManagedIdentityToken(imdsTokenEndpoint, resource, id)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to acquire managed identity token")
+	}
+	return getSecret(keyVaultSecretDownload{secretURI, token})
+}
+
+// getSecret reads the value of the secret with the request of d.
+func getSecret(d Downloader) (string, error) {
+	resp, err := Download(d)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read secret")
+	}
+	defer resp.Body.Close()
+	var v struct {
+		Value *string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return "", errors.New("failed to parse secret response") // without the contents
+	}
+	if v.Value == nil {
+		return "", errors.New("secret response does not contain a value")
+	}
+	return *v.Value, nil
+}
+
+// keyVaultSecretDownload describes an Azure Key Vault secret to be read with
+// an OAuth2 bearer token.
+type keyVaultSecretDownload struct {
+	uri, token string
+}
+
+// GetRequest returns a new request to read the secret with the Authorization
+// header set.
+func (k keyVaultSecretDownload) GetRequest() (*http.Request, error) {
+	u, err := url.Parse(k.uri)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("api-version", keyVaultAPIVersion)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	return req, nil
+}
@@ -0,0 +1,71 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeyVaultSecretURI(t *testing.T) {
+	for uri, resource := range map[string]string{
+		"https://myvault.vault.azure.net/secrets/cmd":                "https://vault.azure.net",
+		"https://myvault.vault.azure.net/secrets/cmd/0123456789abcd": "https://vault.azure.net",
+		"https://MyVault.Vault.Azure.CN/secrets/cmd/":                "https://vault.azure.cn",
+		"https://myvault.vault.usgovcloudapi.net/secrets/cmd":        "https://vault.usgovcloudapi.net",
+	} {
+		r, err := ParseKeyVaultSecretURI(uri)
+		require.Nil(t, err, uri)
+		require.Equal(t, resource, r, uri)
+	}
+
+	for uri, msg := range map[string]string{
+		"http://myvault.vault.azure.net/secrets/cmd":     "Key Vault secret URI must be an https URL",
+		"https://example.com/secrets/cmd":                "not an Azure Key Vault host",
+		"https://vault.azure.net.example.com/secrets/c":  "not an Azure Key Vault host",
+		"https://myvault.vault.azure.net/keys/cmd":       "not a Key Vault secret URI",
+		"https://myvault.vault.azure.net/secrets":        "not a Key Vault secret URI",
+		"https://myvault.vault.azure.net/secrets/a/b/c":  "not a Key Vault secret URI",
+		"https://myvault.vault.azure.net/secrets/a b%zz": "failed to parse Key Vault secret URI",
+	} {
+		_, err := ParseKeyVaultSecretURI(uri)
+		require.NotNil(t, err, uri)
+		require.Contains(t, err.Error(), msg, uri)
+	}
+}
+
+func Test_getSecret(t *testing.T) {
+	var query, auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, auth = r.URL.RawQuery, r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/secrets/cmd":
+			fmt.Fprint(w, `{"value":"echo secret-value","id":"x"}`)
+		case "/secrets/novalue":
+			fmt.Fprint(w, `{"id":"x"}`)
+		case "/secrets/invalid":
+			fmt.Fprint(w, `secret-value`)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	v, err := getSecret(keyVaultSecretDownload{srv.URL + "/secrets/cmd", "token"})
+	require.Nil(t, err)
+	require.Equal(t, "echo secret-value", v)
+	require.Equal(t, "Bearer token", auth)
+	require.Equal(t, "api-version=7.0", query)
+
+	_, err = getSecret(keyVaultSecretDownload{srv.URL + "/secrets/novalue", "token"})
+	require.EqualError(t, err, "secret response does not contain a value")
+
+	_, err = getSecret(keyVaultSecretDownload{srv.URL + "/secrets/invalid", "token"})
+	require.EqualError(t, err, "failed to parse secret response", "value is not included")
+
+	_, err = getSecret(keyVaultSecretDownload{srv.URL + "/secrets/forbidden", "token"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "got=403")
+}
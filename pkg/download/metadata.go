@@ -0,0 +1,69 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// imdsComputeEndpoint is the Azure Instance Metadata Service endpoint
+	// that returns the compute metadata of the VM.
+	imdsComputeEndpoint = "http://169.254.169.254/metadata/instance/compute"
+
+	// imdsComputeAPIVersion is the version of the instance metadata API used.
+	imdsComputeAPIVersion = "2021-02-01"
+)
+
+// InstanceMetadata is the compute metadata of the VM returned by the Instance
+// Metadata Service.
+type InstanceMetadata struct {
+	Name              string `json:"name"`
+	ResourceGroupName string `json:"resourceGroupName"`
+	SubscriptionID    string `json:"subscriptionId"`
+	Location          string `json:"location"`
+	Zone              string `json:"zone"`
+	VMID              string `json:"vmId"`
+	VMSize            string `json:"vmSize"`
+	OSType            string `json:"osType"`
+	OSProfile         struct {
+		ComputerName string `json:"computerName"`
+	} `json:"osProfile"`
+}
+
+// GetInstanceMetadata reads the compute metadata of the VM from the Instance
+// Metadata Service.
+func GetInstanceMetadata() (InstanceMetadata, error) {
+	return getInstanceMetadata(imdsComputeEndpoint)
+}
+
+func getInstanceMetadata(endpoint string) (InstanceMetadata, error) {
+	var m InstanceMetadata
+	q := url.Values{}
+	q.Set("api-version", imdsComputeAPIVersion)
+	q.Set("format", "json")
+	req, err := http.NewRequest("GET", endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return m, errors.Wrap(err, "failed to create instance metadata request")
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := imdsClient.Do(req)
+	if err != nil {
+		return m, errors.Wrap(err, "instance metadata request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return m, fmt.Errorf("unexpected status code from instance metadata endpoint: got=%d expected=%d", resp.StatusCode, http.StatusOK)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return m, errors.Wrap(err, "failed to parse instance metadata response")
+	}
+	if m.Name == "" {
+		return m, errors.New("instance metadata response does not contain the VM name")
+	}
+	return m, nil
+}
@@ -0,0 +1,49 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_getInstanceMetadata(t *testing.T) {
+	var query, metadata string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, metadata = r.URL.RawQuery, r.Header.Get("Metadata")
+		fmt.Fprint(w, `{"name":"vm1","resourceGroupName":"rg","location":"westus2","vmId":"1234","osProfile":{"computerName":"host1"},"tags":"a:b"}`)
+	}))
+	defer srv.Close()
+
+	m, err := getInstanceMetadata(srv.URL)
+	require.Nil(t, err)
+	require.Equal(t, "true", metadata)
+	require.Contains(t, query, "api-version="+imdsComputeAPIVersion)
+	require.Equal(t, "vm1", m.Name)
+	require.Equal(t, "rg", m.ResourceGroupName)
+	require.Equal(t, "westus2", m.Location)
+	require.Equal(t, "1234", m.VMID)
+	require.Equal(t, "host1", m.OSProfile.ComputerName)
+	require.Equal(t, "", m.Zone)
+}
+
+func Test_getInstanceMetadata_failures(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	}))
+	defer srv.Close()
+
+	_, err := getInstanceMetadata(srv.URL + "/bad")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unexpected status code from instance metadata endpoint: got=400")
+
+	_, err = getInstanceMetadata(srv.URL)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "does not contain the VM name")
+}
@@ -0,0 +1,109 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// imdsTokenEndpoint is the Azure Instance Metadata Service endpoint that
+	// issues access tokens for the managed identities of the VM.
+	imdsTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+	// imdsAPIVersion is the version of the token endpoint API used.
+	imdsAPIVersion = "2018-02-01"
+
+	// storageResource is the AAD resource for which the tokens are acquired.
+	storageResource = "https://storage.azure.com/"
+
+	// storageAPIVersion is the Azure Storage API version sent with requests
+	// authenticated with bearer tokens (supported since 2017-11-09).
+	storageAPIVersion = "2018-03-28"
+)
+
+// imdsClient is the client used for the Instance Metadata Service, which is
+// only reachable from the VM, so requests to it never go through a proxy.
+var imdsClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: &http.Transport{Proxy: nil}}
+
+// ManagedIdentity describes a managed identity of the VM. If both fields are
+// empty, the system-assigned identity is used.
+type ManagedIdentity struct {
+	// ClientID is the client ID of a user-assigned identity.
+	ClientID string
+	// ObjectID is the object ID of a user-assigned identity.
+	ObjectID string
+}
+
+// GetManagedIdentityToken acquires an access token for Azure Storage for the
+// given managed identity from the Instance Metadata Service.
+func GetManagedIdentityToken(id ManagedIdentity) (string, error) {
+	return getManagedIdentityToken(imdsTokenEndpoint, storageResource, id)
+}
+
+func getManagedIdentityToken(endpoint, resource string, id ManagedIdentity) (string, error) {
+	q := url.Values{}
+	q.Set("api-version", imdsAPIVersion)
+	q.Set("resource", resource)
+	if id.ClientID != "" {
+		q.Set("client_id", id.ClientID)
+	}
+	if id.ObjectID != "" {
+		q.Set("object_id", id.ObjectID)
+	}
+	req, err := http.NewRequest("GET", endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create token request")
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := imdsClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "token request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code from token endpoint: got=%d expected=%d", resp.StatusCode, http.StatusOK)
+	}
+
+	var v struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return "", errors.Wrap(err, "failed to parse token response")
+	}
+	if v.AccessToken == "" {
+		return "", errors.New("token response does not contain an access token")
+	}
+	return v.AccessToken, nil
+}
+
+// bearerTokenBlobDownload describes an Azure Blob to be downloaded with an
+// OAuth2 bearer token.
+type bearerTokenBlobDownload struct {
+	url, token string
+}
+
+// NewBearerTokenBlobDownload creates a new Downloader for a blob hosted in
+// Azure Blob Storage authenticated with the given access token.
+func NewBearerTokenBlobDownload(url, token string) Downloader {
+	return bearerTokenBlobDownload{url, token}
+}
+
+// GetRequest returns a new request to download the blob with the
+// Authorization header set.
+func (b bearerTokenBlobDownload) GetRequest() (*http.Request, error) {
+	req, err := http.NewRequest("GET", b.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	req.Header.Set("x-ms-version", storageAPIVersion)
+	return req, nil
+}
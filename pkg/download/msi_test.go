@@ -0,0 +1,53 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_getManagedIdentityToken(t *testing.T) {
+	var query, metadata string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, metadata = r.URL.RawQuery, r.Header.Get("Metadata")
+		fmt.Fprint(w, `{"access_token":"secret-token","token_type":"Bearer"}`)
+	}))
+	defer srv.Close()
+
+	token, err := getManagedIdentityToken(srv.URL, storageResource, ManagedIdentity{ClientID: "foo"})
+	require.Nil(t, err)
+	require.Equal(t, "secret-token", token)
+	require.Equal(t, "true", metadata)
+	require.Contains(t, query, "client_id=foo")
+	require.Contains(t, query, "resource=https%3A%2F%2Fstorage.azure.com%2F")
+	require.NotContains(t, query, "object_id")
+}
+
+func Test_getManagedIdentityToken_failures(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("object_id") == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	}))
+	defer srv.Close()
+
+	_, err := getManagedIdentityToken(srv.URL, storageResource, ManagedIdentity{ObjectID: "bad"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unexpected status code from token endpoint: got=400")
+
+	_, err = getManagedIdentityToken(srv.URL, storageResource, ManagedIdentity{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "does not contain an access token")
+}
+
+func Test_bearerTokenBlobDownload_GetRequest(t *testing.T) {
+	r, err := NewBearerTokenBlobDownload("https://a.blob.core.windows.net/c/b.txt", "tkn").GetRequest()
+	require.Nil(t, err)
+	require.Equal(t, "Bearer tkn", r.Header.Get("Authorization"))
+	require.Equal(t, storageAPIVersion, r.Header.Get("x-ms-version"))
+}
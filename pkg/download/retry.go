@@ -1,11 +1,19 @@
 package download
 
 import (
+	"context"
 	"io"
 	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
 )
 
 // SleepFunc pauses the execution for at least duration d.
@@ -16,40 +24,133 @@ var (
 	ActualSleep SleepFunc = time.Sleep
 )
 
+// contextSleep returns a SleepFunc that pauses the execution like ActualSleep,
+// but returns early when c is done.
+func contextSleep(c context.Context) SleepFunc {
+	return func(d time.Duration) {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-c.Done():
+		}
+	}
+}
+
 const (
-	// time to sleep between retries is an exponential backoff formula:
+	// time to sleep between retries is an exponential backoff formula with
+	// a random jitter of up to half of the duration added:
 	//   t(n) = k * m^n
-	expRetryN = 7 // how many times we retry the Download
-	expRetryK = time.Second * 3
 	expRetryM = 2
+
+	// DefaultRetries is how many times a failed download is retried unless
+	// specified otherwise.
+	DefaultRetries = 3
+	// DefaultRetryInterval is the base duration (k) to sleep between retries
+	// unless specified otherwise.
+	DefaultRetryInterval = time.Second * 3
 )
 
-// WithRetries retrieves a response body using the specified downloader. Any
-// error returned from d will be retried (and retrieved response bodies will be
-// closed on failures). If the retries do not succeed, the last error is returned.
+// RetryPolicy describes how many times and how often a failed download is
+// retried.
+type RetryPolicy struct {
+	// Retries is the number of retries after the first attempt.
+	Retries int
+	// Interval is the base duration, doubled after each retry.
+	Interval time.Duration
+}
+
+// DefaultRetryPolicy is the RetryPolicy used unless specified otherwise.
+var DefaultRetryPolicy = RetryPolicy{DefaultRetries, DefaultRetryInterval}
+
+// WithRetries retrieves a response using the specified downloader. Any
+// transient error (see IsTransient) returned from d will be retried as
+// described in p (and retrieved response bodies will be closed on failures).
+// If the retries do not succeed, the last error is returned.
 //
 // It sleeps in exponentially increasing durations between retries.
-func WithRetries(ctx *log.Context, d Downloader, sf SleepFunc) (io.ReadCloser, error) {
+func WithRetries(ctx *log.Context, d Downloader, p RetryPolicy, sf SleepFunc) (*http.Response, error) {
+	var out *http.Response
+	err := retry(ctx, p, sf, func() error {
+		resp, err := Download(d)
+		if err != nil {
+			if resp != nil { // we are not going to read this response body
+				resp.Body.Close()
+			}
+			return err
+		}
+		out = resp
+		return nil
+	})
+	return out, err
+}
+
+// retry calls f until it succeeds or returns an error that is not transient
+// (see IsTransient), at most p.Retries more times after the first attempt,
+// sleeping in exponentially increasing durations between the attempts. The
+// last error is returned if the retries do not succeed.
+func retry(ctx *log.Context, p RetryPolicy, sf SleepFunc, f func() error) error {
 	var lastErr error
-	for n := 0; n < expRetryN; n++ {
-		ctx := ctx.With("retry", n)
-		out, err := Download(d)
+	for n := 0; n <= p.Retries; n++ {
+		ctx := ctx.With("attempt", n+1)
+		err := f()
 		if err == nil {
-			return out, nil
+			return nil
 		}
 		lastErr = err
 		ctx.Log("error", err)
-
-		if out != nil { // we are not going to read this response body
-			out.Close()
+		if !IsTransient(err) {
+			ctx.Log("message", "error is not transient, will not retry")
+			break
 		}
-
-		if n != expRetryN-1 {
+		if n != p.Retries {
 			// have more retries to go, sleep before retrying
-			slp := expRetryK * time.Duration(int(math.Pow(float64(expRetryM), float64(n))))
-			ctx.Log("sleep", slp)
+			slp := p.Interval * time.Duration(int(math.Pow(float64(expRetryM), float64(n))))
+			slp += jitter(slp)
+			ctx.Log("event", "retrying download", "sleep", slp)
 			sf(slp)
 		}
 	}
-	return nil, lastErr
+	return lastErr
+}
+
+// jitter returns a random duration in [0, d/2).
+func jitter(d time.Duration) time.Duration {
+	if d < 2 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d / 2)))
+}
+
+// IsTransient determines if the error returned from Download is a transient
+// condition worth retrying, such as HTTP 5xx or 429 responses, connection
+// resets and timeouts. Errors of canceled contexts are not transient.
+func IsTransient(err error) bool {
+	if c := errors.Cause(err); c == context.Canceled || c == context.DeadlineExceeded {
+		return false
+	}
+	if e, ok := errors.Cause(err).(statusCodeError); ok {
+		return e.got >= 500 || e.got == 429
+	}
+	return isTransientNetError(errors.Cause(err))
+}
+
+func isTransientNetError(err error) bool {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true
+	}
+	switch e := err.(type) {
+	case *url.Error:
+		return isTransientNetError(e.Err)
+	case *net.OpError:
+		return isTransientNetError(e.Err)
+	case *os.SyscallError:
+		return isTransientNetError(e.Err)
+	case *net.DNSError:
+		return e.Timeout() || e.Temporary()
+	case syscall.Errno:
+		return e == syscall.ECONNRESET || e == syscall.ECONNREFUSED ||
+			e == syscall.ECONNABORTED || e == syscall.ETIMEDOUT
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
 }
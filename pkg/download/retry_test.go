@@ -1,6 +1,10 @@
 package download_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -13,14 +17,11 @@ import (
 )
 
 var (
-	// how much we sleep between retries
+	// how much we sleep between retries at minimum, without the jitter
 	sleepSchedule = []time.Duration{
 		3 * time.Second,
 		6 * time.Second,
-		12 * time.Second,
-		24 * time.Second,
-		48 * time.Second,
-		96 * time.Second}
+		12 * time.Second}
 )
 
 func TestActualSleep_actuallySleeps(t *testing.T) {
@@ -37,33 +38,66 @@ func TestWithRetries_noRetries(t *testing.T) {
 	d := download.NewURLDownload(srv.URL + "/status/200")
 
 	sr := new(sleepRecorder)
-	resp, err := download.WithRetries(nopLog(), d, sr.Sleep)
+	resp, err := download.WithRetries(nopLog(), d, download.DefaultRetryPolicy, sr.Sleep)
 	require.Nil(t, err, "should not fail")
 	require.NotNil(t, resp, "response body exists")
 	require.Equal(t, []time.Duration(nil), []time.Duration(*sr), "sleep should not be called")
 }
 
 func TestWithRetries_failing_validateNumberOfCalls(t *testing.T) {
-	srv := httptest.NewServer(httpbin.GetMux())
+	srv := httptest.NewServer(new(failingServer))
 	defer srv.Close()
 
-	bd := new(badDownloader)
-	_, err := download.WithRetries(nopLog(), bd, new(sleepRecorder).Sleep)
-	require.Contains(t, err.Error(), "expected error", "error is preserved")
-	require.EqualValues(t, 7, bd.calls, "calls exactly expRetryN times")
+	_, err := download.WithRetries(nopLog(), download.NewURLDownload(srv.URL), download.DefaultRetryPolicy, new(sleepRecorder).Sleep)
+	require.EqualError(t, err, "unexpected status code: got=503 expected=200 (Service Unavailable) url="+srv.URL, "error is preserved")
+	require.EqualValues(t, 4, *srv.Config.Handler.(*failingServer), "calls exactly DefaultRetries+1 times")
+
+	*srv.Config.Handler.(*failingServer) = 0
+	_, err = download.WithRetries(nopLog(), download.NewURLDownload(srv.URL), download.RetryPolicy{Retries: 0}, new(sleepRecorder).Sleep)
+	require.NotNil(t, err)
+	require.EqualValues(t, 1, *srv.Config.Handler.(*failingServer), "does not retry")
 }
 
 func TestWithRetries_failingBadStatusCode_validateSleeps(t *testing.T) {
 	srv := httptest.NewServer(httpbin.GetMux())
 	defer srv.Close()
 
-	d := download.NewURLDownload(srv.URL + "/status/404")
+	for _, code := range []int{500, 502, 503, 429} {
+		d := download.NewURLDownload(fmt.Sprintf("%s/status/%d", srv.URL, code))
+		sr := new(sleepRecorder)
+		_, err := download.WithRetries(nopLog(), d, download.DefaultRetryPolicy, sr.Sleep)
+		require.EqualError(t, err, fmt.Sprintf("unexpected status code: got=%d expected=200 (%s) url=%s/status/%d", code, http.StatusText(code), srv.URL, code))
+		requireSleeps(t, sleepSchedule, *sr)
+	}
+}
 
+func TestWithRetries_customInterval(t *testing.T) {
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
+
+	d := download.NewURLDownload(srv.URL + "/status/500")
 	sr := new(sleepRecorder)
-	_, err := download.WithRetries(nopLog(), d, sr.Sleep)
-	require.EqualError(t, err, "unexpected status code: got=404 expected=200")
+	_, err := download.WithRetries(nopLog(), d, download.RetryPolicy{Retries: 2, Interval: time.Second}, sr.Sleep)
+	require.NotNil(t, err)
+	requireSleeps(t, []time.Duration{time.Second, 2 * time.Second}, *sr)
+}
+
+func TestWithRetries_clientErrorsFailFast(t *testing.T) {
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
 
-	require.Equal(t, sleepSchedule, []time.Duration(*sr))
+	for _, code := range []int{400, 401, 403, 404} {
+		d := download.NewURLDownload(fmt.Sprintf("%s/status/%d", srv.URL, code))
+		sr := new(sleepRecorder)
+		_, err := download.WithRetries(nopLog(), d, download.DefaultRetryPolicy, sr.Sleep)
+		require.EqualError(t, err, fmt.Sprintf("unexpected status code: got=%d expected=200 (%s) url=%s/status/%d", code, http.StatusText(code), srv.URL, code))
+		require.Equal(t, []time.Duration(nil), []time.Duration(*sr), "should not retry code=%d", code)
+	}
+
+	bd := new(badDownloader)
+	_, err := download.WithRetries(nopLog(), bd, download.DefaultRetryPolicy, new(sleepRecorder).Sleep)
+	require.Contains(t, err.Error(), "expected error", "error is preserved")
+	require.EqualValues(t, 1, bd.calls, "request creation errors are not retried")
 }
 
 func TestWithRetries_healingServer(t *testing.T) {
@@ -72,11 +106,33 @@ func TestWithRetries_healingServer(t *testing.T) {
 
 	d := download.NewURLDownload(srv.URL)
 	sr := new(sleepRecorder)
-	resp, err := download.WithRetries(nopLog(), d, sr.Sleep)
+	resp, err := download.WithRetries(nopLog(), d, download.DefaultRetryPolicy, sr.Sleep)
 	require.Nil(t, err, "should eventually succeed")
 	require.NotNil(t, resp, "response body exists")
 
-	require.Equal(t, sleepSchedule[:3], []time.Duration(*sr))
+	requireSleeps(t, sleepSchedule[:3], *sr)
+}
+
+func TestIsTransient(t *testing.T) {
+	require.False(t, download.IsTransient(errors.New("foo")))
+
+	// connection refused
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	_, err = download.Download(download.NewURLDownload("http://" + addr + "/"))
+	require.NotNil(t, err)
+	require.True(t, download.IsTransient(err), "connection refused is transient: %v", err)
+
+	// unsupported protocol
+	_, err = download.Download(download.NewURLDownload("foo://bar/"))
+	require.NotNil(t, err)
+	require.False(t, download.IsTransient(err), "bad scheme is not transient: %v", err)
+
+	// canceled context
+	require.False(t, download.IsTransient(context.DeadlineExceeded), "deadline exceeded is not transient")
+	require.False(t, download.IsTransient(context.Canceled), "canceled is not transient")
 }
 
 // Test Utilities:
@@ -101,6 +157,23 @@ func (h *healingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// failingServer returns HTTP 503 and counts the calls
+type failingServer int
+
+func (f *failingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	*f++
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// requireSleeps checks if the recorded sleeps follow the expected schedule
+// with at most 50% jitter added.
+func requireSleeps(t *testing.T, expected []time.Duration, actual sleepRecorder) {
+	require.Equal(t, len(expected), len(actual), "wrong number of sleeps: %v", actual)
+	for i, v := range expected {
+		require.True(t, actual[i] >= v && actual[i] < v+v/2, "sleep[%d]=%v not within jitter of %v", i, actual[i], v)
+	}
+}
+
 func nopLog() *log.Context {
 	return log.NewContext(log.NewNopLogger())
 }
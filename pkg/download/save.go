@@ -1,8 +1,18 @@
 package download
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
 	"io"
+	"mime"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
@@ -10,25 +20,500 @@ import (
 
 const (
 	writeBufSize = 1024 * 8
+
+	// tmpSuffix is appended to the destination path to save the partially
+	// downloaded file.
+	tmpSuffix = ".tmp"
 )
 
-// SaveTo uses given downloader to fetch the resource with retries and saves the
-// given file. Directory of dst is not created by this function. If a file at
-// dst exists, it will be truncated. If a new file is created, mode is used to
-// set the permission bits. Written number of bytes are returned on success.
-func SaveTo(ctx *log.Context, d Downloader, dst string, mode os.FileMode) (int64, error) {
-	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, mode)
+// ProgressFunc is called as a download makes progress with the number of bytes
+// written so far and the total number of bytes expected, which is -1 if the
+// server did not report the length of the resource.
+type ProgressFunc func(written, total int64)
+
+// SaveOptions describe how SaveTo downloads and saves a resource.
+type SaveOptions struct {
+	// Mode is used to set the permission bits if a new file is created.
+	Mode os.FileMode
+	// Retry describes how failed downloads are retried.
+	Retry RetryPolicy
+	// Progress, if not nil, is called after every chunk written to the file.
+	// It should return quickly as it is called in the download loop.
+	Progress ProgressFunc
+	// Context, if not nil, cancels the download and its retries when done.
+	Context context.Context
+	// ETag, if not nil, is set to the ETag of the downloaded resource, or to
+	// an empty string if the server did not provide one.
+	ETag *string
+	// MaxSize, if greater than zero, is the maximum size of the resource in
+	// bytes. The download fails without retries if the server reports a
+	// larger length or sends more bytes than that.
+	MaxSize int64
+	// Budget, if not nil, limits the total size of the downloads sharing it.
+	// The bytes written to the file are charged to it, and released if the
+	// download fails. The download fails without retries once it exceeds
+	// the budget, or before it starts if the length reported by the server
+	// does not fit.
+	Budget *SizeBudget
+	// ContentType, if not empty, is the expected media type of the resource,
+	// such as "application/x-sh", or "text/*" for any subtype. The download
+	// fails without retries if the Content-Type of the response is another
+	// one, such as of the HTML page of an error or a captive portal. The
+	// parameters, such as the charset, are ignored.
+	ContentType string
+}
+
+// SizeBudget limits the total size in bytes of a set of downloads, such as
+// all the files of an operation. It is safe for concurrent use.
+type SizeBudget struct {
+	max int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+// NewSizeBudget returns a budget allowing at most max bytes in total.
+func NewSizeBudget(max int64) *SizeBudget {
+	return &SizeBudget{max: max}
+}
+
+// reserve adds n bytes to the budget, or fails with budgetError if it would
+// exceed the max.
+func (b *SizeBudget) reserve(n int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.fits(n); err != nil {
+		return err
+	}
+	b.used += n
+	return nil
+}
+
+// check fails with budgetError if n more bytes would exceed the max, without
+// adding them to the budget.
+func (b *SizeBudget) check(n int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.fits(n)
+}
+
+func (b *SizeBudget) fits(n int64) error {
+	if b.used+n > b.max {
+		return budgetError{b.used + n, b.max}
+	}
+	return nil
+}
+
+// Release removes n bytes added to the budget, such as of a downloaded file
+// which is then discarded.
+func (b *SizeBudget) Release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// budgetError is returned when a resource does not fit in SaveOptions.Budget.
+type budgetError struct {
+	size, max int64
+}
+
+func (e budgetError) Error() string {
+	return fmt.Sprintf("total size of downloads exceeds max size: got=%d bytes max=%d bytes", e.size, e.max)
+}
+
+// sizeLimitError is returned when a resource exceeds SaveOptions.MaxSize.
+type sizeLimitError struct {
+	size, max int64
+}
+
+func (e sizeLimitError) Error() string {
+	return fmt.Sprintf("file exceeds max size: got=%d bytes max=%d bytes", e.size, e.max)
+}
+
+// contentTypeError is returned when the Content-Type of a response is not
+// SaveOptions.ContentType.
+type contentTypeError struct {
+	got, expected string
+}
+
+func (e contentTypeError) Error() string {
+	if e.got == "" {
+		return fmt.Sprintf("unexpected content type: server did not send Content-Type, expected=%s", e.expected)
+	}
+	return fmt.Sprintf("unexpected content type: got=%s expected=%s", e.got, e.expected)
+}
+
+// checkContentType checks if the Content-Type of resp is of the expected
+// media type (see SaveOptions.ContentType).
+func checkContentType(resp *http.Response, expected string) error {
+	got := resp.Header.Get("Content-Type")
+	t, _, err := mime.ParseMediaType(got)
+	if err != nil {
+		return contentTypeError{got, expected}
+	}
+	want := strings.ToLower(strings.TrimSpace(expected))
+	if prefix := strings.TrimSuffix(want, "*"); prefix != want && strings.HasSuffix(prefix, "/") {
+		if strings.HasPrefix(t, prefix) {
+			return nil
+		}
+	} else if t == want {
+		return nil
+	}
+	return contentTypeError{got, expected}
+}
+
+// SaveTo uses given downloader to fetch the resource with retries described in
+// opts and saves the given file. Directory of dst is not created by this
+// function. Written number of bytes are returned on success.
+//
+// The resource is downloaded to a temporary file next to dst (with the .tmp
+// suffix) and moved to dst once completed. If a file at dst exists, it will be
+// replaced keeping its permission bits. If the transfer fails midway with a
+// transient error and the server supports range requests, the download is
+// resumed from where it left off, unless the resource has changed (according
+// to its ETag or Last-Modified date) in which case it is downloaded again. The
+// size of the downloaded file is verified against the length reported by the
+// server, and its MD5 checksum against the Content-MD5 header, if present,
+// and its Content-Type against the expected one, if specified.
+// If the server reports the length, the download fails with DiskSpaceError
+// before it starts if the file system does not have enough space for it, as
+// it does if the disk becomes full while the file is written.
+//
+// A gzip-encoded response (with the Content-Encoding: gzip header) is
+// decompressed before it is saved; as its length and the Content-MD5 are of
+// the compressed body, they are not verified, and the transfer is not resumed.
+// The resources which are gzip files themselves, such as .tar.gz archives, are
+// saved as is unless the server also sends the header.
+func SaveTo(ctx *log.Context, d Downloader, dst string, opts SaveOptions) (_ int64, err error) {
+	mode := opts.Mode
+	if fi, err := os.Stat(dst); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp := dst + tmpSuffix
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0600)
 	if err != nil {
-		return 0, errors.Wrap(err, "failed to open file for writing")
+		return 0, errors.Wrap(WrapDiskFull(err, dst, -1), "failed to open file for writing")
 	}
 	defer f.Close()
 
-	body, err := WithRetries(ctx, d, ActualSleep)
+	var t transfer
+	if opts.Budget != nil {
+		defer func() {
+			if err != nil {
+				opts.Budget.Release(t.written) // charged as written
+			}
+		}()
+	}
+	sleep := ActualSleep
+	if opts.Context != nil {
+		d = contextDownloader{d, opts.Context}
+		sleep = contextSleep(opts.Context)
+	}
+	err = retry(ctx, opts.Retry, sleep, func() error {
+		err := t.attempt(ctx, d, f, opts)
+		if err != nil && opts.Context != nil && opts.Context.Err() != nil {
+			return errors.Wrap(opts.Context.Err(), "download canceled") // not retried
+		}
+		return err
+	})
 	if err != nil {
+		os.Remove(tmp) // do not leave partially downloaded file behind
 		return 0, errors.Wrap(err, "failed to download file")
 	}
-	defer body.Close()
+	if t.contentMD5 == "" {
+		ctx.Log("event", "content MD5 verification unavailable", "message", "server did not send Content-MD5 header")
+	} else if err := verifyContentMD5(f, t.contentMD5); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	} else {
+		ctx.Log("event", "verified content MD5", "md5", t.contentMD5)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		if IsDiskFull(err) {
+			return 0, WrapDiskFull(err, dst, t.total)
+		}
+		return 0, errors.Wrapf(err, "failed to write to file: %s", dst)
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "failed to set file mode")
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return 0, errors.Wrapf(err, "failed to move downloaded file to: %s", dst)
+	}
+	if opts.ETag != nil {
+		*opts.ETag = t.etag
+	}
+	return t.written, nil
+}
+
+// transfer keeps the state of a download across its attempts to resume it.
+type transfer struct {
+	written    int64  // bytes saved to the file
+	total      int64  // expected size of the file, -1 if unknown
+	validator  string // ETag or Last-Modified of the resource, if it can be resumed
+	contentMD5 string // Content-MD5 of the whole resource, if provided
+	etag       string // ETag of the resource, if provided
+}
+
+// attempt downloads the resource into f, resuming the transfer if possible,
+// with the progress, the limits and the expected content type in opts.
+func (t *transfer) attempt(ctx *log.Context, d Downloader, f *os.File, opts SaveOptions) error {
+	progress, maxSize, budget := opts.Progress, opts.MaxSize, opts.Budget
+	offset := int64(0)
+	if t.written > 0 && t.validator != "" {
+		offset = t.written
+	}
+	resp, err := downloadFrom(d, offset, t.validator)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if opts.ContentType != "" {
+		if err := checkContentType(resp, opts.ContentType); err != nil {
+			return err // not retried, checked before downloading
+		}
+	}
+
+	body := io.Reader(resp.Body)
+	encoded := isGzipEncoded(resp)
+	if resp.StatusCode == http.StatusPartialContent {
+		if encoded {
+			// only identity-encoded content is resumed, start over next time
+			t.validator = ""
+			return errors.Wrap(io.ErrUnexpectedEOF, "cannot resume download with gzip-encoded partial content")
+		}
+		ctx.Log("event", "resuming download", "offset", offset)
+		if resp.ContentLength >= 0 {
+			t.total = offset + resp.ContentLength
+		}
+	} else {
+		// starting over, either the first attempt or resuming is not possible
+		if t.written > 0 {
+			ctx.Log("event", "restarting download", "message", "server does not support resuming or the file has changed")
+		}
+		offset = 0
+		t.total = resp.ContentLength
+		t.validator = rangeValidator(resp)
+		t.contentMD5 = resp.Header.Get("Content-MD5")
+		t.etag = resp.Header.Get("ETag")
+		if encoded {
+			ctx.Log("event", "decompressing gzip-encoded response")
+			t.total, t.validator, t.contentMD5 = -1, "", ""
+			gz, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				if IsTransient(err) {
+					return err // failed reading the header from the connection
+				}
+				return decodeError(err)
+			}
+			body = &readErrRecorder{r: gz}
+		}
+	}
+	if maxSize > 0 && t.total > maxSize {
+		return sizeLimitError{t.total, maxSize} // checked before downloading
+	}
+	if budget != nil {
+		// the bytes past offset are written again, charged as they are
+		budget.Release(t.written - offset)
+		t.written = offset
+		if t.total > offset {
+			if err := budget.check(t.total - offset); err != nil {
+				return err // checked before downloading
+			}
+		}
+	}
+	if t.total > offset {
+		if err := checkDiskSpace(dstPath(f), t.total-offset); err != nil {
+			return err
+		}
+	}
+	if err := truncate(f, offset); err != nil {
+		return err
+	}
+	t.written = offset
+
+	w := &progressWriter{w: f, written: t.written, total: t.total, max: maxSize, budget: budget, f: progress}
+	if progress != nil {
+		progress(t.written, t.total)
+	}
+	_, err = io.CopyBuffer(w, body, make([]byte, writeBufSize))
+	t.written = w.written
+	if err != nil {
+		switch err.(type) {
+		case sizeLimitError, budgetError:
+			return err // server sent more than the reported length or the limit
+		}
+		if r, ok := body.(*readErrRecorder); ok && r.err != nil && !IsTransient(r.err) {
+			return decodeError(r.err)
+		}
+		if IsTransient(err) {
+			return err // failed reading the body, can be retried or resumed
+		}
+		if IsDiskFull(err) {
+			return WrapDiskFull(err, dstPath(f), t.total)
+		}
+		return errors.Wrapf(err, "failed to write to file: %s", f.Name())
+	}
+	if t.total >= 0 && t.written != t.total {
+		return errors.Wrapf(io.ErrUnexpectedEOF, "downloaded size does not match: got=%d expected=%d", t.written, t.total)
+	}
+	return nil
+}
+
+// dstPath returns the destination path of the downloaded file from the path of
+// the temporary file f it is written to.
+func dstPath(f *os.File) string {
+	return strings.TrimSuffix(f.Name(), tmpSuffix)
+}
+
+// downloadFrom retrieves the resource from the given offset with a range
+// request if offset is greater than zero. validator is sent in the If-Range
+// header, so that the whole resource is returned with 200 OK if it has changed.
+// The whole resource is requested gzip-encoded, if the server supports it.
+func downloadFrom(d Downloader, offset int64, validator string) (*http.Response, error) {
+	if offset == 0 {
+		return Download(gzipDownloader{d})
+	}
+	return Download(rangeDownloader{d, offset, validator})
+}
+
+// gzipDownloader wraps a Downloader to accept a gzip-encoded response, which is
+// then decompressed by SaveTo rather than the transport, so that a response
+// the server gzip-encodes without being asked is also handled the same way.
+type gzipDownloader struct {
+	Downloader
+}
+
+func (g gzipDownloader) GetRequest() (*http.Request, error) {
+	req, err := g.Downloader.GetRequest()
+	if err != nil {
+		return nil, err
+	}
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	return req, nil
+}
+
+// isGzipEncoded returns whether the body of resp is gzip-encoded and has not
+// been decompressed by the transport.
+func isGzipEncoded(resp *http.Response) bool {
+	return !resp.Uncompressed && strings.EqualFold(strings.TrimSpace(resp.Header.Get("Content-Encoding")), "gzip")
+}
+
+// readErrRecorder wraps a Reader to record the error it returns, so that the
+// errors reading are told apart from the errors writing the data.
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrRecorder) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
 
-	n, err := io.CopyBuffer(f, body, make([]byte, writeBufSize))
-	return n, errors.Wrapf(err, "failed to write to file: %s", dst)
+// decodeError wraps an error decompressing a gzip-encoded response. It is not
+// retried as the server would send the same body again.
+func decodeError(err error) error {
+	return errors.Wrap(err, "failed to decompress gzip-encoded response")
+}
+
+// rangeDownloader wraps a Downloader to request the resource from an offset.
+type rangeDownloader struct {
+	Downloader
+	offset    int64
+	validator string
+}
+
+func (r rangeDownloader) GetRequest() (*http.Request, error) {
+	req, err := r.Downloader.GetRequest()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+	req.Header.Set("If-Range", r.validator)
+	return req, nil
+}
+
+// rangeValidator returns the value to be sent in the If-Range header to resume
+// downloading the resource in resp, or an empty string if the server does not
+// support range requests for it.
+func rangeValidator(resp *http.Response) string {
+	if resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength < 0 {
+		return ""
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag // weak ETags cannot be used with If-Range
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// verifyContentMD5 checks if the MD5 checksum of the contents of f matches the
+// base64-encoded checksum in the Content-MD5 header value.
+func verifyContentMD5(f *os.File, contentMD5 string) error {
+	expected, err := base64.StdEncoding.DecodeString(contentMD5)
+	if err != nil || len(expected) != md5.Size {
+		return fmt.Errorf("invalid Content-MD5 header: %q", contentMD5)
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return errors.Wrap(err, "failed to seek file")
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return errors.Wrap(err, "failed to compute file MD5 checksum")
+	}
+	if computed := h.Sum(nil); !bytes.Equal(computed, expected) {
+		return fmt.Errorf("Content-MD5 mismatch: expected=%s computed=%s",
+			contentMD5, base64.StdEncoding.EncodeToString(computed))
+	}
+	return nil
+}
+
+// truncate truncates f to the given size and moves the offset to its end.
+func truncate(f *os.File, size int64) error {
+	if err := f.Truncate(size); err != nil {
+		return errors.Wrap(err, "failed to truncate file")
+	}
+	if _, err := f.Seek(size, os.SEEK_SET); err != nil {
+		return errors.Wrap(err, "failed to seek file")
+	}
+	return nil
+}
+
+// progressWriter counts the bytes written to w and reports them through f, if
+// not nil. If max is greater than zero, writes beyond it fail.
+type progressWriter struct {
+	w       io.Writer
+	written int64
+	total   int64
+	max     int64
+	budget  *SizeBudget // charged the bytes written, if not nil
+	f       ProgressFunc
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	if p.max > 0 && p.written+int64(len(b)) > p.max {
+		return 0, sizeLimitError{p.written + int64(len(b)), p.max}
+	}
+	if p.budget != nil {
+		if err := p.budget.reserve(int64(len(b))); err != nil {
+			return 0, err
+		}
+	}
+	n, err := p.w.Write(b)
+	if p.budget != nil && n < len(b) {
+		p.budget.Release(int64(len(b) - n))
+	}
+	p.written += int64(n)
+	if p.f != nil {
+		p.f(p.written, p.total)
+	}
+	return n, err
 }
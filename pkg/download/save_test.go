@@ -1,14 +1,23 @@
 package download_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/Azure/custom-script-extension-linux/pkg/download/downloadtest"
 	"github.com/ahmetalpbalkan/go-httpbin"
 	"github.com/stretchr/testify/require"
 )
@@ -19,7 +28,7 @@ func TestSaveTo_invalidDir(t *testing.T) {
 
 	d := download.NewURLDownload(srv.URL + "/bytes/65536")
 
-	_, err := download.SaveTo(nopLog(), d, "/nonexistent-dir/dst", 0600)
+	_, err := download.SaveTo(nopLog(), d, "/nonexistent-dir/dst", download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy})
 	require.Contains(t, err.Error(), "failed to open file for writing")
 }
 
@@ -33,7 +42,7 @@ func TestSave(t *testing.T) {
 
 	d := download.NewURLDownload(srv.URL + "/bytes/65536")
 	path := filepath.Join(dir, "test-file")
-	n, err := download.SaveTo(nopLog(), d, path, 0600)
+	n, err := download.SaveTo(nopLog(), d, path, download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy})
 	require.Nil(t, err)
 	require.EqualValues(t, 65536, n)
 
@@ -52,9 +61,9 @@ func TestSave_truncates(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	path := filepath.Join(dir, "test-file")
-	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL+"/bytes/65536"), path, 0600)
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL+"/bytes/65536"), path, download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy})
 	require.Nil(t, err)
-	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL+"/bytes/128"), path, 0777)
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL+"/bytes/128"), path, download.SaveOptions{Mode: 0777, Retry: download.DefaultRetryPolicy})
 	require.Nil(t, err)
 
 	fi, err := os.Stat(path)
@@ -74,7 +83,7 @@ func TestSave_largeFile(t *testing.T) {
 	size := 1024 * 1024 * 128 // 128 mb
 
 	path := filepath.Join(dir, "large-file")
-	n, err := download.SaveTo(nopLog(), download.NewURLDownload(srv.URL+"/bytes/"+fmt.Sprintf("%d", size)), path, 0600)
+	n, err := download.SaveTo(nopLog(), download.NewURLDownload(srv.URL+"/bytes/"+fmt.Sprintf("%d", size)), path, download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy})
 	require.Nil(t, err)
 	require.EqualValues(t, size, n)
 
@@ -82,3 +91,462 @@ func TestSave_largeFile(t *testing.T) {
 	require.Nil(t, err)
 	require.EqualValues(t, size, fi.Size())
 }
+
+func TestSave_reportsProgress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "65536")
+		w.Write(make([]byte, 65536))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var written, total []int64
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), filepath.Join(dir, "test-file"), download.SaveOptions{
+		Mode:  0600,
+		Retry: download.DefaultRetryPolicy,
+		Progress: func(w, t int64) {
+			written = append(written, w)
+			total = append(total, t)
+		}})
+	require.Nil(t, err)
+	require.True(t, len(written) > 1, "progress should be reported more than once")
+	require.EqualValues(t, 0, written[0], "initial progress")
+	require.EqualValues(t, 65536, written[len(written)-1], "final progress")
+	for _, v := range total {
+		require.EqualValues(t, 65536, v)
+	}
+}
+
+// flakyContentServer serves content with http.ServeContent and the given ETag
+// (changed to the second one after the first request), but the first response
+// is cut off after the half of the content.
+type flakyContentServer struct {
+	content      [2][]byte
+	etags        [2]string
+	acceptRanges bool
+	ranges       []string // Range headers of the requests
+}
+
+func (s *flakyContentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	i := 0
+	if len(s.ranges) > 1 {
+		i = 1
+	}
+	if s.etags[i] != "" {
+		w.Header().Set("ETag", s.etags[i])
+	}
+	if len(s.ranges) > 1 {
+		if !s.acceptRanges {
+			w.Write(s.content[i])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.content[i]))
+		return
+	}
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n", len(s.content[i]))
+	if s.acceptRanges {
+		fmt.Fprintf(buf, "Accept-Ranges: bytes\r\n")
+	}
+	if s.etags[i] != "" {
+		fmt.Fprintf(buf, "ETag: %s\r\n", s.etags[i])
+	}
+	fmt.Fprintf(buf, "\r\n")
+	buf.Write(s.content[i][:len(s.content[i])/2])
+	buf.Flush()
+}
+
+func testSaveFlaky(t *testing.T, s *flakyContentServer) []byte {
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test-file")
+	n, err := download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), path, download.SaveOptions{
+		Mode:  0600,
+		Retry: download.RetryPolicy{Retries: 1, Interval: time.Nanosecond}})
+	require.Nil(t, err)
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.EqualValues(t, len(b), n)
+
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err), "temporary file should not be left behind")
+	return b
+}
+
+func TestSave_resumesDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	s := &flakyContentServer{
+		content:      [2][]byte{content, content},
+		etags:        [2]string{`"v1"`, `"v1"`},
+		acceptRanges: true}
+	require.Equal(t, content, testSaveFlaky(t, s))
+	require.Equal(t, []string{"", "bytes=50000-"}, s.ranges)
+}
+
+func TestSave_reportsETag(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "hello")
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var etag string
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), filepath.Join(dir, "test-file"), download.SaveOptions{
+		Mode: 0600,
+		ETag: &etag})
+	require.Nil(t, err)
+	require.Equal(t, `"v1"`, etag)
+}
+
+func TestSave_restartsIfChanged(t *testing.T) {
+	s := &flakyContentServer{
+		content:      [2][]byte{bytes.Repeat([]byte("a"), 100000), bytes.Repeat([]byte("b"), 80000)},
+		etags:        [2]string{`"v1"`, `"v2"`},
+		acceptRanges: true}
+	require.Equal(t, s.content[1], testSaveFlaky(t, s), "should be downloaded again")
+	require.Equal(t, []string{"", "bytes=50000-"}, s.ranges)
+}
+
+func TestSave_restartsIfRangesNotSupported(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	s := &flakyContentServer{
+		content: [2][]byte{content, content},
+		etags:   [2]string{`"v1"`, `"v1"`}}
+	require.Equal(t, content, testSaveFlaky(t, s))
+	require.Equal(t, []string{"", ""}, s.ranges, "should not send range request")
+}
+
+func TestSave_failsAfterRetriesAndCleansUp(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nshort")
+		buf.Flush()
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test-file")
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), path, download.SaveOptions{
+		Mode:  0600,
+		Retry: download.RetryPolicy{Retries: 2, Interval: time.Nanosecond}})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unexpected EOF")
+	for _, p := range []string{path, path + ".tmp"} {
+		_, err = os.Stat(p)
+		require.True(t, os.IsNotExist(err), "%s should not exist", p)
+	}
+}
+
+func testSaveContentMD5(t *testing.T, dir string, content []byte, contentMD5 string) (string, error) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-MD5", contentMD5)
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(dir, "test-file")
+	_, err := download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), path, download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy})
+	return path, err
+}
+
+func TestSave_verifiesContentMD5(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("hello world")
+	sum := md5.Sum(content)
+	path, err := testSaveContentMD5(t, dir, content, base64.StdEncoding.EncodeToString(sum[:]))
+	require.Nil(t, err)
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, content, b)
+}
+
+func TestSave_contentMD5Mismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sum := md5.Sum([]byte("other content"))
+	path, err := testSaveContentMD5(t, dir, []byte("hello world"), base64.StdEncoding.EncodeToString(sum[:]))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Content-MD5 mismatch: expected="+base64.StdEncoding.EncodeToString(sum[:]))
+	for _, p := range []string{path, path + ".tmp"} {
+		_, err = os.Stat(p)
+		require.True(t, os.IsNotExist(err), "%s should not exist", p)
+	}
+}
+
+func TestSave_invalidContentMD5(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = testSaveContentMD5(t, dir, []byte("hello world"), "not-md5")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), `invalid Content-MD5 header: "not-md5"`)
+}
+
+func TestSave_maxSize(t *testing.T) {
+	lie := false
+	srv := downloadtest.NewCountingServer(func(w http.ResponseWriter, r *http.Request) {
+		if lie { // no Content-Length, more bytes than the limit
+			w.(http.Flusher).Flush()
+		}
+		w.Write(make([]byte, 65536))
+	})
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test-file")
+	opts := download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy, MaxSize: 65536}
+
+	n, err := download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), path, opts)
+	require.Nil(t, err)
+	require.EqualValues(t, 65536, n, "at the limit")
+
+	opts.MaxSize = 1024
+	require.Nil(t, os.Remove(path))
+	for _, lie = range []bool{false, true} {
+		srv.Reset()
+		_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), path, opts)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "file exceeds max size", "lie=%v", lie)
+		require.Equal(t, 1, srv.Requests(), "not retried")
+		_, err = os.Stat(path + ".tmp")
+		require.True(t, os.IsNotExist(err), "partial file should be removed")
+	}
+}
+
+func TestSave_contentType(t *testing.T) {
+	var contentType atomic.Value
+	contentType.Store("text/x-shellscript; charset=utf-8")
+	srv := downloadtest.NewCountingServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType.Load().(string))
+		w.Write([]byte("echo hello"))
+	})
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run.sh")
+
+	for _, ct := range []string{"text/x-shellscript", "Text/X-ShellScript", "text/*"} {
+		_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), path, download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy, ContentType: ct})
+		require.Nil(t, err, ct)
+	}
+	require.Nil(t, os.Remove(path))
+
+	contentType.Store("text/html")
+	for _, ct := range []string{"application/x-sh", "application/*", "text/x-shellscript"} {
+		srv.Reset()
+		_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), path, download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy, ContentType: ct})
+		require.NotNil(t, err, ct)
+		require.Contains(t, err.Error(), "unexpected content type: got=text/html expected="+ct)
+		require.Equal(t, 1, srv.Requests(), "not retried")
+		_, err = os.Stat(path)
+		require.True(t, os.IsNotExist(err), "not saved")
+	}
+
+	contentType.Store("")
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), path, download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy, ContentType: "text/plain"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unexpected content type")
+}
+
+func TestSave_budget(t *testing.T) {
+	srv := downloadtest.NewCountingServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			for i := 0; i < 2; i++ { // of unknown length
+				w.Write(make([]byte, 1024))
+				w.(http.Flusher).Flush()
+			}
+			return
+		}
+		w.Write(make([]byte, 1024))
+	})
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	opts := download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy, Budget: download.NewSizeBudget(2048)}
+
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), filepath.Join(dir, "a"), opts)
+	require.Nil(t, err, "within the budget")
+	srv.Reset()
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL+"/chunked"), filepath.Join(dir, "chunked"), opts)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "total size of downloads exceeds max size: got=3072 bytes max=2048 bytes", "charged as written")
+	require.Equal(t, 1, srv.Requests(), "not retried")
+	_, err = os.Stat(filepath.Join(dir, "chunked.tmp"))
+	require.True(t, os.IsNotExist(err), "partial file should be removed")
+
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), filepath.Join(dir, "b"), opts)
+	require.Nil(t, err, "released after the failure")
+	srv.Reset()
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), filepath.Join(dir, "c"), opts)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "total size of downloads exceeds max size: got=3072 bytes max=2048 bytes")
+	require.Equal(t, 1, srv.Requests(), "not retried")
+	_, err = os.Stat(filepath.Join(dir, "c.tmp"))
+	require.True(t, os.IsNotExist(err), "partial file should be removed")
+
+	opts.Budget.Release(1024)
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), filepath.Join(dir, "c"), opts)
+	require.Nil(t, err, "released")
+}
+
+func TestSave_insufficientDiskSpace(t *testing.T) {
+	srv := downloadtest.NewCountingServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1152921504606846976") // 1 EiB
+	})
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test-file")
+
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), path, download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy})
+	require.NotNil(t, err)
+	require.Regexp(t, `insufficient disk space to write .*/test-file: required=1152921504606846976 bytes available=[0-9]+ bytes`, err.Error())
+	require.Equal(t, 1, srv.Requests(), "not retried")
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err), "temporary file is removed")
+}
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(b)
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestSave_gzipEncoded(t *testing.T) {
+	content := []byte("#!/bin/sh\necho hello\n")
+	encoded := gzipBytes(t, content)
+	var acceptEncoding string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Accept-Ranges", "bytes")
+		sum := md5.Sum(encoded)
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:])) // of the compressed body
+		w.Write(encoded)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run.sh")
+
+	n, err := download.SaveTo(nopLog(), download.NewURLDownload(srv.URL+"/run.sh"), path, download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy})
+	require.Nil(t, err)
+	require.EqualValues(t, len(content), n)
+	require.Equal(t, "gzip", acceptEncoding)
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, content, b, "decompressed")
+
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL+"/run.sh"), path, download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy, MaxSize: 8})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "file exceeds max size", "limit applies to the decompressed size")
+}
+
+func TestSave_gzipEncodedInvalid(t *testing.T) {
+	srv := downloadtest.NewCountingServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		fmt.Fprint(w, "this is not a gzip stream")
+	})
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), filepath.Join(dir, "a"), download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to decompress gzip-encoded response")
+	require.Equal(t, 1, srv.Requests(), "not retried")
+}
+
+func TestSave_gzipFileNotDecompressed(t *testing.T) {
+	archive := gzipBytes(t, []byte("tar contents"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip") // without Content-Encoding
+		w.Write(archive)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.tar.gz")
+
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL+"/app.tar.gz"), path, download.SaveOptions{Mode: 0600, Retry: download.DefaultRetryPolicy})
+	require.Nil(t, err)
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, archive, b, "saved as is")
+}
+
+func TestSave_canceledByContext(t *testing.T) {
+	srv := downloadtest.NewCountingServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select { // never completes the response unless canceled
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	})
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	c, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	s := time.Now()
+	path := filepath.Join(dir, "test-file")
+	_, err = download.SaveTo(nopLog(), download.NewURLDownload(srv.URL), path, download.SaveOptions{
+		Mode:    0600,
+		Retry:   download.RetryPolicy{Retries: 3, Interval: time.Minute},
+		Context: c})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "download canceled: context deadline exceeded")
+	require.True(t, time.Since(s) < 5*time.Second, "download was not canceled in time")
+	require.Equal(t, 1, srv.Requests(), "canceled download should not be retried")
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err), "partial file should be removed")
+}
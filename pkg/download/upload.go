@@ -0,0 +1,68 @@
+package download
+
+import (
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// UploadBlob uploads the last maxBytes of the file at path (the entire file if
+// maxBytes is not positive) as a block blob to Azure Blob Storage, replacing
+// the existing blob. The Put Blob request is made from the request of d, with
+// its URL and headers (such as the credentials), which must be authorized to
+// write the blob.
+func UploadBlob(d Downloader, path string, maxBytes int64) error {
+	req, err := d.GetRequest()
+	if err != nil {
+		return errors.Wrap(err, "failed to create the request")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat file")
+	}
+	off, n := int64(0), fi.Size()
+	if maxBytes > 0 && n > maxBytes {
+		off, n = n-maxBytes, maxBytes
+	}
+
+	var body io.Reader
+	if n > 0 {
+		body = io.NewSectionReader(f, off, n)
+	}
+	put, err := http.NewRequest("PUT", req.URL.String(), body)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the request")
+	}
+	put = put.WithContext(req.Context())
+	for k, v := range req.Header {
+		put.Header[k] = v
+	}
+	put.ContentLength = n
+	put.Header.Set("x-ms-blob-type", "BlockBlob")
+	put.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if put.Header.Get("x-ms-version") == "" {
+		put.Header.Set("x-ms-version", storageAPIVersion)
+	}
+
+	resp, err := httpClient.Do(put)
+	if err != nil {
+		return errors.Wrap(err, "http request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return statusCodeError{
+			got:      resp.StatusCode,
+			expected: http.StatusCreated,
+			url:      redactedURL(put.URL),
+			headers:  diagnosticHeaders(resp.Header),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package download
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stdout")
+	require.Nil(t, ioutil.WriteFile(path, []byte("0123456789"), 0600))
+
+	var (
+		req  *http.Request
+		body []byte
+		code = http.StatusCreated
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("x-ms-error-code", "AuthorizationPermissionMismatch")
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+
+	require.Nil(t, UploadBlob(NewBearerTokenBlobDownload(srv.URL+"/c/stdout?a=b", "token"), path, 0))
+	require.Equal(t, "PUT", req.Method)
+	require.Equal(t, "/c/stdout", req.URL.Path)
+	require.Equal(t, "a=b", req.URL.RawQuery)
+	require.Equal(t, "BlockBlob", req.Header.Get("x-ms-blob-type"))
+	require.Equal(t, "Bearer token", req.Header.Get("Authorization"), "credentials of the downloader")
+	require.Equal(t, storageAPIVersion, req.Header.Get("x-ms-version"))
+	require.EqualValues(t, 10, req.ContentLength)
+	require.Equal(t, "0123456789", string(body))
+
+	require.Nil(t, UploadBlob(NewURLDownload(srv.URL+"/c/stdout"), path, 4))
+	require.Equal(t, "6789", string(body), "tail of the file")
+
+	require.Nil(t, ioutil.WriteFile(path, nil, 0600))
+	require.Nil(t, UploadBlob(NewURLDownload(srv.URL+"/c/stdout"), path, 0))
+	require.EqualValues(t, 0, req.ContentLength)
+	require.Empty(t, req.TransferEncoding, "empty blob")
+
+	code = http.StatusForbidden
+	err = UploadBlob(NewURLDownload(srv.URL+"/c/stdout?sig=secret"), path, 0)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "got=403 expected=201")
+	require.Contains(t, err.Error(), "x-ms-error-code=AuthorizationPermissionMismatch")
+	require.NotContains(t, err.Error(), "secret")
+
+	err = UploadBlob(NewURLDownload(srv.URL+"/c/stdout"), filepath.Join(dir, "missing"), 0)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to open file")
+}
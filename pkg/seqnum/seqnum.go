@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -35,6 +36,34 @@ func IsSmallerThan(path string, num int) (bool, error) {
 		}
 		return false, errors.Wrap(err, "seqnum: failed to read")
 	}
-	stored, err := strconv.Atoi(string(b))
-	return stored < num, errors.Wrapf(err, "seqnum: cannot parse number %q", b)
+	stored, err := parse(b)
+	return stored < num, err
+}
+
+// Normalize rewrites the sequence number stored at path in the format Set
+// writes, if it is stored otherwise, such as with a trailing new line, and
+// returns whether it is rewritten. If no number is stored, it does nothing.
+func Normalize(path string) (rewritten bool, _ error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "seqnum: failed to read")
+	}
+	num, err := parse(b)
+	if err != nil {
+		return false, err
+	}
+	if string(b) == strconv.Itoa(num) {
+		return false, nil
+	}
+	return true, Set(path, num)
+}
+
+// parse parses the stored sequence number b, ignoring the surrounding white
+// space that other tools may write.
+func parse(b []byte) (int, error) {
+	num, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	return num, errors.Wrapf(err, "seqnum: cannot parse number %q", b)
 }
@@ -68,6 +68,40 @@ func TestIsSmallerThan_readFailure(t *testing.T) {
 	require.Contains(t, err.Error(), "seqnum: failed to read")
 }
 
+func TestIsSmallerThan_whitespace(t *testing.T) {
+	fp := testFile(t, 0600)
+	defer os.RemoveAll(fp)
+
+	require.Nil(t, ioutil.WriteFile(fp, []byte("3\n"), 0600))
+	b, err := seqnum.IsSmallerThan(fp, 4)
+	require.Nil(t, err)
+	require.True(t, b)
+}
+
+func TestNormalize(t *testing.T) {
+	fp := testFile(t, 0600)
+	defer os.RemoveAll(fp)
+
+	for in, rewritten := range map[string]bool{"3": false, " 3\n": true, "03": true, "+3": true} {
+		require.Nil(t, ioutil.WriteFile(fp, []byte(in), 0600))
+		ok, err := seqnum.Normalize(fp)
+		require.Nil(t, err, "%q", in)
+		require.Equal(t, rewritten, ok, "%q", in)
+		b, err := ioutil.ReadFile(fp)
+		require.Nil(t, err)
+		require.Equal(t, "3", string(b), "%q", in)
+	}
+
+	require.Nil(t, ioutil.WriteFile(fp, []byte("a"), 0600))
+	_, err := seqnum.Normalize(fp)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "seqnum: cannot parse number \"a\"")
+
+	ok, err := seqnum.Normalize("/non/existing/path")
+	require.Nil(t, err)
+	require.False(t, ok)
+}
+
 func TestIsSmallerThan_parseError(t *testing.T) {
 	fp := testFile(t, 0600)
 	defer os.RemoveAll(fp)